@@ -0,0 +1,336 @@
+package coconet
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of hosts and the nodes running on them.
+// RealClock reads the wall clock; a VirtualClock lets simulations run
+// through hours of protocol time in seconds, in a repeatable order.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	// After sends the time on the returned channel once d has passed.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f once d has passed: in its own goroutine on the
+	// wall clock, on the goroutine running the clock's events otherwise.
+	AfterFunc(d time.Duration, f func()) Timer
+	// Tick sends the time on the returned channel every d,
+	// dropping ticks for slow receivers.
+	Tick(d time.Duration) <-chan time.Time
+	// Hold and Release bracket work done in reaction to the clock's
+	// events outside of them, which a VirtualClock waits for before
+	// running the next event. They do nothing on the wall clock.
+	Hold()
+	Release()
+}
+
+// Timer is a pending call of a Clock's AfterFunc.
+type Timer interface {
+	// Stop cancels the call, reporting whether it was still pending.
+	Stop() bool
+}
+
+// RealClock is the wall clock.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Tick(d time.Duration) <-chan time.Time  { return time.Tick(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) Hold()    {}
+func (realClock) Release() {}
+
+// VirtualClock is a Clock whose time only moves when it runs the events
+// scheduled on it: Step jumps to the next event, Advance runs the events
+// of a span of time, and Run steps on its own in the background.
+//
+// Events run one at a time, and the next one only once nothing holds the
+// clock: whoever reacts to an event outside of it, such as the reader of
+// a SimHost's Get, holds the clock until done, and hands its hold over to
+// any goroutine it wakes to carry on. AfterFunc calls run inline, so that
+// a run depends on the events alone and not on the Go scheduler; the
+// receivers of After, Sleep and Tick are not waited for.
+//
+// Events due at the same time run in the order of their keys, timers
+// first, and in the order they were scheduled for equal keys.
+type VirtualClock struct {
+	mu     sync.Mutex
+	idle   *sync.Cond // signalled when the clock may have an event to run
+	now    time.Time
+	seq    uint64
+	events eventQueue
+	busy   int // holds not yet released
+	stop   chan struct{}
+}
+
+// A function to run at a time on a VirtualClock
+type event struct {
+	at    time.Time
+	key   string
+	seq   uint64
+	fn    func()
+	index int // in the queue, -1 once out of it
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		if q[i].key != q[j].key {
+			return q[i].key < q[j].key
+		}
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	e := x.(*event)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// NewVirtualClock creates a clock standing at the given time.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	c := &VirtualClock{now: start}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the clock's time.
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Since returns the time passed on the clock since t.
+func (c *VirtualClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Sleep blocks until the clock has moved on by d.
+func (c *VirtualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// After sends the clock's time on the returned channel once d has passed.
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.schedule(d, func() {
+		ch <- c.Now()
+	})
+	return ch
+}
+
+// AfterFunc calls f once d has passed on the clock, on the goroutine
+// running its events: f must not block on anything waiting for the clock.
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	return &virtualTimer{c, c.schedule(d, f)}
+}
+
+// Tick sends the clock's time on the returned channel every d.
+func (c *VirtualClock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	ch := make(chan time.Time, 1)
+	var tick func()
+	tick = func() {
+		select {
+		case ch <- c.Now():
+		default:
+		}
+		c.schedule(d, tick)
+	}
+	c.schedule(d, tick)
+	return ch
+}
+
+// Schedule fn to run on the clock's goroutine d from now
+func (c *VirtualClock) schedule(d time.Duration, fn func()) *event {
+	c.mu.Lock()
+	at := c.now.Add(d)
+	c.mu.Unlock()
+	return c.scheduleAt(at, "", fn)
+}
+
+// Schedule fn to run at the given time, or now if it has passed,
+// among the events of that time in the order of its key
+func (c *VirtualClock) scheduleAt(at time.Time, key string, fn func()) *event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if at.Before(c.now) {
+		at = c.now
+	}
+	e := &event{at: at, key: key, seq: c.seq, fn: fn}
+	c.seq++
+	heap.Push(&c.events, e)
+	c.idle.Broadcast()
+	return e
+}
+
+// Hold keeps the clock from running its next event until Release.
+func (c *VirtualClock) Hold() {
+	c.mu.Lock()
+	c.busy++
+	c.mu.Unlock()
+}
+
+// Release lets go of a Hold.
+func (c *VirtualClock) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.busy == 0 {
+		panic("coconet: release of a virtual clock not held")
+	}
+	c.busy--
+	if c.busy == 0 {
+		c.idle.Broadcast()
+	}
+}
+
+// Wait for nothing to hold the clock, with c.mu held
+func (c *VirtualClock) waitIdle() {
+	for c.busy > 0 {
+		c.idle.Wait()
+	}
+}
+
+type virtualTimer struct {
+	c *VirtualClock
+	e *event
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if t.e.index < 0 {
+		return false
+	}
+	heap.Remove(&t.c.events, t.e.index)
+	return true
+}
+
+// Step moves the clock to the next event and runs every event due then,
+// including those they schedule without delay.
+// It returns false if nothing was scheduled.
+// Step waits for the clock's holds, so it must not be called holding it.
+func (c *VirtualClock) Step() bool {
+	c.mu.Lock()
+	c.waitIdle()
+	if len(c.events) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	c.now = c.events[0].at
+	c.mu.Unlock()
+	c.runDue()
+	return true
+}
+
+// Advance moves the clock on by d, running the events due on the way.
+// Like Step, it must not be called holding the clock.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		c.waitIdle()
+		if len(c.events) == 0 || c.events[0].at.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = c.events[0].at
+		c.mu.Unlock()
+		c.runDue()
+	}
+}
+
+// Run the events due at the clock's time, one at a time, in order
+func (c *VirtualClock) runDue() {
+	for {
+		c.mu.Lock()
+		c.waitIdle()
+		if len(c.events) == 0 || c.events[0].at.After(c.now) {
+			c.mu.Unlock()
+			return
+		}
+		e := heap.Pop(&c.events).(*event)
+		c.mu.Unlock()
+		e.fn()
+	}
+}
+
+// Run steps the clock in the background, whenever nothing holds it,
+// until Stop.
+func (c *VirtualClock) Run() {
+	c.mu.Lock()
+	if c.stop != nil {
+		c.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	c.stop = stop
+	c.mu.Unlock()
+
+	go func() {
+		for {
+			c.mu.Lock()
+			for c.stop == stop && (c.busy > 0 || len(c.events) == 0) {
+				c.idle.Wait()
+			}
+			if c.stop != stop {
+				c.mu.Unlock()
+				return
+			}
+			e := heap.Pop(&c.events).(*event)
+			if e.at.After(c.now) {
+				c.now = e.at
+			}
+			c.mu.Unlock()
+			e.fn()
+		}
+	}()
+}
+
+// Stop stops the stepping started by Run.
+func (c *VirtualClock) Stop() {
+	c.mu.Lock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+		c.idle.Broadcast()
+	}
+	c.mu.Unlock()
+}
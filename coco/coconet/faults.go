@@ -0,0 +1,451 @@
+package coconet
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Faults is a script of network faults, shared by the hosts and
+// connections it is injected into with NewFaultInjectionHost and
+// NewFaultInjectionConn. Tests set the faults of each link, schedule
+// partitions and other changes over time, and can change any of it
+// while the hosts run.
+//
+// Faults are applied to messages as they are sent,
+// except partitions which also hold back messages as they are received,
+// so a partition cuts off hosts that are not wrapped themselves.
+//
+// The script runs on a Clock, on which partitions are timed and
+// messages delayed: the wall clock, or the VirtualClock of a SimNet.
+type Faults struct {
+	mu    sync.Mutex
+	rand  *rand.Rand
+	clock Clock
+	start time.Time
+
+	defaults   LinkFaults
+	links      map[link]LinkFaults
+	partitions []partition
+	timers     []Timer
+
+	held map[link]*heldMessage // held back for reordering
+}
+
+// LinkFaults are the faults of the messages sent over a link.
+type LinkFaults struct {
+	// Delay returns how long to hold each message back. Nil for none.
+	Delay DelayFunc
+
+	// Probabilities that a message is dropped, delivered twice,
+	// or held back until after the next one on the link.
+	Drop      float64
+	Duplicate float64
+	Reorder   float64
+
+	// Mutate, if set, sees every message on the link and returns
+	// what is sent instead, or nil to drop it, to play a byzantine host.
+	Mutate func(from, to string, data BinaryMarshaler) BinaryMarshaler
+}
+
+// A DelayFunc draws the delay of one message.
+type DelayFunc func(r *rand.Rand) time.Duration
+
+// ConstantDelay delays every message by d.
+func ConstantDelay(d time.Duration) DelayFunc {
+	return func(*rand.Rand) time.Duration { return d }
+}
+
+// UniformDelay delays messages uniformly between min and max.
+func UniformDelay(min, max time.Duration) DelayFunc {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.Int63n(int64(max-min)+1))
+	}
+}
+
+// ExponentialDelay delays messages by min plus an exponentially
+// distributed time of the given mean, as queueing along a path does.
+func ExponentialDelay(min, mean time.Duration) DelayFunc {
+	return func(r *rand.Rand) time.Duration {
+		return min + time.Duration(r.ExpFloat64()*float64(mean))
+	}
+}
+
+// How long a message held back for reordering waits for the next
+// message on its link before it is sent anyway.
+var ReorderHold = 500 * time.Millisecond
+
+type link struct {
+	from, to string
+}
+
+type partition struct {
+	side     map[string]bool
+	from, to time.Time // to is zero if the partition lasts until healed
+}
+
+type heldMessage struct {
+	msg   BinaryMarshaler
+	put   func(BinaryMarshaler) error
+	timer Timer
+}
+
+// NewFaults creates a script without faults on the wall clock,
+// starting now. The seed makes the random draws of the faults repeatable.
+func NewFaults(seed int64) *Faults {
+	return NewClockFaults(seed, RealClock)
+}
+
+// NewClockFaults creates a script without faults on the given clock,
+// starting at its current time.
+func NewClockFaults(seed int64, clock Clock) *Faults {
+	return &Faults{
+		rand:  rand.New(rand.NewSource(seed)),
+		clock: clock,
+		start: clock.Now(),
+		links: make(map[link]LinkFaults),
+		held:  make(map[link]*heldMessage)}
+}
+
+// SetDefault sets the faults of links with none of their own.
+func (f *Faults) SetDefault(lf LinkFaults) {
+	f.mu.Lock()
+	f.defaults = lf
+	f.mu.Unlock()
+}
+
+// SetLink sets the faults of messages sent from one host to another.
+// Either name may be "" to match any host.
+func (f *Faults) SetLink(from, to string, lf LinkFaults) {
+	f.mu.Lock()
+	f.links[link{from, to}] = lf
+	f.mu.Unlock()
+}
+
+// ClearLink removes the faults set for a link with SetLink.
+func (f *Faults) ClearLink(from, to string) {
+	f.mu.Lock()
+	delete(f.links, link{from, to})
+	f.mu.Unlock()
+}
+
+// Partition cuts the given hosts off from all others, in both directions,
+// from at after the script's start for dur, or until Heal if dur is 0.
+func (f *Faults) Partition(at, dur time.Duration, side ...string) {
+	p := partition{side: make(map[string]bool)}
+	for _, h := range side {
+		p.side[h] = true
+	}
+	f.mu.Lock()
+	p.from = f.start.Add(at)
+	if dur > 0 {
+		p.to = p.from.Add(dur)
+	}
+	f.partitions = append(f.partitions, p)
+	f.mu.Unlock()
+}
+
+// Heal removes all partitions, past, present and scheduled.
+func (f *Faults) Heal() {
+	f.mu.Lock()
+	f.partitions = nil
+	f.mu.Unlock()
+}
+
+// At runs fn at the given time after the script's start,
+// to change the faults as the test goes on.
+func (f *Faults) At(at time.Duration, fn func()) {
+	f.mu.Lock()
+	t := f.clock.AfterFunc(f.start.Add(at).Sub(f.clock.Now()), fn)
+	f.timers = append(f.timers, t)
+	f.mu.Unlock()
+}
+
+// Stop cancels everything scheduled with At.
+func (f *Faults) Stop() {
+	f.mu.Lock()
+	for _, t := range f.timers {
+		t.Stop()
+	}
+	f.timers = nil
+	f.mu.Unlock()
+}
+
+// Cut reports whether a partition separates two hosts now.
+func (f *Faults) Cut(from, to string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	for _, p := range f.partitions {
+		if now.Before(p.from) || (!p.to.IsZero() && !now.Before(p.to)) {
+			continue
+		}
+		if p.side[from] != p.side[to] {
+			return true
+		}
+	}
+	return false
+}
+
+// The faults of a link, the most specific setting first
+func (f *Faults) link(from, to string) LinkFaults {
+	for _, l := range []link{{from, to}, {from, ""}, {"", to}, {"", ""}} {
+		if lf, ok := f.links[l]; ok {
+			return lf
+		}
+	}
+	return f.defaults
+}
+
+// A message as marshalled when it was sent,
+// so later changes by the sender do not reach delayed copies
+type rawMessage struct {
+	typ  byte
+	data []byte
+}
+
+func (m *rawMessage) MarshalBinary() ([]byte, error) {
+	return m.data, nil
+}
+
+func (m *rawMessage) MessageType() byte {
+	return m.typ
+}
+
+// send applies the faults of the link from one host to another to a
+// message, and hands what is left to put, possibly late or twice.
+// A message lost to the faults is not an error, as on a real network.
+func (f *Faults) send(from, to string, data BinaryMarshaler,
+	put func(BinaryMarshaler) error) error {
+
+	if f.Cut(from, to) {
+		return nil
+	}
+	f.mu.Lock()
+	lf := f.link(from, to)
+	drop := f.rand.Float64() < lf.Drop
+	copies := 1
+	if f.rand.Float64() < lf.Duplicate {
+		copies = 2
+	}
+	reorder := f.rand.Float64() < lf.Reorder
+	delays := make([]time.Duration, copies)
+	if lf.Delay != nil {
+		for i := range delays {
+			delays[i] = lf.Delay(f.rand)
+		}
+	}
+	f.mu.Unlock()
+
+	if drop {
+		return nil
+	}
+	if lf.Mutate != nil {
+		if data = lf.Mutate(from, to, data); data == nil {
+			return nil
+		}
+	}
+	b, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	msg := &rawMessage{MessageType(data), b}
+
+	l := link{from, to}
+	if reorder {
+		f.hold(l, msg, put)
+		return nil
+	}
+
+	// The message held back on the link goes out right after this one,
+	// whenever this one is due
+	held := f.take(l)
+	for i, d := range delays {
+		first := i == 0
+		if d == 0 {
+			err = put(msg)
+			if first {
+				held.send()
+			}
+			continue
+		}
+		f.clock.AfterFunc(d, func() {
+			if err := put(msg); err != nil {
+				log.Warnln("faults: delayed message from", from,
+					"to", to, "lost:", err)
+			}
+			if first {
+				held.send()
+			}
+		})
+	}
+	return err
+}
+
+// Hold a message back until the next one on its link is sent
+func (f *Faults) hold(l link, msg BinaryMarshaler, put func(BinaryMarshaler) error) {
+	f.take(l).send()
+	hm := &heldMessage{msg: msg, put: put}
+	f.mu.Lock()
+	f.held[l] = hm
+	hm.timer = f.clock.AfterFunc(ReorderHold, func() {
+		f.mu.Lock()
+		if f.held[l] != hm {
+			f.mu.Unlock()
+			return
+		}
+		delete(f.held, l)
+		f.mu.Unlock()
+		hm.put(hm.msg)
+	})
+	f.mu.Unlock()
+}
+
+// Take the message held back on a link, if any, for the caller to send
+func (f *Faults) take(l link) *heldMessage {
+	f.mu.Lock()
+	hm := f.held[l]
+	delete(f.held, l)
+	f.mu.Unlock()
+	if hm != nil {
+		hm.timer.Stop()
+	}
+	return hm
+}
+
+// Send a message taken from being held back, if any
+func (hm *heldMessage) send() {
+	if hm != nil {
+		hm.put(hm.msg)
+	}
+}
+
+// FaultInjectionConn is a Conn whose messages suffer the faults
+// of the link from its host to its peer.
+type FaultInjectionConn struct {
+	Conn
+	from   string
+	faults *Faults
+}
+
+// NewFaultInjectionConn wraps the connection from host "from" to its peer.
+func NewFaultInjectionConn(c Conn, from string, f *Faults) *FaultInjectionConn {
+	return &FaultInjectionConn{Conn: c, from: from, faults: f}
+}
+
+// Put puts data to the connection through the faults of the link.
+func (fc *FaultInjectionConn) Put(data BinaryMarshaler) error {
+	return fc.faults.send(fc.from, fc.Name(), data, fc.Conn.Put)
+}
+
+// Get gets data from the connection,
+// skipping what arrives while the peer is partitioned from us.
+func (fc *FaultInjectionConn) Get(data BinaryUnmarshaler) error {
+	for {
+		err := fc.Conn.Get(data)
+		if err != nil || !fc.faults.Cut(fc.Name(), fc.from) {
+			return err
+		}
+	}
+}
+
+// FaultInjectionHost is a Host whose messages suffer the faults
+// of the links from it to its peers.
+type FaultInjectionHost struct {
+	Host
+	faults *Faults
+
+	getOnce sync.Once
+	msgchan chan NetworkMessg
+}
+
+// NewFaultInjectionHost wraps a host so its links suffer the given faults.
+func NewFaultInjectionHost(h Host, f *Faults) *FaultInjectionHost {
+	return &FaultInjectionHost{Host: h, faults: f,
+		msgchan: make(chan NetworkMessg, 1)}
+}
+
+// Faults returns the script of faults the host suffers.
+func (fh *FaultInjectionHost) Faults() *Faults {
+	return fh.faults
+}
+
+// PutUp puts data to the parent through the faults of the link.
+func (fh *FaultInjectionHost) PutUp(ctx context.Context, view int, data BinaryMarshaler) error {
+	return fh.faults.send(fh.Name(), fh.Parent(view), data,
+		func(d BinaryMarshaler) error {
+			return fh.Host.PutUp(ctx, view, d)
+		})
+}
+
+// PutDown puts data to each child through the faults of its link.
+func (fh *FaultInjectionHost) PutDown(ctx context.Context, view int, data []BinaryMarshaler) error {
+	children := fh.Views().Children(view)
+	if len(data) != len(children) {
+		panic("number of messages passed down != number of children")
+	}
+	var err error
+	var errLock sync.Mutex
+	var wg sync.WaitGroup
+	for i, c := range children {
+		wg.Add(1)
+		go func(i int, c string) {
+			defer wg.Done()
+			if e := fh.PutTo(ctx, c, data[i]); e != nil {
+				errLock.Lock()
+				err = e
+				errLock.Unlock()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	return err
+}
+
+// PutTo puts data to a peer through the faults of the link.
+func (fh *FaultInjectionHost) PutTo(ctx context.Context, host string, data BinaryMarshaler) error {
+	return fh.faults.send(fh.Name(), host, data,
+		func(d BinaryMarshaler) error {
+			return fh.Host.PutTo(ctx, host, d)
+		})
+}
+
+// Get returns the channel of messages received,
+// without those that arrive while their sender is partitioned from us.
+func (fh *FaultInjectionHost) Get() chan NetworkMessg {
+	fh.getOnce.Do(func() {
+		in := fh.Host.Get()
+		go func() {
+			for nm := range in {
+				if nm.Err == nil && fh.faults.Cut(nm.From, fh.Name()) {
+					continue
+				}
+				fh.msgchan <- nm
+			}
+			close(fh.msgchan)
+		}()
+	})
+	return fh.msgchan
+}
+
+// Peers returns the host's connections, with the faults of their links.
+func (fh *FaultInjectionHost) Peers() map[string]Conn {
+	return fh.wrap(fh.Host.Peers())
+}
+
+// Children returns the connections to the children in the given view,
+// with the faults of their links.
+func (fh *FaultInjectionHost) Children(view int) map[string]Conn {
+	return fh.wrap(fh.Host.Children(view))
+}
+
+func (fh *FaultInjectionHost) wrap(conns map[string]Conn) map[string]Conn {
+	wrapped := make(map[string]Conn, len(conns))
+	for name, c := range conns {
+		wrapped[name] = NewFaultInjectionConn(c, fh.Name(), fh.faults)
+	}
+	return wrapped
+}
@@ -0,0 +1,247 @@
+package coconet
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A connection recording what is put to it,
+// and handing out what is queued for Get
+type recordConn struct {
+	Conn
+	name string
+
+	mu   sync.Mutex
+	sent []string
+	in   chan string
+}
+
+func newRecordConn(name string) *recordConn {
+	return &recordConn{name: name, in: make(chan string, 10)}
+}
+
+func (rc *recordConn) Name() string {
+	return rc.name
+}
+
+func (rc *recordConn) Put(data BinaryMarshaler) error {
+	b, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	rc.mu.Lock()
+	rc.sent = append(rc.sent, string(b))
+	rc.mu.Unlock()
+	return nil
+}
+
+func (rc *recordConn) Get(data BinaryUnmarshaler) error {
+	s, ok := <-rc.in
+	if !ok {
+		return ErrClosed
+	}
+	return data.UnmarshalBinary([]byte(s))
+}
+
+func (rc *recordConn) Sent() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]string(nil), rc.sent...)
+}
+
+func putAll(t *testing.T, c Conn, msgs ...string) {
+	for _, m := range msgs {
+		sm := StringMarshaler(m)
+		if err := c.Put(&sm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectSent(t *testing.T, rc *recordConn, want ...string) {
+	got := rc.Sent()
+	if len(got) != len(want) {
+		t.Fatalf("sent %q, expected %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("sent %q, expected %q", got, want)
+		}
+	}
+}
+
+func TestFaultsDropDuplicate(t *testing.T) {
+	f := NewFaults(1)
+	rc := newRecordConn("b")
+	fc := NewFaultInjectionConn(rc, "a", f)
+
+	f.SetLink("a", "b", LinkFaults{Drop: 1})
+	putAll(t, fc, "lost")
+	f.SetLink("a", "", LinkFaults{Duplicate: 1})
+	putAll(t, fc, "still lost")
+	f.ClearLink("a", "b")
+	putAll(t, fc, "twice")
+	f.ClearLink("a", "")
+	putAll(t, fc, "once")
+	expectSent(t, rc, "twice", "twice", "once")
+}
+
+func TestFaultsDelayReorder(t *testing.T) {
+	f := NewFaults(1)
+	rc := newRecordConn("b")
+	fc := NewFaultInjectionConn(rc, "a", f)
+
+	// A delayed message arrives after a prompt one sent later
+	f.SetLink("a", "b", LinkFaults{Delay: ConstantDelay(100 * time.Millisecond)})
+	putAll(t, fc, "slow")
+	f.ClearLink("a", "b")
+	putAll(t, fc, "fast")
+	time.Sleep(300 * time.Millisecond)
+	expectSent(t, rc, "fast", "slow")
+
+	// A message held back goes out after the next one
+	rc = newRecordConn("b")
+	fc = NewFaultInjectionConn(rc, "a", f)
+	f.SetLink("a", "b", LinkFaults{Reorder: 1})
+	putAll(t, fc, "first")
+	f.ClearLink("a", "b")
+	putAll(t, fc, "second", "third")
+	expectSent(t, rc, "second", "first", "third")
+
+	// or after a while if there is no next one
+	f.SetLink("a", "b", LinkFaults{Reorder: 1})
+	putAll(t, fc, "last")
+	time.Sleep(ReorderHold + 200*time.Millisecond)
+	expectSent(t, rc, "second", "first", "third", "last")
+}
+
+// A message held back goes out after the next one even if that one
+// is delayed
+func TestFaultsReorderDelayed(t *testing.T) {
+	f := NewFaults(1)
+	rc := newRecordConn("b")
+	fc := NewFaultInjectionConn(rc, "a", f)
+	f.SetLink("a", "b", LinkFaults{Reorder: 1})
+	putAll(t, fc, "first")
+	f.SetLink("a", "b", LinkFaults{Delay: ConstantDelay(100 * time.Millisecond)})
+	putAll(t, fc, "second")
+	expectSent(t, rc)
+	time.Sleep(300 * time.Millisecond)
+	expectSent(t, rc, "second", "first")
+}
+
+// Delays and partitions run on the script's clock
+func TestFaultsVirtualClock(t *testing.T) {
+	c := NewVirtualClock(time.Unix(0, 0))
+	f := NewClockFaults(1, c)
+	rc := newRecordConn("b")
+	fc := NewFaultInjectionConn(rc, "a", f)
+
+	f.SetLink("a", "b", LinkFaults{Delay: ConstantDelay(time.Hour)})
+	putAll(t, fc, "late")
+	c.Advance(time.Hour - time.Second)
+	expectSent(t, rc)
+	c.Advance(time.Second)
+	expectSent(t, rc, "late")
+
+	f.Partition(time.Hour+time.Minute, time.Minute, "a")
+	if f.Cut("a", "b") {
+		t.Fatal("cut before the partition")
+	}
+	c.Advance(time.Minute)
+	if !f.Cut("a", "b") {
+		t.Fatal("not cut during the partition")
+	}
+	c.Advance(time.Minute)
+	if f.Cut("a", "b") {
+		t.Fatal("cut after the partition")
+	}
+
+	// and so does the wait of a message held back
+	f.SetLink("a", "b", LinkFaults{Reorder: 1})
+	putAll(t, fc, "held")
+	c.Advance(ReorderHold - time.Millisecond)
+	expectSent(t, rc, "late")
+	c.Advance(time.Millisecond)
+	expectSent(t, rc, "late", "held")
+}
+
+func TestFaultsDelayDistributions(t *testing.T) {
+	f := NewFaults(1)
+	for _, d := range []DelayFunc{
+		UniformDelay(10*time.Millisecond, 20*time.Millisecond),
+		ExponentialDelay(10*time.Millisecond, 5*time.Millisecond),
+	} {
+		for i := 0; i < 100; i++ {
+			if x := d(f.rand); x < 10*time.Millisecond {
+				t.Fatal("delay below the minimum:", x)
+			}
+		}
+	}
+}
+
+func TestFaultsMutate(t *testing.T) {
+	f := NewFaults(1)
+	rc := newRecordConn("b")
+	fc := NewFaultInjectionConn(rc, "a", f)
+	f.SetDefault(LinkFaults{Mutate: func(from, to string, data BinaryMarshaler) BinaryMarshaler {
+		if *data.(*StringMarshaler) == "drop me" {
+			return nil
+		}
+		lie := StringMarshaler(from + " lies to " + to)
+		return &lie
+	}})
+	putAll(t, fc, "truth", "drop me")
+	expectSent(t, rc, "a lies to b")
+}
+
+func TestFaultsPartition(t *testing.T) {
+	f := NewFaults(1)
+	rc := newRecordConn("b")
+	fc := NewFaultInjectionConn(rc, "a", f)
+
+	f.Partition(100*time.Millisecond, 200*time.Millisecond, "a")
+	putAll(t, fc, "before")
+	time.Sleep(150 * time.Millisecond)
+	if !f.Cut("b", "a") || f.Cut("b", "c") {
+		t.Fatal("partition cuts the wrong links")
+	}
+	putAll(t, fc, "during")
+
+	// Messages arriving from across the partition are lost too
+	rc.in <- "incoming during"
+	healed := make(chan bool)
+	f.At(350*time.Millisecond, func() {
+		rc.in <- "incoming after"
+		close(healed)
+	})
+	var got StringMarshaler
+	if err := fc.Get(&got); err != nil || got != "incoming after" {
+		t.Fatal("received", got, err)
+	}
+	<-healed
+	putAll(t, fc, "after")
+	expectSent(t, rc, "before", "after")
+
+	// A partition without an end lasts until healed
+	f.Partition(0, 0, "b")
+	putAll(t, fc, "cut")
+	f.Heal()
+	putAll(t, fc, "healed")
+	expectSent(t, rc, "before", "after", "healed")
+}
+
+type failingMessage struct{}
+
+func (failingMessage) MarshalBinary() ([]byte, error) {
+	return nil, errors.New("cannot marshal")
+}
+
+func TestFaultsMarshalError(t *testing.T) {
+	fc := NewFaultInjectionConn(newRecordConn("b"), "a", NewFaults(1))
+	if err := fc.Put(failingMessage{}); err == nil {
+		t.Fatal("marshalling error lost")
+	}
+}
@@ -49,8 +49,8 @@ type GoHost struct {
 
 	pool *sync.Pool
 
-	msgchan chan NetworkMessg
-	closed  int64
+	queue  *RecvQueue // messages received, waiting for Get
+	closed int64
 }
 
 // GetDirectory returns the underlying directory used for GoHosts.
@@ -62,9 +62,9 @@ func (h *GoHost) GetDirectory() *GoDirectory {
 // and registers it in the given directory.
 func NewGoHost(hostname string, dir *GoDirectory) *GoHost {
 	h := &GoHost{name: hostname,
-		views:   NewViews(),
-		dir:     dir,
-		msgchan: make(chan NetworkMessg, 0)}
+		views: NewViews(),
+		dir:   dir,
+		queue: NewRecvQueue(DefaultQueueLimit, Block)}
 	h.peers = make(map[string]Conn)
 	h.PeerLock = sync.RWMutex{}
 	h.Ready = make(map[string]bool)
@@ -88,6 +88,11 @@ func (h *GoHost) PubKey() abstract.Point {
 	return pk
 }
 
+// StateChanges returns nil, as links between GoHosts never fail.
+func (h *GoHost) StateChanges() <-chan StateChange {
+	return nil
+}
+
 // SetPubKey sets the publick key of the Host.
 func (h *GoHost) SetPubKey(pk abstract.Point) {
 	h.pkLock.Lock()
@@ -140,7 +145,10 @@ func (h *GoHost) ConnectTo(parent string) error {
 			data := h.pool.Get().(BinaryUnmarshaler)
 			err := conn.Get(data)
 
-			h.msgchan <- NetworkMessg{Data: data, From: conn.Name(), Err: err}
+			h.queue.Put(NetworkMessg{Data: data, From: conn.Name(), Err: err})
+			if err == ErrClosed {
+				return
+			}
 		}
 	}()
 
@@ -202,7 +210,10 @@ func (h *GoHost) Listen() error {
 					data := h.pool.Get().(BinaryUnmarshaler)
 					err := conn.Get(data)
 
-					h.msgchan <- NetworkMessg{Data: data, From: conn.Name(), Err: err}
+					h.queue.Put(NetworkMessg{Data: data, From: conn.Name(), Err: err})
+					if err == ErrClosed {
+						return
+					}
 				}
 			}()
 		}(c)
@@ -295,6 +306,7 @@ func (h *GoHost) Close() {
 	h.PeerLock.Unlock()
 
 	atomic.SwapInt64(&h.closed, 1)
+	h.queue.Close()
 }
 
 func (h *GoHost) Closed() bool {
@@ -490,7 +502,13 @@ func (h *GoHost) PutDown(ctx context.Context, view int, data []BinaryMarshaler)
 // Get returns two channels. One of messages that are received, and another of errors
 // associated with each message.
 func (h *GoHost) Get() chan NetworkMessg {
-	return h.msgchan
+	return h.queue.Get()
+}
+
+// Queue returns the queues of messages received from each peer,
+// waiting for Get.
+func (h *GoHost) Queue() *RecvQueue {
+	return h.queue
 }
 
 // Pool returns the underlying pool of objects for creating new BinaryUnmarshalers,
@@ -0,0 +1,416 @@
+package coconet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/random"
+)
+
+// Before any message is exchanged over a TCPHost connection the two
+// ends run a handshake:
+//
+//	dialer   -> listener: hello{name, pubkey, ephemeral point, nonce}
+//	listener -> dialer:   hello{...}, signature
+//	dialer   -> listener: signature
+//
+// Each signature is made with the host's long-term private key over
+// the hash of both hellos, and is checked against the public key
+// configured for the peer's name in the tree.
+// The ephemeral Diffie-Hellman secret then keys an AES-GCM session
+// in each direction, under which the frames of wire.go are sent.
+
+const handshakeLabel = "coconet handshake v1"
+
+// Largest handshake message we accept
+const maxHelloLen = 4096
+
+// Plaintext bytes per encrypted record, apart from MaxFrameLen
+// which bounds a whole message on the wire
+const maxSealedRecord = 16 * 1024
+
+// How long a peer may take to complete the handshake
+var HandshakeTimeout = 10 * time.Second
+
+var ErrNoPrivKey = errors.New("handshake: host has no private key")
+var ErrUnknownPeer = errors.New("handshake: no public key configured for peer")
+var ErrWrongPeerKey = errors.New("handshake: peer key does not match the tree")
+var ErrWrongPeer = errors.New("handshake: peer is not the host dialed")
+
+type hello struct {
+	name   string
+	pubkey abstract.Point
+	eph    abstract.Point
+	nonce  [16]byte
+	raw    []byte // as sent, for the transcript
+}
+
+func newHello(suite abstract.Suite, name string, pub, eph abstract.Point) (*hello, error) {
+	hl := &hello{name: name, pubkey: pub, eph: eph}
+	random.Stream.XORKeyStream(hl.nonce[:], hl.nonce[:])
+	pb, err := pub.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	eb, err := eph.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeBlob(&buf, []byte(name))
+	writeBlob(&buf, pb)
+	writeBlob(&buf, eb)
+	buf.Write(hl.nonce[:])
+	hl.raw = buf.Bytes()
+	return hl, nil
+}
+
+func decodeHello(suite abstract.Suite, raw []byte) (*hello, error) {
+	hl := &hello{raw: raw}
+	r := bytes.NewReader(raw)
+	name, err := readBlob(r, maxHelloLen)
+	if err != nil {
+		return nil, err
+	}
+	hl.name = string(name)
+	pb, err := readBlob(r, maxHelloLen)
+	if err != nil {
+		return nil, err
+	}
+	hl.pubkey = suite.Point()
+	if err := hl.pubkey.UnmarshalBinary(pb); err != nil {
+		return nil, err
+	}
+	eb, err := readBlob(r, maxHelloLen)
+	if err != nil {
+		return nil, err
+	}
+	hl.eph = suite.Point()
+	if err := hl.eph.UnmarshalBinary(eb); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, hl.nonce[:]); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("handshake: trailing bytes in hello")
+	}
+	return hl, nil
+}
+
+func writeBlob(w io.Writer, b []byte) error {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	if _, err := w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readBlob(r io.Reader, max int) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > uint32(max) {
+		return nil, errors.New("handshake: message too long")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// The message each side signs: its role and both hellos
+func transcript(role string, dialer, listener *hello) []byte {
+	h := sha256.New()
+	writeBlob(h, []byte(handshakeLabel))
+	writeBlob(h, dialer.raw)
+	writeBlob(h, listener.raw)
+	return append([]byte(role), h.Sum(nil)...)
+}
+
+// One half of a handshake in progress
+type handshake struct {
+	suite  abstract.Suite
+	priv   abstract.Secret
+	peers  map[string]abstract.Point // keys peers must prove, by name
+	eph    abstract.Secret
+	mine   *hello
+	theirs *hello
+}
+
+func newHandshake(suite abstract.Suite, name string, priv abstract.Secret,
+	peers map[string]abstract.Point) (*handshake, error) {
+
+	if priv == nil {
+		return nil, ErrNoPrivKey
+	}
+	hs := &handshake{suite: suite, priv: priv, peers: peers}
+	hs.eph = suite.Secret().Pick(random.Stream)
+	var err error
+	hs.mine, err = newHello(suite, name,
+		suite.Point().Mul(nil, priv),
+		suite.Point().Mul(nil, hs.eph))
+	return hs, err
+}
+
+// Check the peer's hello against the keys configured for the tree
+func (hs *handshake) checkPeer(raw []byte) error {
+	hl, err := decodeHello(hs.suite, raw)
+	if err != nil {
+		return err
+	}
+	hs.theirs = hl
+	return checkPeerKey(hs.peers, hl.name, hl.pubkey)
+}
+
+// Check a peer proved the key configured for the name it claims.
+// A peer with no configured key is refused, whatever key it proves.
+func checkPeerKey(peers map[string]abstract.Point, name string,
+	pubkey abstract.Point) error {
+
+	pk, ok := peers[name]
+	if !ok {
+		return ErrUnknownPeer
+	}
+	// compare encodings: Equal may normalize the points it compares,
+	// and the configured keys are shared by concurrent handshakes
+	want, err := pk.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	got, err := pubkey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, got) {
+		return ErrWrongPeerKey
+	}
+	return nil
+}
+
+func (hs *handshake) sign(role string, dialer, listener *hello) []byte {
+	return anon.Sign(hs.suite, random.Stream,
+		transcript(role, dialer, listener),
+		anon.Set{hs.mine.pubkey}, nil, 0, hs.priv)
+}
+
+func (hs *handshake) verify(role string, dialer, listener *hello, sig []byte) error {
+	_, err := anon.Verify(hs.suite, transcript(role, dialer, listener),
+		anon.Set{hs.theirs.pubkey}, nil, sig)
+	return err
+}
+
+// Derive the session keys and wrap the connection
+func (hs *handshake) session(conn net.Conn, dialer, listener *hello,
+	isDialer bool) (*secureConn, error) {
+
+	shared, err := hs.suite.Point().Mul(hs.theirs.eph, hs.eph).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	key := func(dir string) (cipher.AEAD, error) {
+		h := sha256.New()
+		writeBlob(h, []byte(handshakeLabel))
+		writeBlob(h, []byte(dir))
+		writeBlob(h, shared)
+		writeBlob(h, dialer.raw)
+		writeBlob(h, listener.raw)
+		block, err := aes.NewCipher(h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	down, err := key("listener to dialer")
+	if err != nil {
+		return nil, err
+	}
+	up, err := key("dialer to listener")
+	if err != nil {
+		return nil, err
+	}
+	if isDialer {
+		return &secureConn{Conn: conn, seal: up, open: down}, nil
+	}
+	return &secureConn{Conn: conn, seal: down, open: up}, nil
+}
+
+// handshakeDial authenticates the listener at the other end of conn,
+// which we dialed as peer, and returns the encrypted connection
+// along with the peer's public key.
+func handshakeDial(conn net.Conn, suite abstract.Suite, name, peer string,
+	priv abstract.Secret, peers map[string]abstract.Point) (net.Conn, abstract.Point, error) {
+
+	hs, err := newHandshake(suite, name, priv, peers)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if err := writeBlob(conn, hs.mine.raw); err != nil {
+		return nil, nil, err
+	}
+	raw, err := readBlob(conn, maxHelloLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := hs.checkPeer(raw); err != nil {
+		return nil, nil, err
+	}
+	if hs.theirs.name != peer {
+		return nil, nil, ErrWrongPeer
+	}
+	sig, err := readBlob(conn, maxHelloLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := hs.verify("l", hs.mine, hs.theirs, sig); err != nil {
+		return nil, nil, err
+	}
+	if err := writeBlob(conn, hs.sign("d", hs.mine, hs.theirs)); err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sc, err := hs.session(conn, hs.mine, hs.theirs, true)
+	return sc, hs.theirs.pubkey, err
+}
+
+// handshakeAccept authenticates the dialer at the other end of conn
+// and returns the encrypted connection along with the name and
+// public key the dialer proved.
+func handshakeAccept(conn net.Conn, suite abstract.Suite, name string,
+	priv abstract.Secret, peers map[string]abstract.Point) (net.Conn, string, abstract.Point, error) {
+
+	hs, err := newHandshake(suite, name, priv, peers)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	raw, err := readBlob(conn, maxHelloLen)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if err := hs.checkPeer(raw); err != nil {
+		return nil, "", nil, err
+	}
+	if err := writeBlob(conn, hs.mine.raw); err != nil {
+		return nil, "", nil, err
+	}
+	if err := writeBlob(conn, hs.sign("l", hs.theirs, hs.mine)); err != nil {
+		return nil, "", nil, err
+	}
+	sig, err := readBlob(conn, maxHelloLen)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if err := hs.verify("d", hs.theirs, hs.mine, sig); err != nil {
+		return nil, "", nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	sc, err := hs.session(conn, hs.theirs, hs.mine, false)
+	return sc, hs.theirs.name, hs.theirs.pubkey, err
+}
+
+// The handshake above, protecting TCPHost connections by default
+type handshakeChannel struct {
+	h *TCPHost
+}
+
+func (hc handshakeChannel) accept(conn net.Conn) (Conn, error) {
+	priv, peers := hc.h.keys()
+	sconn, name, pubkey, err := handshakeAccept(conn, hc.h.suite,
+		hc.h.name, priv, peers)
+	if err != nil {
+		return nil, err
+	}
+	tp := NewTCPConnFromNet(sconn)
+	tp.SetName(name)
+	tp.SetPubKey(pubkey)
+	return tp, nil
+}
+
+func (hc handshakeChannel) dial(conn net.Conn, peer string) (Conn, error) {
+	priv, peers := hc.h.keys()
+	sconn, pubkey, err := handshakeDial(conn, hc.h.suite, hc.h.name, peer,
+		priv, peers)
+	if err != nil {
+		return nil, err
+	}
+	tp := NewTCPConnFromNet(sconn)
+	tp.SetName(peer)
+	tp.SetPubKey(pubkey)
+	return tp, nil
+}
+
+// secureConn carries a byte stream in AES-GCM sealed frames,
+// each numbered by its position in the stream so frames cannot be
+// dropped, replayed or reordered without the reader noticing.
+type secureConn struct {
+	net.Conn
+
+	wlock sync.Mutex
+	seal  cipher.AEAD
+	wseq  uint64
+
+	open cipher.AEAD
+	rseq uint64
+	rbuf []byte // opened but not yet read
+}
+
+func seqNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (sc *secureConn) Write(b []byte) (int, error) {
+	sc.wlock.Lock()
+	defer sc.wlock.Unlock()
+	n := 0
+	for len(b) > 0 {
+		l := len(b)
+		if l > maxSealedRecord {
+			l = maxSealedRecord
+		}
+		frame := sc.seal.Seal(nil, seqNonce(sc.seal, sc.wseq), b[:l], nil)
+		sc.wseq++
+		if err := writeBlob(sc.Conn, frame); err != nil {
+			return n, err
+		}
+		n += l
+		b = b[l:]
+	}
+	return n, nil
+}
+
+func (sc *secureConn) Read(b []byte) (int, error) {
+	for len(sc.rbuf) == 0 {
+		frame, err := readBlob(sc.Conn, maxSealedRecord+sc.open.Overhead())
+		if err != nil {
+			return 0, err
+		}
+		sc.rbuf, err = sc.open.Open(frame[:0], seqNonce(sc.open, sc.rseq),
+			frame, nil)
+		if err != nil {
+			return 0, errors.New("secure conn: frame failed authentication")
+		}
+		sc.rseq++
+	}
+	n := copy(b, sc.rbuf)
+	sc.rbuf = sc.rbuf[n:]
+	return n, nil
+}
@@ -0,0 +1,132 @@
+package coconet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+)
+
+type testKey struct {
+	priv abstract.Secret
+	pub  abstract.Point
+}
+
+func newTestKey(suite abstract.Suite) testKey {
+	priv := suite.Secret().Pick(random.Stream)
+	return testKey{priv, suite.Point().Mul(nil, priv)}
+}
+
+type acceptResult struct {
+	conn   net.Conn
+	name   string
+	pubkey abstract.Point
+	err    error
+}
+
+// Run both halves of a handshake over a pipe
+func testHandshake(suite abstract.Suite, parent, child testKey, claim string,
+	peers map[string]abstract.Point) (net.Conn, acceptResult, error) {
+
+	cconn, pconn := net.Pipe()
+	res := make(chan acceptResult)
+	go func() {
+		var r acceptResult
+		r.conn, r.name, r.pubkey, r.err = handshakeAccept(pconn, suite,
+			"parent", parent.priv, peers)
+		if r.err != nil {
+			pconn.Close()
+		}
+		res <- r
+	}()
+	conn, _, err := handshakeDial(cconn, suite, claim, "parent",
+		child.priv, peers)
+	if err != nil {
+		cconn.Close()
+	}
+	return conn, <-res, err
+}
+
+func TestHandshake(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	parent, child := newTestKey(suite), newTestKey(suite)
+	peers := map[string]abstract.Point{
+		"parent": parent.pub,
+		"child":  child.pub}
+
+	conn, r, err := testHandshake(suite, parent, child, "child", peers)
+	if err != nil || r.err != nil {
+		t.Fatal(err, r.err)
+	}
+	if r.name != "child" || !r.pubkey.Equal(child.pub) {
+		t.Fatal("parent saw the wrong child:", r.name)
+	}
+
+	// Messages get through the encrypted session both ways
+	Latency = 0
+	ctp, ptp := NewTCPConnFromNet(conn), NewTCPConnFromNet(r.conn)
+	go func() {
+		msg := StringMarshaler("up")
+		ctp.Put(&msg)
+	}()
+	var got StringMarshaler
+	if err := ptp.Get(&got); err != nil || got != "up" {
+		t.Fatal("message up:", got, err)
+	}
+	go func() {
+		msg := StringMarshaler("down")
+		ptp.Put(&msg)
+	}()
+	if err := ctp.Get(&got); err != nil || got != "down" {
+		t.Fatal("message down:", got, err)
+	}
+
+	// A child with another key cannot take the name
+	impostor := newTestKey(suite)
+	if _, r, _ := testHandshake(suite, parent, impostor, "child", peers); r.err != ErrWrongPeerKey {
+		t.Fatal("impostor accepted:", r.err)
+	}
+	if _, r, _ := testHandshake(suite, parent, impostor, "other", peers); r.err != ErrUnknownPeer {
+		t.Fatal("unknown peer accepted:", r.err)
+	}
+
+	// Nor can anyone stand in for the parent
+	if _, _, err := testHandshake(suite, impostor, child, "child", peers); err != ErrWrongPeerKey {
+		t.Fatal("impostor parent accepted:", err)
+	}
+}
+
+func TestSecureConnTamper(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	parent, child := newTestKey(suite), newTestKey(suite)
+	peers := map[string]abstract.Point{
+		"parent": parent.pub,
+		"child":  child.pub}
+	conn, r, err := testHandshake(suite, parent, child, "child", peers)
+	if err != nil || r.err != nil {
+		t.Fatal(err, r.err)
+	}
+
+	// Flip a bit of a frame on its way to the parent
+	sc := conn.(*secureConn)
+	raw, wire := net.Pipe()
+	sc.Conn = raw
+	go func() {
+		sc.Write([]byte("hello"))
+	}()
+	frame, err := readBlob(wire, maxSealedRecord+64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame[len(frame)-1] ^= 1
+
+	pc := r.conn.(*secureConn)
+	in, out := net.Pipe()
+	pc.Conn = in
+	go writeBlob(out, frame)
+	if _, err := pc.Read(make([]byte, 10)); err == nil {
+		t.Fatal("tampered frame accepted")
+	}
+}
@@ -86,6 +86,12 @@ type Host interface {
 	// Close closes all the connections in the Host.
 	Close()
 
+	// StateChanges returns a channel on which the host reports links to
+	// its peers going down and coming back up. It always returns a
+	// reference to the same channel, which is nil for hosts whose links
+	// cannot fail.
+	StateChanges() <-chan StateChange
+
 	// SetSuite sets the suite to use for the Host.
 	SetSuite(abstract.Suite)
 	// PubKey returns the public key of the Host.
@@ -95,7 +101,8 @@ type Host interface {
 
 	// Pool is a pool of BinaryUnmarshallers to use when generating NetworkMessg's.
 	Pool() *sync.Pool
-	// SetPool sets the pool of the Host.
+	// SetPool sets the pool of the Host. A Registry's pool lets the
+	// Host carry the messages of several protocols.
 	SetPool(*sync.Pool)
 
 	// Functions to allow group evolution
@@ -107,3 +114,24 @@ type Host interface {
 	AddPeerToHostlist(view int, name string)
 	RemovePeerFromHostlist(view int, name string)
 }
+
+// LinkState is the state of the link to a peer.
+type LinkState int
+
+const (
+	LinkUp LinkState = iota
+	LinkDown
+)
+
+func (s LinkState) String() string {
+	if s == LinkUp {
+		return "up"
+	}
+	return "down"
+}
+
+// StateChange reports the link to a peer changing state.
+type StateChange struct {
+	Peer  string
+	State LinkState
+}
@@ -0,0 +1,199 @@
+package coconet
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DropPolicy is what a RecvQueue does with a message from a peer
+// whose queue is full.
+type DropPolicy int
+
+const (
+	// Block makes the peer's reader wait for room, pushing back on the
+	// peer through its link.
+	Block DropPolicy = iota
+	// DropNewest drops the message arriving.
+	DropNewest
+	// DropOldest drops the oldest message queued from the peer.
+	DropOldest
+)
+
+func (p DropPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop newest"
+	case DropOldest:
+		return "drop oldest"
+	}
+	return "unknown"
+}
+
+// DefaultQueueLimit is the number of messages a host queues from each
+// peer, waiting for Get.
+var DefaultQueueLimit = 64
+
+// QueueStats are the counts of a peer's queue.
+type QueueStats struct {
+	Depth    int // messages queued now
+	MaxDepth int // most messages ever queued at once
+	Received int // messages put into the queue, dropped or not
+	Dropped  int
+}
+
+// RecvQueue holds the messages a host receives in a bounded queue per
+// peer, and hands them out on a single channel taking one message from
+// each peer in turn, so a peer flooding the host only delays its own
+// messages. Messages carrying ErrClosed are always queued, so the
+// reader of Get learns of a closed link even from a full queue.
+type RecvQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // signals messages queued and room made
+	limit  int
+	policy DropPolicy
+	peers  map[string]*peerQueue
+	ready  []string // peers with messages queued, in turn
+	closed bool
+	done   chan struct{} // closed by Close, to stop the pump
+
+	out chan NetworkMessg
+}
+
+type peerQueue struct {
+	msgs  []NetworkMessg
+	stats QueueStats
+	ready bool // in the ready list
+}
+
+// NewRecvQueue creates a queue of limit messages per peer, 0 for
+// no limit, handling full queues by the given policy.
+func NewRecvQueue(limit int, policy DropPolicy) *RecvQueue {
+	q := &RecvQueue{limit: limit, policy: policy,
+		peers: make(map[string]*peerQueue),
+		done:  make(chan struct{}),
+		out:   make(chan NetworkMessg)}
+	q.cond = sync.NewCond(&q.mu)
+	go q.pump()
+	return q
+}
+
+// SetLimit changes the limit and policy of the queues.
+func (q *RecvQueue) SetLimit(limit int, policy DropPolicy) {
+	q.mu.Lock()
+	q.limit = limit
+	q.policy = policy
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// Get returns the channel the messages are handed out on. It is closed
+// once the queue is closed and what was left in it handed out.
+func (q *RecvQueue) Get() chan NetworkMessg {
+	return q.out
+}
+
+// Put queues a message from its sender, nm.From. Under the Block
+// policy it waits for room in the sender's queue; otherwise it returns
+// false if a message was dropped to make room or this one was.
+func (q *RecvQueue) Put(nm NetworkMessg) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := q.peers[nm.From]
+	if p == nil {
+		p = &peerQueue{}
+		q.peers[nm.From] = p
+	}
+	p.stats.Received++
+	kept := true
+	for nm.Err != ErrClosed && q.limit > 0 && len(p.msgs) >= q.limit {
+		if q.policy == Block && !q.closed {
+			q.cond.Wait()
+			continue
+		}
+		p.stats.Dropped++
+		kept = false
+		if q.policy == DropOldest {
+			p.msgs = p.msgs[1:]
+			continue
+		}
+		log.Warnln("recvqueue: queue full, dropping message from", nm.From)
+		return false
+	}
+	p.msgs = append(p.msgs, nm)
+	p.stats.Depth = len(p.msgs)
+	if p.stats.Depth > p.stats.MaxDepth {
+		p.stats.MaxDepth = p.stats.Depth
+	}
+	if !p.ready {
+		p.ready = true
+		q.ready = append(q.ready, nm.From)
+	}
+	q.cond.Broadcast()
+	return kept
+}
+
+// Hand out the messages queued, one peer after the other, until the
+// queue is closed and drained
+func (q *RecvQueue) pump() {
+	defer close(q.out)
+	for {
+		q.mu.Lock()
+		for len(q.ready) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.ready) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		name := q.ready[0]
+		q.ready = q.ready[1:]
+		p := q.peers[name]
+		nm := p.msgs[0]
+		p.msgs = p.msgs[1:]
+		p.stats.Depth = len(p.msgs)
+		if len(p.msgs) > 0 {
+			q.ready = append(q.ready, name)
+		} else {
+			p.ready = false
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		select {
+		case q.out <- nm:
+		case <-q.done:
+			// closed: what is left only goes to a reader already waiting
+			select {
+			case q.out <- nm:
+			default:
+				return
+			}
+		}
+	}
+}
+
+// Stats returns the counts of each peer's queue.
+func (q *RecvQueue) Stats() map[string]QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := make(map[string]QueueStats, len(q.peers))
+	for name, p := range q.peers {
+		stats[name] = p.stats
+	}
+	return stats
+}
+
+// Close stops Put from blocking: once the host is closed nobody may
+// be left to make room, and full queues drop what arrives instead.
+// It also stops handing out messages once nobody is waiting for them.
+func (q *RecvQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
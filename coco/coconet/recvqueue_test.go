@@ -0,0 +1,130 @@
+package coconet
+
+import (
+	"testing"
+	"time"
+)
+
+func queued(from string, i int) NetworkMessg {
+	m := StringMarshaler(string(rune('a' + i)))
+	return NetworkMessg{Data: &m, From: from}
+}
+
+func got(t *testing.T, q *RecvQueue) NetworkMessg {
+	select {
+	case nm := <-q.Get():
+		return nm
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing to get")
+	}
+	return NetworkMessg{}
+}
+
+// A peer flooding the queue does not keep another's messages waiting
+func TestRecvQueueFair(t *testing.T) {
+	q := NewRecvQueue(0, Block)
+	for i := 0; i < 100; i++ {
+		q.Put(queued("flood", i))
+	}
+	q.Put(queued("quiet", 0))
+	for i := 0; i < 3; i++ {
+		if nm := got(t, q); nm.From == "quiet" {
+			return
+		}
+	}
+	t.Fatal("quiet peer starved by the flooding one")
+}
+
+func TestRecvQueueBlock(t *testing.T) {
+	q := NewRecvQueue(2, Block)
+	// one message is taken by the pump, waiting to be got
+	for i := 0; i < 3; i++ {
+		q.Put(queued("a", i))
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	put := make(chan bool)
+	go func() {
+		put <- q.Put(queued("a", 3))
+	}()
+	select {
+	case <-put:
+		t.Fatal("put into a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// others are not held up
+	q.Put(queued("b", 0))
+
+	for i := 0; i < 5; i++ {
+		got(t, q)
+	}
+	if !<-put {
+		t.Fatal("blocked message dropped")
+	}
+	s := q.Stats()["a"]
+	if s.Received != 4 || s.Dropped != 0 || s.MaxDepth != 2 || s.Depth != 0 {
+		t.Fatal("wrong stats", s)
+	}
+
+	// once closed, full queues drop instead of blocking,
+	// except for the closing messages
+	q.Close()
+	for i := 0; i < 4; i++ {
+		q.Put(queued("a", i))
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	q.Put(NetworkMessg{From: "a", Err: ErrClosed})
+	if s := q.Stats()["a"]; s.Dropped != 1 || s.Depth != 3 {
+		t.Fatal("wrong stats once closed", s)
+	}
+}
+
+func TestRecvQueueDrop(t *testing.T) {
+	for _, c := range []struct {
+		policy DropPolicy
+		first  StringMarshaler
+	}{{DropNewest, "b"}, {DropOldest, "c"}} {
+		q := NewRecvQueue(2, c.policy)
+		// "a" is taken by the pump, "b" and "c" queued
+		kept := true
+		for i := 0; i < 4; i++ {
+			kept = q.Put(queued("p", i)) && kept
+			if i == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if kept {
+			t.Fatal(c.policy, ": nothing dropped")
+		}
+		if s := q.Stats()["p"]; s.Received != 4 || s.Dropped != 1 || s.Depth != 2 {
+			t.Fatal(c.policy, ": wrong stats", s)
+		}
+		got(t, q)
+		if nm := got(t, q); *nm.Data.(*StringMarshaler) != c.first {
+			t.Fatal(c.policy, ": got", *nm.Data.(*StringMarshaler), "expected", c.first)
+		}
+	}
+}
+
+// Closing the queue stops its pump, even with messages nobody takes
+func TestRecvQueueClose(t *testing.T) {
+	for _, n := range []int{0, 3} {
+		q := NewRecvQueue(0, Block)
+		for i := 0; i < n; i++ {
+			q.Put(queued("peer", i))
+		}
+		q.Close()
+		timeout := time.After(5 * time.Second)
+		for closed := false; !closed; {
+			select {
+			case _, ok := <-q.Get():
+				closed = !ok
+			case <-timeout:
+				t.Fatal("pump still running with", n, "messages queued")
+			}
+		}
+	}
+}
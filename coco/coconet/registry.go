@@ -0,0 +1,146 @@
+package coconet
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A Registry maps message type IDs to the constructors of their
+// messages, so that the messages of several protocols can be carried
+// over the same Host: each is sent in an Envelope tagged with the ID
+// of its type, and received into a new message of that type.
+//
+// Both ends of a link must register the same IDs for the same types.
+type Registry struct {
+	lock  sync.RWMutex
+	news  map[byte]func() BinaryUnmarshaler
+	types map[reflect.Type]byte
+}
+
+// MsgEnvelope is the frame type of Envelopes.
+const MsgEnvelope byte = 1
+
+// IDs the messages of this repository's protocols are registered under,
+// by the RegisterMessages function of their package.
+const (
+	SigningMessageID byte = iota + 1
+	TimeStampMessageID
+	PolicyMessageID
+)
+
+var ErrTypeRegistered = errors.New("registry: message type already registered")
+
+// An UnregisteredTypeError reports a message of a type with no
+// constructor registered, or whose ID is not registered.
+type UnregisteredTypeError struct {
+	ID   byte
+	Type reflect.Type // of the message sent, nil for one received
+}
+
+func (e UnregisteredTypeError) Error() string {
+	if e.Type != nil {
+		return fmt.Sprintf("registry: message type %v not registered", e.Type)
+	}
+	return fmt.Sprintf("registry: message type %d not registered", e.ID)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{news: make(map[byte]func() BinaryUnmarshaler),
+		types: make(map[reflect.Type]byte)}
+}
+
+// Register maps the ID to the constructor of a type of message,
+// and messages of that type to the ID.
+func (r *Registry) Register(id byte, new func() BinaryUnmarshaler) error {
+	t := reflect.TypeOf(new())
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.news[id]; ok {
+		return ErrTypeRegistered
+	}
+	if _, ok := r.types[t]; ok {
+		return ErrTypeRegistered
+	}
+	r.news[id] = new
+	r.types[t] = id
+	return nil
+}
+
+// New returns a new message of the type registered under the ID.
+func (r *Registry) New(id byte) (BinaryUnmarshaler, error) {
+	r.lock.RLock()
+	new, ok := r.news[id]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, UnregisteredTypeError{ID: id}
+	}
+	return new(), nil
+}
+
+// Wrap returns the Envelope to send a message in,
+// tagged with the ID its type is registered under.
+func (r *Registry) Wrap(m BinaryMarshaler) (*Envelope, error) {
+	t := reflect.TypeOf(m)
+	r.lock.RLock()
+	id, ok := r.types[t]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, UnregisteredTypeError{Type: t}
+	}
+	return &Envelope{ID: id, Msg: m, reg: r}, nil
+}
+
+// Pool returns a pool of Envelopes to receive messages of the
+// registered types in, to be given to Host.SetPool.
+func (r *Registry) Pool() *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		return &Envelope{reg: r}
+	}}
+}
+
+// An Envelope carries a message tagged with the ID of its type.
+// The messages a Host gets with the pool of a Registry are Envelopes,
+// holding a message of the type its ID is registered with.
+type Envelope struct {
+	ID  byte
+	Msg interface{} // the message, a BinaryMarshaler to send
+
+	reg *Registry
+}
+
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	m, ok := e.Msg.(BinaryMarshaler)
+	if !ok {
+		return nil, errors.New("envelope: message cannot be marshaled")
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{e.ID}, b...), nil
+}
+
+func (e *Envelope) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("envelope: no message type")
+	}
+	if e.reg == nil {
+		return errors.New("envelope: no registry to unmarshal with")
+	}
+	m, err := e.reg.New(data[0])
+	if err != nil {
+		return err
+	}
+	if err := m.UnmarshalBinary(data[1:]); err != nil {
+		return err
+	}
+	e.ID, e.Msg = data[0], m
+	return nil
+}
+
+func (e *Envelope) MessageType() byte {
+	return MsgEnvelope
+}
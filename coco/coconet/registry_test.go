@@ -0,0 +1,113 @@
+package coconet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/nist"
+	"golang.org/x/net/context"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(1, func() BinaryUnmarshaler { return new(StringMarshaler) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(2, func() BinaryUnmarshaler { return new(typedMessage) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(1, func() BinaryUnmarshaler { return new(NetworkMessg) }); err != ErrTypeRegistered {
+		t.Fatal("registered an ID twice")
+	}
+	if err := r.Register(3, func() BinaryUnmarshaler { return new(StringMarshaler) }); err != ErrTypeRegistered {
+		t.Fatal("registered a type twice")
+	}
+	if _, err := r.Wrap(&NetworkMessg{}); err == nil {
+		t.Fatal("wrapped a message of an unregistered type")
+	}
+
+	e := &Envelope{reg: r}
+	if err := e.UnmarshalBinary([]byte{4, 'x'}); err != (UnregisteredTypeError{ID: 4}) {
+		t.Fatal("unmarshaled a message of an unregistered ID:", err)
+	}
+	s := StringMarshaler("hello")
+	w, _ := r.Wrap(&s)
+	b, err := w.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("\x01hello")) {
+		t.Fatalf("envelope marshaled as %q", b)
+	}
+	if err := e.UnmarshalBinary(b); err != nil || *e.Msg.(*StringMarshaler) != s {
+		t.Fatal("envelope unmarshaled wrong:", err)
+	}
+}
+
+// Messages of two protocols multiplexed over the same link
+func TestRegistryHost(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	r := NewRegistry()
+	r.Register(1, func() BinaryUnmarshaler { return new(StringMarshaler) })
+	r.Register(2, func() BinaryUnmarshaler { return new(typedMessage) })
+	parent := newTestTCPHost(t, suite)
+	child := newTestTCPHost(t, suite)
+	trustHosts(parent, child)
+	defer parent.Close()
+	defer child.Close()
+	parent.SetPool(r.Pool())
+	child.SetPool(r.Pool())
+	if err := parent.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ConnectTo(parent.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	s := StringMarshaler("signing")
+	m := typedMessage("insurance")
+	for _, msg := range []BinaryMarshaler{&s, &m} {
+		e, err := r.Wrap(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := child.PutTo(context.TODO(), parent.Name(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []interface{}{&s, &m} {
+		select {
+		case nm := <-parent.Get():
+			if nm.Err != nil {
+				t.Fatal(nm.Err)
+			}
+			got := nm.Data.(*Envelope).Msg
+			switch w := want.(type) {
+			case *StringMarshaler:
+				if g, ok := got.(*StringMarshaler); !ok || *g != *w {
+					t.Fatalf("got %#v, expected %q", got, *w)
+				}
+			case *typedMessage:
+				if g, ok := got.(*typedMessage); !ok || !bytes.Equal(*g, *w) {
+					t.Fatalf("got %#v, expected %q", got, *w)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing received")
+		}
+	}
+
+	// messages sent outside envelopes are rejected
+	if err := child.PutTo(context.TODO(), parent.Name(), &s); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case nm := <-parent.Get():
+		if nm.Err != (WireTypeError{MsgBinary, MsgEnvelope}) {
+			t.Fatal("bare message received:", nm.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+	}
+}
@@ -0,0 +1,532 @@
+package coconet
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dedis/crypto/abstract"
+	"golang.org/x/net/context"
+)
+
+// SimNet is a simulated network of SimHosts, for running large trees on
+// one machine. Messages are events on the network's VirtualClock: each
+// is delivered after a latency drawn from a source seeded for its link,
+// links keep their messages in order, and messages arriving at the same
+// time are delivered in the order of their links.
+//
+// A host hands each message to the reader of its Get with a hold of the
+// clock, which the reader releases once it has acted on the message, so
+// the clock moves on only when every host is done. Give the clock to the
+// nodes running on the hosts as well (sign.Node's Clock), so their
+// timeouts run in the same virtual time, and Start the network once they
+// are set up. A run then depends on the seed alone.
+type SimNet struct {
+	Clock *VirtualClock
+
+	// Trace, if set, is called with each message as it is delivered,
+	// on the clock's goroutine.
+	Trace func(at time.Time, from, to string)
+
+	mu      sync.Mutex
+	seed    int64
+	rands   map[link]*rand.Rand // latency source of each link
+	latency DelayFunc
+	hosts   map[string]*SimHost
+	last    map[link]time.Time // latest delivery on each link
+
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// SimLatency is the latency of the links of a new SimNet.
+var SimLatency = 10 * time.Millisecond
+
+// ErrNoSimHost is returned for messages to a host not on the SimNet.
+var ErrNoSimHost = errors.New("simnet: no such host")
+
+// ErrSimConnGet is returned by SimConn.Get: hosts on a SimNet receive
+// their messages from the host's Get only.
+var ErrSimConnGet = errors.New("simnet: get messages from the host")
+
+// NewSimNet creates an empty network, whose clock stands at the Unix epoch.
+// The seed makes the latencies drawn repeatable.
+func NewSimNet(seed int64) *SimNet {
+	return &SimNet{
+		Clock:   NewVirtualClock(time.Unix(0, 0)),
+		seed:    seed,
+		rands:   make(map[link]*rand.Rand),
+		latency: ConstantDelay(SimLatency),
+		hosts:   make(map[string]*SimHost),
+		last:    make(map[link]time.Time),
+		done:    make(chan struct{})}
+}
+
+// SetLatency sets how the latency of each message is drawn.
+func (n *SimNet) SetLatency(d DelayFunc) {
+	n.mu.Lock()
+	n.latency = d
+	n.mu.Unlock()
+}
+
+// Start runs the network's clock in the background.
+func (n *SimNet) Start() {
+	n.Clock.Run()
+}
+
+// Stop stops the clock and drops the messages still in flight.
+func (n *SimNet) Stop() {
+	n.Clock.Stop()
+	n.stopOnce.Do(func() {
+		close(n.done)
+	})
+}
+
+func (n *SimNet) host(name string) *SimHost {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.hosts[name]
+}
+
+// send schedules the delivery of a message from one host to another.
+func (n *SimNet) send(from, to string, data BinaryMarshaler) error {
+	b, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	typ := MessageType(data)
+
+	n.mu.Lock()
+	dst := n.hosts[to]
+	if dst == nil {
+		n.mu.Unlock()
+		return ErrNoSimHost
+	}
+	l := link{from, to}
+	r := n.rands[l]
+	if r == nil {
+		h := fnv.New64a()
+		h.Write([]byte(from + "\x00" + to))
+		r = rand.New(rand.NewSource(n.seed ^ int64(h.Sum64())))
+		n.rands[l] = r
+	}
+	at := n.Clock.Now().Add(n.latency(r))
+	if at.Before(n.last[l]) {
+		at = n.last[l]
+	}
+	n.last[l] = at
+	n.mu.Unlock()
+
+	n.Clock.scheduleAt(at, from+"\x00"+to, func() {
+		if n.Trace != nil {
+			n.Trace(n.Clock.Now(), from, to)
+		}
+		dst.deliver(from, typ, b)
+	})
+	return nil
+}
+
+// a SimHost must satisfy the host interface
+var _ Host = &SimHost{}
+
+// SimHost is an implementation of the Host interface on a SimNet.
+// Its links are up as soon as both ends are on the network,
+// so Listen and Connect only learn the public keys of peers.
+type SimHost struct {
+	name string
+	net  *SimNet
+
+	views        *Views
+	PeerLock     sync.RWMutex
+	peers        map[string]Conn
+	PendingPeers map[string]bool
+
+	suite abstract.Suite
+
+	pkLock sync.RWMutex
+	Pubkey abstract.Point
+
+	pool *sync.Pool
+
+	msgchan chan NetworkMessg
+	closed  int64
+	done    chan struct{}
+}
+
+// NewSimHost creates a new SimHost with the given hostname,
+// and puts it on the given network.
+func NewSimHost(hostname string, n *SimNet) *SimHost {
+	h := &SimHost{name: hostname,
+		net:          n,
+		views:        NewViews(),
+		peers:        make(map[string]Conn),
+		PendingPeers: make(map[string]bool),
+		msgchan:      make(chan NetworkMessg),
+		done:         make(chan struct{})}
+	n.mu.Lock()
+	n.hosts[hostname] = h
+	n.mu.Unlock()
+	return h
+}
+
+// Hand a message to the host's Get, once it has taken the previous one,
+// with a hold of the clock for the reader to release
+func (h *SimHost) deliver(from string, typ byte, b []byte) {
+	if h.Closed() {
+		return
+	}
+	data := h.pool.Get().(BinaryUnmarshaler)
+	var err error
+	if want := MessageType(data); typ != want {
+		err = WireTypeError{typ, want}
+	} else {
+		err = data.UnmarshalBinary(b)
+	}
+	h.net.Clock.Hold()
+	select {
+	case h.msgchan <- NetworkMessg{Data: data, From: from, Err: err}:
+	case <-h.done:
+		h.net.Clock.Release()
+	case <-h.net.done:
+		h.net.Clock.Release()
+	}
+}
+
+// Name returns the hostname of the Host.
+func (h *SimHost) Name() string {
+	return h.name
+}
+
+func (h *SimHost) Views() *Views {
+	return h.views
+}
+
+// SetSuite sets the crypto suite which this Host is using.
+func (h *SimHost) SetSuite(s abstract.Suite) {
+	h.suite = s
+}
+
+// PubKey returns the public key of the Host.
+func (h *SimHost) PubKey() abstract.Point {
+	h.pkLock.RLock()
+	pk := h.Pubkey
+	h.pkLock.RUnlock()
+	return pk
+}
+
+// SetPubKey sets the public key of the Host.
+func (h *SimHost) SetPubKey(pk abstract.Point) {
+	h.pkLock.Lock()
+	h.Pubkey = pk
+	h.pkLock.Unlock()
+}
+
+// StateChanges returns nil, as links between SimHosts never fail.
+func (h *SimHost) StateChanges() <-chan StateChange {
+	return nil
+}
+
+// The connection to a peer, created on first use
+func (h *SimHost) conn(peer string) Conn {
+	h.PeerLock.Lock()
+	defer h.PeerLock.Unlock()
+	c, ok := h.peers[peer]
+	if !ok {
+		c = &SimConn{net: h.net, from: h.name, to: peer}
+		h.peers[peer] = c
+	}
+	return c
+}
+
+// ConnectTo learns the public key of a peer on the network.
+func (h *SimHost) ConnectTo(peer string) error {
+	p := h.net.host(peer)
+	if p == nil {
+		return ErrNoSimHost
+	}
+	h.conn(peer).SetPubKey(p.PubKey())
+	return nil
+}
+
+// Connect connects to the parent of the host in the given view.
+func (h *SimHost) Connect(view int) error {
+	parent := h.views.Parent(view)
+	if parent == "" {
+		return nil
+	}
+	return h.ConnectTo(parent)
+}
+
+// Listen learns the public keys of the children of the first view.
+func (h *SimHost) Listen() error {
+	for _, c := range h.views.Children(0) {
+		if err := h.ConnectTo(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewView creates a new view with the given view number, parent, and children.
+func (h *SimHost) NewView(view int, parent string, children []string, hostlist []string) {
+	h.views.NewView(view, parent, children, hostlist)
+}
+
+func (h *SimHost) NewViewFromPrev(view int, parent string) {
+	h.views.NewViewFromPrev(view, parent)
+}
+
+func (h *SimHost) Parent(view int) string {
+	return h.views.Parent(view)
+}
+
+// AddParent adds a parent node to the specified view.
+func (h *SimHost) AddParent(view int, c string) {
+	h.conn(c)
+	h.views.AddParent(view, c)
+}
+
+// AddChildren adds children to the specified view.
+func (h *SimHost) AddChildren(view int, cs ...string) {
+	for _, c := range cs {
+		h.conn(c)
+		h.views.AddChildren(view, c)
+	}
+}
+
+// AddPeers adds the list of Peers to the host.
+func (h *SimHost) AddPeers(cs ...string) {
+	for _, c := range cs {
+		h.conn(c)
+	}
+}
+
+func (h *SimHost) AddPeerToPending(p string) {
+	h.PeerLock.Lock()
+	h.PendingPeers[p] = true
+	h.PeerLock.Unlock()
+}
+
+func (h *SimHost) AddPeerToHostlist(view int, name string) {
+	h.views.AddPeerToHostlist(view, name)
+}
+
+func (h *SimHost) RemovePeerFromHostlist(view int, name string) {
+	h.views.RemovePeerFromHostlist(view, name)
+}
+
+func (h *SimHost) AddPendingPeer(view int, name string) error {
+	h.PeerLock.Lock()
+	if _, ok := h.PendingPeers[name]; !ok {
+		h.PeerLock.Unlock()
+		log.Errorln("Attempt to add peer not present in pending Peers")
+		return errors.New("attempted to add peer not present in pending peers")
+	}
+	h.PeerLock.Unlock()
+	if err := h.ConnectTo(name); err != nil {
+		return err
+	}
+	h.views.AddChildren(view, name)
+	return nil
+}
+
+func (h *SimHost) RemovePendingPeer(peer string) {
+	h.PeerLock.Lock()
+	delete(h.PendingPeers, peer)
+	h.PeerLock.Unlock()
+}
+
+func (h *SimHost) Pending() map[string]bool {
+	return h.PendingPeers
+}
+
+func (h *SimHost) RemovePeer(view int, name string) bool {
+	return h.views.RemovePeer(view, name)
+}
+
+// NChildren returns the number of children specified by the given view.
+func (h *SimHost) NChildren(view int) int {
+	return h.views.NChildren(view)
+}
+
+func (h *SimHost) HostListOn(view int) []string {
+	return h.views.HostList(view)
+}
+
+func (h *SimHost) SetHostList(view int, hostlist []string) {
+	h.views.SetHostList(view, hostlist)
+}
+
+// IsRoot returns true if this Host is the root of the specified view.
+func (h *SimHost) IsRoot(view int) bool {
+	return h.views.Parent(view) == ""
+}
+
+// IsParent returns true if the peer is the Parent of the specified view.
+func (h *SimHost) IsParent(view int, peer string) bool {
+	return h.views.Parent(view) == peer
+}
+
+// IsChild returns true if the peer is a Child for the specified view.
+func (h *SimHost) IsChild(view int, peer string) bool {
+	h.PeerLock.RLock()
+	_, ok := h.peers[peer]
+	h.PeerLock.RUnlock()
+	return !h.IsParent(view, peer) && ok
+}
+
+// Peers returns the list of Peers as a mapping from hostname to Conn
+func (h *SimHost) Peers() map[string]Conn {
+	h.PeerLock.RLock()
+	defer h.PeerLock.RUnlock()
+	peers := make(map[string]Conn, len(h.peers))
+	for name, c := range h.peers {
+		peers[name] = c
+	}
+	return peers
+}
+
+// Children returns the children in the specified view.
+func (h *SimHost) Children(view int) map[string]Conn {
+	children := make(map[string]Conn)
+	for _, c := range h.views.Children(view) {
+		children[c] = h.conn(c)
+	}
+	return children
+}
+
+// PutTo sends a message to a peer, arriving after the link's latency.
+func (h *SimHost) PutTo(ctx context.Context, host string, data BinaryMarshaler) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return h.conn(host).Put(data)
+}
+
+// PutUp sends a message to the parent on the given view.
+func (h *SimHost) PutUp(ctx context.Context, view int, data BinaryMarshaler) error {
+	return h.PutTo(ctx, h.views.Parent(view), data)
+}
+
+// PutDown sends messages to its children on the given view,
+// in the order of the children.
+func (h *SimHost) PutDown(ctx context.Context, view int, data []BinaryMarshaler) error {
+	children := h.views.Children(view)
+	if len(data) != len(children) {
+		panic("number of messages passed down != number of children")
+	}
+	var err error
+	for i, c := range children {
+		if e := h.PutTo(ctx, c, data[i]); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Get returns the channel of messages received. The reader must Release
+// the network's clock once done with each message, closing one included.
+func (h *SimHost) Get() chan NetworkMessg {
+	return h.msgchan
+}
+
+// Pool returns the underlying pool of objects for creating new BinaryUnmarshalers,
+// when Getting from network connections.
+func (h *SimHost) Pool() *sync.Pool {
+	return h.pool
+}
+
+// SetPool sets the pool of underlying objects for creating new BinaryUnmarshalers,
+// when Getting from network connections.
+func (h *SimHost) SetPool(p *sync.Pool) {
+	h.pool = p
+}
+
+// Close takes the host off the network: messages to it are dropped,
+// and a reader of Get is told it is closed.
+func (h *SimHost) Close() {
+	if !atomic.CompareAndSwapInt64(&h.closed, 0, 1) {
+		return
+	}
+	close(h.done)
+	h.net.Clock.Hold()
+	go func() {
+		select {
+		case h.msgchan <- NetworkMessg{From: h.name, Err: ErrClosed}:
+		case <-h.net.done:
+			h.net.Clock.Release()
+		}
+	}()
+}
+
+func (h *SimHost) Closed() bool {
+	return atomic.LoadInt64(&h.closed) == 1
+}
+
+// SimConn is the Conn from one host on a SimNet to another.
+type SimConn struct {
+	net      *SimNet
+	from, to string
+
+	mupk   sync.RWMutex
+	pubkey abstract.Point
+
+	closed int64
+}
+
+// Name returns the To end of the connection.
+func (c *SimConn) Name() string {
+	return c.to
+}
+
+// PubKey returns the public key of the peer, as it was learned by
+// connecting, or as the peer has it now if not.
+func (c *SimConn) PubKey() abstract.Point {
+	c.mupk.RLock()
+	pk := c.pubkey
+	c.mupk.RUnlock()
+	if pk == nil {
+		if p := c.net.host(c.to); p != nil {
+			pk = p.PubKey()
+		}
+	}
+	return pk
+}
+
+// SetPubKey sets the public key of the peer.
+func (c *SimConn) SetPubKey(pk abstract.Point) {
+	c.mupk.Lock()
+	c.pubkey = pk
+	c.mupk.Unlock()
+}
+
+// Put sends data to the peer, arriving after the link's latency.
+func (c *SimConn) Put(data BinaryMarshaler) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	return c.net.send(c.from, c.to, data)
+}
+
+// Get returns ErrSimConnGet: messages are received from the host's Get.
+func (c *SimConn) Get(data BinaryUnmarshaler) error {
+	return ErrSimConnGet
+}
+
+// Connect is a no-op, the link is up as long as the peer is on the network.
+func (c *SimConn) Connect() error {
+	return nil
+}
+
+// Close closes the connection for sending.
+func (c *SimConn) Close() {
+	atomic.StoreInt64(&c.closed, 1)
+}
+
+func (c *SimConn) Closed() bool {
+	return atomic.LoadInt64(&c.closed) == 1
+}
@@ -0,0 +1,210 @@
+package coconet
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewVirtualClock(start)
+	a := c.After(time.Second)
+	cc := c.After(3 * time.Second)
+	b := c.After(2 * time.Second)
+	fired := make(chan bool, 1)
+	stopped := c.AfterFunc(time.Second, func() { fired <- true })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("stopping a timer twice")
+	}
+
+	c.Advance(1500 * time.Millisecond)
+	if c.Since(start) != 1500*time.Millisecond {
+		t.Fatal("advanced to", c.Since(start))
+	}
+	select {
+	case now := <-a:
+		if now.Sub(start) != time.Second {
+			t.Fatal("fired at", now.Sub(start))
+		}
+	default:
+		t.Fatal("not fired on the way")
+	}
+	if !c.Step() || c.Since(start) != 2*time.Second || len(b) != 1 || len(cc) != 0 {
+		t.Fatal("stepped to", c.Since(start))
+	}
+	if !c.Step() || c.Since(start) != 3*time.Second || len(cc) != 1 {
+		t.Fatal("stepped to", c.Since(start))
+	}
+	if c.Step() || len(fired) != 0 {
+		t.Fatal("stopped timer fired")
+	}
+
+	// Sleep returns once Run has moved the clock on
+	c.Run()
+	defer c.Stop()
+	before := c.Now()
+	c.Sleep(time.Hour)
+	if c.Since(before) != time.Hour {
+		t.Fatal("slept for", c.Since(before))
+	}
+}
+
+type simReceived struct {
+	from string
+	i    int
+	at   time.Duration
+}
+
+// Send numbered messages from two hosts to a third, and return what
+// it receives, with the virtual time it arrives at
+func simRun(t *testing.T, seed int64) []simReceived {
+	n := NewSimNet(seed)
+	defer n.Stop()
+	n.SetLatency(UniformDelay(time.Millisecond, 50*time.Millisecond))
+	hosts := make([]*SimHost, 3)
+	for i := range hosts {
+		hosts[i] = NewSimHost(fmt.Sprint("host", i), n)
+		hosts[i].SetPool(&sync.Pool{New: func() interface{} {
+			return new(StringMarshaler)
+		}})
+	}
+	hosts[1].AddParent(0, "host0")
+	hosts[2].AddParent(0, "host0")
+	hosts[0].AddChildren(0, "host1", "host2")
+
+	for i := 0; i < 10; i++ {
+		for _, h := range hosts[1:] {
+			m := StringMarshaler(fmt.Sprint(h.Name(), " ", i))
+			if err := h.PutUp(context.TODO(), 0, &m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n.Start()
+	var got []simReceived
+	for len(got) < 20 {
+		select {
+		case nm := <-hosts[0].Get():
+			if nm.Err != nil {
+				t.Fatal(nm.Err)
+			}
+			r := simReceived{at: n.Clock.Since(time.Unix(0, 0))}
+			fmt.Sscan(string(*nm.Data.(*StringMarshaler)), &r.from, &r.i)
+			got = append(got, r)
+			n.Clock.Release()
+		case <-time.After(5 * time.Second):
+			t.Fatal("received only", got)
+		}
+	}
+	return got
+}
+
+func TestSimNet(t *testing.T) {
+	got := simRun(t, 1)
+	if again := simRun(t, 1); !reflect.DeepEqual(got, again) {
+		t.Fatalf("runs differ:\n%v\n%v", got, again)
+	}
+
+	// each link keeps its messages in order
+	next := map[string]int{}
+	for _, r := range got {
+		if r.i != next[r.from] {
+			t.Fatal("out of order:", got)
+		}
+		next[r.from]++
+		if r.at < time.Millisecond || r.at > 50*time.Millisecond {
+			t.Fatal("delivered outside the latencies:", r)
+		}
+	}
+}
+
+func TestSimHostClose(t *testing.T) {
+	n := NewSimNet(1)
+	defer n.Stop()
+	h := NewSimHost("host0", n)
+	if err := h.PutTo(context.TODO(), "nowhere", new(StringMarshaler)); err != ErrNoSimHost {
+		t.Fatal("put to a host not on the network:", err)
+	}
+	h.Close()
+	if nm := <-h.Get(); nm.Err != ErrClosed {
+		t.Fatal("closed host gave", nm)
+	}
+	n.Clock.Release()
+}
+
+// Hosts pass a message on to random peers, each of them reacting in its
+// own goroutine, and the network traces the deliveries
+func simTrace(t *testing.T, seed int64) []string {
+	n := NewSimNet(seed)
+	defer n.Stop()
+	n.SetLatency(UniformDelay(time.Millisecond, 5*time.Millisecond))
+	var trace []string
+	n.Trace = func(at time.Time, from, to string) {
+		trace = append(trace, fmt.Sprint(at.Sub(time.Unix(0, 0)), from, to))
+	}
+	names := []string{"host0", "host1", "host2", "host3"}
+	hosts := make([]*SimHost, len(names))
+	for i := range hosts {
+		hosts[i] = NewSimHost(names[i], n)
+		hosts[i].SetPool(&sync.Pool{New: func() interface{} {
+			return new(StringMarshaler)
+		}})
+		hosts[i].AddPeers(names...)
+	}
+
+	// every message starts two more, until the hops run out
+	const hops = 6
+	done := make(chan bool)
+	for i, h := range hosts {
+		go func(h *SimHost, r *rand.Rand) {
+			for nm := range h.Get() {
+				if nm.Err != nil {
+					n.Clock.Release()
+					return
+				}
+				var hop int
+				fmt.Sscan(string(*nm.Data.(*StringMarshaler)), &hop)
+				if hop == hops {
+					done <- true
+				}
+				for k := 0; hop < hops && k < 2; k++ {
+					m := StringMarshaler(fmt.Sprint(hop + 1))
+					to := names[r.Intn(len(names))]
+					if err := h.PutTo(context.TODO(), to, &m); err != nil {
+						t.Error(err)
+					}
+				}
+				n.Clock.Release()
+			}
+		}(h, rand.New(rand.NewSource(int64(i))))
+	}
+	m := StringMarshaler("0")
+	if err := hosts[0].PutTo(context.TODO(), "host1", &m); err != nil {
+		t.Fatal(err)
+	}
+	n.Start()
+	for i := 0; i < 1<<hops; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("only", i, "messages made it through")
+		}
+	}
+	return trace
+}
+
+func TestSimNetTrace(t *testing.T) {
+	trace := simTrace(t, 7)
+	if again := simTrace(t, 7); !reflect.DeepEqual(trace, again) {
+		t.Fatalf("runs differ:\n%v\n%v", trace, again)
+	}
+	if len(trace) != 1<<7-1 {
+		t.Fatal("traced", len(trace), "deliveries")
+	}
+}
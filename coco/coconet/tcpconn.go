@@ -1,8 +1,9 @@
 package coconet
 
 import (
-	"encoding/gob"
+	"bufio"
 	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
@@ -13,16 +14,24 @@ import (
 	"github.com/dedis/crypto/abstract"
 )
 
+// Latency is the most a Get sleeps, in milliseconds, before receiving,
+// to simulate a slow network. For more faithful conditions set it to 0
+// and inject Faults instead.
 var Latency = 100
 
 // TCPConn is an implementation of the Conn interface for TCP network connections.
+// Messages are sent in the frames described in wire.go.
 type TCPConn struct {
-	// encLock guards the encoder and decoder and underlying conn.
+	// encLock guards the underlying conn and its reader.
 	encLock sync.Mutex
 	name    string
 	conn    net.Conn
-	enc     *gob.Encoder
-	dec     *gob.Decoder
+	r       *bufio.Reader
+
+	// wlock and rlock keep frames whole when several goroutines
+	// Put or Get at once.
+	wlock sync.Mutex
+	rlock sync.Mutex
 
 	// pkLock guards the public key
 	pkLock sync.Mutex
@@ -39,8 +48,7 @@ func NewTCPConnFromNet(conn net.Conn) *TCPConn {
 	return &TCPConn{
 		name: conn.RemoteAddr().String(),
 		conn: conn,
-		enc:  gob.NewEncoder(conn),
-		dec:  gob.NewDecoder(conn)}
+		r:    bufio.NewReader(conn)}
 
 }
 
@@ -65,12 +73,16 @@ func (tc *TCPConn) Connect() error {
 	if err != nil {
 		return err
 	}
+	tc.setConn(conn)
+	return nil
+}
+
+// setConn makes conn the underlying connection.
+func (tc *TCPConn) setConn(conn net.Conn) {
 	tc.encLock.Lock()
 	tc.conn = conn
-	tc.enc = gob.NewEncoder(conn)
-	tc.dec = gob.NewDecoder(conn)
+	tc.r = bufio.NewReader(conn)
 	tc.encLock.Unlock()
-	return nil
 }
 
 // SetName sets the name of the connection.
@@ -115,21 +127,31 @@ func IsTemporary(err error) bool {
 
 // Put puts data to the connection.
 // Returns io.EOF on an irrecoverable error.
-// Returns actual error if it is Temporary.
+// Returns actual error if it is Temporary, or if data cannot be marshalled.
 func (tc *TCPConn) Put(bm BinaryMarshaler) error {
 	if tc.Closed() {
 		log.Errorln("tcpconn: put: connection closed")
 		return ErrClosed
 	}
 	tc.encLock.Lock()
-	if tc.enc == nil {
+	if tc.conn == nil {
 		tc.encLock.Unlock()
 		return ErrNotEstablished
 	}
-	enc := tc.enc
+	conn := tc.conn
 	tc.encLock.Unlock()
 
-	err := enc.Encode(bm)
+	b, err := bm.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	frame, err := EncodeFrame(MessageType(bm), b)
+	if err != nil {
+		return err
+	}
+	tc.wlock.Lock()
+	_, err = conn.Write(frame)
+	tc.wlock.Unlock()
 	if err != nil {
 		if IsTemporary(err) {
 			return err
@@ -137,39 +159,48 @@ func (tc *TCPConn) Put(bm BinaryMarshaler) error {
 		tc.Close()
 		return ErrClosed
 	}
-	return err
+	return nil
 }
 
 // Get gets data from the connection.
 // Returns io.EOF on an irrecoveralbe error.
-// Returns given error if it is Temporary.
+// Returns given error if it is Temporary, if the frame holds another
+// type of message than bum, or if bum cannot unmarshal it.
 func (tc *TCPConn) Get(bum BinaryUnmarshaler) error {
 	if tc.Closed() {
 		log.Errorln("tcpconn: get: connection closed")
 		return ErrClosed
 	}
 	tc.encLock.Lock()
-	for tc.dec == nil {
+	if tc.r == nil {
 		tc.encLock.Unlock()
 		return ErrNotEstablished
 	}
-	dec := tc.dec
+	r := tc.r
 	tc.encLock.Unlock()
 
 	if Latency != 0 {
 		time.Sleep(time.Duration(rand.Intn(Latency)) * time.Millisecond)
 	}
-	err := dec.Decode(bum)
+	tc.rlock.Lock()
+	typ, payload, err := ReadFrame(r)
+	tc.rlock.Unlock()
 	if err != nil {
 		if IsTemporary(err) {
 			return err
 		}
 		// if it is an irrecoverable error
 		// close the channel and return that it has been closed
+		if err != io.EOF {
+			log.Errorln("tcpconn: get:", err)
+		}
 		tc.Close()
 		return ErrClosed
 	}
-	return err
+	if want := MessageType(bum); typ != want {
+		return WireTypeError{typ, want}
+	}
+	return bum.UnmarshalBinary(payload)
 }
 
 // Close closes the connection.
@@ -184,6 +215,5 @@ func (tc *TCPConn) Close() {
 	}
 	tc.closed = true
 	tc.conn = nil
-	tc.enc = nil
-	tc.dec = nil
+	tc.r = nil
 }
@@ -30,14 +30,25 @@ type TCPHost struct {
 	// via connection to current host node
 	PendingPeers map[string]bool
 
-	pkLock sync.RWMutex
-	Pubkey abstract.Point // own public key
+	pkLock   sync.RWMutex
+	Pubkey   abstract.Point            // own public key
+	privKey  abstract.Secret           // own private key, for the handshake
+	peerKeys map[string]abstract.Point // public keys of the tree, by name
 
 	pool  *sync.Pool
 	suite abstract.Suite
 
-	// channels to send on Get() and update
-	msgchan chan NetworkMessg
+	// authenticates and protects new connections
+	channel secureChannel
+
+	// messages received, waiting for Get, and link state changes
+	queue  *RecvQueue
+	states chan StateChange
+
+	// peers we dialed, and so redial when their link fails
+	dialed map[string]bool
+	// dials in progress, waited for by other ConnectTo calls to the peer
+	dialing map[string]*pendingDial
 
 	// 1 if closed, 0 if not closed
 	closed int64
@@ -47,13 +58,25 @@ type TCPHost struct {
 func NewTCPHost(hostname string) *TCPHost {
 	h := &TCPHost{name: hostname,
 		views:        NewViews(),
-		msgchan:      make(chan NetworkMessg, 1),
+		queue:        NewRecvQueue(DefaultQueueLimit, Block),
+		states:       make(chan StateChange, 64),
+		dialed:       make(map[string]bool),
+		dialing:      make(map[string]*pendingDial),
 		PendingPeers: make(map[string]bool)}
 	h.peers = make(map[string]Conn)
 	h.Ready = make(map[string]bool)
+	h.channel = handshakeChannel{h}
 	return h
 }
 
+// A secureChannel authenticates the peer at the other end of a new
+// connection and returns a Conn protecting what is sent over it,
+// with the peer's name and public key set.
+type secureChannel interface {
+	accept(conn net.Conn) (Conn, error)
+	dial(conn net.Conn, peer string) (Conn, error)
+}
+
 func (h *TCPHost) Views() *Views {
 	return h.views
 }
@@ -78,6 +101,29 @@ func (h *TCPHost) SetPubKey(pk abstract.Point) {
 	h.pkLock.Unlock()
 }
 
+// SetPrivKey sets the private key the host proves its identity with
+// when connecting to peers.
+func (h *TCPHost) SetPrivKey(sk abstract.Secret) {
+	h.pkLock.Lock()
+	h.privKey = sk
+	h.pkLock.Unlock()
+}
+
+// SetPeerKeys sets the public keys of the hosts in the tree, by name.
+// Peers are only accepted if they prove the key configured for the name
+// they claim. Until it is set, no peer is accepted.
+func (h *TCPHost) SetPeerKeys(keys map[string]abstract.Point) {
+	h.pkLock.Lock()
+	h.peerKeys = keys
+	h.pkLock.Unlock()
+}
+
+func (h *TCPHost) keys() (abstract.Secret, map[string]abstract.Point) {
+	h.pkLock.RLock()
+	defer h.pkLock.RUnlock()
+	return h.privKey, h.peerKeys
+}
+
 // StringMarshaler is a wrapper type to allow strings to be marshalled and unmarshalled.
 type StringMarshaler string
 
@@ -95,9 +141,9 @@ func (s *StringMarshaler) UnmarshalBinary(b []byte) error {
 // Listen listens for incoming TCP connections.
 // It is a non-blocking call that runs in the background.
 // It accepts incoming connections and establishes Peers.
-// When a peer attempts to connect it must send over its name (as a StringMarshaler),
-// as well as its public key.
-// Only after that point can be communicated with.
+// When a peer attempts to connect it must prove, through the handshake,
+// the name it claims and the public key configured for that name.
+// Only after that point can be communicated with, over an encrypted session.
 func (h *TCPHost) Listen() error {
 	var err error
 	ln, err := net.Listen("tcp4", h.name)
@@ -119,119 +165,202 @@ func (h *TCPHost) Listen() error {
 				continue
 			}
 
-			// Read in name of client
-			tp := NewTCPConnFromNet(conn)
-			var mname StringMarshaler
-			err = tp.Get(&mname)
-			if err != nil {
-				log.Errorln("failed to establish connection: getting name: ", err)
-				tp.Close()
-				continue
-			}
-			name := string(mname)
-
-			// create connection
-			tp.SetName(name)
-
-			// get and set public key
-			suite := h.suite
-			pubkey := suite.Point()
-			err = tp.Get(pubkey)
-			if err != nil {
-				log.Errorln("failed to establish connection: getting pubkey:", err)
-				tp.Close()
-				continue
-			}
-			tp.SetPubKey(pubkey)
-
-			// give child the public key
-			err = tp.Put(h.Pubkey)
-			if err != nil {
-				log.Errorln("failed to send public key:", err)
-				continue
-			}
-
-			// the connection is now Ready to use
-			h.PeerLock.Lock()
-			h.Ready[name] = true
-			h.peers[name] = tp
-			log.Infoln("CONNECTED TO CHILD:", tp, tp.conn)
-			h.PeerLock.Unlock()
-
-			go func() {
-				for {
-					data := h.pool.Get().(BinaryUnmarshaler)
-					err := tp.Get(data)
-
-					h.msgchan <- NetworkMessg{Data: data, From: tp.Name(), Err: err}
-				}
-			}()
+			// a slow or silent child must not hold up the others
+			go h.accept(conn)
 		}
 	}()
 	return nil
 }
 
+// Authenticate a child that connected to us
+// and set up the encrypted session.
+func (h *TCPHost) accept(conn net.Conn) {
+	tp, err := h.channel.accept(conn)
+	if err != nil {
+		log.Errorln("failed to establish connection:", err)
+		conn.Close()
+		return
+	}
+	name := tp.Name()
+
+	h.PeerLock.Lock()
+	if h.Ready[name] && h.dialed[name] && h.keepsDialed(name) {
+		// the peer dialed us while we dialed it, and our link wins:
+		// read what it sent on this one until it closes it
+		h.PeerLock.Unlock()
+		go h.serve(tp)
+		return
+	}
+	// the connection is now Ready to use,
+	// in place of any earlier one from the same child
+	// or of the one we dialed, if the peer's link wins
+	old := h.peers[name]
+	if !h.Ready[name] {
+		old = nil
+	}
+	h.Ready[name] = true
+	h.peers[name] = tp
+	delete(h.dialed, name)
+	log.Infoln("CONNECTED TO CHILD:", name)
+	h.PeerLock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	h.stateChange(name, LinkUp)
+
+	go h.serve(tp)
+}
+
 func (h *TCPHost) ConnectTo(parent string) error {
 	// If we have alReady set up this connection don't do anything
 	h.PeerLock.Lock()
 	if h.Ready[parent] {
-		log.Println("ConnectTo: node already ready")
-		h.PeerLock.RUnlock()
+		h.PeerLock.Unlock()
 		return nil
 	}
+	// nor dial it twice at once
+	if d := h.dialing[parent]; d != nil {
+		h.PeerLock.Unlock()
+		<-d.done
+		return d.err
+	}
+	d := &pendingDial{done: make(chan struct{})}
+	h.dialing[parent] = d
+	h.PeerLock.Unlock()
+
+	d.err = h.dial(parent)
+	h.PeerLock.Lock()
+	delete(h.dialing, parent)
 	h.PeerLock.Unlock()
+	close(d.done)
+	return d.err
+}
+
+// A dial in progress, and its outcome once done is closed
+type pendingDial struct {
+	done chan struct{}
+	err  error
+}
 
+// Of the links two hosts dial to each other at once, both keep the one
+// dialed by the host with the lower name, which closes neither: the
+// other host closes its own once it has accepted the winning one,
+// after the messages it sent on it.
+func (h *TCPHost) keepsDialed(peer string) bool {
+	return h.name < peer
+}
+
+// Dial a peer and set up the link to it
+func (h *TCPHost) dial(parent string) error {
 	// connect to the parent
 	conn, err := net.Dial("tcp4", parent)
 	if err != nil {
 		log.Warnln("tcphost: failed to connect to parent:", err)
 		return err
 	}
-	tp := NewTCPConnFromNet(conn)
-
-	mname := StringMarshaler(h.Name())
-	err = tp.Put(&mname)
+	// authenticate the parent and set up the encrypted session
+	tp, err := h.channel.dial(conn, parent)
 	if err != nil {
-		log.Errorln(err)
+		log.Errorln("failed to establish connection:", err)
+		conn.Close()
 		return err
 	}
-	tp.SetName(parent)
 
-	// give parent the public key
-	err = tp.Put(h.Pubkey)
-	if err != nil {
-		log.Errorln("failed to send public key")
-		return err
-	}
-
-	// get and set the parents public key
-	suite := h.suite
-	pubkey := suite.Point()
-	err = tp.Get(pubkey)
-	if err != nil {
-		log.Errorln("failed to establish connection: getting pubkey:", err)
+	h.PeerLock.Lock()
+	if h.Ready[parent] && !h.keepsDialed(parent) {
+		// the peer dialed us meanwhile, and its link wins
+		h.PeerLock.Unlock()
 		tp.Close()
-		return err
+		return nil
 	}
-	tp.SetPubKey(pubkey)
-
-	h.PeerLock.Lock()
-	h.Ready[tp.Name()] = true
+	h.Ready[parent] = true
 	h.peers[parent] = tp
+	h.dialed[parent] = true
 	// h.PendingPeers[parent] = true
 	h.PeerLock.Unlock()
 	log.Infoln("CONNECTED TO PARENT:", parent)
+	h.stateChange(parent, LinkUp)
 
-	go func() {
-		for {
-			data := h.pool.Get().(BinaryUnmarshaler)
-			err := tp.Get(data)
+	go h.serve(tp)
 
-			h.msgchan <- NetworkMessg{Data: data, From: tp.Name(), Err: err}
+	return nil
+}
+
+// Delay before the first attempt to reconnect a failed link,
+// doubling after each failed attempt up to ReconnectMax.
+var ReconnectMin = 100 * time.Millisecond
+var ReconnectMax = 10 * time.Second
+
+// serve passes on the messages received from a peer until its link fails.
+// The link is then marked down and, if we dialed the peer, reconnected.
+func (h *TCPHost) serve(tp Conn) {
+	name := tp.Name()
+	for {
+		data := h.pool.Get().(BinaryUnmarshaler)
+		err := tp.Get(data)
+		if err == ErrClosed || err == ErrNotEstablished {
+			break
 		}
-	}()
+		h.queue.Put(NetworkMessg{Data: data, From: name, Err: err})
+	}
+	if h.Closed() {
+		h.queue.Put(NetworkMessg{From: name, Err: ErrClosed})
+		return
+	}
 
-	return nil
+	h.PeerLock.Lock()
+	if h.peers[name] != tp {
+		// already replaced by a newer link
+		h.PeerLock.Unlock()
+		return
+	}
+	h.Ready[name] = false
+	redial := h.dialed[name]
+	h.PeerLock.Unlock()
+	log.Warnln("tcphost: lost link to", name)
+	h.stateChange(name, LinkDown)
+	if redial {
+		h.reconnect(name)
+	}
+}
+
+// reconnect redials a peer, backing off exponentially,
+// until the link is up again or the host is closed.
+func (h *TCPHost) reconnect(peer string) {
+	wait := ReconnectMin
+	for !h.Closed() {
+		time.Sleep(wait)
+		h.PeerLock.Lock()
+		ready := h.Ready[peer]
+		h.PeerLock.Unlock()
+		if ready || h.Closed() {
+			return
+		}
+		err := h.ConnectTo(peer)
+		if err == nil {
+			return
+		}
+		wait *= 2
+		if wait > ReconnectMax {
+			wait = ReconnectMax
+		}
+		log.Warnln("tcphost: reconnecting to", peer, "in", wait)
+	}
+}
+
+// StateChanges returns the channel on which links to peers are
+// reported going down and coming back up.
+// Changes are dropped rather than block the host if nobody receives them.
+func (h *TCPHost) StateChanges() <-chan StateChange {
+	return h.states
+}
+
+func (h *TCPHost) stateChange(peer string, state LinkState) {
+	select {
+	case h.states <- StateChange{peer, state}:
+	default:
+		log.Warnln("tcphost: dropped state change:", peer, state)
+	}
 }
 
 func (h *TCPHost) Pending() map[string]bool {
@@ -246,8 +375,8 @@ func (h *TCPHost) AddPeerToPending(p string) {
 }
 
 // Connect connects to the parent in the given view.
-// It connects to the parent by establishing a TCPConn.
-// It then sends its name and public key to initialize the connection.
+// It connects to the parent by establishing a TCPConn,
+// after both have authenticated each other through the handshake.
 func (h *TCPHost) Connect(view int) error {
 	// Get the parent of the given view.
 	v := h.views.Views[view]
@@ -275,7 +404,9 @@ func (h *TCPHost) Close() {
 	log.Println("tcphost: closing")
 	// stop accepting new connections
 	atomic.StoreInt64(&h.closed, 1)
-	h.listener.Close()
+	if h.listener != nil {
+		h.listener.Close()
+	}
 
 	// close peer connections
 	h.PeerLock.Lock()
@@ -285,7 +416,7 @@ func (h *TCPHost) Close() {
 		}
 	}
 	h.PeerLock.Unlock()
-
+	h.queue.Close()
 }
 
 func (h *TCPHost) Closed() bool {
@@ -579,7 +710,14 @@ func (h *TCPHost) PutDown(ctx context.Context, view int, data []BinaryMarshaler)
 // TODO: each of these goroutines could be spawned when we initally connect to
 // them instead.
 func (h *TCPHost) Get() chan NetworkMessg {
-	return h.msgchan
+	return h.queue.Get()
+}
+
+// Queue returns the queues of messages received from each peer,
+// waiting for Get. A full queue stops its peer's link from being read,
+// leaving the peer to wait on TCP flow control.
+func (h *TCPHost) Queue() *RecvQueue {
+	return h.queue
 }
 
 // Pool is the underlying pool of BinaryUnmarshallers to use when getting.
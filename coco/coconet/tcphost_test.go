@@ -0,0 +1,146 @@
+package coconet
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+)
+
+// Pick a free local address for a host to listen on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func newTestTCPHost(t *testing.T, suite abstract.Suite) *TCPHost {
+	h := NewTCPHost(freeAddr(t))
+	h.SetSuite(suite)
+	key := newTestKey(suite)
+	h.SetPrivKey(key.priv)
+	h.SetPubKey(key.pub)
+	h.SetPool(&sync.Pool{New: func() interface{} {
+		return new(StringMarshaler)
+	}})
+	return h
+}
+
+// Have hosts accept each other, and no one else
+func trustHosts(hosts ...*TCPHost) {
+	keys := make(map[string]abstract.Point)
+	for _, h := range hosts {
+		keys[h.Name()] = h.PubKey()
+	}
+	for _, h := range hosts {
+		h.SetPeerKeys(keys)
+	}
+}
+
+func expectState(t *testing.T, h Host, peer string, state LinkState) {
+	select {
+	case sc := <-h.StateChanges():
+		if sc.Peer != peer || sc.State != state {
+			t.Fatalf("%s: link to %s %s, expected %s %s",
+				h.Name(), sc.Peer, sc.State, peer, state)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: link to %s never went %s", h.Name(), peer, state)
+	}
+}
+
+func TestTCPHostReconnect(t *testing.T) {
+	Latency = 0
+	suite := nist.NewAES128SHA256P256()
+	parent := newTestTCPHost(t, suite)
+	child := newTestTCPHost(t, suite)
+	trustHosts(parent, child)
+	defer parent.Close()
+	defer child.Close()
+	if err := parent.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.ConnectTo(parent.Name()); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, child, parent.Name(), LinkUp)
+	expectState(t, parent, child.Name(), LinkUp)
+
+	// Cut the link from the parent's end: the child redials
+	parent.PeerLock.Lock()
+	link := parent.peers[child.Name()]
+	parent.PeerLock.Unlock()
+	link.Close()
+	expectState(t, parent, child.Name(), LinkDown)
+	expectState(t, child, parent.Name(), LinkDown)
+	expectState(t, child, parent.Name(), LinkUp)
+	expectState(t, parent, child.Name(), LinkUp)
+
+	// and messages flow over the new link
+	msg := StringMarshaler("again")
+	parent.PeerLock.Lock()
+	link = parent.peers[child.Name()]
+	parent.PeerLock.Unlock()
+	if err := link.Put(&msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case nm := <-child.Get():
+		if nm.Err != nil || *nm.Data.(*StringMarshaler) != msg {
+			t.Fatal("received", nm.Data, nm.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message over the new link")
+	}
+}
+
+func TestTCPHostUnknownPeer(t *testing.T) {
+	Latency = 0
+	suite := nist.NewAES128SHA256P256()
+	parent := newTestTCPHost(t, suite)
+	child := newTestTCPHost(t, suite)
+	defer parent.Close()
+	defer child.Close()
+	if err := parent.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A host with no peer keys refuses everyone
+	if err := child.ConnectTo(parent.Name()); err == nil {
+		t.Fatal("connected without knowing the parent's key")
+	}
+	child.SetPeerKeys(map[string]abstract.Point{parent.Name(): parent.PubKey()})
+	if err := child.ConnectTo(parent.Name()); err == nil {
+		t.Fatal("parent accepted a child whose key it does not know")
+	}
+}
+
+func TestTCPHostSilentChild(t *testing.T) {
+	Latency = 0
+	suite := nist.NewAES128SHA256P256()
+	parent := newTestTCPHost(t, suite)
+	child := newTestTCPHost(t, suite)
+	trustHosts(parent, child)
+	defer parent.Close()
+	defer child.Close()
+	if err := parent.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A connection that never says hello holds up no one else
+	silent, err := net.Dial("tcp4", parent.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	if err := child.ConnectTo(parent.Name()); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, parent, child.Name(), LinkUp)
+}
@@ -0,0 +1,295 @@
+package coconet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/random"
+)
+
+// TLS hosts identify themselves with self-signed certificates made
+// fresh when the host starts. Each certificate carries, in an extension,
+// the node's long-term public key and a signature made with the node's
+// private key over the certificate's name and TLS public key.
+// A peer's certificate is accepted only if that signature verifies
+// under the key configured for the name in the tree, so no
+// certificate authority is involved.
+
+const certLabel = "coconet tls v1"
+
+// How long the certificates we make are valid for
+var CertLifetime = 365 * 24 * time.Hour
+
+// Extension holding the node key, under the UUID arc 2.25
+var oidNodeKey = asn1.ObjectIdentifier{2, 25, 307681744, 209348204, 1}
+
+var ErrNoNodeKey = errors.New("tls: certificate carries no node key")
+
+type nodeKeyExt struct {
+	PubKey []byte
+	Sig    []byte
+}
+
+// The message a node signs to bind a certificate to its key
+func certMessage(name string, spki []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(certLabel)
+	writeBlob(&buf, []byte(name))
+	writeBlob(&buf, spki)
+	return buf.Bytes()
+}
+
+// Make a certificate for the node with the given name and private key
+func nodeCertificate(suite abstract.Suite, name string,
+	priv abstract.Secret) (*tls.Certificate, error) {
+
+	if priv == nil {
+		return nil, ErrNoPrivKey
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pub := suite.Point().Mul(nil, priv)
+	pb, err := pub.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	sig := anon.Sign(suite, random.Stream, certMessage(name, spki),
+		anon.Set{pub}, nil, 0, priv)
+	ext, err := asn1.Marshal(nodeKeyExt{pb, sig})
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(CertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: oidNodeKey, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Return the name and node key a certificate was signed for
+func nodeIdentity(suite abstract.Suite, cert *x509.Certificate) (string, abstract.Point, error) {
+	for _, e := range cert.Extensions {
+		if !e.Id.Equal(oidNodeKey) {
+			continue
+		}
+		var nk nodeKeyExt
+		if _, err := asn1.Unmarshal(e.Value, &nk); err != nil {
+			return "", nil, err
+		}
+		pub := suite.Point()
+		if err := pub.UnmarshalBinary(nk.PubKey); err != nil {
+			return "", nil, err
+		}
+		name := cert.Subject.CommonName
+		msg := certMessage(name, cert.RawSubjectPublicKeyInfo)
+		if _, err := anon.Verify(suite, msg, anon.Set{pub}, nil, nk.Sig); err != nil {
+			return "", nil, err
+		}
+		return name, pub, nil
+	}
+	return "", nil, ErrNoNodeKey
+}
+
+// The TLS handshake, protecting TLSHost connections
+type tlsChannel struct {
+	h *TCPHost
+
+	lock sync.Mutex
+	cert *tls.Certificate
+	priv abstract.Secret // the certificate was made for
+}
+
+func (tc *tlsChannel) certificate() (*tls.Certificate, error) {
+	priv, _ := tc.h.keys()
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if tc.cert == nil || tc.priv != priv {
+		cert, err := nodeCertificate(tc.h.suite, tc.h.name, priv)
+		if err != nil {
+			return nil, err
+		}
+		tc.cert, tc.priv = cert, priv
+	}
+	return tc.cert, nil
+}
+
+// The peer a TLS connection was authenticated as
+type tlsPeer struct {
+	name   string
+	pubkey abstract.Point
+}
+
+// Make the configuration for one connection, which checks the peer's
+// certificate against the tree and records who the peer is.
+// If peer is not empty it must be the name the certificate is for.
+func (tc *tlsChannel) config(peer string) (*tls.Config, *tlsPeer, error) {
+	cert, err := tc.certificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	suite := tc.h.suite
+	_, peers := tc.h.keys()
+	id := &tlsPeer{}
+	verify := func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("tls: peer sent no certificate")
+		}
+		c, err := x509.ParseCertificate(raw[0])
+		if err != nil {
+			return err
+		}
+		name, pubkey, err := nodeIdentity(suite, c)
+		if err != nil {
+			return err
+		}
+		if peer != "" && name != peer {
+			return ErrWrongPeer
+		}
+		if err := checkPeerKey(peers, name, pubkey); err != nil {
+			return err
+		}
+		id.name, id.pubkey = name, pubkey
+		return nil
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// there is no certificate authority:
+		// peers are checked against the tree by verify instead
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verify,
+	}, id, nil
+}
+
+func (tc *tlsChannel) accept(conn net.Conn) (Conn, error) {
+	config, id, err := tc.config("")
+	if err != nil {
+		return nil, err
+	}
+	tconn := tls.Server(conn, config)
+	if err := tlsHandshake(tconn); err != nil {
+		return nil, err
+	}
+	tp := NewTLSConnFromNet(tconn)
+	tp.SetName(id.name)
+	tp.SetPubKey(id.pubkey)
+	return tp, nil
+}
+
+func (tc *tlsChannel) dial(conn net.Conn, peer string) (Conn, error) {
+	config, id, err := tc.config(peer)
+	if err != nil {
+		return nil, err
+	}
+	tconn := tls.Client(conn, config)
+	if err := tlsHandshake(tconn); err != nil {
+		return nil, err
+	}
+	tp := NewTLSConnFromNet(tconn)
+	tp.SetName(peer)
+	tp.SetPubKey(id.pubkey)
+	return tp, nil
+}
+
+func tlsHandshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// TLSConn is a TCPConn running over TLS.
+type TLSConn struct {
+	*TCPConn
+	config *tls.Config
+}
+
+// NewTLSConnFromNet wraps an established TLS connection.
+// As with NewTCPConnFromNet it might be necessary to call SetName.
+func NewTLSConnFromNet(conn *tls.Conn) *TLSConn {
+	return &TLSConn{TCPConn: NewTCPConnFromNet(conn)}
+}
+
+// NewTLSConn takes a hostname and the TLS configuration to connect with.
+// Before calling Get or Put Connect must first be called to establish the connection.
+func NewTLSConn(hostname string, config *tls.Config) *TLSConn {
+	return &TLSConn{TCPConn: NewTCPConn(hostname), config: config}
+}
+
+// Connect connects to the endpoint specified.
+func (tc *TLSConn) Connect() error {
+	conn, err := tls.Dial("tcp", tc.name, tc.config)
+	if err != nil {
+		return err
+	}
+	tc.setConn(conn)
+	return nil
+}
+
+// ConnectionState returns the state of the TLS session,
+// and false if the connection is not established.
+func (tc *TLSConn) ConnectionState() (tls.ConnectionState, bool) {
+	tc.encLock.Lock()
+	conn, ok := tc.conn.(*tls.Conn)
+	tc.encLock.Unlock()
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return conn.ConnectionState(), true
+}
+
+// Ensure that TLSHost satisfies the Host interface.
+var _ Host = &TLSHost{}
+
+// TLSHost is a TCPHost whose connections run over TLS,
+// with certificates derived from the host's keys.
+// Like TCPHost it must be given its private key with SetPrivKey,
+// and the keys of the tree with SetPeerKeys, before it connects.
+type TLSHost struct {
+	*TCPHost
+}
+
+// NewTLSHost creates a new TLSHost with a given hostname.
+func NewTLSHost(hostname string) *TLSHost {
+	h := NewTCPHost(hostname)
+	h.channel = &tlsChannel{h: h}
+	return &TLSHost{h}
+}
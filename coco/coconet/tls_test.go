@@ -0,0 +1,127 @@
+package coconet
+
+import (
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+)
+
+func newTestTLSHost(suite abstract.Suite, name string, key testKey,
+	peers map[string]abstract.Point) *tlsChannel {
+
+	h := NewTLSHost(name)
+	h.SetSuite(suite)
+	h.SetPrivKey(key.priv)
+	h.SetPeerKeys(peers)
+	return h.channel.(*tlsChannel)
+}
+
+// Connect a child to a parent over loopback, returning both ends.
+// (A pipe would deadlock on an alert sent while the other side writes.)
+func testTLS(t *testing.T, parent, child *tlsChannel) (Conn, Conn, error, error) {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	type result struct {
+		conn Conn
+		err  error
+	}
+	res := make(chan result)
+	go func() {
+		pconn, err := lsock.Accept()
+		if err != nil {
+			res <- result{nil, err}
+			return
+		}
+		c, err := parent.accept(pconn)
+		if err != nil {
+			pconn.Close()
+		}
+		res <- result{c, err}
+	}()
+	cconn, err := net.Dial("tcp", lsock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := child.dial(cconn, "parent")
+	if err != nil {
+		cconn.Close()
+	}
+	r := <-res
+	return r.conn, c, r.err, err
+}
+
+func TestTLSHost(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	pk, ck := newTestKey(suite), newTestKey(suite)
+	peers := map[string]abstract.Point{
+		"parent": pk.pub,
+		"child":  ck.pub}
+	parent := newTestTLSHost(suite, "parent", pk, peers)
+
+	pconn, cconn, perr, cerr := testTLS(t, parent,
+		newTestTLSHost(suite, "child", ck, peers))
+	if perr != nil || cerr != nil {
+		t.Fatal(perr, cerr)
+	}
+	if pconn.Name() != "child" || !pconn.PubKey().Equal(ck.pub) {
+		t.Fatal("parent saw the wrong child:", pconn.Name())
+	}
+	if !cconn.PubKey().Equal(pk.pub) {
+		t.Fatal("child saw the wrong parent key")
+	}
+	if _, ok := pconn.(*TLSConn).ConnectionState(); !ok {
+		t.Fatal("no TLS session")
+	}
+
+	Latency = 0
+	go func() {
+		msg := StringMarshaler("up")
+		cconn.Put(&msg)
+	}()
+	var got StringMarshaler
+	if err := pconn.Get(&got); err != nil || got != "up" {
+		t.Fatal("message up:", got, err)
+	}
+
+	// A node with another key can take neither name
+	impostor := newTestKey(suite)
+	_, _, perr, _ = testTLS(t, parent,
+		newTestTLSHost(suite, "child", impostor, peers))
+	if perr != ErrWrongPeerKey {
+		t.Fatal("impostor child accepted:", perr)
+	}
+	_, _, _, cerr = testTLS(t, newTestTLSHost(suite, "parent", impostor, nil),
+		newTestTLSHost(suite, "child", ck, peers))
+	if cerr == nil {
+		t.Fatal("impostor parent accepted")
+	}
+}
+
+func TestNodeCertificate(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	key := newTestKey(suite)
+	cert, err := nodeCertificate(suite, "node", key.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, pub, err := nodeIdentity(suite, c)
+	if err != nil || name != "node" || !pub.Equal(key.pub) {
+		t.Fatal("identity read back wrong:", name, err)
+	}
+
+	// The signature covers the name
+	c.Subject.CommonName = "other"
+	if _, _, err := nodeIdentity(suite, c); err == nil {
+		t.Fatal("renamed certificate accepted")
+	}
+}
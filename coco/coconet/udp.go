@@ -0,0 +1,643 @@
+package coconet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+)
+
+// Datagrams sent between UDPHosts:
+//
+//	version  byte: udpVersion
+//	kind     byte: udpData or udpAck
+//	from     byte length, then the sender's name
+//	nonce    12 bytes
+//	body     sealed with AES-GCM, authenticating the header and
+//	         the receiver's name as additional data
+//
+// The body of a data datagram is one fragment of a message:
+//
+//	session  uint64: the sender's session with the receiver
+//	run      uint64: the receiver's run, as last acked to the sender
+//	id       uint64: the message's number in the session, from 1
+//	index    uint16, count uint16: the fragment's place in the message
+//	type     byte: the message's frame type, as in wire.go
+//	payload
+//
+// and that of an ack lists the fragments received of a message:
+//
+//	session  uint64: as in the message
+//	run      uint64: the receiver's run
+//	id, count: as in the message
+//	bitmap   (count+7)/8 bytes, bit i set if fragment i was received
+//
+// Each pair of hosts seals its datagrams with a key derived from the
+// Diffie-Hellman secret of their long-term keys, so a datagram is
+// authentic if it opens under the key of the sender it names, and no
+// state is kept per link besides the messages in flight.
+//
+// Messages are delivered in order within a session. A sender that gives
+// up on a message starts a new session with the receiver, which drops
+// what it kept of the old one and never goes back to it.
+//
+// Each run of a host draws a random run number, which its acks carry.
+// A receiver only takes in data naming its current run, and acks other
+// data as having none of its fragments, to tell the sender its run: so
+// datagrams recorded before the receiver restarted cannot be replayed to
+// its new run. A sender hearing of a peer's new run starts a new session
+// with it, to send again what the old run may have lost.
+
+const udpVersion byte = 2
+
+const (
+	udpData byte = iota
+	udpAck
+)
+
+const udpLabel = "coconet udp v1"
+
+const udpNonceLen = 12
+
+// Bytes of the body of a data datagram before the payload,
+// and of an ack before the bitmap
+const udpDataHeaderLen = 8 + 8 + 8 + 2 + 2 + 1
+const udpAckHeaderLen = 8 + 8 + 8 + 2
+
+// Payload bytes per datagram, keeping datagrams under common path MTUs
+const udpFragmentLen = 1200
+
+// Largest datagram we read
+const udpMaxDatagram = 2048
+
+// UDPMaxMessage is the largest message a UDPHost sends.
+var UDPMaxMessage = 4 * 1024 * 1024
+
+// How long the fragments of a message wait for their ack before being
+// sent again, doubling with each try, and how many tries are made before
+// the message is given up and the link reported down.
+var UDPRetransmit = 100 * time.Millisecond
+var UDPMaxRetries = 6
+
+// How long a receiver waits for more fragments of a message before
+// acking those it has. Complete messages are acked at once.
+var UDPAckDelay = 10 * time.Millisecond
+
+// How many messages a receiver keeps per peer while it waits for their
+// fragments, or for those before them, and how many bytes they may take,
+// counting each message at the most its fragments can hold. Fragments
+// of messages further ahead are dropped, to be sent again once the
+// earlier ones are in; the next message in order is always kept.
+var UDPMaxPending = 256
+var UDPMaxPendingBytes = 4 * UDPMaxMessage
+
+var ErrUDPMessageTooLong = errors.New("udp: message too long")
+
+// The most fragments a message of UDPMaxMessage bytes is sent in
+func udpMaxFragments() int {
+	return (UDPMaxMessage + udpFragmentLen - 1) / udpFragmentLen
+}
+
+// The pairwise key of two hosts, the same at both ends
+func udpKey(suite abstract.Suite, priv abstract.Secret, peer abstract.Point,
+	names ...string) (cipher.AEAD, error) {
+
+	shared, err := suite.Point().Mul(peer, priv).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	h.Write([]byte(udpLabel))
+	h.Write(shared)
+	for _, n := range names {
+		writeBlob(h, []byte(n))
+	}
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Header of a datagram from the given host, up to the nonce
+func udpHeader(kind byte, from string) []byte {
+	hdr := make([]byte, 3+len(from), 3+len(from)+udpNonceLen)
+	hdr[0] = udpVersion
+	hdr[1] = kind
+	hdr[2] = byte(len(from))
+	copy(hdr[3:], from)
+	return hdr
+}
+
+// Seal a body into a datagram to the named host
+func udpSeal(aead cipher.AEAD, kind byte, from, to string, body []byte) []byte {
+	d := udpHeader(kind, from)
+	hdrLen := len(d)
+	var nonce [udpNonceLen]byte
+	random.Stream.XORKeyStream(nonce[:], nonce[:])
+	d = append(d, nonce[:]...)
+	ad := append(append([]byte(nil), d[:hdrLen]...), to...)
+	return aead.Seal(d, nonce[:], body, ad)
+}
+
+// Parse the header of a datagram, returning its kind and sender
+func udpParse(d []byte) (kind byte, from string, err error) {
+	if len(d) < 3 || len(d) < 3+int(d[2])+udpNonceLen {
+		return 0, "", errors.New("udp: short datagram")
+	}
+	if d[0] != udpVersion {
+		return 0, "", WireVersionError(d[0])
+	}
+	return d[1], string(d[3 : 3+d[2]]), nil
+}
+
+// Open the body of a datagram sent to the named host
+func udpOpen(aead cipher.AEAD, d []byte, to string) ([]byte, error) {
+	hdrLen := 3 + int(d[2])
+	nonce := d[hdrLen : hdrLen+udpNonceLen]
+	ad := append(append([]byte(nil), d[:hdrLen]...), to...)
+	return aead.Open(nil, nonce, d[hdrLen+udpNonceLen:], ad)
+}
+
+// A message being sent, until all its fragments are acked
+type udpOutgoing struct {
+	to        string
+	id        uint64
+	typ       byte
+	frags     [][]byte
+	datagrams [][]byte // frags sealed for the session and run they go in
+	acked     []bool
+	left      int
+	tries     int
+	rto       time.Duration
+	timer     *time.Timer
+}
+
+// What a host sends to a peer
+type udpOut struct {
+	session  uint64
+	run      uint64 // the peer's run, 0 until it acks
+	next     uint64
+	inFlight map[uint64]*udpOutgoing
+}
+
+// Seal the fragments of a message into datagrams of the session
+func (o *udpOut) seal(aead cipher.AEAD, from string, m *udpOutgoing) {
+	count := len(m.frags)
+	for i, frag := range m.frags {
+		body := make([]byte, udpDataHeaderLen, udpDataHeaderLen+len(frag))
+		binary.BigEndian.PutUint64(body[0:], o.session)
+		binary.BigEndian.PutUint64(body[8:], o.run)
+		binary.BigEndian.PutUint64(body[16:], m.id)
+		binary.BigEndian.PutUint16(body[24:], uint16(i))
+		binary.BigEndian.PutUint16(body[26:], uint16(count))
+		body[28] = m.typ
+		body = append(body, frag...)
+		m.datagrams[i] = udpSeal(aead, udpData, from, m.to, body)
+	}
+}
+
+// A message being received, until all its fragments are in
+type udpPartial struct {
+	typ   byte
+	frags [][]byte
+	got   []byte // bitmap
+	left  int
+	size  int         // bytes counted against the pending limit
+	timer *time.Timer // pending ack
+}
+
+// A message received whole, waiting for those before it
+type udpComplete struct {
+	typ     byte
+	payload []byte
+	size    int
+}
+
+// What a host receives from a peer
+type udpIn struct {
+	session  uint64
+	next     uint64
+	partial  map[uint64]*udpPartial
+	complete map[uint64]udpComplete
+	bytes    int // size of the messages kept
+}
+
+func newUDPIn(session uint64) *udpIn {
+	return &udpIn{session: session, next: 1,
+		partial:  make(map[uint64]*udpPartial),
+		complete: make(map[uint64]udpComplete)}
+}
+
+// Session numbers start from the time, so that those of a restarted host
+// are higher than those of its earlier run, plus a random offset of up to
+// a few milliseconds, so that two runs started on the same tick differ.
+func udpSessionSeed() uint64 {
+	var b [8]byte
+	random.Stream.XORKeyStream(b[:], b[:])
+	return uint64(time.Now().UnixNano()) + binary.BigEndian.Uint64(b[:])%(1<<22)
+}
+
+// A random run number, never 0
+func udpRunNumber() uint64 {
+	var b [8]byte
+	for {
+		random.Stream.XORKeyStream(b[:], b[:])
+		if run := binary.BigEndian.Uint64(b[:]); run != 0 {
+			return run
+		}
+	}
+}
+
+// send fragments a message to a peer into datagrams, sends them,
+// and retransmits them until they are acked.
+func (h *UDPHost) send(to string, data BinaryMarshaler) error {
+	b, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(b) > UDPMaxMessage {
+		return ErrUDPMessageTooLong
+	}
+	typ := MessageType(data)
+	aead, addr, err := h.link(to)
+	if err != nil {
+		return err
+	}
+
+	count := (len(b) + udpFragmentLen - 1) / udpFragmentLen
+	if count == 0 {
+		count = 1
+	}
+	h.outLock.Lock()
+	o := h.out[to]
+	if o == nil {
+		o = &udpOut{session: h.newSession(), next: 1,
+			inFlight: make(map[uint64]*udpOutgoing)}
+		h.out[to] = o
+	}
+	m := &udpOutgoing{to: to, id: o.next, typ: typ,
+		frags:     make([][]byte, count),
+		datagrams: make([][]byte, count),
+		acked:     make([]bool, count),
+		left:      count,
+		rto:       UDPRetransmit}
+	o.next++
+	for i := range m.frags {
+		frag := b[i*udpFragmentLen:]
+		if len(frag) > udpFragmentLen {
+			frag = frag[:udpFragmentLen]
+		}
+		m.frags[i] = frag
+	}
+	o.seal(aead, h.name, m)
+	o.inFlight[m.id] = m
+	h.arm(o.session, m)
+	h.outLock.Unlock()
+
+	for _, d := range m.datagrams {
+		if err := h.write(to, d, addr); err != nil {
+			// retransmission will try again
+			log.Warnln("udphost: sending to", to, "failed:", err)
+		}
+	}
+	return nil
+}
+
+// Set the retransmission timer of a message in a session
+func (h *UDPHost) arm(session uint64, m *udpOutgoing) {
+	m.timer = time.AfterFunc(m.rto, func() {
+		h.retransmit(session, m)
+	})
+}
+
+// Send again the fragments of a message not acked yet,
+// or give up on the session if it has been tried enough.
+func (h *UDPHost) retransmit(session uint64, m *udpOutgoing) {
+	h.outLock.Lock()
+	o := h.out[m.to]
+	if h.Closed() || o == nil || o.session != session || o.inFlight[m.id] != m {
+		h.outLock.Unlock()
+		return
+	}
+	m.tries++
+	if m.tries > UDPMaxRetries {
+		for _, lost := range o.inFlight {
+			lost.timer.Stop()
+		}
+		delete(h.out, m.to)
+		down := !h.down[m.to]
+		h.down[m.to] = true
+		h.outLock.Unlock()
+		log.Warnln("udphost: no ack from", m.to, "for message", m.id)
+		if down {
+			h.stateChange(m.to, LinkDown)
+		}
+		return
+	}
+	var resend [][]byte
+	for i, d := range m.datagrams {
+		if !m.acked[i] {
+			resend = append(resend, d)
+		}
+	}
+	m.rto *= 2
+	m.timer.Reset(m.rto)
+	h.outLock.Unlock()
+
+	_, addr, err := h.link(m.to)
+	if err != nil {
+		return
+	}
+	for _, d := range resend {
+		h.write(m.to, d, addr)
+	}
+}
+
+// Take in an ack from a peer
+func (h *UDPHost) acked(from string, body []byte) {
+	if len(body) < udpAckHeaderLen {
+		return
+	}
+	session := binary.BigEndian.Uint64(body[0:])
+	run := binary.BigEndian.Uint64(body[8:])
+	id := binary.BigEndian.Uint64(body[16:])
+	count := int(binary.BigEndian.Uint16(body[24:]))
+	bitmap := body[udpAckHeaderLen:]
+	if len(bitmap) != (count+7)/8 {
+		return
+	}
+	aead, addr, err := h.link(from)
+	if err != nil {
+		return
+	}
+
+	h.outLock.Lock()
+	o := h.out[from]
+	if o == nil || o.session != session {
+		h.outLock.Unlock()
+		return
+	}
+	up := h.down[from]
+	delete(h.down, from)
+	var resend [][]byte
+	if run != o.run {
+		resend = h.newRun(o, run, aead)
+	} else if m := o.inFlight[id]; m != nil && len(m.acked) == count {
+		for i := range m.acked {
+			if !m.acked[i] && bitmap[i/8]&(1<<uint(i%8)) != 0 {
+				m.acked[i] = true
+				m.left--
+			}
+		}
+		if m.left == 0 {
+			m.timer.Stop()
+			delete(o.inFlight, id)
+		}
+	}
+	h.outLock.Unlock()
+	if up {
+		h.stateChange(from, LinkUp)
+	}
+	for _, d := range resend {
+		h.write(from, d, addr)
+	}
+}
+
+// Take up a peer's new run, heard of in an ack, returning the datagrams
+// to send it again. What was sent before we first heard of its run it
+// turned down, and takes again as it was. What was sent to an earlier
+// run, which may have been lost with it, goes again in a new session.
+func (h *UDPHost) newRun(o *udpOut, run uint64, aead cipher.AEAD) [][]byte {
+	inFlight := make([]*udpOutgoing, 0, len(o.inFlight))
+	for _, m := range o.inFlight {
+		inFlight = append(inFlight, m)
+	}
+	sort.Slice(inFlight, func(i, j int) bool {
+		return inFlight[i].id < inFlight[j].id
+	})
+	if o.run != 0 {
+		o.session = h.newSession()
+		o.next = 1
+		o.inFlight = make(map[uint64]*udpOutgoing)
+		for _, m := range inFlight {
+			m.timer.Stop()
+			m.id = o.next
+			o.next++
+			for i := range m.acked {
+				m.acked[i] = false
+			}
+			m.left = len(m.acked)
+			m.tries = 0
+			m.rto = UDPRetransmit
+			o.inFlight[m.id] = m
+			h.arm(o.session, m)
+		}
+	}
+	o.run = run
+	var resend [][]byte
+	for _, m := range inFlight {
+		o.seal(aead, h.name, m)
+		for i, d := range m.datagrams {
+			if !m.acked[i] {
+				resend = append(resend, d)
+			}
+		}
+	}
+	return resend
+}
+
+// Take in a fragment of a message from a peer, acking it
+// and delivering the messages it completes.
+func (h *UDPHost) received(from string, body []byte) {
+	if len(body) < udpDataHeaderLen {
+		return
+	}
+	session := binary.BigEndian.Uint64(body[0:])
+	run := binary.BigEndian.Uint64(body[8:])
+	id := binary.BigEndian.Uint64(body[16:])
+	index := int(binary.BigEndian.Uint16(body[24:]))
+	count := int(binary.BigEndian.Uint16(body[26:]))
+	typ := body[28]
+	frag := body[udpDataHeaderLen:]
+	if index >= count || count > udpMaxFragments() {
+		return
+	}
+	if run != h.run {
+		// sent before the sender heard of this run: tell it
+		h.sendAck(from, session, id, 0, nil)
+		return
+	}
+
+	h.inLock.Lock()
+	in := h.in[from]
+	if in == nil || session > in.session {
+		if in != nil {
+			for _, p := range in.partial {
+				if p.timer != nil {
+					p.timer.Stop()
+				}
+			}
+		}
+		in = newUDPIn(session)
+		h.in[from] = in
+	} else if session < in.session {
+		h.inLock.Unlock()
+		return
+	}
+
+	if _, done := in.complete[id]; done || id < in.next {
+		// a retransmission: our ack was lost
+		h.inLock.Unlock()
+		h.sendAck(from, session, id, count, nil)
+		return
+	}
+	p := in.partial[id]
+	if p == nil {
+		size := count * udpFragmentLen
+		if id != in.next && (id >= in.next+uint64(UDPMaxPending) ||
+			len(in.partial)+len(in.complete) >= UDPMaxPending ||
+			in.bytes+size > UDPMaxPendingBytes) {
+			h.inLock.Unlock()
+			return
+		}
+		p = &udpPartial{typ: typ,
+			frags: make([][]byte, count),
+			got:   make([]byte, (count+7)/8),
+			left:  count,
+			size:  size}
+		in.partial[id] = p
+		in.bytes += size
+	}
+	if len(p.frags) != count || p.typ != typ {
+		h.inLock.Unlock()
+		return
+	}
+	if p.got[index/8]&(1<<uint(index%8)) == 0 {
+		p.got[index/8] |= 1 << uint(index%8)
+		p.frags[index] = append([]byte(nil), frag...)
+		p.left--
+	}
+	if p.left > 0 {
+		if p.timer == nil {
+			p.timer = time.AfterFunc(UDPAckDelay, func() {
+				h.inLock.Lock()
+				p.timer = nil
+				got := append([]byte(nil), p.got...)
+				h.inLock.Unlock()
+				h.sendAck(from, session, id, count, got)
+			})
+		}
+		h.inLock.Unlock()
+		return
+	}
+
+	// complete: ack it, and deliver it and those after it, in order
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(in.partial, id)
+	var payload []byte
+	for _, f := range p.frags {
+		payload = append(payload, f...)
+	}
+	in.complete[id] = udpComplete{typ, payload, p.size}
+	var ready []udpComplete
+	for {
+		c, ok := in.complete[in.next]
+		if !ok {
+			break
+		}
+		ready = append(ready, c)
+		delete(in.complete, in.next)
+		in.bytes -= c.size
+		in.next++
+	}
+	h.inLock.Unlock()
+
+	h.sendAck(from, session, id, count, nil)
+	for _, c := range ready {
+		h.deliver(from, c)
+	}
+}
+
+// Ack the fragments of a message in the bitmap, all of them if nil
+func (h *UDPHost) sendAck(to string, session, id uint64, count int, got []byte) {
+	aead, addr, err := h.link(to)
+	if err != nil {
+		return
+	}
+	if got == nil {
+		got = make([]byte, (count+7)/8)
+		for i := 0; i < count; i++ {
+			got[i/8] |= 1 << uint(i%8)
+		}
+	}
+	body := make([]byte, udpAckHeaderLen, udpAckHeaderLen+len(got))
+	binary.BigEndian.PutUint64(body[0:], session)
+	binary.BigEndian.PutUint64(body[8:], h.run)
+	binary.BigEndian.PutUint64(body[16:], id)
+	binary.BigEndian.PutUint16(body[24:], uint16(count))
+	body = append(body, got...)
+	if err := h.write(to, udpSeal(aead, udpAck, h.name, to, body), addr); err != nil {
+		log.Warnln("udphost: acking to", to, "failed:", err)
+	}
+}
+
+// Send a datagram, unless the test hook drops it
+func (h *UDPHost) write(to string, d []byte, addr *net.UDPAddr) error {
+	if h.drop != nil && h.drop(to, d) {
+		return nil
+	}
+	_, err := h.sock.WriteToUDP(d, addr)
+	return err
+}
+
+// Read datagrams until the host is closed
+func (h *UDPHost) read() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, _, err := h.sock.ReadFromUDP(buf)
+		if err != nil {
+			if h.Closed() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Errorln("udphost: reading:", err)
+			return
+		}
+		d := buf[:n]
+		kind, from, err := udpParse(d)
+		if err != nil {
+			log.Warnln("udphost: dropping datagram:", err)
+			continue
+		}
+		aead, _, err := h.link(from)
+		if err != nil {
+			log.Warnln("udphost: dropping datagram from", from, ":", err)
+			continue
+		}
+		body, err := udpOpen(aead, d, h.name)
+		if err != nil {
+			log.Warnln("udphost: dropping forged datagram from", from)
+			continue
+		}
+		switch kind {
+		case udpData:
+			h.received(from, body)
+		case udpAck:
+			h.acked(from, body)
+		}
+	}
+}
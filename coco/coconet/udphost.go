@@ -0,0 +1,549 @@
+package coconet
+
+import (
+	"crypto/cipher"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dedis/crypto/abstract"
+	"golang.org/x/net/context"
+)
+
+// Ensure that UDPHost satisfies the Host interface.
+var _ Host = &UDPHost{}
+
+// UDPHost is an implementation of Host that sends its messages as
+// authenticated datagrams from a single UDP socket, as described in udp.go.
+// It keeps no connection per peer, so a host can have thousands of
+// children at the cost of the messages in flight to them.
+//
+// Every peer's public key must be set with SetPeerKeys, along with the
+// host's private key, before messages can be sent or received.
+type UDPHost struct {
+	name string
+	sock *net.UDPConn
+	bind sync.Once
+
+	views *Views
+
+	PeerLock     sync.RWMutex
+	peers        map[string]Conn
+	PendingPeers map[string]bool
+
+	pkLock   sync.RWMutex
+	Pubkey   abstract.Point
+	privKey  abstract.Secret
+	peerKeys map[string]abstract.Point
+
+	pool  *sync.Pool
+	suite abstract.Suite
+
+	// pairwise keys and addresses of peers, derived on first use
+	linkLock sync.Mutex
+	links    map[string]*udpLink
+
+	outLock  sync.Mutex
+	out      map[string]*udpOut
+	down     map[string]bool // peers given up on, until they ack again
+	sessions uint64
+
+	inLock sync.Mutex
+	in     map[string]*udpIn
+	run    uint64 // this run of the host, as named in the data it takes
+
+	// messages received, waiting for Get
+	queue  *RecvQueue
+	states chan StateChange
+
+	// 1 if closed, 0 if not closed
+	closed int64
+
+	// if set, datagrams it returns true for are lost, for tests
+	drop func(to string, d []byte) bool
+}
+
+type udpLink struct {
+	aead cipher.AEAD
+	addr *net.UDPAddr
+}
+
+// ErrUDPConnGet is returned by UDPConn.Get: a UDPHost receives all its
+// messages on its single socket, and hands them out from its Get.
+var ErrUDPConnGet = errors.New("udp: get messages from the host")
+
+// NewUDPHost creates a new UDPHost with the given hostname,
+// which is also the address it listens on.
+func NewUDPHost(hostname string) *UDPHost {
+	h := &UDPHost{name: hostname,
+		views:        NewViews(),
+		peers:        make(map[string]Conn),
+		PendingPeers: make(map[string]bool),
+		links:        make(map[string]*udpLink),
+		out:          make(map[string]*udpOut),
+		down:         make(map[string]bool),
+		sessions:     udpSessionSeed(),
+		in:           make(map[string]*udpIn),
+		run:          udpRunNumber(),
+		queue:        NewRecvQueue(DefaultQueueLimit, DropNewest),
+		states:       make(chan StateChange, 64)}
+	return h
+}
+
+// A session number higher than any used before by this host,
+// or by an earlier run of it
+func (h *UDPHost) newSession() uint64 {
+	return atomic.AddUint64(&h.sessions, 1)
+}
+
+// Open the host's socket, once, and start reading from it
+func (h *UDPHost) open() error {
+	var err error
+	h.bind.Do(func() {
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr("udp4", h.name)
+		if err != nil {
+			return
+		}
+		h.sock, err = net.ListenUDP("udp4", addr)
+		if err != nil {
+			return
+		}
+		go h.read()
+	})
+	if err == nil && h.sock == nil {
+		err = errors.New("udphost: socket failed to open")
+	}
+	return err
+}
+
+// The pairwise key and address of a peer
+func (h *UDPHost) link(peer string) (cipher.AEAD, *net.UDPAddr, error) {
+	h.linkLock.Lock()
+	defer h.linkLock.Unlock()
+	if l, ok := h.links[peer]; ok {
+		return l.aead, l.addr, nil
+	}
+	priv, keys := h.keys()
+	if priv == nil {
+		return nil, nil, ErrNoPrivKey
+	}
+	pk, ok := keys[peer]
+	if !ok {
+		return nil, nil, ErrUnknownPeer
+	}
+	aead, err := udpKey(h.suite, priv, pk, h.name, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp4", peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.links[peer] = &udpLink{aead, addr}
+	return aead, addr, nil
+}
+
+// Hand a message received whole to Get
+func (h *UDPHost) deliver(from string, c udpComplete) {
+	data := h.pool.Get().(BinaryUnmarshaler)
+	var err error
+	if want := MessageType(data); c.typ != want {
+		err = WireTypeError{c.typ, want}
+	} else {
+		err = data.UnmarshalBinary(c.payload)
+	}
+	h.queue.Put(NetworkMessg{Data: data, From: from, Err: err})
+}
+
+func (h *UDPHost) Views() *Views {
+	return h.views
+}
+
+// SetSuite sets the suite of the UDPHost to use.
+func (h *UDPHost) SetSuite(s abstract.Suite) {
+	h.suite = s
+}
+
+// PubKey returns the public key of the host.
+func (h *UDPHost) PubKey() abstract.Point {
+	h.pkLock.RLock()
+	pk := h.Pubkey
+	h.pkLock.RUnlock()
+	return pk
+}
+
+// SetPubKey sets the public key of the host.
+func (h *UDPHost) SetPubKey(pk abstract.Point) {
+	h.pkLock.Lock()
+	h.Pubkey = pk
+	h.pkLock.Unlock()
+}
+
+// SetPrivKey sets the private key the host's datagrams are keyed with.
+func (h *UDPHost) SetPrivKey(sk abstract.Secret) {
+	h.pkLock.Lock()
+	h.privKey = sk
+	h.pkLock.Unlock()
+	h.resetLinks()
+}
+
+// SetPeerKeys sets the public keys of the hosts in the tree, by name.
+// Datagrams are only exchanged with the hosts listed.
+func (h *UDPHost) SetPeerKeys(keys map[string]abstract.Point) {
+	h.pkLock.Lock()
+	h.peerKeys = keys
+	h.pkLock.Unlock()
+	h.resetLinks()
+}
+
+func (h *UDPHost) keys() (abstract.Secret, map[string]abstract.Point) {
+	h.pkLock.RLock()
+	defer h.pkLock.RUnlock()
+	return h.privKey, h.peerKeys
+}
+
+func (h *UDPHost) resetLinks() {
+	h.linkLock.Lock()
+	h.links = make(map[string]*udpLink)
+	h.linkLock.Unlock()
+}
+
+// Listen opens the host's socket to receive datagrams from its peers.
+func (h *UDPHost) Listen() error {
+	return h.open()
+}
+
+// ConnectTo checks that the peer can be reached: its key and address
+// are known. No datagram is exchanged, the link is up until messages
+// to the peer go unacked.
+func (h *UDPHost) ConnectTo(peer string) error {
+	if err := h.open(); err != nil {
+		return err
+	}
+	if _, _, err := h.link(peer); err != nil {
+		return err
+	}
+	_, keys := h.keys()
+	h.conn(peer).SetPubKey(keys[peer])
+	h.stateChange(peer, LinkUp)
+	return nil
+}
+
+// Connect connects to the parent in the given view.
+func (h *UDPHost) Connect(view int) error {
+	parent := h.views.Parent(view)
+	if parent == "" {
+		return nil
+	}
+	h.PeerLock.Lock()
+	delete(h.PendingPeers, parent)
+	h.PeerLock.Unlock()
+	return h.ConnectTo(parent)
+}
+
+// StateChanges returns the channel on which links to peers are reported
+// going down, when a message to them is given up, and back up, when
+// they ack again.
+func (h *UDPHost) StateChanges() <-chan StateChange {
+	return h.states
+}
+
+func (h *UDPHost) stateChange(peer string, state LinkState) {
+	select {
+	case h.states <- StateChange{peer, state}:
+	default:
+		log.Warnln("udphost: dropped state change:", peer, state)
+	}
+}
+
+// The connection to a peer, created on first use
+func (h *UDPHost) conn(peer string) Conn {
+	h.PeerLock.Lock()
+	defer h.PeerLock.Unlock()
+	c, ok := h.peers[peer]
+	if !ok {
+		c = &UDPConn{h: h, to: peer}
+		h.peers[peer] = c
+	}
+	return c
+}
+
+// NewView creates a new view with the given view number, parent and children.
+func (h *UDPHost) NewView(view int, parent string, children []string, hostlist []string) {
+	h.views.NewView(view, parent, children, hostlist)
+}
+
+func (h *UDPHost) NewViewFromPrev(view int, parent string) {
+	h.views.NewViewFromPrev(view, parent)
+}
+
+// AddParent adds a parent node to the UDPHost, for the given view.
+func (h *UDPHost) AddParent(view int, c string) {
+	h.conn(c)
+	h.PeerLock.Lock()
+	delete(h.PendingPeers, c)
+	h.PeerLock.Unlock()
+	h.views.AddParent(view, c)
+}
+
+// AddChildren adds children to the specified view.
+func (h *UDPHost) AddChildren(view int, cs ...string) {
+	for _, c := range cs {
+		h.conn(c)
+		h.PeerLock.Lock()
+		delete(h.PendingPeers, c)
+		h.PeerLock.Unlock()
+		h.views.AddChildren(view, c)
+	}
+}
+
+// AddPeers adds the list of Peers.
+func (h *UDPHost) AddPeers(cs ...string) {
+	for _, c := range cs {
+		h.conn(c)
+	}
+}
+
+func (h *UDPHost) Pending() map[string]bool {
+	return h.PendingPeers
+}
+
+func (h *UDPHost) AddPeerToPending(p string) {
+	h.PeerLock.Lock()
+	h.PendingPeers[p] = true
+	h.PeerLock.Unlock()
+}
+
+func (h *UDPHost) AddPeerToHostlist(view int, name string) {
+	h.views.AddPeerToHostlist(view, name)
+}
+
+func (h *UDPHost) RemovePeerFromHostlist(view int, name string) {
+	h.views.RemovePeerFromHostlist(view, name)
+}
+
+func (h *UDPHost) AddPendingPeer(view int, name string) error {
+	h.PeerLock.Lock()
+	if _, ok := h.PendingPeers[name]; !ok {
+		h.PeerLock.Unlock()
+		return errors.New("error adding pending peer: not in pending peers")
+	}
+	delete(h.PendingPeers, name)
+	h.PeerLock.Unlock()
+	h.AddChildren(view, name)
+	return nil
+}
+
+func (h *UDPHost) RemovePendingPeer(peer string) {
+	h.PeerLock.Lock()
+	delete(h.PendingPeers, peer)
+	h.PeerLock.Unlock()
+}
+
+func (h *UDPHost) RemovePeer(view int, name string) bool {
+	return h.views.RemovePeer(view, name)
+}
+
+// NChildren returns the number of children for the specified view.
+func (h *UDPHost) NChildren(view int) int {
+	return h.views.NChildren(view)
+}
+
+func (h *UDPHost) HostListOn(view int) []string {
+	return h.views.HostList(view)
+}
+
+func (h *UDPHost) SetHostList(view int, hostlist []string) {
+	h.views.SetHostList(view, hostlist)
+}
+
+// Name returns the hostname of the UDPHost.
+func (h *UDPHost) Name() string {
+	return h.name
+}
+
+// IsRoot returns true if the UDPHost is the root of its tree for the given view.
+func (h *UDPHost) IsRoot(view int) bool {
+	return h.views.Parent(view) == ""
+}
+
+// IsParent returns true if the given peer is the parent for the specified view.
+func (h *UDPHost) IsParent(view int, peer string) bool {
+	return h.views.Parent(view) == peer
+}
+
+func (h *UDPHost) Parent(view int) string {
+	return h.views.Parent(view)
+}
+
+// IsChild returns true if the given peer is a child for the specified view.
+func (h *UDPHost) IsChild(view int, peer string) bool {
+	h.PeerLock.RLock()
+	_, ok := h.peers[peer]
+	h.PeerLock.RUnlock()
+	return h.views.Parent(view) != peer && ok
+}
+
+// Peers returns the list of Peers as a mapping from hostname to Conn.
+func (h *UDPHost) Peers() map[string]Conn {
+	h.PeerLock.RLock()
+	defer h.PeerLock.RUnlock()
+	peers := make(map[string]Conn, len(h.peers))
+	for name, c := range h.peers {
+		peers[name] = c
+	}
+	return peers
+}
+
+// Children returns a map of childname to Conn for the given view.
+func (h *UDPHost) Children(view int) map[string]Conn {
+	children := make(map[string]Conn)
+	for _, c := range h.views.Children(view) {
+		children[c] = h.conn(c)
+	}
+	return children
+}
+
+// PutTo sends a message to a peer. It returns once the message is sent,
+// and is retransmitted in the background until the peer acks it.
+func (h *UDPHost) PutTo(ctx context.Context, host string, data BinaryMarshaler) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return h.conn(host).Put(data)
+}
+
+// PutUp sends a message to the parent in the specified view.
+func (h *UDPHost) PutUp(ctx context.Context, view int, data BinaryMarshaler) error {
+	return h.PutTo(ctx, h.views.Parent(view), data)
+}
+
+// PutDown sends a message to each child in the specified view.
+// If sending to some of them fails, the last error is returned.
+func (h *UDPHost) PutDown(ctx context.Context, view int, data []BinaryMarshaler) error {
+	children := h.views.Children(view)
+	if len(data) != len(children) {
+		panic("number of messages passed down != number of children")
+	}
+	var err error
+	for i, c := range children {
+		if e := h.PutTo(ctx, c, data[i]); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Get returns the channel of messages received from all peers.
+func (h *UDPHost) Get() chan NetworkMessg {
+	return h.queue.Get()
+}
+
+// Queue returns the queues of messages received, waiting for Get.
+// They drop the newest messages when full, so that reading datagrams,
+// and acks among them, never waits for the application.
+func (h *UDPHost) Queue() *RecvQueue {
+	return h.queue
+}
+
+// Pool is the underlying pool of BinaryUnmarshallers to use when getting.
+func (h *UDPHost) Pool() *sync.Pool {
+	return h.pool
+}
+
+// SetPool sets the pool of BinaryUnmarshallers when getting from channels
+func (h *UDPHost) SetPool(p *sync.Pool) {
+	h.pool = p
+}
+
+// Close closes the host's socket, dropping the messages in flight.
+func (h *UDPHost) Close() {
+	if !atomic.CompareAndSwapInt64(&h.closed, 0, 1) {
+		return
+	}
+	log.Println("udphost: closing")
+	if h.sock != nil {
+		h.sock.Close()
+	}
+	h.outLock.Lock()
+	for _, o := range h.out {
+		for _, m := range o.inFlight {
+			m.timer.Stop()
+		}
+	}
+	h.outLock.Unlock()
+	h.queue.Put(NetworkMessg{From: h.name, Err: ErrClosed})
+	h.queue.Close()
+}
+
+func (h *UDPHost) Closed() bool {
+	return atomic.LoadInt64(&h.closed) == 1
+}
+
+// UDPConn is the Conn from a UDPHost to one of its peers.
+type UDPConn struct {
+	h  *UDPHost
+	to string
+
+	mupk   sync.RWMutex
+	pubkey abstract.Point
+
+	closed int64
+}
+
+// Name returns the peer's name.
+func (c *UDPConn) Name() string {
+	return c.to
+}
+
+// PubKey returns the public key of the peer.
+func (c *UDPConn) PubKey() abstract.Point {
+	c.mupk.RLock()
+	pk := c.pubkey
+	c.mupk.RUnlock()
+	if pk == nil {
+		_, keys := c.h.keys()
+		pk = keys[c.to]
+	}
+	return pk
+}
+
+// SetPubKey sets the public key of the peer.
+func (c *UDPConn) SetPubKey(pk abstract.Point) {
+	c.mupk.Lock()
+	c.pubkey = pk
+	c.mupk.Unlock()
+}
+
+// Put sends data to the peer, retransmitting it until acked.
+func (c *UDPConn) Put(data BinaryMarshaler) error {
+	if c.Closed() || c.h.Closed() {
+		return ErrClosed
+	}
+	if err := c.h.open(); err != nil {
+		return err
+	}
+	return c.h.send(c.to, data)
+}
+
+// Get returns ErrUDPConnGet: messages are received from the host's Get.
+func (c *UDPConn) Get(data BinaryUnmarshaler) error {
+	return ErrUDPConnGet
+}
+
+// Connect checks that the peer can be reached.
+func (c *UDPConn) Connect() error {
+	return c.h.ConnectTo(c.to)
+}
+
+// Close closes the connection for sending.
+func (c *UDPConn) Close() {
+	atomic.StoreInt64(&c.closed, 1)
+}
+
+func (c *UDPConn) Closed() bool {
+	return atomic.LoadInt64(&c.closed) == 1
+}
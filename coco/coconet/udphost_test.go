@@ -0,0 +1,349 @@
+package coconet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"golang.org/x/net/context"
+)
+
+// Pick a free local address for a UDP host
+func freeUDPAddr(t *testing.T) string {
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+// Hosts knowing each other's keys
+func newTestUDPHosts(t *testing.T, suite abstract.Suite, n int) []*UDPHost {
+	hosts := make([]*UDPHost, n)
+	keys := make(map[string]abstract.Point)
+	for i := range hosts {
+		h := NewUDPHost(freeUDPAddr(t))
+		h.SetSuite(suite)
+		key := newTestKey(suite)
+		h.SetPrivKey(key.priv)
+		h.SetPubKey(key.pub)
+		h.SetPool(&sync.Pool{New: func() interface{} {
+			return new(StringMarshaler)
+		}})
+		keys[h.Name()] = key.pub
+		hosts[i] = h
+	}
+	for _, h := range hosts {
+		h.SetPeerKeys(keys)
+	}
+	return hosts
+}
+
+func expectMessage(t *testing.T, h Host, from string, want StringMarshaler) {
+	select {
+	case nm := <-h.Get():
+		if nm.Err != nil || nm.From != from || *nm.Data.(*StringMarshaler) != want {
+			t.Fatalf("unexpected message from %s, %v", nm.From, nm.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing received from %s", from)
+	}
+}
+
+func TestUDPHost(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	hosts := newTestUDPHosts(t, suite, 3)
+	parent, child := hosts[0], hosts[1]
+	for _, h := range hosts {
+		defer h.Close()
+	}
+	child.AddParent(0, parent.Name())
+	parent.AddChildren(0, child.Name())
+	if err := parent.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Connect(0); err != nil {
+		t.Fatal(err)
+	}
+	if !child.Peers()[parent.Name()].PubKey().Equal(parent.PubKey()) {
+		t.Fatal("wrong public key for the parent")
+	}
+
+	// Messages arrive in order, whole however many fragments they take
+	small := StringMarshaler("hello")
+	large := StringMarshaler(bytes.Repeat([]byte("0123456789"), 1000))
+	for _, m := range []StringMarshaler{small, large, small} {
+		m := m
+		if err := child.PutUp(context.TODO(), 0, &m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMessage(t, parent, child.Name(), small)
+	expectMessage(t, parent, child.Name(), large)
+	expectMessage(t, parent, child.Name(), small)
+	if err := parent.PutDown(context.TODO(), 0, []BinaryMarshaler{&small}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, child, parent.Name(), small)
+
+	// A host whose key the parent does not know is not heard
+	stranger := NewUDPHost(freeUDPAddr(t))
+	defer stranger.Close()
+	stranger.SetSuite(suite)
+	key := newTestKey(suite)
+	stranger.SetPrivKey(key.priv)
+	stranger.SetPeerKeys(map[string]abstract.Point{parent.Name(): parent.PubKey()})
+	if err := stranger.PutTo(context.TODO(), parent.Name(), &small); err != nil {
+		t.Fatal(err)
+	}
+	// nor one forging the name of a host the parent knows
+	hosts[2].SetPrivKey(key.priv)
+	if err := hosts[2].PutTo(context.TODO(), parent.Name(), &small); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case nm := <-parent.Get():
+		t.Fatal("received from", nm.From)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestUDPSelectiveRetransmit(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	hosts := newTestUDPHosts(t, suite, 2)
+	parent, child := hosts[0], hosts[1]
+	defer parent.Close()
+	defer child.Close()
+	parent.Listen()
+
+	// once the child has learnt the parent's run,
+	// lose the second and fourth fragments the first time they are sent
+	var mu sync.Mutex
+	counting := false
+	sent := 0
+	child.drop = func(to string, d []byte) bool {
+		if d[1] != udpData {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !counting {
+			return false
+		}
+		sent++
+		return sent == 2 || sent == 4
+	}
+	hello := StringMarshaler("hello")
+	if err := child.PutTo(context.TODO(), parent.Name(), &hello); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, parent, child.Name(), hello)
+	mu.Lock()
+	counting = true
+	mu.Unlock()
+
+	m := StringMarshaler(bytes.Repeat([]byte("x"), 5*udpFragmentLen))
+	if err := child.PutTo(context.TODO(), parent.Name(), &m); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, parent, child.Name(), m)
+	time.Sleep(2 * UDPRetransmit)
+	mu.Lock()
+	defer mu.Unlock()
+	if sent != 7 {
+		t.Fatal("sent", sent, "data datagrams, expected 5 and 2 again")
+	}
+}
+
+func TestUDPLinkDown(t *testing.T) {
+	retransmit, retries := UDPRetransmit, UDPMaxRetries
+	UDPRetransmit, UDPMaxRetries = 10*time.Millisecond, 2
+	defer func() {
+		UDPRetransmit, UDPMaxRetries = retransmit, retries
+	}()
+	suite := nist.NewAES128SHA256P256()
+	hosts := newTestUDPHosts(t, suite, 2)
+	parent, child := hosts[0], hosts[1]
+	defer parent.Close()
+	defer child.Close()
+	child.ConnectTo(parent.Name())
+	expectState(t, child, parent.Name(), LinkUp)
+
+	// The parent does not listen yet: the message is given up
+	m := StringMarshaler("lost")
+	child.PutTo(context.TODO(), parent.Name(), &m)
+	expectState(t, child, parent.Name(), LinkDown)
+
+	// and the link is back up once the parent acks a new one
+	parent.Listen()
+	m = "found"
+	child.PutTo(context.TODO(), parent.Name(), &m)
+	expectMessage(t, parent, child.Name(), m)
+	expectState(t, child, parent.Name(), LinkUp)
+}
+
+func TestUDPPendingLimit(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	hosts := newTestUDPHosts(t, suite, 2)
+	parent, child := hosts[0], hosts[1]
+	parent.drop = func(to string, d []byte) bool { return true }
+	fragment := func(id uint64, count int) []byte {
+		body := make([]byte, udpDataHeaderLen+1)
+		binary.BigEndian.PutUint64(body[0:], 1)
+		binary.BigEndian.PutUint64(body[8:], parent.run)
+		binary.BigEndian.PutUint64(body[16:], id)
+		binary.BigEndian.PutUint16(body[26:], uint16(count))
+		return body
+	}
+	pending := func() int {
+		parent.inLock.Lock()
+		defer parent.inLock.Unlock()
+		in := parent.in[child.Name()]
+		return len(in.partial) + len(in.complete)
+	}
+
+	// the first fragment of message 1 is kept, while a message claiming
+	// more fragments than the largest message takes is not
+	parent.received(child.Name(), fragment(1, 2))
+	parent.received(child.Name(), fragment(2, udpMaxFragments()+1))
+	if n := pending(); n != 1 {
+		t.Fatal(n, "messages pending, expected 1")
+	}
+
+	// no more than UDPMaxPending messages are kept waiting for message 1,
+	// and none beyond the window
+	for id := uint64(2); id <= uint64(2*UDPMaxPending); id++ {
+		parent.received(child.Name(), fragment(id, 1))
+	}
+	if n := pending(); n != UDPMaxPending {
+		t.Fatal(n, "messages pending, expected", UDPMaxPending)
+	}
+}
+
+// Messages waiting for those before them take no more than
+// UDPMaxPendingBytes, though the next message in order always gets in
+func TestUDPPendingBytes(t *testing.T) {
+	maxBytes := UDPMaxPendingBytes
+	UDPMaxPendingBytes = 4 * udpFragmentLen
+	defer func() { UDPMaxPendingBytes = maxBytes }()
+	suite := nist.NewAES128SHA256P256()
+	hosts := newTestUDPHosts(t, suite, 2)
+	parent, child := hosts[0], hosts[1]
+	parent.drop = func(to string, d []byte) bool { return true }
+	fragment := func(id uint64, count int) []byte {
+		body := make([]byte, udpDataHeaderLen+1)
+		binary.BigEndian.PutUint64(body[0:], 1)
+		binary.BigEndian.PutUint64(body[8:], parent.run)
+		binary.BigEndian.PutUint64(body[16:], id)
+		binary.BigEndian.PutUint16(body[26:], uint16(count))
+		return body
+	}
+	pending := func() (int, int) {
+		parent.inLock.Lock()
+		defer parent.inLock.Unlock()
+		in := parent.in[child.Name()]
+		return len(in.partial) + len(in.complete), in.bytes
+	}
+
+	parent.received(child.Name(), fragment(2, 3))
+	parent.received(child.Name(), fragment(3, 2))
+	if n, b := pending(); n != 1 || b != 3*udpFragmentLen {
+		t.Fatal(n, "messages pending in", b, "bytes, expected 1 in",
+			3*udpFragmentLen)
+	}
+	parent.received(child.Name(), fragment(1, 5))
+	if n, b := pending(); n != 2 || b != 8*udpFragmentLen {
+		t.Fatal(n, "messages pending in", b, "bytes, expected 2 in",
+			8*udpFragmentLen)
+	}
+
+	// and what is delivered no longer counts
+	parent.received(child.Name(), fragment(4, 1))
+	for i := 1; i < 5; i++ {
+		f := fragment(1, 5)
+		binary.BigEndian.PutUint16(f[24:], uint16(i))
+		parent.received(child.Name(), f)
+	}
+	if n, b := pending(); n != 1 || b != 3*udpFragmentLen {
+		t.Fatal(n, "messages pending in", b, "bytes, expected 1 in",
+			3*udpFragmentLen)
+	}
+}
+
+// Datagrams sent to an earlier run of a host are not taken in by the
+// next one, while what is sent after it restarts gets through
+func TestUDPReceiverRestart(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	hosts := newTestUDPHosts(t, suite, 2)
+	parent, child := hosts[0], hosts[1]
+	defer child.Close()
+	parent.Listen()
+
+	var mu sync.Mutex
+	var recorded [][]byte
+	child.drop = func(to string, d []byte) bool {
+		if d[1] == udpData {
+			mu.Lock()
+			recorded = append(recorded, append([]byte(nil), d...))
+			mu.Unlock()
+		}
+		return false
+	}
+	m := StringMarshaler("once")
+	if err := child.PutTo(context.TODO(), parent.Name(), &m); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, parent, child.Name(), m)
+	parent.Close()
+
+	restarted := NewUDPHost(parent.Name())
+	defer restarted.Close()
+	restarted.SetSuite(suite)
+	priv, keys := parent.keys()
+	restarted.SetPrivKey(priv)
+	restarted.SetPubKey(parent.PubKey())
+	restarted.SetPool(&sync.Pool{New: func() interface{} {
+		return new(StringMarshaler)
+	}})
+	restarted.SetPeerKeys(keys)
+	for try := 0; restarted.Listen() != nil; try++ {
+		if try == 50 {
+			t.Fatal("can't listen again on", parent.Name())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// replaying what the first run took in delivers nothing
+	addr, err := net.ResolveUDPAddr("udp4", parent.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayer.Close()
+	mu.Lock()
+	for _, d := range recorded {
+		replayer.Write(d)
+	}
+	mu.Unlock()
+	select {
+	case nm := <-restarted.Get():
+		t.Fatal("replayed message received from", nm.From)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// while the child starts over with the new run
+	m = "again"
+	if err := child.PutTo(context.TODO(), parent.Name(), &m); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, restarted, child.Name(), m)
+}
@@ -0,0 +1,105 @@
+package coconet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Wire format of the messages sent over a TCPConn.
+// Each message is one frame:
+//
+//	length   uint32, big-endian: number of bytes that follow
+//	version  byte: WireVersion
+//	type     byte: what the payload holds, MsgBinary if unspecified
+//	payload  the message's MarshalBinary output
+//
+// A reader rejects frames of another version, so the format can change
+// without older and newer hosts misreading each other.
+
+// WireVersion is the version of the frame format we speak.
+const WireVersion byte = 1
+
+// MsgBinary is the type of frames holding a message whose type
+// is left to the application.
+const MsgBinary byte = 0
+
+// Bytes in a frame before the payload, length included
+const frameHeaderLen = 6
+
+// MaxFrameLen is the largest payload we send or accept.
+var MaxFrameLen = 16 * 1024 * 1024
+
+var ErrFrameTooLong = errors.New("wire: frame too long")
+
+// A WireVersionError reports a frame sent in another version of the format.
+type WireVersionError byte
+
+func (e WireVersionError) Error() string {
+	return fmt.Sprintf("wire: frame version %d, we speak %d",
+		byte(e), WireVersion)
+}
+
+// A WireTypeError reports a frame holding another type of message
+// than the one it is read into.
+type WireTypeError struct {
+	Got, Want byte
+}
+
+func (e WireTypeError) Error() string {
+	return fmt.Sprintf("wire: frame of type %d, expected %d", e.Got, e.Want)
+}
+
+// A MessageTyper gives the frame type its messages are sent with,
+// and checked against on receipt.
+type MessageTyper interface {
+	MessageType() byte
+}
+
+// MessageType returns the frame type of a message.
+func MessageType(m interface{}) byte {
+	if mt, ok := m.(MessageTyper); ok {
+		return mt.MessageType()
+	}
+	return MsgBinary
+}
+
+// EncodeFrame returns the frame carrying payload as a message of type typ.
+func EncodeFrame(typ byte, payload []byte) ([]byte, error) {
+	if len(payload) > MaxFrameLen {
+		return nil, ErrFrameTooLong
+	}
+	f := make([]byte, frameHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(f, uint32(len(payload)+2))
+	f[4] = WireVersion
+	f[5] = typ
+	copy(f[frameHeaderLen:], payload)
+	return f, nil
+}
+
+// ReadFrame reads one frame, returning its type and payload.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 2 {
+		return 0, nil, errors.New("wire: frame too short")
+	}
+	if n-2 > uint32(MaxFrameLen) {
+		return 0, nil, ErrFrameTooLong
+	}
+	payload := make([]byte, n-2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	if hdr[4] != WireVersion {
+		return 0, nil, WireVersionError(hdr[4])
+	}
+	return hdr[5], payload, nil
+}
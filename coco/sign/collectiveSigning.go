@@ -35,19 +35,35 @@ func (sn *Node) get() error {
 	sn.hbLock.Unlock() */
 
 	// as votes get approved they are streamed in ApplyVotes
-	voteChan := sn.VoteLog.Stream()
+	voteChan := sn.VoteLog.Stream(sn.Clock)
 	sn.ApplyVotes(voteChan)
 
 	// gossip to make sure we are up to date
 	sn.StartGossip()
 
+	// act on lost links before the heartbeat times out
+	go sn.watchLinks()
+
+	// each message comes with a hold of a simulated network's clock,
+	// to let go of once we have acted on it
+	held := false
+	defer func() {
+		if held {
+			sn.Clock.Release()
+		}
+	}()
 	for {
+		if held {
+			sn.Clock.Release()
+			held = false
+		}
 		select {
 		case <-sn.closed:
 			sn.StopHeartbeat()
 			return nil
 		default:
 			nm, ok := <-msgchan
+			held = ok
 			err := nm.Err
 
 			// TODO: graceful shutdown voting
@@ -64,7 +80,21 @@ func (sn *Node) get() error {
 			}
 			// interpret network message as Siging Message
 			//log.Printf("got message: %#v with error %v\n", sm, err)
-			sm := nm.Data.(*SigningMessage)
+			sm, ok := nm.Data.(*SigningMessage)
+			if e, isEnvelope := nm.Data.(*coconet.Envelope); isEnvelope {
+				sm, ok = e.Msg.(*SigningMessage)
+				if !ok {
+					// a message of another protocol on our hosts
+					if sn.OtherFunc != nil {
+						sn.OtherFunc(nm.From, e)
+					}
+					continue
+				}
+			}
+			if !ok {
+				log.Errorln(sn.Name(), "got a message of unknown type from", nm.From)
+				continue
+			}
 			sm.From = nm.From
 			// log.Println(sn.Name(), "received message: ", sm.Type)
 
@@ -178,7 +208,11 @@ func (sn *Node) get() error {
 				}
 				// TODO sanity checks: check if view is == sn.ViewNo
 				if sn.RootFor(sm.View) == sn.Name() {
-					go sn.StartVotingRound(sm.Vrm.Vote)
+					sn.Clock.Hold()
+					go func() {
+						defer sn.Clock.Release()
+						sn.StartVotingRound(sm.Vrm.Vote)
+					}()
 					continue
 				}
 				sn.PutUp(context.TODO(), sm.View, sm)
@@ -508,6 +542,7 @@ func (sn *Node) actOnResponses(view, Round int, exceptionV_hat abstract.Point, e
 
 	// root reports round is done
 	if isroot {
+		sn.Clock.Hold()
 		sn.done <- Round
 	}
 
@@ -532,7 +567,9 @@ func (sn *Node) TryViewChange(view int) error {
 	// take action if new view root
 	if sn.Name() == sn.RootFor(view) {
 		log.Println(sn.Name(), "INITIATING VIEW CHANGE FOR VIEW:", view)
+		sn.Clock.Hold()
 		go func() {
+			defer sn.Clock.Release()
 			err := sn.StartVotingRound(
 				&Vote{
 					View: view,
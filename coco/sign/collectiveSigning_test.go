@@ -14,6 +14,7 @@ import (
 	"github.com/dedis/prifi/coco/coconet"
 	"github.com/dedis/prifi/coco/sign"
 	"github.com/dedis/prifi/coco/test/oldconfig"
+	"golang.org/x/net/context"
 )
 
 // NOTE: when announcing must provide round numbers
@@ -54,6 +55,11 @@ func TestStaticFaulty(t *testing.T) {
 var DefaultView = 0
 
 func runStaticTest(signType sign.Type, RoundsPerView int, faultyNodes ...int) error {
+	return runStaticTestFaults(signType, RoundsPerView, nil, faultyNodes...)
+}
+
+// Run the static tree with its links suffering the given faults, if any
+func runStaticTestFaults(signType sign.Type, RoundsPerView int, faults *coconet.Faults, faultyNodes ...int) error {
 	// Crypto setup
 	suite := nist.NewAES128SHA256P256()
 	rand := suite.Cipher([]byte("example"))
@@ -75,6 +81,9 @@ func runStaticTest(signType sign.Type, RoundsPerView int, faultyNodes ...int) er
 		} else {
 			h[i] = coconet.NewGoHost(hostName, dir)
 		}
+		if faults != nil {
+			h[i] = coconet.NewFaultInjectionHost(h[i], faults)
+		}
 
 	}
 
@@ -131,6 +140,230 @@ func runStaticTest(signType sign.Type, RoundsPerView int, faultyNodes ...int) er
 	return nodes[0].StartAnnouncement(&sign.AnnouncementMessage{LogTest: nodes[0].LogTest, Round: 1})
 }
 
+// Signing still succeeds over slow, reordering links
+func TestStaticFaultInjection(t *testing.T) {
+	faults := coconet.NewFaults(1)
+	faults.SetDefault(coconet.LinkFaults{
+		Delay:   coconet.UniformDelay(0, 50*time.Millisecond),
+		Reorder: 0.2})
+	defer faults.Stop()
+	if err := runStaticTestFaults(sign.MerkleTree, 100, faults); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Signing shares its hosts with another protocol, whose messages are
+// carried in Envelopes of the same Registry
+func TestStaticRegistry(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	rand := suite.Cipher([]byte("example"))
+	r := coconet.NewRegistry()
+	if err := sign.RegisterMessages(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(100, func() coconet.BinaryUnmarshaler { return new(coconet.StringMarshaler) }); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := coconet.NewGoDirectory()
+	h := make([]coconet.Host, 3)
+	nodes := make([]*sign.Node, len(h))
+	others := make(chan string, 10)
+	for i := range h {
+		h[i] = coconet.NewGoHost("host"+strconv.Itoa(i), dir)
+		nodes[i] = sign.NewNode(h[i], suite, rand)
+		nodes[i].Type = sign.MerkleTree
+		nodes[i].Registry = r
+		nodes[i].OtherFunc = func(from string, e *coconet.Envelope) {
+			others <- from + ": " + string(*e.Msg.(*coconet.StringMarshaler))
+		}
+		nodes[i].GenSetPool()
+		h[i].SetPubKey(nodes[i].PubKey)
+		defer nodes[i].Close()
+	}
+	h[1].AddParent(DefaultView, h[0].Name())
+	h[2].AddParent(DefaultView, h[0].Name())
+	h[0].AddChildren(DefaultView, h[1].Name(), h[2].Name())
+	for i := range h {
+		h[i].Listen()
+		h[i].Connect(DefaultView)
+		go nodes[i].Listen()
+	}
+
+	for i := 1; i <= 3; i++ {
+		m := coconet.StringMarshaler("hello " + strconv.Itoa(i))
+		e, err := r.Wrap(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h[i%2+1].PutUp(context.TODO(), DefaultView, e); err != nil {
+			t.Fatal(err)
+		}
+		nodes[0].LogTest = []byte("Hello World" + strconv.Itoa(i))
+		err = nodes[0].StartAnnouncement(&sign.AnnouncementMessage{LogTest: nodes[0].LogTest, Round: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-others:
+			if want := h[i%2+1].Name() + ": " + string(m); got != want {
+				t.Fatal("other protocol got", got, "expected", want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("other protocol got nothing")
+		}
+	}
+}
+
+// Nodes on a simulated network, in a tree of the given branching,
+// listening with the network's clock held
+func simulatedTree(t *testing.T, seed int64, nNodes, branching int) (
+	*coconet.SimNet, []*sign.Node) {
+	suite := nist.NewAES128SHA256P256()
+	rand := suite.Cipher([]byte("example"))
+	net := coconet.NewSimNet(seed)
+	h := make([]*coconet.SimHost, nNodes)
+	nodes := make([]*sign.Node, nNodes)
+	names := make([]string, nNodes)
+	for i := range h {
+		names[i] = "host" + strconv.Itoa(i)
+		h[i] = coconet.NewSimHost(names[i], net)
+		nodes[i] = sign.NewNode(h[i], suite, rand)
+		nodes[i].Type = sign.MerkleTree
+		nodes[i].GenSetPool()
+		nodes[i].Clock = net.Clock
+		h[i].SetPubKey(nodes[i].PubKey)
+	}
+	for i := range h {
+		h[i].SetHostList(DefaultView, names)
+		if i > 0 {
+			parent := (i - 1) / branching
+			h[i].AddParent(DefaultView, h[parent].Name())
+			h[parent].AddChildren(DefaultView, h[i].Name())
+		}
+	}
+	// the test holds the clock between rounds, as StartAnnouncement expects
+	net.Clock.Hold()
+	for i := range h {
+		h[i].Listen()
+		h[i].Connect(DefaultView)
+		go nodes[i].Listen()
+	}
+	net.Start()
+	return net, nodes
+}
+
+// Stop a simulated network and its nodes
+func stopSimulated(net *coconet.SimNet, nodes []*sign.Node) {
+	net.Clock.Release()
+	for _, n := range nodes {
+		n.Close()
+	}
+	net.Stop()
+}
+
+// Run signing rounds from a root, each taking four trips through the tree
+func simulatedRounds(t *testing.T, net *coconet.SimNet, root *sign.Node,
+	first, rounds, depth int) {
+	start := net.Clock.Now()
+	for i := first; i < first+rounds; i++ {
+		root.LogTest = []byte("Hello World" + strconv.Itoa(i))
+		err := root.StartAnnouncement(&sign.AnnouncementMessage{LogTest: root.LogTest, Round: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := time.Duration(rounds*4*depth) * coconet.SimLatency
+	if took := net.Clock.Since(start); took != want {
+		t.Fatal("rounds took", took, "of virtual time, expected", want)
+	}
+}
+
+// A thousand nodes sign on a simulated network, in virtual time:
+// each round takes four trips through the tree and nothing more.
+func TestSimulatedTree(t *testing.T) {
+	net, nodes := simulatedTree(t, 1, 1000, 10)
+	defer stopSimulated(net, nodes)
+	simulatedRounds(t, net, nodes[0], 1, 3, 3)
+}
+
+// Rounds on a network with random latencies, and the messages traced
+func simulatedTrace(t *testing.T, seed int64) []string {
+	net, nodes := simulatedTree(t, seed, 40, 3)
+	defer stopSimulated(net, nodes)
+	net.SetLatency(coconet.UniformDelay(time.Millisecond, 20*time.Millisecond))
+	var trace []string
+	net.Trace = func(at time.Time, from, to string) {
+		trace = append(trace, fmt.Sprint(at.Sub(time.Unix(0, 0)), from, to))
+	}
+	for i := 1; i <= 3; i++ {
+		nodes[0].LogTest = []byte("Hello World" + strconv.Itoa(i))
+		err := nodes[0].StartAnnouncement(&sign.AnnouncementMessage{LogTest: nodes[0].LogTest, Round: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]string(nil), trace...)
+}
+
+// Runs with the same seed deliver the same messages at the same times
+func TestSimulatedTrace(t *testing.T) {
+	trace := simulatedTrace(t, 3)
+	again := simulatedTrace(t, 3)
+	if len(trace) != len(again) {
+		t.Fatal("runs delivered", len(trace), "and", len(again), "messages")
+	}
+	for i := range trace {
+		if trace[i] != again[i] {
+			t.Fatal("runs differ at message", i, ":", trace[i], "and", again[i])
+		}
+	}
+}
+
+// The nodes vote to change the view, and sign in the new tree
+//
+//        0               1
+//     /  |  \         /  |  \
+//    1   2   3   ->  0  4 5 6
+//  ...  ...  ...    / \
+//                  2   3 ...
+func TestSimulatedViewChange(t *testing.T) {
+	net, nodes := simulatedTree(t, 1, 13, 3)
+	defer stopSimulated(net, nodes)
+	roles := make([]chan string, len(nodes))
+	for i, n := range nodes {
+		roles[i] = make(chan string, 1)
+		go func(n *sign.Node, role chan string) {
+			role <- <-n.ViewChangeCh()
+			net.Clock.Release()
+		}(n, roles[i])
+	}
+	simulatedRounds(t, net, nodes[0], 1, 2, 2)
+
+	err := nodes[1].StartVotingRound(&sign.Vote{
+		Type: sign.ViewChangeVT,
+		View: 1,
+		Vcv:  &sign.ViewChangeVote{View: 1, Root: nodes[1].Name()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range nodes {
+		want := "regular"
+		if i == 1 {
+			want = "root"
+		}
+		select {
+		case got := <-roles[i]:
+			if got != want {
+				t.Fatal(nodes[i].Name(), "is", got, "in the new view")
+			}
+		default:
+			t.Fatal(nodes[i].Name(), "did not change view")
+		}
+	}
+	simulatedRounds(t, net, nodes[1], 4, 2, 3)
+}
+
 // Configuration file data/exconf.json
 //       0
 //      / \
@@ -334,6 +567,70 @@ func TestTCPStaticConfig(t *testing.T) {
 	log.Println("Test Done")
 }
 
+func TestTLSStaticConfig(t *testing.T) {
+	// not mixing view changes in
+	RoundsPerView := 100
+	hc, err := oldconfig.LoadConfig("../test/data/extcpconf.json", oldconfig.ConfigOptions{ConnType: "tls", GenHosts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range hc.SNodes {
+		n.RoundsPerView = RoundsPerView
+	}
+	defer func() {
+		for _, n := range hc.SNodes {
+			n.Close()
+		}
+		time.Sleep(1 * time.Second)
+	}()
+
+	err = hc.Run(false, sign.MerkleTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// give it some time to set up
+	time.Sleep(2 * time.Second)
+
+	hc.SNodes[0].LogTest = []byte("hello world")
+	err = hc.SNodes[0].StartAnnouncement(&sign.AnnouncementMessage{LogTest: hc.SNodes[0].LogTest, Round: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPStaticConfig(t *testing.T) {
+	// not mixing view changes in
+	RoundsPerView := 100
+	hc, err := oldconfig.LoadConfig("../test/data/extcpconf.json", oldconfig.ConfigOptions{ConnType: "udp", GenHosts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range hc.SNodes {
+		n.RoundsPerView = RoundsPerView
+	}
+	defer func() {
+		for _, n := range hc.SNodes {
+			n.Close()
+		}
+		time.Sleep(1 * time.Second)
+	}()
+
+	err = hc.Run(false, sign.MerkleTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// give it some time to set up
+	time.Sleep(2 * time.Second)
+
+	hc.SNodes[0].LogTest = []byte("hello world")
+	err = hc.SNodes[0].StartAnnouncement(&sign.AnnouncementMessage{LogTest: hc.SNodes[0].LogTest, Round: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestTCPStaticConfigRounds(t *testing.T) {
 	// not mixing view changes in
 	RoundsPerView := 100
@@ -221,6 +221,7 @@ func (sn *Node) Accepted(view, Round int, sm *SigningMessage) error {
 	// nodes can raise an alarm respond by ack/nack
 
 	if sn.IsRoot(view) {
+		sn.Clock.Hold()
 		sn.done <- Round
 	} else {
 		// create and putup own response message
@@ -7,4 +7,7 @@ import "time"
 var ROUND_TIME time.Duration = 1 * time.Second
 var HEARTBEAT = ROUND_TIME + ROUND_TIME/2
 
+// How long the link to our parent may stay down before we try a view change
+var LINK_GRACE = ROUND_TIME / 2
+
 var GOSSIP_TIME time.Duration = 3 * ROUND_TIME
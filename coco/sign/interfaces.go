@@ -2,6 +2,7 @@ package sign
 
 import (
 	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/prifi/coco/coconet"
 	"github.com/dedis/prifi/coco/hashid"
 	"github.com/dedis/prifi/coco/proof"
 )
@@ -15,6 +16,10 @@ type CommitFunc func(view int) []byte
 // Allows client of Signer to receive signature, proof, and error via RPC
 type DoneFunc func(view int, SNRoot hashid.HashId, LogHash hashid.HashId, p proof.Proof)
 
+// Called with the messages of other protocols sharing the Node's hosts,
+// in the Envelopes they were received in
+type OtherFunc func(from string, e *coconet.Envelope)
+
 // todo: see where Signer should be located
 type Signer interface {
 	Name() string
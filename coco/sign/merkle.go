@@ -11,7 +11,6 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 
-	"github.com/dedis/prifi/coco/coconet"
 	"github.com/dedis/prifi/coco/hashid"
 	"github.com/dedis/prifi/coco/proof"
 )
@@ -118,8 +117,10 @@ func (sn *Node) SendChildrenChallengesProofs(view int, chm *ChallengeMessage) er
 		newChm := *chm
 		newChm.Proof = append(baseProof, round.Proofs[name]...)
 
-		var messg coconet.BinaryMarshaler
-		messg = &SigningMessage{View: view, Type: Challenge, Chm: &newChm}
+		messg, err := sn.wrap(&SigningMessage{View: view, Type: Challenge, Chm: &newChm})
+		if err != nil {
+			return err
+		}
 
 		// send challenge message to child
 		// log.Println("connection: sending children challenge proofs:", name, conn)
@@ -1,7 +1,5 @@
 package sign
 
-import "github.com/dedis/prifi/coco/coconet"
-
 // Functions used in collective signing
 // That are direclty related to the generation/ verification/ sending
 // of the Simple Combined Public Key Signature
@@ -9,8 +7,10 @@ import "github.com/dedis/prifi/coco/coconet"
 // Send children challenges
 func (sn *Node) SendChildrenChallenges(view int, chm *ChallengeMessage) error {
 	for _, child := range sn.Children(view) {
-		var messg coconet.BinaryMarshaler
-		messg = &SigningMessage{View: view, Type: Challenge, Chm: chm}
+		messg, err := sn.wrap(&SigningMessage{View: view, Type: Challenge, Chm: chm})
+		if err != nil {
+			return err
+		}
 
 		// fmt.Println(sn.Name(), "send to", i, child, "on view", view)
 		if err := child.Put(messg); err != nil {
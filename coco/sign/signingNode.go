@@ -69,6 +69,11 @@ type Node struct {
 	CommitFunc CommitFunc
 	DoneFunc   DoneFunc
 
+	// If set, messages are sent in Envelopes of the Registry, so that
+	// other protocols can share the hosts; their messages go to OtherFunc.
+	Registry  *coconet.Registry
+	OtherFunc OtherFunc
+
 	// NOTE: reuse of channels via round-number % Max-Rounds-In-Mermory can be used
 	roundLock sync.RWMutex
 	LogTest   []byte                    // for testing purposes
@@ -81,7 +86,8 @@ type Node struct {
 
 	RoundsPerView int
 	// "root" or "regular" are sent on this channel to
-	// notify the maker of the sn what role sn plays in the new view
+	// notify the maker of the sn what role sn plays in the new view,
+	// each with a hold of the node's Clock for it to release
 	viewChangeCh chan string
 	ChangingView bool // TRUE if node is currently engaged in changing the view
 	viewmu       sync.Mutex
@@ -90,8 +96,12 @@ type Node struct {
 	timeout  time.Duration
 	timeLock sync.RWMutex
 
+	// Clock times heartbeats, gossip and rounds: the wall clock,
+	// or the virtual clock of a simulated network.
+	Clock coconet.Clock
+
 	hbLock    sync.Mutex
-	heartbeat *time.Timer
+	heartbeat coconet.Timer
 
 	// ActionsLock sync.Mutex
 	// Actions     []*VoteRequest
@@ -214,19 +224,31 @@ var MAX_WILLING_TO_WAIT time.Duration = 50 * time.Second
 
 var ChangingViewError error = errors.New("In the process of changing view")
 
+// StartAnnouncement runs a round from the root, and returns once it is
+// done. It is called holding the node's clock, which it lets go of while
+// the round runs: whatever ends the round hands the clock back, so that
+// a simulation stands still between rounds.
 func (sn *Node) StartAnnouncement(am *AnnouncementMessage) error {
 	sn.AnnounceLock.Lock()
 	defer sn.AnnounceLock.Unlock()
 
 	log.Infoln("root", sn.Name(), "starting announcement round for round: ", sn.nRounds, "on view", sn.ViewNo)
 
-	first := time.Now()
-	total := time.Now()
+	first := sn.Clock.Now()
+	total := sn.Clock.Now()
 	var firstRoundTime time.Duration
 	var totalTime time.Duration
 
-	ctx, cancel := context.WithTimeout(context.Background(), MAX_WILLING_TO_WAIT)
-	var cancelederr error
+	// the round times out on the node's clock, so that a simulated
+	// round waits for simulated time and not for the wall clock
+	failed := make(chan error, 1)
+	expired := make(chan struct{})
+	timer := sn.Clock.AfterFunc(MAX_WILLING_TO_WAIT, func() {
+		sn.Clock.Hold()
+		close(expired)
+	})
+	defer timer.Stop()
+	sn.Clock.Hold()
 	go func() {
 		var err error
 		if am.Vote != nil {
@@ -237,25 +259,27 @@ func (sn *Node) StartAnnouncement(am *AnnouncementMessage) error {
 
 		if err != nil {
 			log.Errorln(err)
-			cancelederr = err
-			cancel()
+			failed <- err
+			return
 		}
+		sn.Clock.Release()
 	}()
+	sn.Clock.Release()
 
 	// 1st Phase succeeded or connection error
 	select {
 	case _ = <-sn.commitsDone:
 		// log time it took for first round to complete
-		firstRoundTime = time.Since(first)
+		firstRoundTime = sn.Clock.Since(first)
 		sn.logFirstPhase(firstRoundTime)
 		break
 	case <-sn.closed:
+		sn.Clock.Hold()
 		return errors.New("closed")
-	case <-ctx.Done():
-		log.Errorln(ctx.Err())
-		if ctx.Err() == context.Canceled {
-			return cancelederr
-		}
+	case err := <-failed:
+		return err
+	case <-expired:
+		log.Errorln("round timed out")
 		return errors.New("Really bad. Round did not finish commit phase and did not report network errors.")
 	}
 
@@ -263,17 +287,17 @@ func (sn *Node) StartAnnouncement(am *AnnouncementMessage) error {
 	select {
 	case _ = <-sn.done:
 		// log time it took for second round to complete
-		totalTime = time.Since(total)
+		totalTime = sn.Clock.Since(total)
 		sn.logSecondPhase(totalTime - firstRoundTime)
 		sn.logTotalTime(totalTime)
 		return nil
 	case <-sn.closed:
+		sn.Clock.Hold()
 		return errors.New("closed")
-	case <-ctx.Done():
-		log.Errorln(ctx.Err())
-		if ctx.Err() == context.Canceled {
-			return cancelederr
-		}
+	case err := <-failed:
+		return err
+	case <-expired:
+		log.Errorln("round timed out")
 		return errors.New("Really bad. Round did not finish response phase and did not report network errors.")
 	}
 }
@@ -350,6 +374,7 @@ func NewNode(hn coconet.Host, suite abstract.Suite, random cipher.Stream) *Node
 	sn.VoteLog = NewVoteLog()
 	sn.Actions = make(map[int][]*Vote)
 	sn.RoundsPerView = 100
+	sn.Clock = coconet.RealClock
 	return sn
 }
 
@@ -375,6 +400,7 @@ func NewKeyedNode(hn coconet.Host, suite abstract.Suite, PrivKey abstract.Secret
 	sn.VoteLog = NewVoteLog()
 	sn.Actions = make(map[int][]*Vote)
 	sn.RoundsPerView = 100
+	sn.Clock = coconet.RealClock
 	return sn
 }
 
@@ -516,11 +542,64 @@ func (sn *Node) SetBackLink(Round int) {
 }
 
 func (sn *Node) GenSetPool() {
+	if sn.Registry != nil {
+		sn.SetPool(sn.Registry.Pool())
+		return
+	}
 	var p sync.Pool
 	p.New = NewSigningMessage
 	sn.SetPool(&p)
 }
 
+// RegisterMessages registers SigningMessages in the Registry.
+func RegisterMessages(r *coconet.Registry) error {
+	return r.Register(coconet.SigningMessageID, func() coconet.BinaryUnmarshaler {
+		return &SigningMessage{}
+	})
+}
+
+// Put a message in an Envelope of the node's Registry, if it has one
+func (sn *Node) wrap(m coconet.BinaryMarshaler) (coconet.BinaryMarshaler, error) {
+	if sn.Registry == nil {
+		return m, nil
+	}
+	return sn.Registry.Wrap(m)
+}
+
+// PutUp puts a message up to the parent, in an Envelope if the node
+// has a Registry.
+func (sn *Node) PutUp(ctx context.Context, view int, data coconet.BinaryMarshaler) error {
+	m, err := sn.wrap(data)
+	if err != nil {
+		return err
+	}
+	return sn.Host.PutUp(ctx, view, m)
+}
+
+// PutDown puts messages down to the children, in Envelopes if the node
+// has a Registry.
+func (sn *Node) PutDown(ctx context.Context, view int, data []coconet.BinaryMarshaler) error {
+	ms := make([]coconet.BinaryMarshaler, len(data))
+	for i := range data {
+		m, err := sn.wrap(data[i])
+		if err != nil {
+			return err
+		}
+		ms[i] = m
+	}
+	return sn.Host.PutDown(ctx, view, ms)
+}
+
+// PutTo puts a message to a peer, in an Envelope if the node
+// has a Registry.
+func (sn *Node) PutTo(ctx context.Context, host string, data coconet.BinaryMarshaler) error {
+	m, err := sn.wrap(data)
+	if err != nil {
+		return err
+	}
+	return sn.Host.PutTo(ctx, host, m)
+}
+
 func (sn *Node) SetTimeout(t time.Duration) {
 	sn.timeLock.Lock()
 	sn.timeout = t
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"strconv"
 	"sync/atomic"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/dedis/crypto/abstract"
@@ -58,7 +57,7 @@ func (sn *Node) ReceivedHeartbeat(view int) {
 	// hearbeat is nil if we have sust close the signing node
 	if sn.heartbeat != nil {
 		sn.heartbeat.Stop()
-		sn.heartbeat = time.AfterFunc(HEARTBEAT, func() {
+		sn.heartbeat = sn.Clock.AfterFunc(HEARTBEAT, func() {
 			log.Println(sn.Name(), "NO HEARTBEAT - try view change:", view)
 			sn.TryViewChange(view + 1)
 		})
@@ -67,6 +66,40 @@ func (sn *Node) ReceivedHeartbeat(view int) {
 
 }
 
+// Watch the host's links: if the one to our parent goes down and is not
+// back up within LINK_GRACE, try a view change without waiting for the
+// heartbeat to time out.
+func (sn *Node) watchLinks() {
+	states := sn.Host.StateChanges()
+	var grace coconet.Timer
+	for {
+		select {
+		case <-sn.closed:
+			if grace != nil {
+				grace.Stop()
+			}
+			return
+		case sc := <-states:
+			sn.viewmu.Lock()
+			view := sn.ViewNo
+			sn.viewmu.Unlock()
+			if sc.Peer != sn.Parent(view) {
+				continue
+			}
+			if grace != nil {
+				grace.Stop()
+				grace = nil
+			}
+			if sc.State == coconet.LinkDown {
+				grace = sn.Clock.AfterFunc(LINK_GRACE, func() {
+					log.Println(sn.Name(), "LOST PARENT - try view change:", view)
+					sn.TryViewChange(view + 1)
+				})
+			}
+		}
+	}
+}
+
 func (sn *Node) TryRootFailure(view, Round int) bool {
 	if sn.IsRoot(view) && sn.FailAsRootEvery != 0 {
 		if sn.RoundsAsRoot != 0 && sn.RoundsAsRoot%sn.FailAsRootEvery == 0 {
@@ -9,6 +9,7 @@ func (sn *Node) ChangeView(vcv *ViewChangeVote) {
 	sn.viewmu.Lock()
 	sn.ViewNo = vcv.View
 	sn.viewmu.Unlock()
+	sn.Clock.Hold()
 	if sn.RootFor(vcv.View) == sn.Name() {
 		log.Println(sn.Name(), "CHANGE VIEW TO ROOT", "children", sn.Children(vcv.View))
 		sn.viewChangeCh <- "root"
@@ -2,7 +2,6 @@ package sign
 
 import (
 	"sync/atomic"
-	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"golang.org/x/net/context"
@@ -15,6 +14,7 @@ func (sn *Node) ApplyVotes(ch chan *Vote) {
 				sn.RoundTypes[v.Round] = RoundType(v.Type)
 			}
 			sn.ApplyVote(v)
+			sn.Clock.Release()
 		}
 	}()
 }
@@ -137,28 +137,32 @@ func (sn *Node) CatchUp(vi int, from string) {
 			Cureq: &CatchUpRequest{Index: vi}})
 }
 
+// StartGossip asks a random peer for the vote after our last one
+// every GOSSIP_TIME, until the node is closed.
 func (sn *Node) StartGossip() {
-	go func() {
-		t := time.Tick(GOSSIP_TIME)
-		for {
-			select {
-			case <-t:
-				sn.viewmu.Lock()
-				c := sn.HostListOn(sn.ViewNo)
-				sn.viewmu.Unlock()
-				if len(c) == 0 {
-					log.Errorln(sn.Name(), "StartGossip: none in hostlist for view: ", sn.ViewNo, len(c))
-					continue
-				}
-				sn.randmu.Lock()
-				from := c[sn.Rand.Int()%len(c)]
-				sn.randmu.Unlock()
-				log.Errorln("Gossiping with: ", from)
-				sn.CatchUp(int(atomic.LoadInt64(&sn.LastAppliedVote)+1), from)
-			case <-sn.closed:
-				log.Warnln("stopping gossip: closed")
-				return
-			}
+	// the gossip runs on the node's clock, as a timer calling itself
+	// again: a simulated network then runs it among its own events
+	var gossip func()
+	gossip = func() {
+		select {
+		case <-sn.closed:
+			log.Warnln("stopping gossip: closed")
+			return
+		default:
 		}
-	}()
+		sn.Clock.AfterFunc(GOSSIP_TIME, gossip)
+		sn.viewmu.Lock()
+		c := sn.HostListOn(sn.ViewNo)
+		sn.viewmu.Unlock()
+		if len(c) == 0 {
+			log.Errorln(sn.Name(), "StartGossip: none in hostlist for view: ", sn.ViewNo, len(c))
+			return
+		}
+		sn.randmu.Lock()
+		from := c[sn.Rand.Int()%len(c)]
+		sn.randmu.Unlock()
+		log.Errorln("Gossiping with: ", from)
+		sn.CatchUp(int(atomic.LoadInt64(&sn.LastAppliedVote)+1), from)
+	}
+	sn.Clock.AfterFunc(GOSSIP_TIME, gossip)
 }
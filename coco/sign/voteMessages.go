@@ -3,11 +3,12 @@ package sign
 import (
 	"reflect"
 	"sync"
-	"time"
 
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/nist"
 	"github.com/dedis/protobuf"
+
+	"github.com/dedis/prifi/coco/coconet"
 )
 
 type VoteType int
@@ -109,6 +110,12 @@ type VoteLog struct {
 	Last    int // last set entry
 
 	mu sync.Mutex
+
+	// Streaming: each vote is handed on with a hold of the clock,
+	// taken once it and all before it are in the log
+	added *sync.Cond // signalled as votes are put
+	clock coconet.Clock
+	held  int // last vote the clock was held for
 }
 
 func (vl *VoteLog) Put(index int, v *Vote) {
@@ -122,6 +129,18 @@ func (vl *VoteLog) Put(index int, v *Vote) {
 	vl.Entries[index] = v
 
 	vl.Last = max(vl.Last, index)
+	if vl.added != nil {
+		vl.holdStreamed()
+		vl.added.Broadcast()
+	}
+}
+
+// Hold the clock for the votes the stream can now hand on, with vl.mu held
+func (vl *VoteLog) holdStreamed() {
+	for vl.Get(vl.held+1) != nil {
+		vl.held++
+		vl.clock.Hold()
+	}
 }
 
 func (vl *VoteLog) Get(index int) *Vote {
@@ -136,21 +155,28 @@ func NewVoteLog() *VoteLog {
 	return &VoteLog{Last: -1}
 }
 
-func (vl *VoteLog) Stream() chan *Vote {
+// Stream hands on the votes of the log in order, as they are put in it.
+// Each comes with a hold of the clock, to be released once it is applied.
+func (vl *VoteLog) Stream(clock coconet.Clock) chan *Vote {
 	ch := make(chan *Vote, 0)
+	vl.mu.Lock()
+	vl.added = sync.NewCond(&vl.mu)
+	vl.clock = clock
+	vl.holdStreamed()
+	vl.mu.Unlock()
 	go func() {
 
 		i := 1
 		for {
 			vl.mu.Lock()
 			v := vl.Get(i)
-			vl.mu.Unlock()
-			if v != nil {
-				ch <- v
-				i++
-			} else {
-				time.Sleep(500 * time.Millisecond)
+			for v == nil {
+				vl.added.Wait()
+				v = vl.Get(i)
 			}
+			vl.mu.Unlock()
+			ch <- v
+			i++
 		}
 	}()
 	return ch
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 
+	"github.com/dedis/prifi/coco/coconet"
 	"github.com/dedis/prifi/coco/hashid"
 	"github.com/dedis/prifi/coco/proof"
 )
@@ -122,6 +123,13 @@ func (sm *TimeStampMessage) UnmarshalBinary(data []byte) error {
 	return err
 }
 
+// RegisterMessages registers TimeStampMessages in the Registry.
+func RegisterMessages(r *coconet.Registry) error {
+	return r.Register(coconet.TimeStampMessageID, func() coconet.BinaryUnmarshaler {
+		return &TimeStampMessage{}
+	})
+}
+
 func (Sreq StampRequest) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	enc := gob.NewEncoder(&b)
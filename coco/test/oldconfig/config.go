@@ -32,6 +32,8 @@ file format: json
 conn: indicates what protocol should be used
 	by default it uses the "tcp" protocol
 	"tcp": uses TcpConn for communications
+	"tls": uses TLSConn for communications
+	"udp": uses UDPHost datagrams for communications
 	"goroutine": uses GoConn for communications [default]
 
 ex.json
@@ -166,6 +168,8 @@ type ConnType int
 const (
 	GoC ConnType = iota
 	TcpC
+	TlsC
+	UdpC
 )
 
 func max(a, b int) int {
@@ -338,7 +342,7 @@ func GetAddress() (string, error) {
 var StartConfigPort = 9000
 
 type ConfigOptions struct {
-	ConnType  string         // "go", tcp"
+	ConnType  string         // "go", "tcp", "tls"
 	Hostnames []string       // if not nil replace hostnames with these
 	GenHosts  bool           // if true generate random hostnames (all tcp)
 	Host      string         // hostname to load into memory: "" for all
@@ -365,11 +369,20 @@ func LoadJSON(file []byte, optsSlice ...ConfigOptions) (*HostConfig, error) {
 	connT := GoC
 	if cf.Conn == "tcp" {
 		connT = TcpC
+	} else if cf.Conn == "tls" {
+		connT = TlsC
+	} else if cf.Conn == "udp" {
+		connT = UdpC
 	}
 
-	// options override file
-	if opts.ConnType == "tcp" {
+	// options override file,
+	// except that asking for tcp keeps tls as it runs over tcp
+	if opts.ConnType == "tcp" && connT != TlsC {
 		connT = TcpC
+	} else if opts.ConnType == "tls" {
+		connT = TlsC
+	} else if opts.ConnType == "udp" {
+		connT = UdpC
 	}
 
 	dir := hc.Dir
@@ -390,7 +403,7 @@ func LoadJSON(file []byte, optsSlice ...ConfigOptions) (*HostConfig, error) {
 			}
 		}
 
-	} else if connT == TcpC {
+	} else if connT == TcpC || connT == TlsC || connT == UdpC {
 		localAddr := ""
 
 		if opts.GenHosts {
@@ -426,12 +439,16 @@ func LoadJSON(file []byte, optsSlice ...ConfigOptions) (*HostConfig, error) {
 			if _, ok := hc.Hosts[addr]; !ok {
 				// only create the tcp hosts requested
 				if opts.Host == "" || opts.Host == addr {
+					var host coconet.Host = coconet.NewTCPHost(addr)
+					if connT == TlsC {
+						host = coconet.NewTLSHost(addr)
+					} else if connT == UdpC {
+						host = coconet.NewUDPHost(addr)
+					}
 					if opts.Faulty == true {
-						tcpHost := coconet.NewTCPHost(addr)
-						hosts[addr] = coconet.NewFaultyHost(tcpHost)
-					} else {
-						hosts[addr] = coconet.NewTCPHost(addr)
+						host = coconet.NewFaultyHost(host)
 					}
+					hosts[addr] = host
 				} else {
 					hosts[addr] = nil // it is there but not backed
 				}
@@ -448,6 +465,9 @@ func LoadJSON(file []byte, optsSlice ...ConfigOptions) (*HostConfig, error) {
 	if connT != GoC {
 		hc.Dir = nil
 	}
+	if err == nil && connT != GoC {
+		err = setHandshakeKeys(cf.Tree, hc, suite, nameToAddr)
+	}
 
 	log.Println("IN LOAD JSON")
 	// add a hostlist to each of the signing nodes
@@ -468,6 +488,70 @@ func LoadJSON(file []byte, optsSlice ...ConfigOptions) (*HostConfig, error) {
 	return hc, err
 }
 
+// Hosts authenticating their peers against the tree's keys
+type keyedHost interface {
+	SetPrivKey(abstract.Secret)
+	SetPeerKeys(map[string]abstract.Point)
+}
+
+// Collect the public key of every host in the tree, by address.
+// Returns false if some host's key is neither in the configuration
+// file nor generated here.
+func treeKeys(n *Node, hc *HostConfig, suite abstract.Suite,
+	nameToAddr map[string]string, keys map[string]abstract.Point) (bool, error) {
+
+	addr := nameToAddr[n.Name]
+	if sn, ok := hc.Hosts[addr]; ok {
+		keys[addr] = sn.PubKey
+	} else if len(n.PubKey) != 0 {
+		encoded, err := hex.DecodeString(n.PubKey)
+		if err != nil {
+			return false, err
+		}
+		pubkey := suite.Point()
+		if err := pubkey.UnmarshalBinary(encoded); err != nil {
+			return false, err
+		}
+		keys[addr] = pubkey
+	} else {
+		return false, nil
+	}
+	for _, c := range n.Children {
+		ok, err := treeKeys(c, hc, suite, nameToAddr, keys)
+		if !ok || err != nil {
+			return ok, err
+		}
+	}
+	return true, nil
+}
+
+// Give each TCP, TLS or UDP host the private key it authenticates with,
+// and the public keys it expects its peers to prove.
+// Every key of the tree must be known, or no peer could be checked.
+func setHandshakeKeys(tree *Node, hc *HostConfig, suite abstract.Suite,
+	nameToAddr map[string]string) error {
+
+	keys := make(map[string]abstract.Point)
+	ok, err := treeKeys(tree, hc, suite, nameToAddr, keys)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("hosts need every public key of the tree")
+	}
+	for _, sn := range hc.SNodes {
+		h := sn.Host
+		if fh, ok := h.(*coconet.FaultyHost); ok {
+			h = fh.Host
+		}
+		if kh, ok := h.(keyedHost); ok {
+			kh.SetPrivKey(sn.PrivKey)
+			kh.SetPeerKeys(keys)
+		}
+	}
+	return nil
+}
+
 // run the given hostnames
 func (hc *HostConfig) Run(stamper bool, signType sign.Type, hostnameSlice ...string) error {
 	hostnames := make(map[string]*sign.Node)
@@ -24,6 +24,17 @@ func TestPubKeysConfig(t *testing.T) {
 	// }
 }
 
+func TestPubKeysMissing(t *testing.T) {
+	// Only host0 is run here, and no other host's key is configured
+	for _, connType := range []string{"tcp", "tls", "udp"} {
+		_, err := LoadConfig("../data/exconf.json",
+			ConfigOptions{ConnType: connType, Host: "host0"})
+		if err == nil {
+			t.Fatal(connType, "hosts run without their peers' keys")
+		}
+	}
+}
+
 func TestPubKeysOneNode(t *testing.T) {
 	// has hosts 8089 - 9094 @ 172.27.187.80
 	done := make(chan bool)
@@ -2,7 +2,7 @@ package connMan
 
 import (
 	"github.com/dedis/crypto/abstract"
-	"github.com/dedis/prifi/coconet"
+	"github.com/dedis/prifi/coco/coconet"
 )
 
 /* This class serves as the connection manager for the GoConn connection
@@ -19,17 +19,6 @@ type ChanConnManager struct {
 	pubKey abstract.Point
 }
 
-// TODO: Prototypes to consider for the future
-//
-//type ConnManager struct {
-//	peerMap map[string]coconet.Conn
-//}
-
-//func (cm *ConnManager) AddConn(top abstract.Point, conn coconet.Conn) {
-//	to := top.String()
-//	peerMap[to] = conn
-//}
-
 /* Initializes a new ChanConnManager
  *
  * Arguments:
@@ -81,10 +70,15 @@ func (gcm *ChanConnManager) GetDir() *coconet.GoDirectory {
  * 	data = the message to send
  *
  * Returns:
- * 	An error denoting whether the put was successfull
+ * 	An error denoting whether the put was successfull, ErrUnknownPeer if
+ * 	there is no connection to the peer.
  */
 func (gcm *ChanConnManager) Put(p abstract.Point, data coconet.BinaryMarshaler) error {
-	return gcm.peerMap[p.String()].Put(data)
+	conn, ok := gcm.peerMap[p.String()]
+	if !ok {
+		return ErrUnknownPeer
+	}
+	return conn.Put(data)
 }
 
 /* Get a message from a given peer.
@@ -94,8 +88,13 @@ func (gcm *ChanConnManager) Put(p abstract.Point, data coconet.BinaryMarshaler)
  *	 bum = a buffer for receiving the message
  *
  * Returns:
- *	An error denoting whether the get to the buffer was successfull
+ *	An error denoting whether the get to the buffer was successfull,
+ *	ErrUnknownPeer if there is no connection to the peer.
  */
-func (gcm ChanConnManager) Get(p abstract.Point, bum coconet.BinaryUnmarshaler) error {
-	return gcm.peerMap[p.String()].Get(bum)
+func (gcm *ChanConnManager) Get(p abstract.Point, bum coconet.BinaryUnmarshaler) error {
+	conn, ok := gcm.peerMap[p.String()]
+	if !ok {
+		return ErrUnknownPeer
+	}
+	return conn.Get(bum)
 }
@@ -0,0 +1,162 @@
+package connMan
+
+import (
+	"sync"
+
+	"github.com/dedis/crypto/abstract"
+	"golang.org/x/net/context"
+
+	"github.com/dedis/prifi/coco/coconet"
+)
+
+/* This class serves as the connection manager over any coconet.Host,
+ * sending to and getting from each peer by the host name the directory
+ * gives for its key. Messages got from a key are only known to be sent
+ * by its owner if the host authenticates its peers, as a TCPHost with
+ * peer keys does.
+ */
+type HostConnManager struct {
+	host coconet.Host
+	dir  *AddrDirectory
+
+	// Messages received, by name of their sender
+	lock  sync.Mutex
+	inbox map[string]*coconet.RecvQueue
+
+	// Closed when the manager is
+	done  chan struct{}
+	close sync.Once
+}
+
+// The messages received, unmarshaled by Get into the caller's buffer
+type rawMessage []byte
+
+func (m *rawMessage) UnmarshalBinary(data []byte) error {
+	*m = data
+	return nil
+}
+
+/* Initializes a new HostConnManager and starts sorting what the host
+ * receives by sender. The host is given the manager's pool, and is to
+ * be closed by closing the manager.
+ *
+ * Arguments:
+ * 	host = the host to send and receive over
+ * 	dir = the host names of the servers, by key
+ *
+ * Returns:
+ * 	The initialized HostConnManager
+ */
+func (hcm *HostConnManager) Init(host coconet.Host, dir *AddrDirectory) *HostConnManager {
+	hcm.host = host
+	hcm.dir = dir
+	hcm.inbox = make(map[string]*coconet.RecvQueue)
+	hcm.done = make(chan struct{})
+	host.SetPool(&sync.Pool{New: func() interface{} {
+		return new(rawMessage)
+	}})
+	go hcm.dispatch()
+	return hcm
+}
+
+// Returns the host the manager sends and receives over.
+func (hcm *HostConnManager) Host() coconet.Host {
+	return hcm.host
+}
+
+// Returns the queue of messages received from a peer, by address.
+func (hcm *HostConnManager) peerInbox(addr string) *coconet.RecvQueue {
+	hcm.lock.Lock()
+	defer hcm.lock.Unlock()
+	in, ok := hcm.inbox[addr]
+	if !ok {
+		in = coconet.NewRecvQueue(coconet.DefaultQueueLimit,
+			coconet.DropNewest)
+		hcm.inbox[addr] = in
+	}
+	return in
+}
+
+// Sorts the messages the host receives by sender, until it is closed.
+// It never waits on a sender's queue: once a queue is full, what its
+// sender sends is dropped until its messages are got, and the other
+// senders are not held up.
+func (hcm *HostConnManager) dispatch() {
+	for {
+		select {
+		case nm := <-hcm.host.Get():
+			hcm.peerInbox(nm.From).Put(nm)
+		case <-hcm.done:
+			return
+		}
+	}
+}
+
+/* Put a message to a given peer, connecting to it first if need be.
+ *
+ * Arguments:
+ * 	p = the public key of the destination
+ * 	data = the message to send
+ *
+ * Returns:
+ * 	An error denoting whether the put was successfull, ErrUnknownPeer if
+ * 	the peer has no address in the directory.
+ */
+func (hcm *HostConnManager) Put(p abstract.Point, data coconet.BinaryMarshaler) error {
+	addr, ok := hcm.dir.Addr(p)
+	if !ok {
+		return ErrUnknownPeer
+	}
+	if err := hcm.host.ConnectTo(addr); err != nil {
+		return err
+	}
+	return hcm.host.PutTo(context.TODO(), addr, data)
+}
+
+/* Get a message from a given peer, waiting for one to arrive.
+ *
+ * Arguments:
+ *	 p = the public key of the origin
+ *	 bum = a buffer for receiving the message
+ *
+ * Returns:
+ *	An error denoting whether the get to the buffer was successfull,
+ *	ErrUnknownPeer if the peer has no address in the directory.
+ */
+func (hcm *HostConnManager) Get(p abstract.Point, bum coconet.BinaryUnmarshaler) error {
+	addr, ok := hcm.dir.Addr(p)
+	if !ok {
+		return ErrUnknownPeer
+	}
+	select {
+	case <-hcm.done:
+		return coconet.ErrClosed
+	default:
+	}
+	select {
+	case nm, ok := <-hcm.peerInbox(addr).Get():
+		if !ok {
+			return coconet.ErrClosed
+		}
+		if nm.Err != nil {
+			return nm.Err
+		}
+		return bum.UnmarshalBinary(*nm.Data.(*rawMessage))
+	case <-hcm.done:
+		return coconet.ErrClosed
+	}
+}
+
+// Closes the connections of the manager. Gets waiting return ErrClosed.
+// Closing it again does nothing.
+func (hcm *HostConnManager) Close() {
+	hcm.close.Do(func() {
+		hcm.host.Close()
+		close(hcm.done)
+		hcm.lock.Lock()
+		for _, in := range hcm.inbox {
+			in.Close()
+		}
+		hcm.lock.Unlock()
+	})
+}
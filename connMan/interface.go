@@ -1,13 +1,19 @@
 package connMan
 
 import (
+	"errors"
+
 	"github.com/dedis/crypto/abstract"
-	"github.com/dedis/prifi/coconet"
+	"github.com/dedis/prifi/coco/coconet"
 )
 
 /* The ConnManager is responsible for managing multiple connections. It allows
  * servers to send/receive messages to other servers by specifying the public
  * key of the desired server.
+ *
+ * ChanConnManager implements it over go channels, for testing,
+ * HostConnManager over any coconet.Host, and TCPConnManager over a
+ * coconet.TCPHost.
  */
 type ConnManager interface {
 	// Sends a message to a specific peer.
@@ -16,3 +22,7 @@ type ConnManager interface {
 	// Receive a message from the desired peer.
 	Get(abstract.Point, coconet.BinaryUnmarshaler) error
 }
+
+// ErrUnknownPeer is returned when putting to or getting from a peer the
+// manager has no connection to, or no address for.
+var ErrUnknownPeer = errors.New("connMan: unknown peer")
@@ -0,0 +1,96 @@
+package connMan
+
+import (
+	"sync"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
+
+	"github.com/dedis/prifi/coco/coconet"
+)
+
+/* An AddrDirectory maps the public keys of servers to the TCP addresses
+ * they listen on, or to their host names on other networks.
+ */
+type AddrDirectory struct {
+	lock  sync.RWMutex
+	addrs map[string]string
+	// The public keys, by address
+	keys map[string]abstract.Point
+}
+
+// Initializes a new, empty, AddrDirectory.
+func (ad *AddrDirectory) Init() *AddrDirectory {
+	ad.addrs = make(map[string]string)
+	ad.keys = make(map[string]abstract.Point)
+	return ad
+}
+
+// Adds the address of the server with the given public key.
+func (ad *AddrDirectory) Add(key abstract.Point, addr string) {
+	ad.lock.Lock()
+	ad.addrs[key.String()] = addr
+	ad.keys[addr] = key
+	ad.lock.Unlock()
+}
+
+// Returns the address of the server with the given public key.
+func (ad *AddrDirectory) Addr(key abstract.Point) (string, bool) {
+	ad.lock.RLock()
+	addr, ok := ad.addrs[key.String()]
+	ad.lock.RUnlock()
+	return addr, ok
+}
+
+// Returns the public keys of the servers, by address.
+func (ad *AddrDirectory) Keys() map[string]abstract.Point {
+	ad.lock.RLock()
+	defer ad.lock.RUnlock()
+	keys := make(map[string]abstract.Point, len(ad.keys))
+	for addr, key := range ad.keys {
+		keys[addr] = key
+	}
+	return keys
+}
+
+/* This class serves as the connection manager over TCP. It wraps a
+ * coconet.TCPHost named after the address its owner listens on, dialing
+ * peers on their first Put at the address the directory gives for their
+ * key. The host's handshake checks each peer proves the key the
+ * directory gives for its address, so messages got from a key were sent
+ * by its owner.
+ *
+ * The directory is read when the manager is initialized: servers added
+ * later are unknown to it.
+ */
+type TCPConnManager struct {
+	HostConnManager
+}
+
+/* Initializes a new TCPConnManager and starts listening.
+ *
+ * Arguments:
+ * 	kp = the key pair of the owner of this manager
+ * 	dir = the addresses of the servers, the owner's included
+ *
+ * Returns:
+ * 	The initialized TCPConnManager, and an error if the owner has no
+ * 	address in the directory or listening on it failed.
+ */
+func (tcm *TCPConnManager) Init(kp *config.KeyPair, dir *AddrDirectory) (*TCPConnManager, error) {
+	addr, ok := dir.Addr(kp.Public)
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	host := coconet.NewTCPHost(addr)
+	host.SetSuite(kp.Suite)
+	host.SetPubKey(kp.Public)
+	host.SetPrivKey(kp.Secret)
+	host.SetPeerKeys(dir.Keys())
+	tcm.HostConnManager.Init(host, dir)
+	if err := host.Listen(); err != nil {
+		tcm.Close()
+		return nil, err
+	}
+	return tcm, nil
+}
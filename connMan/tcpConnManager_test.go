@@ -0,0 +1,191 @@
+package connMan
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+
+	"github.com/dedis/prifi/coco/coconet"
+)
+
+// Pick a free local address for a manager to listen on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestTCPConnManager(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	dir := new(AddrDirectory).Init()
+	keys := make([]*config.KeyPair, 3)
+	for i := range keys {
+		keys[i] = new(config.KeyPair)
+		keys[i].Gen(suite, random.Stream)
+		dir.Add(keys[i].Public, freeAddr(t))
+	}
+	managers := make([]*TCPConnManager, len(keys))
+	for i, kp := range keys {
+		var err error
+		managers[i], err = new(TCPConnManager).Init(kp, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer managers[i].Close()
+	}
+	var cm ConnManager = managers[0]
+
+	// messages are got from the key they were put from
+	one, two := coconet.StringMarshaler("one"), coconet.StringMarshaler("two")
+	if err := managers[1].Put(keys[0].Public, &one); err != nil {
+		t.Fatal(err)
+	}
+	if err := managers[2].Put(keys[0].Public, &two); err != nil {
+		t.Fatal(err)
+	}
+	var got coconet.StringMarshaler
+	if err := cm.Get(keys[2].Public, &got); err != nil || got != two {
+		t.Fatal("got", got, err, "expected", two)
+	}
+	if err := cm.Get(keys[1].Public, &got); err != nil || got != one {
+		t.Fatal("got", got, err, "expected", one)
+	}
+
+	// and answered over the connection they came on
+	if err := cm.Put(keys[1].Public, &two); err != nil {
+		t.Fatal(err)
+	}
+	if err := managers[1].Get(keys[0].Public, &got); err != nil || got != two {
+		t.Fatal("got", got, err, "expected", two)
+	}
+
+	// Peers without an address are errors, not panics
+	stranger := new(config.KeyPair)
+	stranger.Gen(suite, random.Stream)
+	if err := cm.Put(stranger.Public, &one); err != ErrUnknownPeer {
+		t.Fatal("put to an unknown peer:", err)
+	}
+	if err := cm.Get(stranger.Public, &got); err != ErrUnknownPeer {
+		t.Fatal("got from an unknown peer:", err)
+	}
+	if _, err := new(TCPConnManager).Init(stranger, dir); err != ErrUnknownPeer {
+		t.Fatal("initialized a manager without an address:", err)
+	}
+
+	chan1 := new(ChanConnManager).Init(keys[0].Public, nil)
+	if err := chan1.Put(stranger.Public, &one); err != ErrUnknownPeer {
+		t.Fatal("put to an unknown peer:", err)
+	}
+	if err := chan1.Get(stranger.Public, &got); err != ErrUnknownPeer {
+		t.Fatal("got from an unknown peer:", err)
+	}
+}
+
+// Two managers putting to each other at once end up sharing one link,
+// and lose no message on the one they drop
+func TestTCPConnManagerMutualPut(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	for try := 0; try < 5; try++ {
+		dir := new(AddrDirectory).Init()
+		keys := make([]*config.KeyPair, 2)
+		for i := range keys {
+			keys[i] = new(config.KeyPair)
+			keys[i].Gen(suite, random.Stream)
+			dir.Add(keys[i].Public, freeAddr(t))
+		}
+		managers := make([]*TCPConnManager, len(keys))
+		for i, kp := range keys {
+			var err error
+			managers[i], err = new(TCPConnManager).Init(kp, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer managers[i].Close()
+		}
+
+		const n = 10
+		errs := make(chan error, 2*n)
+		for i := range managers {
+			for j := 0; j < n; j++ {
+				go func(from, to int) {
+					m := coconet.StringMarshaler("hello")
+					errs <- managers[from].Put(keys[to].Public, &m)
+				}(i, 1-i)
+			}
+		}
+		for i := 0; i < 2*n; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range managers {
+			for j := 0; j < n; j++ {
+				var got coconet.StringMarshaler
+				if err := managers[i].Get(keys[1-i].Public, &got); err != nil || got != "hello" {
+					t.Fatal("got", got, err, "expected hello")
+				}
+			}
+		}
+
+		// the link left works both ways
+		for i := range managers {
+			m := coconet.StringMarshaler("again")
+			if err := managers[i].Put(keys[1-i].Public, &m); err != nil {
+				t.Fatal(err)
+			}
+			var got coconet.StringMarshaler
+			if err := managers[1-i].Get(keys[i].Public, &got); err != nil || got != m {
+				t.Fatal("got", got, err, "expected", m)
+			}
+		}
+	}
+}
+
+// A peer whose messages are not got holds up no other peer, and
+// closing a manager twice is harmless
+func TestTCPConnManagerFlood(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	dir := new(AddrDirectory).Init()
+	keys := make([]*config.KeyPair, 3)
+	for i := range keys {
+		keys[i] = new(config.KeyPair)
+		keys[i].Gen(suite, random.Stream)
+		dir.Add(keys[i].Public, freeAddr(t))
+	}
+	managers := make([]*TCPConnManager, len(keys))
+	for i, kp := range keys {
+		var err error
+		managers[i], err = new(TCPConnManager).Init(kp, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer managers[i].Close()
+	}
+
+	flood := coconet.StringMarshaler("flood")
+	for i := 0; i < 4*coconet.DefaultQueueLimit; i++ {
+		if err := managers[1].Put(keys[0].Public, &flood); err != nil {
+			t.Fatal(err)
+		}
+	}
+	one := coconet.StringMarshaler("one")
+	if err := managers[2].Put(keys[0].Public, &one); err != nil {
+		t.Fatal(err)
+	}
+	var got coconet.StringMarshaler
+	if err := managers[0].Get(keys[2].Public, &got); err != nil || got != one {
+		t.Fatal("got", got, err, "expected", one)
+	}
+
+	managers[0].Close()
+	managers[0].Close()
+	if err := managers[0].Get(keys[1].Public, &got); err != coconet.ErrClosed {
+		t.Fatal("got from a closed manager:", err)
+	}
+}
@@ -0,0 +1,146 @@
+package dcnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+)
+
+// Cell coders by name, for benchmarks and tools comparing them.
+var CoderFactories = map[string]CellFactory{
+	"simple": SimpleCoderFactory,
+	"owned":  OwnedCoderFactory,
+}
+
+// Timings of a CellCoder over a series of cells,
+// in seconds per cell unless noted otherwise.
+type BenchStats struct {
+	Coder      string
+	Suite      string
+	PayloadLen int
+	NClients   int
+	NTrustees  int
+	NCells     int
+
+	// Whole cell, from client encoding to decoded payload
+	MinTime float64
+	MaxTime float64
+	AvgTime float64
+	StdDev  float64
+
+	// Time spent in each step, averaged over the cells
+	ClientTime  float64 // ClientEncode, all clients
+	TrusteeTime float64 // TrusteeEncode, all trustees
+	DecodeTime  float64 // DecodeStart through DecodeCell
+
+	Rate float64 // cells per second
+}
+
+func (s BenchStats) CSVHeader() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("coder, suite, payload, clients, trustees, cells, min, max, avg, stddev, client, trustee, decode, rate\n")
+	return buf.Bytes()
+}
+
+func (s BenchStats) CSV() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s, %s, %d, %d, %d, %d, %g, %g, %g, %g, %g, %g, %g, %g\n",
+		s.Coder,
+		s.Suite,
+		s.PayloadLen,
+		s.NClients,
+		s.NTrustees,
+		s.NCells,
+		s.MinTime,
+		s.MaxTime,
+		s.AvgTime,
+		s.StdDev,
+		s.ClientTime,
+		s.TrusteeTime,
+		s.DecodeTime,
+		s.Rate)
+	return buf.Bytes()
+}
+
+// Run a group of nclients and ntrustees through ncells cells
+// of payloadlen bytes each, the first client transmitting in every cell,
+// timing each step and checking every cell decodes correctly.
+func BenchCellCoder(suite abstract.Suite, coder string,
+	nclients, ntrustees, payloadlen, ncells int) (BenchStats, error) {
+
+	s := BenchStats{Coder: coder, Suite: suite.String(),
+		PayloadLen: payloadlen, NClients: nclients,
+		NTrustees: ntrustees, NCells: ncells}
+	factory := CoderFactories[coder]
+	if factory == nil {
+		return s, fmt.Errorf("unknown cell coder %q", coder)
+	}
+	if ncells < 1 {
+		return s, errors.New("no cells to time")
+	}
+
+	tg := TestSetup(nil, suite, factory, nclients, ntrustees)
+	relay := tg.Relay
+	cslice := make([][]byte, nclients)
+	tslice := make([][]byte, ntrustees)
+	payload := make([]byte, payloadlen)
+	times := make([]float64, ncells)
+	var ctime, ttime, dtime time.Duration
+	for c := 0; c < ncells; c++ {
+		payload[0] = byte(c)
+		p := append([]byte(nil), payload...) // may be encoded in place
+
+		beg := time.Now()
+		for i, n := range tg.Clients {
+			cslice[i] = n.Coder.ClientEncode(p, payloadlen, n.History)
+			p = nil // for remaining clients
+		}
+		cend := time.Now()
+
+		for i, n := range tg.Trustees {
+			tslice[i] = n.Coder.TrusteeEncode(payloadlen)
+		}
+		tend := time.Now()
+
+		relay.Coder.DecodeStart(payloadlen, relay.History)
+		for i := range cslice {
+			relay.Coder.DecodeClient(cslice[i])
+		}
+		for i := range tslice {
+			relay.Coder.DecodeTrustee(tslice[i])
+		}
+		outb := relay.Coder.DecodeCell()
+		end := time.Now()
+
+		if !bytes.Equal(outb, payload) {
+			return s, errors.New("cell decoded wrong")
+		}
+		ctime += cend.Sub(beg)
+		ttime += tend.Sub(cend)
+		dtime += end.Sub(tend)
+		times[c] = end.Sub(beg).Seconds()
+	}
+
+	// Whole-cell statistics
+	n := float64(ncells)
+	s.MinTime, s.MaxTime = times[0], times[0]
+	for _, t := range times {
+		s.MinTime = math.Min(s.MinTime, t)
+		s.MaxTime = math.Max(s.MaxTime, t)
+		s.AvgTime += t / n
+	}
+	for _, t := range times {
+		s.StdDev += (t - s.AvgTime) * (t - s.AvgTime) / n
+	}
+	s.StdDev = math.Sqrt(s.StdDev)
+
+	s.ClientTime = ctime.Seconds() / n
+	s.TrusteeTime = ttime.Seconds() / n
+	s.DecodeTime = dtime.Seconds() / n
+	s.Rate = 1 / s.AvgTime
+	return s, nil
+}
@@ -0,0 +1,141 @@
+package dcnet
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/suites"
+)
+
+// Parameters the benchmarks range over
+var benchSizes = []int{64, 256, 1200, 9000}
+var benchClients = []int{1, 10, 50}
+
+const benchTrustees = 3
+
+// Run a benchmark over every suite, coder, payload size and client count,
+// on a fresh group for each.
+func benchCoders(b *testing.B, run func(b *testing.B, tg *TestGroup,
+	payloadlen int)) {
+
+	var names []string
+	for name := range suites.All() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, sname := range names {
+		suite := suites.All()[sname]
+		for _, coder := range []string{"simple", "owned"} {
+			for _, size := range benchSizes {
+				for _, nclients := range benchClients {
+					name := fmt.Sprintf("%s/%s/%dB/%dclients",
+						sname, coder, size, nclients)
+					b.Run(name, func(b *testing.B) {
+						tg := TestSetup(nil, suite,
+							CoderFactories[coder], nclients,
+							benchTrustees)
+						b.SetBytes(int64(size))
+						b.ResetTimer()
+						run(b, tg, size)
+					})
+				}
+			}
+		}
+	}
+}
+
+// Encode a cell at every client, the first one transmitting
+func benchClientSlices(tg *TestGroup, payload []byte) [][]byte {
+	slices := make([][]byte, len(tg.Clients))
+	p := append([]byte(nil), payload...) // may be encoded in place
+	for i, n := range tg.Clients {
+		slices[i] = n.Coder.ClientEncode(p, len(payload), n.History)
+		p = nil
+	}
+	return slices
+}
+
+func BenchmarkClientEncode(b *testing.B) {
+	benchCoders(b, func(b *testing.B, tg *TestGroup, payloadlen int) {
+		n := tg.Clients[0]
+		payload := make([]byte, payloadlen)
+		for i := 0; i < b.N; i++ {
+			n.Coder.ClientEncode(payload, payloadlen, n.History)
+		}
+	})
+}
+
+func BenchmarkTrusteeEncode(b *testing.B) {
+	benchCoders(b, func(b *testing.B, tg *TestGroup, payloadlen int) {
+		n := tg.Trustees[0]
+		for i := 0; i < b.N; i++ {
+			n.Coder.TrusteeEncode(payloadlen)
+		}
+	})
+}
+
+// Time the relay's decoding of whole cells,
+// encoding fresh slices for each cell outside the timer.
+func BenchmarkDecode(b *testing.B) {
+	benchCoders(b, func(b *testing.B, tg *TestGroup, payloadlen int) {
+		relay := tg.Relay
+		payload := make([]byte, payloadlen)
+		tslices := make([][]byte, len(tg.Trustees))
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			payload[0] = byte(i)
+			cslices := benchClientSlices(tg, payload)
+			for j, n := range tg.Trustees {
+				tslices[j] = n.Coder.TrusteeEncode(payloadlen)
+			}
+			b.StartTimer()
+
+			relay.Coder.DecodeStart(payloadlen, relay.History)
+			for _, s := range cslices {
+				relay.Coder.DecodeClient(s)
+			}
+			for _, s := range tslices {
+				relay.Coder.DecodeTrustee(s)
+			}
+			if !bytes.Equal(relay.Coder.DecodeCell(), payload) {
+				b.Fatal("cell decoded wrong")
+			}
+		}
+	})
+}
+
+func testBenchStats(t *testing.T, suite abstract.Suite, coder string) {
+	s, err := BenchCellCoder(suite, coder, 3, 2, 100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.MinTime > s.AvgTime || s.AvgTime > s.MaxTime || s.Rate <= 0 {
+		t.Fatalf("inconsistent timings: %+v", s)
+	}
+	hdr := bytes.Count(s.CSVHeader(), []byte(","))
+	if row := bytes.Count(s.CSV(), []byte(",")); row != hdr {
+		t.Fatalf("CSV row has %d fields, header %d", row+1, hdr+1)
+	}
+
+	// Sub-microsecond timings must not print as zero
+	s.MinTime = 5e-8
+	fields := strings.Split(strings.TrimSpace(string(s.CSV())), ", ")
+	if min, _ := strconv.ParseFloat(fields[6], 64); min != s.MinTime {
+		t.Fatalf("min time %v written as %q", s.MinTime, fields[6])
+	}
+}
+
+func TestBenchCellCoder(t *testing.T) {
+	testBenchStats(t, nist.NewAES128SHA256P256(), "simple")
+	testBenchStats(t, nist.NewAES128SHA256P256(), "owned")
+	if _, err := BenchCellCoder(nist.NewAES128SHA256P256(), "nosuch",
+		1, 1, 100, 1); err == nil {
+		t.Fatal("unknown coder accepted")
+	}
+}
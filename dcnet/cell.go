@@ -1,9 +1,15 @@
 package dcnet
 
 import (
+	"errors"
+
 	"github.com/dedis/crypto/abstract"
 )
 
+// Reasons DecodeCell() may fail to produce a cell, reported by DecodeErr().
+var ErrCellHeader = errors.New("dcnet: undecipherable cell header")
+var ErrMAC = errors.New("dcnet: MAC check failed")
+
 // Cell encoding, decoding, and accountability interface.
 // One instance per series.
 // Designed to support multiple alternative cell encoding methods,
@@ -55,6 +61,18 @@ type CellCoder interface {
 	// Combine all client and trustee slices provided via DecodeSlice(),
 	// to reveal the anonymized plaintext for this cell.
 	DecodeCell() []byte
+
+	// Explain why the last DecodeCell() returned nil:
+	// nil if there simply was no transmission in the cell,
+	// otherwise one of the Err* values above.
+	DecodeErr() error
+
+	// Combine several client ciphertext slices into a single slice
+	// that DecodeClient() treats exactly like the individual slices.
+	// Lets an intermediate relay pre-aggregate its own clients' slices
+	// before forwarding them to the relay that decodes the cell.
+	// Only requires RelaySetup() to have been called.
+	CombineClients(slices [][]byte) []byte
 }
 
 type CellFactory func() CellCoder
@@ -0,0 +1,98 @@
+// Dcbench times the DC-net cell coders across ciphersuites,
+// cell coders, payload sizes and client counts,
+// and writes one line of CSV per combination for comparison graphs.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/suites"
+	"github.com/dedis/prifi/dcnet"
+)
+
+var suiteList string
+var coderList string
+var sizeList string
+var clientList string
+var ntrustees int
+var ncells int
+var output string
+
+func init() {
+	flag.StringVar(&suiteList, "suites", "", "comma-separated ciphersuites (default all)")
+	flag.StringVar(&coderList, "coders", "simple,owned", "comma-separated cell coders")
+	flag.StringVar(&sizeList, "sizes", "64,256,1200,9000", "comma-separated payload sizes in bytes")
+	flag.StringVar(&clientList, "clients", "1,10,50", "comma-separated client counts")
+	flag.IntVar(&ntrustees, "trustees", 3, "number of trustees")
+	flag.IntVar(&ncells, "cells", 100, "cells to time per combination")
+	flag.StringVar(&output, "o", "", "CSV output file (default standard output)")
+}
+
+func ints(list string) []int {
+	var is []int
+	for _, s := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatal("bad number in list: ", s)
+		}
+		is = append(is, i)
+	}
+	return is
+}
+
+func main() {
+	flag.Parse()
+
+	var ss []abstract.Suite
+	if suiteList == "" {
+		var names []string
+		for name := range suites.All() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		suiteList = strings.Join(names, ",")
+	}
+	for _, name := range strings.Split(suiteList, ",") {
+		suite := suites.All()[name]
+		if suite == nil {
+			log.Fatal("unknown ciphersuite: ", name)
+		}
+		ss = append(ss, suite)
+	}
+
+	f := os.Stdout
+	if output != "" {
+		var err error
+		f, err = os.OpenFile(output, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0660)
+		if err != nil {
+			log.Fatal("error opening output file:", err)
+		}
+		defer f.Close()
+	}
+	if _, err := f.Write(dcnet.BenchStats{}.CSVHeader()); err != nil {
+		log.Fatal("error writing output header:", err)
+	}
+
+	for _, suite := range ss {
+		for _, coder := range strings.Split(coderList, ",") {
+			for _, size := range ints(sizeList) {
+				for _, nclients := range ints(clientList) {
+					s, err := dcnet.BenchCellCoder(suite, coder,
+						nclients, ntrustees, size, ncells)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if _, err := f.Write(s.CSV()); err != nil {
+						log.Fatal("error writing output:", err)
+					}
+				}
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package dcnet
 
 import (
 	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/suites"
 	"testing"
 )
 
@@ -12,3 +13,20 @@ func TestSimple(t *testing.T) {
 func TestOwned(t *testing.T) {
 	TestCellCoder(t, nist.NewAES128SHA256P256(), OwnedCoderFactory)
 }
+
+func TestSimpleCombined(t *testing.T) {
+	TestCellCombiner(t, nist.NewAES128SHA256P256(), SimpleCoderFactory)
+}
+
+func TestOwnedCombined(t *testing.T) {
+	TestCellCombiner(t, nist.NewAES128SHA256P256(), OwnedCoderFactory)
+}
+
+// Run the cell coders over every ciphersuite we have
+func TestAllSuites(t *testing.T) {
+	for name, suite := range suites.All() {
+		t.Logf("ciphersuite %s", name)
+		TestCellCoder(t, suite, SimpleCoderFactory)
+		TestCellCoder(t, suite, OwnedCoderFactory)
+	}
+}
@@ -30,6 +30,7 @@ type ownedCoder struct {
 	point  abstract.Point
 	pnull  abstract.Point // neutral/identity element
 	xorbuf []byte
+	err    error // why the last DecodeCell() failed
 }
 
 // OwnedCoderFactory creates a DC-net cell coder for "owned" cells:
@@ -309,8 +310,35 @@ func (c *ownedCoder) DecodeTrustee(slice []byte) {
 	}
 }
 
+func (c *ownedCoder) CombineClients(slices [][]byte) []byte {
+
+	// Sum the verifiable DC-net points in the slice headers
+	plen := c.suite.PointLen()
+	p := c.suite.Point().Null()
+	for i := range slices {
+		sp := c.suite.Point()
+		if err := sp.UnmarshalBinary(slices[i][:plen]); err != nil {
+			println("warning: error decoding point")
+		}
+		p.Add(p, sp)
+	}
+
+	// XOR together the symmetric ciphertext streams
+	payout := make([]byte, len(slices[0])-plen)
+	for i := range slices {
+		slice := slices[i][plen:]
+		for j := range slice {
+			payout[j] ^= slice[j]
+		}
+	}
+
+	out, _ := p.MarshalBinary()
+	return append(out, payout...)
+}
+
 func (c *ownedCoder) DecodeCell() []byte {
 
+	c.err = nil
 	if c.point.Equal(c.pnull) {
 		//println("no transmission in cell")
 		return nil
@@ -320,7 +348,8 @@ func (c *ownedCoder) DecodeCell() []byte {
 	hdr, err := c.point.Data()
 	if err != nil || len(hdr) < c.maclen {
 		println("warning: undecipherable cell header")
-		return nil // XXX differentiate from no transmission?
+		c.err = ErrCellHeader
+		return nil
 	}
 
 	if c.xorbuf == nil { // short inline cell
@@ -343,6 +372,7 @@ func (c *ownedCoder) inlineDecode(hdr []byte) []byte {
 	check := h.Sum(nil)[:c.maclen]
 	if !bytes.Equal(mac, check) {
 		println("warning: MAC check failed on inline cell")
+		c.err = ErrMAC
 		return nil
 	}
 
@@ -355,6 +385,7 @@ func (c *ownedCoder) ownerDecode(hdr []byte) []byte {
 	keylen := len(hdr) - c.maclen
 	if keylen != c.keylen {
 		println("warning: wrong size cell encryption key")
+		c.err = ErrCellHeader
 		return nil
 	}
 	key := hdr[:keylen]
@@ -367,6 +398,7 @@ func (c *ownedCoder) ownerDecode(hdr []byte) []byte {
 	check := h.Sum(nil)[:c.maclen]
 	if !bytes.Equal(mac, check) {
 		println("warning: MAC check failed on out-of-line cell")
+		c.err = ErrMAC
 		return nil
 	}
 
@@ -374,3 +406,7 @@ func (c *ownedCoder) ownerDecode(hdr []byte) []byte {
 	c.suite.Cipher(key).XORKeyStream(dat, dat)
 	return dat
 }
+
+func (c *ownedCoder) DecodeErr() error {
+	return c.err
+}
@@ -56,6 +56,19 @@ func (n *TestNode) nodeSetup(name string, peerkeys []abstract.Point) {
 	}
 }
 
+// Make the given keypair own this node's transmission series
+// in place of the one picked at setup, such as a long-term pseudonym.
+// Only the owner client holds the private key: other nodes pass nil.
+func (n *TestNode) SetOwner(opri abstract.Secret, opub abstract.Point) {
+	n.opri = opri
+	n.opub = opub
+}
+
+// Return the owner public key of this node's transmission series.
+func (n *TestNode) Owner() abstract.Point {
+	return n.opub
+}
+
 func TestSetup(t *testing.T, suite abstract.Suite, factory CellFactory,
 	nclients, ntrustees int) *TestGroup {
 
@@ -206,3 +219,52 @@ func TestCellCoder(t *testing.T, suite abstract.Suite, factory CellFactory) {
 		float64(end.Sub(beg))/1000000000.0,
 		ncells, nbytes, nclients, ntrustees)
 }
+
+// Check that client slices pre-aggregated by CombineClients,
+// as an intermediate relay would do, still decode correctly.
+func TestCellCombiner(t *testing.T, suite abstract.Suite, factory CellFactory) {
+
+	nclients := 3
+	ntrustees := 2
+
+	// Use a fresh group for each cell size,
+	// since the owned coder's trustee streams assume a fixed size.
+	for _, payloadlen := range []int{8, 1200} {
+		tg := TestSetup(t, suite, factory, nclients, ntrustees)
+		relay := tg.Relay
+		clients := tg.Clients
+		trustees := tg.Trustees
+
+		// An intermediate relay, serving all but the first client
+		sub := factory()
+		sub.RelaySetup(suite, nil)
+
+		inb := make([]byte, payloadlen)
+		copy(inb, "combined cell payload")
+
+		cslice := make([][]byte, nclients)
+		p := make([]byte, payloadlen)
+		copy(p, inb)
+		for i := range clients {
+			cslice[i] = clients[i].Coder.ClientEncode(p, payloadlen,
+				clients[i].History)
+			p = nil
+		}
+
+		relay.Coder.DecodeStart(payloadlen, relay.History)
+		relay.Coder.DecodeClient(cslice[0])
+		relay.Coder.DecodeClient(sub.CombineClients(cslice[1:]))
+		for i := range trustees {
+			relay.Coder.DecodeTrustee(
+				trustees[i].Coder.TrusteeEncode(payloadlen))
+		}
+		outb := relay.Coder.DecodeCell()
+
+		if outb == nil || len(outb) != payloadlen ||
+			!bytes.Equal(inb, outb) {
+			t.Logf("oops, combined data corrupted at length %d",
+				payloadlen)
+			t.FailNow()
+		}
+	}
+}
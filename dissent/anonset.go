@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
+)
+
+// Anonymity-set monitoring.
+//
+// Every statusInterval the decoding relay signs a report of
+// how many clients sent it a slice over the interval
+// and which trustees are taking part in the session,
+// and broadcasts it as the downstream cell for connection 0,
+// which never carries proxied data.
+// Each client checks the report against the relay's configured key,
+// and checks that it names the very round it arrived in,
+// so an old report cannot be replayed later.
+// A client with a configured minimum holds back its upstream data
+// whenever the latest report is missing, stale,
+// or counts fewer participants than the minimum.
+
+// How often the relay publishes a report
+const statusInterval = 3 * time.Second
+
+// How long a client trusts a report
+const statusStale = 3 * statusInterval
+
+// Domain separation for report signatures
+const statusLabel = "dissent-anonset-report"
+
+var errReportFormat = errors.New("malformed anonymity-set report")
+var errReportRound = errors.New("anonymity-set report for another round")
+
+// Signed report of the relay's view of the anonymity set.
+type anonReport struct {
+	round        uint64 // downstream round carrying the report
+	interval     uint64 // report sequence number
+	participants int    // clients that sent slices in the interval
+	trustees     []int  // trustees taking part in the session
+	sig          []byte
+}
+
+// The signed part of the report
+func (ar *anonReport) message() []byte {
+	buf := make([]byte, 8+8+4+2+2*len(ar.trustees))
+	binary.BigEndian.PutUint64(buf[0:8], ar.round)
+	binary.BigEndian.PutUint64(buf[8:16], ar.interval)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(ar.participants))
+	binary.BigEndian.PutUint16(buf[20:22], uint16(len(ar.trustees)))
+	for i, tno := range ar.trustees {
+		binary.BigEndian.PutUint16(buf[22+2*i:], uint16(tno))
+	}
+	return buf
+}
+
+func (ar *anonReport) sign(kp *config.KeyPair) {
+	msg := append([]byte(statusLabel), ar.message()...)
+	ar.sig = anon.Sign(kp.Suite, random.Stream, msg,
+		anon.Set{kp.Public}, nil, 0, kp.Secret)
+}
+
+func (ar *anonReport) verify(s abstract.Suite, pub abstract.Point) error {
+	msg := append([]byte(statusLabel), ar.message()...)
+	_, err := anon.Verify(s, msg, anon.Set{pub}, nil, ar.sig)
+	return err
+}
+
+// Report followed by its signature, as carried in a downstream cell
+func (ar *anonReport) encode() []byte {
+	msg := ar.message()
+	buf := make([]byte, len(msg)+2+len(ar.sig))
+	copy(buf, msg)
+	binary.BigEndian.PutUint16(buf[len(msg):], uint16(len(ar.sig)))
+	copy(buf[len(msg)+2:], ar.sig)
+	return buf
+}
+
+func decodeAnonReport(buf []byte) (*anonReport, error) {
+	if len(buf) < 22 {
+		return nil, errReportFormat
+	}
+	ar := &anonReport{}
+	ar.round = binary.BigEndian.Uint64(buf[0:8])
+	ar.interval = binary.BigEndian.Uint64(buf[8:16])
+	ar.participants = int(binary.BigEndian.Uint32(buf[16:20]))
+	ntru := int(binary.BigEndian.Uint16(buf[20:22]))
+	buf = buf[22:]
+	if len(buf) < 2*ntru+2 {
+		return nil, errReportFormat
+	}
+	for i := 0; i < ntru; i++ {
+		ar.trustees = append(ar.trustees,
+			int(binary.BigEndian.Uint16(buf[2*i:])))
+	}
+	buf = buf[2*ntru:]
+	siglen := int(binary.BigEndian.Uint16(buf[0:2]))
+	if len(buf) != 2+siglen {
+		return nil, errReportFormat
+	}
+	ar.sig = buf[2:]
+	return ar, nil
+}
+
+// A client's view of its anonymity set, built from the relay's reports.
+type anonStatus struct {
+	mu       sync.Mutex
+	suite    abstract.Suite
+	relayKey abstract.Point // relay's public key, nil if not configured
+	minimum  int            // participants required to transmit
+	last     *anonReport    // latest verified report
+	received time.Time      // when the latest report arrived
+	holding  bool           // whether we are holding back data
+}
+
+func newAnonStatus(s abstract.Suite, relayKey abstract.Point,
+	minimum int) *anonStatus {
+	return &anonStatus{suite: s, relayKey: relayKey, minimum: minimum}
+}
+
+// Take in a report that arrived in the downstream cell for a given round.
+func (s *anonStatus) update(round uint64, buf []byte) error {
+	ar, err := decodeAnonReport(buf)
+	if err != nil {
+		return err
+	}
+	if ar.round != round {
+		return errReportRound
+	}
+	if s.relayKey == nil {
+		return errors.New("no relay key configured")
+	}
+	if err := ar.verify(s.suite, s.relayKey); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = ar
+	s.received = time.Now()
+	return nil
+}
+
+// Decide whether we may transmit data now,
+// logging whenever the answer changes.
+func (s *anonStatus) ok() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok := s.okLocked(time.Now())
+	if ok == s.holding {
+		s.holding = !ok
+		if ok {
+			log.Printf("anonymity set restored; transmitting")
+		} else {
+			log.Printf("anonymity set below minimum of %d; "+
+				"holding upstream data", s.minimum)
+		}
+	}
+	return ok
+}
+
+func (s *anonStatus) okLocked(now time.Time) bool {
+	if s.minimum <= 0 {
+		return true
+	}
+	return s.last != nil && now.Sub(s.received) < statusStale &&
+		s.last.participants >= s.minimum
+}
+
+// Local status API: the latest report, and whether we are transmitting
+func (s *anonStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	now := time.Now()
+	st := struct {
+		Round        uint64  `json:"round"`
+		Interval     uint64  `json:"interval"`
+		Participants int     `json:"participants"`
+		Trustees     []int   `json:"trustees"`
+		Age          float64 `json:"age"`
+		Verified     bool    `json:"verified"`
+		Minimum      int     `json:"minimum"`
+		Transmitting bool    `json:"transmitting"`
+	}{Minimum: s.minimum, Transmitting: s.okLocked(now)}
+	if s.last != nil {
+		st.Round = s.last.round
+		st.Interval = s.last.interval
+		st.Participants = s.last.participants
+		st.Trustees = s.last.trustees
+		st.Age = now.Sub(s.received).Seconds()
+		st.Verified = true
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// Serve the status API in the background.
+func startStatus(addr string, s *anonStatus) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", s)
+	go func() {
+		log.Printf("Serving anonymity-set status on %s\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Can't serve status: " + err.Error())
+		}
+	}()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
+)
+
+func testKeyPair() *config.KeyPair {
+	kp := &config.KeyPair{}
+	kp.Gen(suite, random.Stream)
+	return kp
+}
+
+func TestAnonReport(t *testing.T) {
+	kp := testKeyPair()
+	ar := &anonReport{round: 17, interval: 2, participants: 5,
+		trustees: []int{0, 2}}
+	ar.sign(kp)
+	buf := ar.encode()
+
+	s := newAnonStatus(suite, kp.Public, 5)
+	if s.ok() {
+		t.Fatal("transmitting without any report")
+	}
+	if err := s.update(18, buf); err != errReportRound {
+		t.Fatalf("report for another round: got %v", err)
+	}
+	bad := append([]byte{}, buf...)
+	bad[19]++ // participant count
+	if err := s.update(17, bad); err == nil {
+		t.Fatal("tampered report accepted")
+	}
+	if err := s.update(17, buf[:len(buf)-1]); err == nil {
+		t.Fatal("truncated report accepted")
+	}
+	if err := newAnonStatus(suite, testKeyPair().Public, 5).update(17,
+		buf); err == nil {
+		t.Fatal("report signed by another key accepted")
+	}
+
+	if err := s.update(17, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !s.ok() {
+		t.Fatal("not transmitting with enough participants")
+	}
+	if s.last.participants != 5 || len(s.last.trustees) != 2 ||
+		s.last.trustees[1] != 2 || s.last.interval != 2 {
+		t.Fatalf("report decoded wrong: %+v", s.last)
+	}
+
+	// Too few participants
+	s.minimum = 6
+	if s.ok() {
+		t.Fatal("transmitting below minimum")
+	}
+
+	// Stale report
+	s.minimum = 5
+	s.received = time.Now().Add(-statusStale)
+	if s.ok() {
+		t.Fatal("transmitting on a stale report")
+	}
+
+	// No minimum: always transmit
+	if !newAnonStatus(suite, nil, 0).ok() {
+		t.Fatal("not transmitting without a minimum")
+	}
+}
+
+func TestAnonStatusAPI(t *testing.T) {
+	kp := testKeyPair()
+	ar := &anonReport{round: 3, participants: 4, trustees: []int{1}}
+	ar.sign(kp)
+	s := newAnonStatus(suite, kp.Public, 2)
+	if err := s.update(3, ar.encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var st struct {
+		Participants int
+		Trustees     []int
+		Verified     bool
+		Transmitting bool
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Participants != 4 || len(st.Trustees) != 1 ||
+		!st.Verified || !st.Transmitting {
+		t.Fatalf("status %+v", st)
+	}
+}
+
+// Wait for a client to get its first report from the relay
+func waitReport(t *testing.T, s *anonStatus) {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		last := s.last
+		s.mu.Unlock()
+		if last != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("no anonymity-set report received")
+}
+
+// Wait for a client to get a report counting n participants
+func waitParticipants(t *testing.T, s *anonStatus, n int) {
+	for i := 0; i < 200; i++ {
+		s.mu.Lock()
+		last := s.last
+		s.mu.Unlock()
+		if last != nil && last.participants == n {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("no report of %d participants received", n)
+}
+
+// A transport on which one node's link can be made to stop sending,
+// while staying open.
+type mutingTransport struct {
+	tcpTransport
+	link  byte
+	muted *int32 // nonzero once the link is muted
+}
+
+func (mt mutingTransport) Dial(addr string, link byte) (net.Conn, error) {
+	conn, err := mt.tcpTransport.Dial(addr, link)
+	if err != nil || link != mt.link {
+		return conn, err
+	}
+	return &mutedConn{conn, mt.muted}, nil
+}
+
+type mutedConn struct {
+	net.Conn
+	muted *int32
+}
+
+func (c *mutedConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(c.muted) != 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// A client that stops sending is never counted out of a round:
+// the cells it took part in still decode,
+// and the session stalls rather than report a smaller set.
+func TestAnonSetClientStops(t *testing.T) {
+	kp := testKeyPair()
+	tn := newTestNet(t, 3, 2, 1)
+	muted := new(int32)
+	tn.g.transport = mutingTransport{link: 2, muted: muted}
+	tn.relay.statusKey = kp
+	s := newAnonStatus(suite, kp.Public, 0)
+	tn.clients[0].status = s
+	tn.start()
+	defer tn.stop()
+	waitParticipants(t, s, 3)
+	testStreams(t, tn.socks.Addr().String())
+
+	// Client 2 keeps its link open but sends nothing more
+	atomic.StoreInt32(muted, 1)
+	s.mu.Lock()
+	interval := s.last.interval
+	s.mu.Unlock()
+	time.Sleep(3 * statusInterval)
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+	if last.participants != 3 {
+		t.Fatalf("report of %d participants after a client stopped",
+			last.participants)
+	}
+	if last.interval > interval+1 {
+		t.Fatalf("reports went on to interval %d without client 2",
+			last.interval)
+	}
+}
+
+func TestAnonSetEndToEnd(t *testing.T) {
+	kp := testKeyPair()
+	tn := newTestNet(t, 3, 2, 1)
+	tn.relay.statusKey = kp
+	for _, c := range tn.clients {
+		c.status = newAnonStatus(suite, kp.Public, 3)
+	}
+	tn.start()
+	defer tn.stop()
+	for _, c := range tn.clients {
+		waitReport(t, c.status)
+	}
+	testStreams(t, tn.socks.Addr().String())
+}
+
+func TestAnonSetTooSmall(t *testing.T) {
+	kp := testKeyPair()
+	tn := newTestNet(t, 2, 2, 1)
+	tn.relay.statusKey = kp
+	owner := tn.clients[0]
+	owner.status = newAnonStatus(suite, kp.Public, 3)
+	tn.start()
+	defer tn.stop()
+	waitReport(t, owner.status)
+
+	// The slot owner must hold back even the SOCKS greeting
+	conn, err := net.Dial("tcp", tn.socks.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{5, 1, methNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 2)); err == nil {
+		t.Fatalf("got %d bytes through a too-small anonymity set", n)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
+)
+
+// Anonymous group messaging.
+//
+// Besides proxying connections, the DC-net can carry a group chat.
+// The slot owner posts messages on the reserved connection chatConn,
+// each signed by its pseudonym for the round in which it goes upstream,
+// so a message can be neither forged nor replayed into a later round.
+// The relay checks each decoded message and broadcasts it back down
+// to every client, prefixed by the round it was decoded from,
+// and every client checks it again before showing it.
+//
+// Locally, each client offers a line-based chat port:
+// every line a local program writes is posted,
+// and every message from the group is written back as
+// "<pseudonym>: <text>", with the pseudonym abbreviated.
+// The chat command is a minimal terminal front end for that port.
+
+// Connection number reserved for group messages
+const chatConn = 0x7fffffff
+
+// Domain separation for message signatures
+const chatLabel = "dissent-chat"
+
+// Hex digits of the pseudonym shown with each message
+const chatNameLen = 8
+
+// Lines a local session may fall behind before we drop it
+const chatSessionQueue = 64
+
+// Group messages the relay holds awaiting broadcast
+const chatRelayQueue = 64
+
+var errChatFormat = errors.New("malformed chat message")
+var errChatTooLong = errors.New("chat message too long for a cell")
+
+// A group message, signed by its author's pseudonym.
+type chatMsg struct {
+	round uint64 // round in which the message went upstream
+	pub   []byte // author's pseudonym
+	sig   []byte
+	text  string
+}
+
+func (m *chatMsg) message() []byte {
+	msg := []byte(chatLabel)
+	msg = append(msg, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(msg[len(msg)-8:], m.round)
+	msg = append(msg, byte(len(m.pub)))
+	msg = append(msg, m.pub...)
+	return append(msg, m.text...)
+}
+
+// Sign a message for the round in which we send it
+func newChatMsg(kp *config.KeyPair, round uint64, text string) *chatMsg {
+	m := &chatMsg{round: round, text: text}
+	m.pub, _ = kp.Public.MarshalBinary()
+	m.sig = anon.Sign(kp.Suite, random.Stream, m.message(),
+		anon.Set{kp.Public}, nil, 0, kp.Secret)
+	return m
+}
+
+func (m *chatMsg) verify(s abstract.Suite) error {
+	p := s.Point()
+	if err := p.UnmarshalBinary(m.pub); err != nil {
+		return err
+	}
+	_, err := anon.Verify(s, m.message(), anon.Set{p}, nil, m.sig)
+	return err
+}
+
+// Pseudonym, abbreviated for display
+func (m *chatMsg) name() string {
+	name := hex.EncodeToString(m.pub)
+	if len(name) > chatNameLen {
+		name = name[len(name)-chatNameLen:]
+	}
+	return name
+}
+
+// Encode the message as the slot owner sends it upstream;
+// the round is implied by the cell carrying it.
+func (m *chatMsg) encode() []byte {
+	buf := make([]byte, 0, 4+len(m.pub)+len(m.sig)+len(m.text))
+	buf = appendBlob(buf, m.pub)
+	buf = appendBlob(buf, m.sig)
+	return append(buf, m.text...)
+}
+
+func decodeChatMsg(round uint64, buf []byte) (*chatMsg, error) {
+	m := &chatMsg{round: round}
+	var ok bool
+	if m.pub, buf, ok = splitBlob(buf); !ok {
+		return nil, errChatFormat
+	}
+	if m.sig, buf, ok = splitBlob(buf); !ok {
+		return nil, errChatFormat
+	}
+	m.text = string(buf)
+	return m, nil
+}
+
+// Encode the message as the relay broadcasts it downstream
+func (m *chatMsg) encodeDown() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, m.round)
+	return append(buf, m.encode()...)
+}
+
+func decodeChatDown(buf []byte) (*chatMsg, error) {
+	if len(buf) < 8 {
+		return nil, errChatFormat
+	}
+	return decodeChatMsg(binary.BigEndian.Uint64(buf), buf[8:])
+}
+
+func appendBlob(buf, b []byte) []byte {
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(b)))
+	return append(buf, b...)
+}
+
+func splitBlob(buf []byte) ([]byte, []byte, bool) {
+	if len(buf) < 2 {
+		return nil, nil, false
+	}
+	l := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+l {
+		return nil, nil, false
+	}
+	return buf[2 : 2+l], buf[2+l:], true
+}
+
+// Check a message the relay decoded from the given round,
+// and return it framed for broadcast, or nil if it is invalid.
+func relayChat(s abstract.Suite, round uint64, buf []byte) []byte {
+	m, err := decodeChatMsg(round, buf)
+	if err == nil {
+		err = m.verify(s)
+	}
+	if err != nil {
+		log.Println("Dropping chat message: " + err.Error())
+		return nil
+	}
+	return m.encodeDown()
+}
+
+// The client's local chat port, shared by any number of local programs.
+// Each session has its own writer, fed through a bounded queue,
+// so a session that stops reading cannot hold up the others.
+type chatHub struct {
+	suite abstract.Suite
+	mu    sync.Mutex
+	conns map[net.Conn]chan string // each session's outgoing lines
+	post  chan string              // lines to post, picked up by the client main loop
+}
+
+func newChatHub(s abstract.Suite) *chatHub {
+	return &chatHub{suite: s, conns: make(map[net.Conn]chan string),
+		post: make(chan string)}
+}
+
+// Accept local chat sessions on lsock
+func (h *chatHub) listen(lsock net.Listener) {
+	for {
+		conn, err := lsock.Accept()
+		if err != nil {
+			lsock.Close()
+			return
+		}
+		h.add(conn)
+	}
+}
+
+// Serve a local session
+func (h *chatHub) add(conn net.Conn) {
+	out := make(chan string, chatSessionQueue)
+	h.mu.Lock()
+	h.conns[conn] = out
+	h.mu.Unlock()
+	go h.write(conn, out)
+	go h.read(conn)
+}
+
+// Post every line a local session writes
+func (h *chatHub) read(conn net.Conn) {
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			h.post <- line
+		}
+	}
+	h.drop(conn)
+}
+
+// Write a local session's lines until it is dropped or fails
+func (h *chatHub) write(conn net.Conn, out <-chan string) {
+	for line := range out {
+		if _, err := fmt.Fprintln(conn, line); err != nil {
+			h.drop(conn)
+			return
+		}
+	}
+}
+
+// Forget a local session and close it, if not done already
+func (h *chatHub) drop(conn net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dropLocked(conn)
+}
+
+func (h *chatHub) dropLocked(conn net.Conn) {
+	if out, ok := h.conns[conn]; ok {
+		delete(h.conns, conn)
+		close(out)
+		conn.Close()
+	}
+}
+
+// Queue a line for every local session,
+// dropping any session too far behind to take it.
+func (h *chatHub) show(line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn, out := range h.conns {
+		select {
+		case out <- line:
+		default:
+			log.Println("Dropping chat session that stopped reading")
+			h.dropLocked(conn)
+		}
+	}
+}
+
+// Deliver a message broadcast by the relay
+func (h *chatHub) deliver(buf []byte) {
+	m, err := decodeChatDown(buf)
+	if err == nil {
+		err = m.verify(h.suite)
+	}
+	if err != nil {
+		log.Println("Bad chat message from relay: " + err.Error())
+		return
+	}
+	h.show(m.name() + ": " + printable(m.text))
+}
+
+// Strip control characters, so no message can pass itself off
+// as several lines, or as a line from another pseudonym.
+func printable(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// Build the upstream cell carrying a message, signed for a given round
+func chatCell(kp *config.KeyPair, round uint64, text string) ([]byte, error) {
+	m := newChatMsg(kp, round, text).encode()
+	if proxyhdrlen+len(m) > payloadlen {
+		return nil, errChatTooLong
+	}
+	buf := make([]byte, payloadlen)
+	binary.BigEndian.PutUint32(buf[0:4], chatConn)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(m)))
+	copy(buf[proxyhdrlen:], m)
+	return buf, nil
+}
+
+// Longest message that fits in a cell, for a given pseudonym
+func chatMaxLen(kp *config.KeyPair) int {
+	m := newChatMsg(kp, 0, "").encode()
+	return payloadlen - proxyhdrlen - len(m)
+}
@@ -0,0 +1,52 @@
+// Chat is a minimal terminal client for the dissent group chat.
+//
+// It connects to the chat port of a local dissent client
+// (started with -chat), prints every message posted to the group,
+// and posts each line typed on standard input.
+// Only the slot owner's messages reach the group;
+// any client can read them.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:1082",
+		"Address of the local dissent client's chat port")
+	post := flag.String("post", "",
+		"Post a single message and exit")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	if *post != "" {
+		if _, err := fmt.Fprintln(conn, *post); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Post what we type, and show what the group says
+	go func() {
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			if _, err := fmt.Fprintln(conn, s.Text()); err != nil {
+				break
+			}
+		}
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatMsg(t *testing.T) {
+	kp := testKeyPair()
+	m := newChatMsg(kp, 7, "hello, group")
+
+	up, err := decodeChatMsg(7, m.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.verify(suite); err != nil {
+		t.Fatal(err)
+	}
+	if up.text != "hello, group" {
+		t.Fatalf("decoded text %q", up.text)
+	}
+	again, _ := decodeChatMsg(8, m.encode())
+	if again.verify(suite) == nil {
+		t.Fatal("message replayed in another round")
+	}
+	if _, err := decodeChatMsg(7, m.encode()[:3]); err != errChatFormat {
+		t.Fatal("truncated message accepted")
+	}
+	bad := m.encode()
+	bad[len(bad)-1]++
+	if up, _ := decodeChatMsg(7, bad); up.verify(suite) == nil {
+		t.Fatal("tampered message accepted")
+	}
+
+	// The relay broadcasts the message with its round
+	down, err := decodeChatDown(relayChat(suite, 7, m.encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if down.round != 7 || down.text != m.text ||
+		down.verify(suite) != nil {
+		t.Fatalf("broadcast decoded wrong: %+v", down)
+	}
+	if relayChat(suite, 8, m.encode()) != nil {
+		t.Fatal("relay broadcast a message from another round")
+	}
+
+	// Messages must fit in a single cell
+	max := chatMaxLen(kp)
+	if _, err := chatCell(kp, 7, strings.Repeat("x", max)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chatCell(kp, 7, strings.Repeat("x", max+1)); err == nil {
+		t.Fatal("oversized message accepted")
+	}
+}
+
+func TestChatSlowSession(t *testing.T) {
+	h := newChatHub(suite)
+	stalled, peer := net.Pipe() // never read
+	defer peer.Close()
+	h.add(stalled)
+	live, reader := net.Pipe()
+	defer live.Close()
+	h.add(live)
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(reader)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	// The stalled session holds up neither us nor the live one,
+	// which keeps up with every line
+	for i := 0; i < chatSessionQueue+2; i++ {
+		want := fmt.Sprintf("line %d", i)
+		h.show(want)
+		select {
+		case line := <-lines:
+			if strings.TrimSpace(line) != want {
+				t.Fatalf("live session read %q, want %q", line, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("live session stuck at line %d", i)
+		}
+	}
+
+	h.mu.Lock()
+	_, ok := h.conns[stalled]
+	n := len(h.conns)
+	h.mu.Unlock()
+	if ok || n != 1 {
+		t.Fatalf("stalled session not dropped alone: %d sessions left", n)
+	}
+}
+
+// Open a local chat session on a client, once it is being served
+func chatSession(t *testing.T, c *client) net.Conn {
+	lsock := listenLocal(t)
+	go c.listenChat(lsock)
+	conn, err := net.Dial("tcp", lsock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	for i := 0; i < 100; i++ {
+		c.chat.mu.Lock()
+		n := len(c.chat.conns)
+		c.chat.mu.Unlock()
+		if n > 0 {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("chat session not accepted")
+	return nil
+}
+
+// Post through the slot owner and read the message back at every client
+func testChat(t *testing.T, nclients, ntrustees, nrelays int) {
+	kp := testKeyPair()
+	tn := newTestNet(t, nclients, ntrustees, nrelays)
+	tn.clients[0].pseudonym = kp
+	sessions := make([]net.Conn, nclients)
+	readers := make([]*bufio.Reader, nclients)
+	for i, c := range tn.clients {
+		sessions[i] = chatSession(t, c)
+		readers[i] = bufio.NewReader(sessions[i])
+		defer sessions[i].Close()
+	}
+	tn.start()
+	defer tn.stop()
+
+	if _, err := fmt.Fprintln(sessions[0], "hello, group"); err != nil {
+		t.Fatal(err)
+	}
+	want := newChatMsg(kp, 0, "").name() + ": hello, group"
+	for i, r := range readers {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if got := strings.TrimSpace(line); got != want {
+			t.Fatalf("client %d read %q, want %q", i, got, want)
+		}
+	}
+
+	// Other clients can read but not post
+	if _, err := fmt.Fprintln(sessions[1], "not mine"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := readers[1].ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "!") {
+		t.Fatalf("non-owner's post not refused: %q", line)
+	}
+}
+
+func TestChatEndToEnd(t *testing.T) {
+	testChat(t, 3, 2, 1)
+}
+
+func TestChatSubRelay(t *testing.T) {
+	testChat(t, 4, 3, 2)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/hex"
+
+	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/config"
 	"github.com/dedis/crypto/suites"
 )
@@ -9,7 +12,15 @@ var configFile config.File
 
 // Dissent config file format
 type ConfigData struct {
-	Keys config.Keys // Info on configured key-pairs
+	Keys  config.Keys // Info on configured key-pairs
+	Suite string      // Group ciphersuite, as named in suites.All()
+
+	Transport  string            // Relay link transport: "tcp", "tls", or "ws"
+	LinkKeys   map[string]string // Hex keys of "tls" dialers, by decimal link byte
+	RelayKey   string            // Hex public key of the relay, signing anonymity-set reports
+	ClientKeys []string          // Hex public keys signing history reports, by client number
+
+	Pseudonym config.Keys // Client's persistent pseudonym key-pairs
 }
 
 var configData ConfigData
@@ -20,9 +31,14 @@ func readConfig() error {
 	// Load the configuration file
 	configFile.Load("dissent", &configData)
 
+	// All roles run the ciphersuite the group configuration names
+	if err := selectSuite(configData.Suite); err != nil {
+		return err
+	}
+
 	// Read or create our public/private keypairs
 	pairs, err := configFile.Keys(&configData.Keys, suites.All(),
-		defaultSuite)
+		suite)
 	if err != nil {
 		return err
 	}
@@ -31,3 +47,51 @@ func readConfig() error {
 
 	return nil
 }
+
+// Our own key-pair for the ciphersuite in use, or nil if we have none
+func ourKeyPair() *config.KeyPair {
+	for i := range keyPairs {
+		if keyPairs[i].Suite.String() == suite.String() {
+			return &keyPairs[i]
+		}
+	}
+	return nil
+}
+
+// Decode a hex-encoded public key in the ciphersuite in use
+func decodePoint(s string) (abstract.Point, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	p := suite.Point()
+	if err := p.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// The relay's configured public key, or nil if none is configured
+func configRelayKey() (abstract.Point, error) {
+	if configData.RelayKey == "" {
+		return nil, nil
+	}
+	return decodePoint(configData.RelayKey)
+}
+
+// The clients' configured public keys by client number,
+// or nil if none are configured
+func configClientKeys() ([]abstract.Point, error) {
+	if len(configData.ClientKeys) == 0 {
+		return nil, nil
+	}
+	keys := make([]abstract.Point, len(configData.ClientKeys))
+	for i, s := range configData.ClientKeys {
+		p, err := decodePoint(s)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = p
+	}
+	return keys, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/suites"
+)
+
+// Name under which the test's echo server is reached through SOCKS.
+// The relay's injected dialer resolves it, so no DNS is involved.
+const echoHost = "echo.invalid"
+const echoPort = 7
+
+// Round rate of the test relays,
+// paced rather than spinning through empty cells.
+const testRate = 500
+
+func listenLocal(t *testing.T) net.Listener {
+	lsock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lsock
+}
+
+// Start a server echoing everything back on each connection
+func startEcho(t *testing.T) net.Listener {
+	lsock := listenLocal(t)
+	go func() {
+		for {
+			conn, err := lsock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return lsock
+}
+
+// A whole dissent group running in-process
+type testNet struct {
+	g        *group
+	relay    *relay
+	clients  []*client
+	trustees []*trustee
+	lsocks   []net.Listener // one per relay
+	tsocks   []net.Listener // one per trustee, for history reports
+	socks    net.Listener   // slot owner's SOCKS port
+	echo     net.Listener   // echo server the relay proxies to
+	nodes    sync.WaitGroup // main loops of the running nodes
+	stopped  sync.Once
+}
+
+// Set up a group whose relay proxies to an echo server.
+// Nodes can be adjusted before the group is started.
+func newTestNet(t *testing.T, nclients, ntrustees, nrelays int) *testNet {
+	return newSuiteTestNet(t, suite, nclients, ntrustees, nrelays)
+}
+
+// Set up a test group running ciphersuite s.
+func newSuiteTestNet(t *testing.T, s abstract.Suite,
+	nclients, ntrustees, nrelays int) *testNet {
+
+	// Listen for every relay first, so the group knows its addresses
+	tn := &testNet{echo: startEcho(t)}
+	tn.g = &group{nclients: nclients, ntrustees: ntrustees,
+		nrelays: nrelays, suite: s, transport: tcpTransport{},
+		done: make(chan struct{})}
+	tn.lsocks = make([]net.Listener, nrelays)
+	for i := range tn.lsocks {
+		tn.lsocks[i] = listenLocal(t)
+		tn.g.relays = append(tn.g.relays, tn.lsocks[i].Addr().String())
+	}
+	tn.tsocks = make([]net.Listener, ntrustees)
+	for i := range tn.tsocks {
+		tn.tsocks[i] = listenLocal(t)
+		tn.g.trustees = append(tn.g.trustees,
+			tn.tsocks[i].Addr().String())
+	}
+
+	pace, err := newPacer(testRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.relay = newRelay(tn.g, tn.lsocks[0], 2, pace)
+	tn.relay.dial = func(network, addr string) (net.Conn, error) {
+		if addr != net.JoinHostPort(echoHost, strconv.Itoa(echoPort)) {
+			return nil, fmt.Errorf("unexpected destination %s", addr)
+		}
+		return net.Dial(network, tn.echo.Addr().String())
+	}
+	for i := 0; i < nclients; i++ {
+		tn.clients = append(tn.clients, newClient(tn.g, i, padNone{}))
+	}
+	for i := 0; i < ntrustees; i++ {
+		tn.trustees = append(tn.trustees, newTrustee(tn.g, i))
+	}
+	tn.socks = listenLocal(t)
+	return tn
+}
+
+// Start all the group's nodes
+func (tn *testNet) start() {
+	g := tn.g
+	tn.run(func() { tn.relay.serve() })
+	for i := 1; i < g.nrelays; i++ {
+		lsock := tn.lsocks[i]
+		r := i
+		tn.run(func() { runSubRelay(g, r, lsock, 2) })
+	}
+	for i, tr := range tn.trustees {
+		go tr.listen(tn.tsocks[i])
+		tn.run(tr.run)
+	}
+	go tn.clients[0].listen(tn.socks)
+	for _, c := range tn.clients {
+		tn.run(c.run)
+	}
+}
+
+// Run a node's main loop in the background
+func (tn *testNet) run(f func()) {
+	tn.nodes.Add(1)
+	go func() {
+		defer tn.nodes.Done()
+		f()
+	}()
+}
+
+// Stop all the group's nodes, and wait for them to finish.
+// Stopping again does nothing.
+func (tn *testNet) stop() {
+	tn.stopped.Do(tn.stopNodes)
+}
+
+func (tn *testNet) stopNodes() {
+	tn.g.stop()
+	for _, lsock := range tn.lsocks {
+		lsock.Close()
+	}
+	for _, lsock := range tn.tsocks {
+		lsock.Close()
+	}
+	tn.socks.Close()
+	tn.echo.Close()
+	tn.nodes.Wait()
+}
+
+// Open a SOCKS5 stream to the echo server
+func dialEcho(socks string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", socks)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	if err := socksConnect(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func socksConnect(conn net.Conn) error {
+	if _, err := conn.Write([]byte{5, 1, methNoAuth}); err != nil {
+		return err
+	}
+	meth := [2]byte{}
+	if _, err := io.ReadFull(conn, meth[:]); err != nil {
+		return err
+	}
+	if meth != [2]byte{5, methNoAuth} {
+		return fmt.Errorf("SOCKS method reply %v", meth)
+	}
+
+	req := []byte{5, cmdConnect, 0, addrDomain, byte(len(echoHost))}
+	req = append(req, echoHost...)
+	port := [2]byte{}
+	binary.BigEndian.PutUint16(port[:], echoPort)
+	req = append(req, port[:]...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	rep := make([]byte, 4)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		return err
+	}
+	if rep[0] != 5 || rep[1] != repSucceeded {
+		return fmt.Errorf("SOCKS connect reply %v", rep)
+	}
+	alen := net.IPv4len
+	if rep[3] == addrIPv6 {
+		alen = net.IPv6len
+	}
+	_, err := io.ReadFull(conn, make([]byte, alen+2))
+	return err
+}
+
+// Push data through a SOCKS stream and check it comes back intact.
+// Some messages span several upstream cells.
+func testEcho(conn net.Conn, seed byte) error {
+	for _, size := range []int{1, 100, payloadlen, 3*payloadlen + 17} {
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = seed + byte(i*7)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		back := make([]byte, size)
+		if _, err := io.ReadFull(conn, back); err != nil {
+			return err
+		}
+		if !bytes.Equal(msg, back) {
+			return errors.New("echoed data corrupted")
+		}
+	}
+	return nil
+}
+
+// Run a group and push a couple of concurrent SOCKS streams through it
+func testGroup(t *testing.T, nclients, ntrustees, nrelays int) {
+	testSuiteGroup(t, suite, nclients, ntrustees, nrelays)
+}
+
+func testSuiteGroup(t *testing.T, s abstract.Suite,
+	nclients, ntrustees, nrelays int) {
+
+	tn := newSuiteTestNet(t, s, nclients, ntrustees, nrelays)
+	tn.start()
+	defer tn.stop()
+	testStreams(t, tn.socks.Addr().String())
+}
+
+func testStreams(t *testing.T, socks string) {
+
+	errs := make(chan error)
+	for s := 0; s < 2; s++ {
+		go func(seed byte) {
+			conn, err := dialEcho(socks)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			errs <- testEcho(conn, seed)
+		}(byte(s * 100))
+	}
+	for s := 0; s < 2; s++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	testGroup(t, 3, 2, 1)
+}
+
+func TestEndToEndSubRelay(t *testing.T) {
+	testGroup(t, 4, 3, 2)
+}
+
+// Run a group over every ciphersuite we have
+func TestEndToEndSuites(t *testing.T) {
+	for _, name := range suiteNames() {
+		t.Logf("ciphersuite %s", name)
+		testSuiteGroup(t, suites.All()[name], 2, 2, 1)
+	}
+}
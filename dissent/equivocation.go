@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
+)
+
+// Relay equivocation detection.
+//
+// A relay that sends different downstream cells to different clients
+// could partition the anonymity set without anyone noticing.
+// Every checkInterval rounds the relay therefore signs a digest of the
+// downstream history it has broadcast so far, the same hash chain the
+// clients keep for session resumption, and sends it to every trustee.
+// At each such checkpoint every client reports its own history hash,
+// signed by its own key, directly to one of the trustees, taking turns
+// so each trustee samples every client over time without any trustee
+// hearing from all. Trustees drop any report whose signature does not
+// check out against the reporting client's configured key, so nobody
+// can frame the relay by reporting a history on a client's behalf.
+// A trustee holding a client report that differs from the relay's
+// signed digest for the same round, or two signed digests for the
+// same round that differ, raises an alarm signed by its own key,
+// carrying the relay's signed digests and the client's signed report
+// as evidence.
+
+// Rounds between history checkpoints
+const checkInterval = 64
+
+// Checkpoints a trustee remembers
+const checkKeep = 16
+
+// Size of the signed part of a client's history report:
+// client, round, history
+const reportlen = 2 + 8 + historylen
+
+// Domain separation for digest, report and alarm signatures
+const digestLabel = "dissent-history-digest"
+const reportLabel = "dissent-history-report"
+const alarmLabel = "dissent-equivocation-alarm"
+
+var errDigestFormat = errors.New("malformed history digest")
+var errReportClient = errors.New("history report from unknown client")
+var errReportCheckpoint = errors.New("history report for no checkpoint")
+var errAlarmFormat = errors.New("malformed equivocation alarm")
+
+var metHistoryChecks = expvar.NewInt("dissent_history_checks")
+var metAlarms = expvar.NewInt("dissent_equivocation_alarms")
+
+// Whether the history after a round is a checkpoint
+func isCheckpoint(round uint64) bool {
+	return (round+1)%checkInterval == 0
+}
+
+// The relay's signed digest of its downstream history after a round.
+type historyDigest struct {
+	round   uint64
+	history []byte
+	sig     []byte
+}
+
+func (d *historyDigest) message() []byte {
+	msg := []byte(digestLabel)
+	msg = append(msg, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(msg[len(msg)-8:], d.round)
+	return append(msg, d.history...)
+}
+
+func (d *historyDigest) sign(kp *config.KeyPair) {
+	d.sig = anon.Sign(kp.Suite, random.Stream, d.message(),
+		anon.Set{kp.Public}, nil, 0, kp.Secret)
+}
+
+func (d *historyDigest) verify(s abstract.Suite, pub abstract.Point) error {
+	_, err := anon.Verify(s, d.message(), anon.Set{pub}, nil, d.sig)
+	return err
+}
+
+func (d *historyDigest) encode() []byte {
+	buf := make([]byte, 8+historylen, 8+historylen+len(d.sig))
+	binary.BigEndian.PutUint64(buf[0:8], d.round)
+	copy(buf[8:], d.history)
+	return append(buf, d.sig...)
+}
+
+func decodeHistoryDigest(buf []byte) (*historyDigest, error) {
+	if len(buf) < 8+historylen {
+		return nil, errDigestFormat
+	}
+	return &historyDigest{round: binary.BigEndian.Uint64(buf[0:8]),
+		history: buf[8 : 8+historylen],
+		sig:     buf[8+historylen:]}, nil
+}
+
+// A client's own view of the downstream history after a round,
+// signed by the client.
+type historyReport struct {
+	clino   int
+	round   uint64
+	history []byte
+	sig     []byte
+}
+
+// The signed part of the report
+func (r *historyReport) body() []byte {
+	buf := make([]byte, reportlen)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(r.clino))
+	binary.BigEndian.PutUint64(buf[2:10], r.round)
+	copy(buf[10:], r.history)
+	return buf
+}
+
+func (r *historyReport) message() []byte {
+	return append([]byte(reportLabel), r.body()...)
+}
+
+func (r *historyReport) sign(kp *config.KeyPair) {
+	r.sig = anon.Sign(kp.Suite, random.Stream, r.message(),
+		anon.Set{kp.Public}, nil, 0, kp.Secret)
+}
+
+// Check the report in ciphersuite s against its client's keys,
+// listed by client number.
+func (r *historyReport) verify(s abstract.Suite,
+	clientKeys []abstract.Point) error {
+
+	if r.clino >= len(clientKeys) || clientKeys[r.clino] == nil {
+		return errReportClient
+	}
+	_, err := anon.Verify(s, r.message(), anon.Set{clientKeys[r.clino]},
+		nil, r.sig)
+	return err
+}
+
+// Report followed by its signature
+func (r *historyReport) encode() []byte {
+	return appendBlob(r.body(), r.sig)
+}
+
+func readHistoryReport(rd io.Reader) (*historyReport, error) {
+	buf := make([]byte, reportlen)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return nil, err
+	}
+	sig, err := readBlob(rd)
+	if err != nil {
+		return nil, err
+	}
+	return &historyReport{clino: int(binary.BigEndian.Uint16(buf[0:2])),
+		round:   binary.BigEndian.Uint64(buf[2:10]),
+		history: buf[10:],
+		sig:     sig}, nil
+}
+
+// A trustee's signed accusation that the relay equivocated.
+// The evidence is the relay's signed digest for the round,
+// and either a conflicting client report or a second,
+// conflicting digest the relay signed for the same round.
+type equivocationAlarm struct {
+	tno      int
+	digest   *historyDigest
+	report   *historyReport // nil if the relay signed two digests
+	conflict *historyDigest // nil if a client contradicts the relay
+	sig      []byte
+}
+
+// The signed part of the alarm
+func (a *equivocationAlarm) message() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(alarmLabel)
+	binary.Write(buf, binary.BigEndian, uint16(a.tno))
+	writeBlob(buf, a.digest.encode())
+	if a.report != nil {
+		buf.WriteByte('c')
+		buf.Write(a.report.encode())
+	} else {
+		buf.WriteByte('r')
+		writeBlob(buf, a.conflict.encode())
+	}
+	return buf.Bytes()
+}
+
+func (a *equivocationAlarm) encode() []byte {
+	msg := a.message()[len(alarmLabel):]
+	buf := make([]byte, len(msg), len(msg)+len(a.sig))
+	copy(buf, msg)
+	return append(buf, a.sig...)
+}
+
+func decodeEquivocationAlarm(buf []byte) (*equivocationAlarm, error) {
+	a := &equivocationAlarm{}
+	r := bytes.NewReader(buf)
+	var tno uint16
+	if binary.Read(r, binary.BigEndian, &tno) != nil {
+		return nil, errAlarmFormat
+	}
+	a.tno = int(tno)
+	b, err := readBlob(r)
+	if err != nil {
+		return nil, errAlarmFormat
+	}
+	if a.digest, err = decodeHistoryDigest(b); err != nil {
+		return nil, err
+	}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, errAlarmFormat
+	}
+	switch kind {
+	case 'c':
+		if a.report, err = readHistoryReport(r); err != nil {
+			return nil, errAlarmFormat
+		}
+	case 'r':
+		if b, err = readBlob(r); err != nil {
+			return nil, errAlarmFormat
+		}
+		if a.conflict, err = decodeHistoryDigest(b); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errAlarmFormat
+	}
+	a.sig = make([]byte, r.Len())
+	r.Read(a.sig)
+	return a, nil
+}
+
+// Check an alarm in ciphersuite s: signed by the trustee holding key
+// trusteeKey, and backed by evidence the relay holding key relayKey signed,
+// along with any report signed by one of clientKeys.
+func (a *equivocationAlarm) verify(s abstract.Suite, trusteeKey,
+	relayKey abstract.Point, clientKeys []abstract.Point) error {
+
+	_, err := anon.Verify(s, a.message(), anon.Set{trusteeKey}, nil,
+		a.sig)
+	if err != nil {
+		return err
+	}
+	if err := a.digest.verify(s, relayKey); err != nil {
+		return err
+	}
+	if a.report != nil {
+		if err := a.report.verify(s, clientKeys); err != nil {
+			return err
+		}
+		if a.report.round != a.digest.round ||
+			bytes.Equal(a.report.history, a.digest.history) {
+			return errors.New("alarm shows no conflict")
+		}
+		return nil
+	}
+	if err := a.conflict.verify(s, relayKey); err != nil {
+		return err
+	}
+	if a.conflict.round != a.digest.round ||
+		bytes.Equal(a.conflict.history, a.digest.history) {
+		return errors.New("alarm shows no conflict")
+	}
+	return nil
+}
+
+// A trustee's cross-check of the relay's digests against client reports.
+type historyCheck struct {
+	mu         sync.Mutex
+	suite      abstract.Suite
+	tno        int
+	relayKey   abstract.Point   // relay's public key, nil if not configured
+	clientKeys []abstract.Point // clients' public keys, nil if not configured
+	key        *config.KeyPair  // our key for signing alarms
+	latest     uint64           // latest checkpoint the relay signed
+	digests    map[uint64]*historyDigest
+	reports    map[uint64][]*historyReport // awaiting the relay's digest
+	reported   map[uint64]map[int]bool     // clients heard from per round
+	checked    int                         // reports compared
+	alarms     []*equivocationAlarm
+}
+
+func newHistoryCheck(s abstract.Suite, tno int, relayKey abstract.Point,
+	clientKeys []abstract.Point, key *config.KeyPair) *historyCheck {
+	return &historyCheck{suite: s, tno: tno, relayKey: relayKey,
+		clientKeys: clientKeys, key: key,
+		digests:  make(map[uint64]*historyDigest),
+		reports:  make(map[uint64][]*historyReport),
+		reported: make(map[uint64]map[int]bool)}
+}
+
+// Take in a digest received from the relay.
+func (hc *historyCheck) digest(d *historyDigest) error {
+	if hc.relayKey == nil {
+		return nil // nothing to check digests against
+	}
+	if err := d.verify(hc.suite, hc.relayKey); err != nil {
+		return err
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if old := hc.digests[d.round]; old != nil {
+		if !bytes.Equal(old.history, d.history) {
+			hc.alarm(&equivocationAlarm{digest: old, conflict: d})
+		}
+		return nil
+	}
+	hc.digests[d.round] = d
+	for _, r := range hc.reports[d.round] {
+		hc.compare(d, r)
+	}
+	delete(hc.reports, d.round)
+	if d.round > hc.latest {
+		hc.latest = d.round
+	}
+	hc.prune()
+	return nil
+}
+
+// Take in a client's report, once it checks out against its client's key.
+// Only the first report from each client for a checkpoint counts.
+func (hc *historyCheck) report(r *historyReport) error {
+	if hc.clientKeys == nil {
+		return nil // nothing to check reports against
+	}
+	if !isCheckpoint(r.round) {
+		return errReportCheckpoint
+	}
+	if err := r.verify(hc.suite, hc.clientKeys); err != nil {
+		return err
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if r.round+checkKeep*checkInterval < hc.latest ||
+		r.round > hc.latest+checkKeep*checkInterval {
+		return nil // too far from where the relay is to be kept
+	}
+	if hc.reported[r.round][r.clino] {
+		return nil // already heard from this client
+	}
+	if hc.reported[r.round] == nil {
+		hc.reported[r.round] = make(map[int]bool)
+	}
+	hc.reported[r.round][r.clino] = true
+	if d := hc.digests[r.round]; d != nil {
+		hc.compare(d, r)
+		return nil
+	}
+	hc.reports[r.round] = append(hc.reports[r.round], r)
+	return nil
+}
+
+func (hc *historyCheck) compare(d *historyDigest, r *historyReport) {
+	hc.checked++
+	metHistoryChecks.Add(1)
+	if !bytes.Equal(d.history, r.history) {
+		hc.alarm(&equivocationAlarm{digest: d, report: r})
+	}
+}
+
+// Forget checkpoints too old to matter
+func (hc *historyCheck) prune() {
+	for round := range hc.digests {
+		if round+checkKeep*checkInterval < hc.latest {
+			delete(hc.digests, round)
+		}
+	}
+	for round := range hc.reports {
+		if round+checkKeep*checkInterval < hc.latest {
+			delete(hc.reports, round)
+		}
+	}
+	for round := range hc.reported {
+		if round+checkKeep*checkInterval < hc.latest {
+			delete(hc.reported, round)
+		}
+	}
+}
+
+// Sign and publish an alarm
+func (hc *historyCheck) alarm(a *equivocationAlarm) {
+	a.tno = hc.tno
+	if hc.key != nil {
+		a.sig = anon.Sign(hc.key.Suite, random.Stream, a.message(),
+			anon.Set{hc.key.Public}, nil, 0, hc.key.Secret)
+	}
+	hc.alarms = append(hc.alarms, a)
+	metAlarms.Add(1)
+	log.Printf("RELAY EQUIVOCATION at round %d: alarm %s",
+		a.digest.round, hex.EncodeToString(a.encode()))
+}
+
+// Take in digests from the relay until the link fails.
+// The relay's link must always be drained, even if we check nothing.
+func (hc *historyCheck) readRelay(conn net.Conn) {
+	for {
+		b, err := readBlob(conn)
+		if err != nil {
+			return
+		}
+		d, err := decodeHistoryDigest(b)
+		if err == nil {
+			err = hc.digest(d)
+		}
+		if err != nil {
+			log.Println("Bad history digest from relay: " +
+				err.Error())
+		}
+	}
+}
+
+// Take in client reports from connections accepted on lsock.
+func (hc *historyCheck) listen(lsock net.Listener) {
+	for {
+		conn, err := lsock.Accept()
+		if err != nil {
+			lsock.Close()
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				r, err := readHistoryReport(conn)
+				if err != nil || !linkAllowed(conn, byte(r.clino)) {
+					return
+				}
+				if err := hc.report(r); err != nil {
+					log.Printf("Bad history report from client %d: %s",
+						r.clino, err.Error())
+					return
+				}
+			}
+		}()
+	}
+}
+
+// A client's links to the trustees, for history reports.
+type historyReporter struct {
+	g     *group
+	clino int
+	key   *config.KeyPair // our key for signing reports, set before use
+	links []chan *historyReport
+}
+
+func newHistoryReporter(g *group, clino int) *historyReporter {
+	hr := &historyReporter{g: g, clino: clino}
+	for t := range g.trustees {
+		link := make(chan *historyReport, checkKeep)
+		hr.links = append(hr.links, link)
+		go hr.send(g.trustees[t], link)
+	}
+	return hr
+}
+
+// Report our history after a checkpoint round to the trustee whose
+// turn it is; never hold up the session if the trustee lags.
+func (hr *historyReporter) report(round uint64, history []byte) {
+	if len(hr.links) == 0 {
+		return
+	}
+	t := (int(round/checkInterval) + hr.clino) % len(hr.links)
+	select {
+	case hr.links[t] <- &historyReport{clino: hr.clino, round: round,
+		history: history}:
+	default:
+	}
+}
+
+// Send reports to a trustee, reconnecting as needed,
+// until the group stops.
+func (hr *historyReporter) send(addr string, link <-chan *historyReport) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var r *historyReport
+		select {
+		case r = <-link:
+		case <-hr.g.done:
+			return
+		}
+		if hr.key != nil {
+			r.sign(hr.key)
+		}
+		if conn == nil {
+			c, err := hr.g.transport.Dial(addr, byte(hr.clino))
+			if err != nil {
+				log.Printf("Can't report history to trustee %s: %s",
+					addr, err.Error())
+				continue
+			}
+			conn = c
+		}
+		if _, err := conn.Write(r.encode()); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
+)
+
+func testDigest(round uint64, b byte) *historyDigest {
+	h := make([]byte, historylen)
+	h[0] = b
+	return &historyDigest{round: round, history: h}
+}
+
+// A report of the given history, signed by kp
+func testReport(kp *config.KeyPair, clino int, round uint64,
+	history []byte) *historyReport {
+	r := &historyReport{clino: clino, round: round, history: history}
+	r.sign(kp)
+	return r
+}
+
+// Key-pairs for n clients, and their public keys
+func testClientKeys(n int) ([]*config.KeyPair, []abstract.Point) {
+	var kps []*config.KeyPair
+	var pubs []abstract.Point
+	for i := 0; i < n; i++ {
+		kps = append(kps, testKeyPair())
+		pubs = append(pubs, kps[i].Public)
+	}
+	return kps, pubs
+}
+
+func TestHistoryCheck(t *testing.T) {
+	relay := testKeyPair()
+	trustee := testKeyPair()
+	clients, clientKeys := testClientKeys(3)
+	hc := newHistoryCheck(suite, 1, relay.Public, clientKeys, trustee)
+
+	d := testDigest(63, 1)
+	d.sign(relay)
+	if err := hc.digest(d); err != nil {
+		t.Fatal(err)
+	}
+
+	// A forged digest is rejected
+	forged := testDigest(127, 1)
+	forged.sign(trustee)
+	if err := hc.digest(forged); err == nil {
+		t.Fatal("digest signed by another key accepted")
+	}
+
+	// Matching reports, before or after the digest, raise nothing
+	if err := hc.report(testReport(clients[0], 0, 63,
+		d.history)); err != nil {
+		t.Fatal(err)
+	}
+	early := testDigest(127, 2)
+	if err := hc.report(testReport(clients[2], 2, 127,
+		early.history)); err != nil {
+		t.Fatal(err)
+	}
+	early.sign(relay)
+	if err := hc.digest(early); err != nil {
+		t.Fatal(err)
+	}
+	if hc.checked != 2 || len(hc.alarms) != 0 {
+		t.Fatalf("%d checks, %d alarms", hc.checked, len(hc.alarms))
+	}
+
+	// A report forged in a client's name, or unsigned, raises nothing
+	other := testDigest(63, 9).history
+	if hc.report(testReport(clients[1], 2, 63, other)) == nil {
+		t.Fatal("report signed by another client accepted")
+	}
+	if hc.report(&historyReport{clino: 2, round: 63,
+		history: other}) == nil {
+		t.Fatal("unsigned report accepted")
+	}
+	if hc.report(testReport(clients[2], 3, 63, other)) == nil {
+		t.Fatal("report from an unknown client accepted")
+	}
+	if len(hc.alarms) != 0 {
+		t.Fatal("forged report raised an alarm")
+	}
+
+	// A client that saw another history
+	if err := hc.report(testReport(clients[2], 2, 63, other)); err != nil {
+		t.Fatal(err)
+	}
+	if len(hc.alarms) != 1 {
+		t.Fatal("conflicting client report raised no alarm")
+	}
+
+	// Each client counts once per checkpoint, and only at checkpoints
+	checked := hc.checked
+	if err := hc.report(testReport(clients[2], 2, 63, other)); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.report(testReport(clients[2], 2, 63,
+		d.history)); err != nil {
+		t.Fatal(err)
+	}
+	if hc.checked != checked || len(hc.alarms) != 1 {
+		t.Fatal("repeated client report counted again")
+	}
+	if hc.report(testReport(clients[1], 1, 64, other)) != errReportCheckpoint {
+		t.Fatal("report for a non-checkpoint round accepted")
+	}
+	a, err := decodeEquivocationAlarm(hc.alarms[0].encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.verify(suite, trustee.Public, relay.Public,
+		clientKeys); err != nil {
+		t.Fatal(err)
+	}
+	if a.tno != 1 || a.report.clino != 2 || a.digest.round != 63 {
+		t.Fatalf("alarm decoded wrong: %+v", a)
+	}
+	if a.verify(suite, relay.Public, relay.Public, clientKeys) == nil {
+		t.Fatal("alarm verified against another trustee's key")
+	}
+	if a.verify(suite, trustee.Public, relay.Public,
+		[]abstract.Point{nil, nil, relay.Public}) == nil {
+		t.Fatal("alarm verified against another client's key")
+	}
+
+	// An alarm over a report the client never signed
+	framed := &equivocationAlarm{tno: 1, digest: d,
+		report: testReport(clients[1], 2, 63, other)}
+	framed.sig = anon.Sign(suite, random.Stream, framed.message(),
+		anon.Set{trustee.Public}, nil, 0, trustee.Secret)
+	if framed.verify(suite, trustee.Public, relay.Public,
+		clientKeys) == nil {
+		t.Fatal("alarm over a forged report verified")
+	}
+
+	// The relay signing two histories for one round
+	twice := testDigest(63, 3)
+	twice.sign(relay)
+	if err := hc.digest(twice); err != nil {
+		t.Fatal(err)
+	}
+	if len(hc.alarms) != 2 {
+		t.Fatal("conflicting digests raised no alarm")
+	}
+	a, err = decodeEquivocationAlarm(hc.alarms[1].encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.verify(suite, trustee.Public, relay.Public,
+		clientKeys); err != nil {
+		t.Fatal(err)
+	}
+	if a.conflict == nil || a.report != nil {
+		t.Fatalf("alarm decoded wrong: %+v", a)
+	}
+}
+
+// A transport whose links show the client a different history:
+// the downstream cell for one round arrives with a changed header.
+type equivocatingTransport struct {
+	tcpTransport
+	round uint64
+}
+
+func (et equivocatingTransport) Dial(addr string, link byte) (net.Conn,
+	error) {
+
+	conn, err := et.tcpTransport.Dial(addr, link)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		rec := make([]byte, resumelen)
+		_, err := io.ReadFull(conn, rec)
+		for err == nil {
+			pw.Write(rec)
+			var round uint64
+			round, rec, err = readDown(conn)
+			if round == et.round {
+				rec[11]++ // connection number
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return &pipeConn{conn, pr}, nil
+}
+
+type pipeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (pc *pipeConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+// Run a group whose relay and trustees check histories,
+// and return the trustees once each has compared some reports
+// and the group has stopped.
+func testHistoryNet(t *testing.T, equivocate bool) []*historyCheck {
+	relay := testKeyPair()
+	clients, clientKeys := testClientKeys(3)
+	tn := newTestNet(t, 3, 2, 1)
+	tn.relay.statusKey = relay
+	for i, c := range tn.clients {
+		c.reporter.key = clients[i]
+	}
+	var checks []*historyCheck
+	for i, tr := range tn.trustees {
+		tr.check = newHistoryCheck(tn.g.suite, i, relay.Public,
+			clientKeys, testKeyPair())
+		checks = append(checks, tr.check)
+	}
+	if equivocate {
+		g := *tn.g
+		g.transport = equivocatingTransport{round: 10}
+		tn.clients[1].g = &g
+	}
+	tn.start()
+	defer tn.stop()
+
+	for i := 0; i < 100; i++ {
+		done := true
+		for _, hc := range checks {
+			hc.mu.Lock()
+			if hc.checked < 3 {
+				done = false
+			}
+			hc.mu.Unlock()
+		}
+		if done {
+			return checks
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("trustees never checked the relay's history")
+	return nil
+}
+
+// Reporters stop sending when their group stops
+func TestHistoryReporterStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+	g := &group{nclients: 1, ntrustees: 3, suite: suite,
+		transport: tcpTransport{}, done: make(chan struct{}),
+		trustees: []string{"127.0.0.1:1", "127.0.0.1:1", "127.0.0.1:1"}}
+	newHistoryReporter(g, 0)
+	g.stop()
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines left running",
+				runtime.NumGoroutine()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEquivocationHonest(t *testing.T) {
+	for _, hc := range testHistoryNet(t, false) {
+		hc.mu.Lock()
+		n := len(hc.alarms)
+		hc.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("trustee %d raised %d alarms on an honest relay",
+				hc.tno, n)
+		}
+	}
+}
+
+func TestEquivocationDetected(t *testing.T) {
+	nalarms := 0
+	for _, hc := range testHistoryNet(t, true) {
+		hc.mu.Lock()
+		alarms := hc.alarms
+		hc.mu.Unlock()
+		for _, a := range alarms {
+			if a.report == nil || a.report.clino != 1 {
+				t.Fatalf("alarm names the wrong client: %+v", a)
+			}
+			a, err := decodeEquivocationAlarm(a.encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = a.verify(suite, hc.key.Public, hc.relayKey,
+				hc.clientKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		nalarms += len(alarms)
+	}
+	if nalarms == 0 {
+		t.Fatal("relay equivocation went unnoticed")
+	}
+}
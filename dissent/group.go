@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/prifi/dcnet"
+)
+
+// A dissent group: how many nodes of each kind it has,
+// the ciphersuite they all run, and how its nodes reach the relays.
+// The command-line roles all run the group this binary was built for;
+// tests build their own, with listeners on whatever ports they got.
+type group struct {
+	nclients  int
+	ntrustees int
+	nrelays   int // including the decoding relay (relay 0)
+
+	suite     abstract.Suite // ciphersuite of every node and signature
+	transport Transport      // carries all links to the relays
+	relays    []string       // network address of each relay
+	trustees  []string       // address of each trustee's history report port
+
+	done chan struct{} // closed to make the group's nodes stop
+}
+
+// The group described by our built-in constants and configuration
+func defaultGroup() *group {
+	g := &group{nclients: nclients, ntrustees: ntrustees,
+		nrelays: nrelays, suite: suite, transport: transport,
+		done: make(chan struct{})}
+	for r := 0; r < nrelays; r++ {
+		g.relays = append(g.relays, relayAddr(r))
+	}
+	for t := 0; t < ntrustees; t++ {
+		g.trustees = append(g.trustees, trusteeAddr(t))
+	}
+	return g
+}
+
+// Relay to which a given client attaches
+func (g *group) clientRelay(clino int) int {
+	return clino % g.nrelays
+}
+
+// Clients attached to relay r
+func (g *group) relayClients(r int) []int {
+	clients := make([]int, 0)
+	for i := 0; i < g.nclients; i++ {
+		if g.clientRelay(i) == r {
+			clients = append(clients, i)
+		}
+	}
+	return clients
+}
+
+// Set up the DC-net state shared by the group
+func (g *group) setup() *dcnet.TestGroup {
+	return dcnet.TestSetup(nil, g.suite, factory, g.nclients, g.ntrustees)
+}
+
+// Make all the group's nodes stop.
+func (g *group) stop() {
+	close(g.done)
+}
+
+// Whether the group's nodes have been told to stop
+func (g *group) stopped() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -12,24 +12,53 @@ import (
 	"os/signal"
 	//"encoding/hex"
 	"encoding/binary"
-	"github.com/dedis/crypto/nist"
-	//"github.com/dedis/crypto/openssl"
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
 	"github.com/dedis/prifi/dcnet"
 	//"github.com/elazarl/goproxy"
 )
 
-var suite = nist.NewAES128SHA256P256() // XXX should only have defaultSuite
-//var suite = openssl.NewAES128SHA256P256()
-//var suite = ed25519.NewAES128SHA256Ed25519()
 var factory = dcnet.OwnedCoderFactory
 
-var defaultSuite = suite
-
 const nclients = 1
 const ntrustees = 3
 
-const relayhost = "localhost:9876" // XXX
-const bindport = ":9876"
+// Number of relays, including the decoding relay (relay 0).
+// Clients are spread across relays by group.clientRelay();
+// trustees and intermediate relays attach to relay 0.
+const nrelays = 1
+
+const relayhost = "localhost" // XXX
+const relayport = 9876        // relay r listens on relayport+r
+
+const trusteehost = "localhost" // XXX
+const trusteeport = 9900        // trustee t listens on trusteeport+t
+
+// Node-type flags in the byte identifying a new link to a relay
+const (
+	linkTrustee = 0x80
+	linkRelay   = 0x40
+)
+
+// Network address at which to reach relay r
+func relayAddr(r int) string {
+	return fmt.Sprintf("%s:%d", relayhost, relayport+r)
+}
+
+// Local port on which relay r listens
+func relayBind(r int) string {
+	return fmt.Sprintf(":%d", relayport+r)
+}
+
+// Network address at which to report history to trustee t
+func trusteeAddr(t int) string {
+	return fmt.Sprintf("%s:%d", trusteehost, trusteeport+t)
+}
+
+// Local port on which trustee t takes history reports
+func trusteeBind(t int) string {
+	return fmt.Sprintf(":%d", trusteeport+t)
+}
 
 //const payloadlen = 1200			// upstream cell size
 const payloadlen = 256 // upstream cell size
@@ -264,10 +293,13 @@ func socks5Reply(cno int, err error, addr net.Addr) connbuf {
 
 // Main loop of our socks relay-side SOCKS proxy.
 func relaySocksProxy(cno int, upstream <-chan []byte,
-	downstream chan<- connbuf) {
+	downstream chan<- connbuf,
+	dial func(network, addr string) (net.Conn, error)) {
 
 	// Send downstream close indication when we bail for whatever reason
+	metSocksStreams.Add(1)
 	defer func() {
+		metSocksStreams.Add(-1)
 		downstream <- connbuf{cno, []byte{}}
 	}()
 
@@ -343,7 +375,7 @@ func relaySocksProxy(cno int, upstream <-chan []byte,
 	//log.Printf("SOCKS proxy: request %d for %s\n", cmd, hostport)
 	switch cmd {
 	case cmdConnect:
-		conn, err := net.Dial("tcp", hostport)
+		conn, err := dial("tcp", hostport)
 		if err != nil {
 			log.Printf("SOCKS: error connecting to destionation: " +
 				err.Error())
@@ -363,7 +395,8 @@ func relaySocksProxy(cno int, upstream <-chan []byte,
 	}
 }
 
-func relayNewConn(cno int, downstream chan<- connbuf) chan<- []byte {
+func relayNewConn(cno int, downstream chan<- connbuf,
+	dial func(network, addr string) (net.Conn, error)) chan<- []byte {
 
 	/* connect to local HTTP proxy
 	conn,err := net.Dial("tcp", "localhost:8888")
@@ -374,27 +407,10 @@ func relayNewConn(cno int, downstream chan<- connbuf) chan<- []byte {
 	*/
 
 	upstream := make(chan []byte)
-	go relaySocksProxy(cno, upstream, downstream)
+	go relaySocksProxy(cno, upstream, downstream, dial)
 	return upstream
 }
 
-func openRelay(ctno int) net.Conn {
-	conn, err := net.Dial("tcp", relayhost)
-	if err != nil {
-		panic("Can't connect to relay:" + err.Error())
-	}
-
-	// Tell the relay our client or trustee number
-	b := make([]byte, 1)
-	b[0] = byte(ctno)
-	n, err := conn.Write(b)
-	if n < 1 || err != nil {
-		panic("Error writing to socket:" + err.Error())
-	}
-
-	return conn
-}
-
 func clientListen(listenport string, newconn chan<- net.Conn) {
 	log.Printf("Listening on port %s\n", listenport)
 	lsock, err := net.Listen("tcp", listenport)
@@ -403,9 +419,14 @@ func clientListen(listenport string, newconn chan<- net.Conn) {
 			listenport, err.Error())
 		return
 	}
+	clientAccept(lsock, newconn)
+}
+
+// Hand connections accepted on lsock to the client main loop.
+func clientAccept(lsock net.Listener, newconn chan<- net.Conn) {
 	for {
 		conn, err := lsock.Accept()
-		log.Printf("Accept on port %s\n", listenport)
+		log.Printf("Accept on %s\n", lsock.Addr())
 		if err != nil {
 			//log.Printf("Accept error: %s", err.Error())
 			lsock.Close()
@@ -445,30 +466,33 @@ func clientConnRead(cno int, conn net.Conn, upload chan<- []byte,
 	}
 }
 
-func clientReadRelay(rconn net.Conn, fromrelay chan<- connbuf) {
-	hdr := [6]byte{}
+// Read downstream cells from the relay, starting with the given round,
+// and pass them to the main loop in order.
+func clientReadRelay(rconn net.Conn, fromrelay chan<- connbuf,
+	round uint64) {
+	defer close(fromrelay) // signal the link failed
 	totcells := uint64(0)
 	totbytes := uint64(0)
-	for {
+	for ; ; round++ {
 		// Read the next downstream/broadcast cell from the relay
-		n, err := io.ReadFull(rconn, hdr[:])
-		if n != len(hdr) {
-			panic("clientReadRelay: " + err.Error())
+		cround, dbuf, err := readDown(rconn)
+		if err != nil {
+			log.Println("clientReadRelay: " + err.Error())
+			return
+		}
+		if cround != round {
+			log.Printf("clientReadRelay: got round %d, expected %d",
+				cround, round)
+			return
 		}
-		cno := int(binary.BigEndian.Uint32(hdr[0:4]))
-		dlen := int(binary.BigEndian.Uint16(hdr[4:6]))
+		cno := int(binary.BigEndian.Uint32(dbuf[8:12]))
+		buf := dbuf[downhdrlen:]
+		dlen := len(buf)
 		//if cno != 0 || dlen != 0 {
 		//	fmt.Printf("clientReadRelay: cno %d dlen %d\n",
 		//			cno, dlen)
 		//}
 
-		// Read the downstream data itself
-		buf := make([]byte, dlen)
-		n, err = io.ReadFull(rconn, buf)
-		if n != dlen {
-			panic("clientReadRelay: " + err.Error())
-		}
-
 		// Pass the downstream cell to the main loop
 		fromrelay <- connbuf{cno, buf}
 
@@ -479,129 +503,426 @@ func clientReadRelay(rconn net.Conn, fromrelay chan<- connbuf) {
 	}
 }
 
-func startClient(clino int) {
+func startClient(clino int, transparent string, tproxy bool,
+	pad padPolicy, minanon int, status string, pseudonym bool,
+	chat string) {
 	fmt.Printf("startClient %d\n", clino)
 
-	tg := dcnet.TestSetup(nil, suite, factory, nclients, ntrustees)
-	me := tg.Clients[clino]
-	clisize := me.Coder.ClientCellSize(payloadlen)
+	c := newClient(defaultGroup(), clino, pad)
 
-	rconn := openRelay(clino)
-	fromrelay := make(chan connbuf)
-	go clientReadRelay(rconn, fromrelay)
-	println("client", clino, "connected")
+	// Use a persistent pseudonym if asked
+	if pseudonym {
+		kp, err := loadPseudonym(&configFile, &configData.Pseudonym,
+			c.g.suite)
+		if err != nil {
+			println("Error: can't load pseudonym: " + err.Error())
+			return
+		}
+		c.pseudonym = kp
+	}
+
+	// Check the relay's anonymity-set reports if we know its key
+	relayKey, err := configRelayKey()
+	if err != nil {
+		println("Error: bad RelayKey: " + err.Error())
+		return
+	}
+	if relayKey == nil && minanon > 0 {
+		println("Error: -minanon needs the relay's RelayKey configured")
+		return
+	}
+	c.status = newAnonStatus(c.g.suite, relayKey, minanon)
+	if status != "" {
+		startStatus(status, c.status)
+	}
+
+	// Sign our history reports to the trustees
+	c.reporter.key = ourKeyPair()
+	if c.reporter.key == nil {
+		log.Println("No key-pair: trustees will drop our history reports")
+	}
+
+	// Serve the group chat locally if asked
+	if chat != "" {
+		lsock, err := net.Listen("tcp", chat)
+		if err != nil {
+			println("Error: can't listen for chat: " + err.Error())
+			return
+		}
+		go c.listenChat(lsock)
+	}
 
 	// We're the "slot owner" - start an HTTP proxy
-	newconn := make(chan net.Conn)
+	if clino == 0 {
+		go clientListen(":1080", c.newconn)
+		//go clientListen(":8080",c.newconn)
+		if transparent != "" {
+			go clientListenTransparent(transparent, tproxy,
+				c.newconn)
+		}
+	}
+	c.run()
+}
+
+// A client node, proxying its local connections through the group.
+type client struct {
+	g       *group
+	clino   int
+	me      *dcnet.TestNode
+	pad     padPolicy     // slot owner's idle cell padding
+	status  *anonStatus   // anonymity set, as reported by the relay
+	newconn chan net.Conn // new proxied connections, from any listener
+
+	// Long-term pseudonym, if any, announced in each session
+	pseudonym *config.KeyPair
+	announce  bool // announcement due in this session
+
+	// Reports our downstream history to the trustees at checkpoints
+	reporter *historyReporter
+
+	// Group chat, with the key our messages are signed by:
+	// our pseudonym if we have one, or else a key for this run only
+	chat    *chatHub
+	chatKey *config.KeyPair
+}
+
+func newClient(g *group, clino int, pad padPolicy) *client {
+	return &client{g: g, clino: clino, me: g.setup().Clients[clino],
+		pad: pad, status: newAnonStatus(g.suite, nil, 0),
+		newconn: make(chan net.Conn), chat: newChatHub(g.suite),
+		reporter: newHistoryReporter(g, clino)}
+}
+
+// Proxy the connections accepted on lsock through the group.
+// Only the slot owner, client 0, can carry any traffic.
+func (c *client) listen(lsock net.Listener) {
+	clientAccept(lsock, c.newconn)
+}
+
+// Serve the group chat to local programs connecting to lsock.
+// Every client can read the chat, but only the slot owner can post.
+func (c *client) listenChat(lsock net.Listener) {
+	c.chat.listen(lsock)
+}
+
+// Queue a line posted on the local chat port
+func (c *client) post(postq []string, text string) []string {
+	if c.clino != 0 {
+		c.chat.show("! only the slot owner can post")
+		return postq
+	}
+	if max := chatMaxLen(c.chatKey); len(text) > max {
+		c.chat.show(fmt.Sprintf("! message longer than %d bytes", max))
+		return postq
+	}
+	return append(postq, text)
+}
+
+// Build the upstream cell announcing our pseudonym in a given round
+func (c *client) announcement(round uint64) []byte {
+	a := announcePseudonym(c.pseudonym, round)
+	if proxyhdrlen+len(a) > payloadlen {
+		log.Println("Pseudonym announcement does not fit in a cell")
+		return nil
+	}
+	buf := make([]byte, payloadlen)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(a)))
+	copy(buf[proxyhdrlen:], a)
+	return buf
+}
+
+// Run the client, reconnecting to its relay whenever the link fails,
+// until the group is stopped.
+func (c *client) run() {
+	clino := c.clino
+	me := c.me
+	pad := c.pad
+	newconn := c.newconn
+	clisize := me.Coder.ClientCellSize(payloadlen)
+
 	upload := make(chan []byte)
 	close := make(chan int)
 	conns := make([]net.Conn, 1) // reserve conns[0]
-	if clino == 0 {
-		go clientListen(":1080", newconn)
-		//go clientListen(":8080",newconn)
+
+	if c.chatKey == nil {
+		c.chatKey = c.pseudonym
+	}
+	if c.chatKey == nil {
+		c.chatKey = &config.KeyPair{}
+		c.chatKey.Gen(c.g.suite, random.Stream)
 	}
 
-	// Client/proxy main loop
+	rs := newResumeState()
 	upq := make([][]byte, 0)
+	postq := make([]string, 0) // chat messages to post
+	idle := 0                  // consecutive cells without upstream data
 	totupcells := uint64(0)
 	totupbytes := uint64(0)
 	for {
-		select {
-		case conn := <-newconn: // New TCP connection
-			cno := len(conns)
-			conns = append(conns, conn)
-			//fmt.Printf("new conn %d %p %p\n", cno, conn, conns[cno])
-			go clientConnRead(cno, conn, upload, close)
-
-		case buf := <-upload: // Upstream data from client
-			upq = append(upq, buf)
-
-		case cno := <-close: // Connection closed
-			conns[cno] = nil
+		// (Re)connect to our relay and catch up to the session
+		rconn, rr := resumeRelay(c.g, c.g.relays[c.g.clientRelay(clino)],
+			clino, []resumeState{rs})
+		if rconn == nil {
+			c.closeConns(conns)
+			return
+		}
+		for ; rs.cellno < rr.cellno; rs.cellno++ {
+			me.Coder.ClientEncode(nil, payloadlen, me.History)
+		}
+		rs.history = rr.history
+		c.announce = c.pseudonym != nil && clino == 0
+		if c.announce { // our pseudonym owns the slot this session
+			me.SetOwner(c.pseudonym.Secret, c.pseudonym.Public)
+		}
+		fromrelay := make(chan connbuf)
+		go clientReadRelay(rconn, fromrelay, rs.cellno)
+		println("client", clino, "connected at cell", rs.cellno)
+
+		// Client/proxy main loop
+	session:
+		for {
+			select {
+			case conn := <-newconn: // New TCP connection
+				cno := len(conns)
+				conns = append(conns, conn)
+				//fmt.Printf("new conn %d %p %p\n", cno, conn, conns[cno])
+				go clientConnRead(cno, conn, upload, close)
+
+			case buf := <-upload: // Upstream data from client
+				upq = append(upq, buf)
+
+			case cno := <-close: // Connection closed
+				conns[cno] = nil
+
+			case text := <-c.chat.post: // Local chat message
+				postq = c.post(postq, text)
+
+			case <-c.g.done: // Group stopped
+				rconn.Close()
+				for range fromrelay {
+				} // wait for the reader to notice
+				c.closeConns(conns)
+				return
+
+			case cbuf, ok := <-fromrelay: // Downstream cell from relay
+				//print(".")
+				if !ok {
+					break session
+				}
 
-		case cbuf := <-fromrelay: // Downstream cell from relay
-			//print(".")
-
-			cno := cbuf.cno
-			//if cno != 0 || len(cbuf.buf) != 0 {
-			//	fmt.Printf("v %d (conn %d)\n",
-			//			len(cbuf.buf), cno)
-			//}
-			if cno > 0 && cno < len(conns) && conns[cno] != nil {
-				buf := cbuf.buf
-				blen := len(buf)
-				//println(hex.Dump(buf))
-				if blen > 0 {
-					// Data from relay for this connection
-					n, err := conns[cno].Write(buf)
-					if n < blen {
-						panic("Write to client: " +
+				cno := cbuf.cno
+				if cno == 0 && len(cbuf.buf) > 0 {
+					// Anonymity-set report from the relay
+					err := c.status.update(rs.cellno, cbuf.buf)
+					if err != nil {
+						log.Println("Bad anonymity-set report: " +
 							err.Error())
 					}
-				} else {
-					// Relay indicating EOF on this conn
-					fmt.Printf("upstream closed conn %d",
-						cno)
-					conns[cno].Close()
 				}
-			}
+				if cno == chatConn {
+					c.chat.deliver(cbuf.buf)
+				}
+				//if cno != 0 || len(cbuf.buf) != 0 {
+				//	fmt.Printf("v %d (conn %d)\n",
+				//			len(cbuf.buf), cno)
+				//}
+				if cno > 0 && cno < len(conns) && conns[cno] != nil {
+					buf := cbuf.buf
+					blen := len(buf)
+					//println(hex.Dump(buf))
+					if blen > 0 {
+						// Data from relay for this connection
+						n, err := conns[cno].Write(buf)
+						if n < blen {
+							log.Println("Write to client: " +
+								err.Error())
+							conns[cno].Close()
+						}
+					} else {
+						// Relay indicating EOF on this conn
+						fmt.Printf("upstream closed conn %d",
+							cno)
+						conns[cno].Close()
+					}
+				}
 
-			// XXX account for downstream cell in history
+				// Account for downstream cell in history
+				rs.addHistory(cbuf.cno, cbuf.buf)
+				if isCheckpoint(rs.cellno) {
+					c.reporter.report(rs.cellno, rs.history)
+				}
 
-			// Produce and ship the next upstream cell
-			var p []byte
-			if len(upq) > 0 {
-				p = upq[0]
-				upq = upq[1:]
-				//fmt.Printf("^ %d\n", len(p))
-			}
-			slice := me.Coder.ClientEncode(p, payloadlen, me.History)
-			//println("client slice")
-			//println(hex.Dump(slice))
-			if len(slice) != clisize {
-				panic("client slice wrong size")
-			}
-			n, err := rconn.Write(slice)
-			if n != len(slice) {
-				panic("Write to relay conn: " + err.Error())
+				// Produce and ship the next upstream cell,
+				// holding back our data while the anonymity set
+				// is too small to hide in
+				var p []byte
+				send := (c.announce || len(postq) > 0 ||
+					len(upq) > 0) && c.status.ok()
+				if send && c.announce {
+					p = c.announcement(rs.cellno)
+					c.announce = false
+					idle = 0
+				} else if send && len(postq) > 0 {
+					var err error
+					p, err = chatCell(c.chatKey, rs.cellno, postq[0])
+					if err != nil {
+						log.Println("Can't post: " + err.Error())
+					}
+					postq = postq[1:]
+					idle = 0
+				} else if send {
+					p = upq[0]
+					upq = upq[1:]
+					idle = 0
+					//fmt.Printf("^ %d\n", len(p))
+				} else if clino == 0 {
+					if pad.pad(idle) {
+						p = padCell()
+					}
+					idle++
+				}
+				slice := me.Coder.ClientEncode(p, payloadlen,
+					me.History)
+				//println("client slice")
+				//println(hex.Dump(slice))
+				if len(slice) != clisize {
+					panic("client slice wrong size")
+				}
+				err := writeSlice(rconn, rs.cellno, slice)
+				rs.cellno++
+				if err != nil {
+					log.Println("Write to relay conn: " +
+						err.Error())
+					rconn.Close()
+					for range fromrelay {
+					} // wait for the reader to notice
+					break session
+				}
+
+				totupcells++
+				totupbytes += uint64(payloadlen)
+				//fmt.Printf("sent %d upstream cells, %d bytes\n",
+				//		totupcells, totupbytes)
 			}
+		}
+
+		// Cells in flight were lost with the link,
+		// so reset all proxied connections before resuming.
+		rconn.Close()
+		c.closeConns(conns)
+		upq = upq[:0]
+	}
+}
 
-			totupcells++
-			totupbytes += uint64(payloadlen)
-			//fmt.Printf("sent %d upstream cells, %d bytes\n",
-			//		totupcells, totupbytes)
+// Close all our proxied connections
+func (c *client) closeConns(conns []net.Conn) {
+	for cno := range conns {
+		if conns[cno] != nil {
+			conns[cno].Close()
+			conns[cno] = nil
 		}
 	}
 }
 
 func startTrustee(tno int) {
-	tg := dcnet.TestSetup(nil, suite, factory, nclients, ntrustees)
-	me := tg.Trustees[tno]
+	t := newTrustee(defaultGroup(), tno)
 
-	conn := openRelay(tno | 0x80)
-	println("trustee", tno, "connected")
+	// Check the relay's history digests against client reports
+	// if we know the relay's key
+	relayKey, err := configRelayKey()
+	if err != nil {
+		println("Error: bad RelayKey: " + err.Error())
+		return
+	}
+	if relayKey == nil {
+		log.Println("No RelayKey: not checking for relay equivocation")
+	}
+	clientKeys, err := configClientKeys()
+	if err != nil {
+		println("Error: bad ClientKeys: " + err.Error())
+		return
+	}
+	if clientKeys == nil {
+		log.Println("No ClientKeys: not checking client history reports")
+	}
+	t.check = newHistoryCheck(t.g.suite, tno, relayKey, clientKeys,
+		ourKeyPair())
+	lsock, err := transport.Listen(trusteeBind(tno))
+	if err != nil {
+		println("Error: can't listen for history reports: " +
+			err.Error())
+		return
+	}
+	go t.listen(lsock)
+	t.run()
+}
+
+// A trustee node, streaming its ciphertext to the decoding relay.
+type trustee struct {
+	g     *group
+	tno   int
+	me    *dcnet.TestNode
+	check *historyCheck // cross-checks the relay's downstream history
+}
+
+func newTrustee(g *group, tno int) *trustee {
+	return &trustee{g: g, tno: tno, me: g.setup().Trustees[tno],
+		check: newHistoryCheck(g.suite, tno, nil, nil, nil)}
+}
+
+// Take in the clients' history reports from connections on lsock.
+func (t *trustee) listen(lsock net.Listener) {
+	t.check.listen(lsock)
+}
+
+// Run the trustee, reconnecting to the relay whenever the link fails,
+// until the group is stopped.
+func (t *trustee) run() {
+	tno := t.tno
+	me := t.me
 
-	// Just generate ciphertext cells and stream them to the server.
+	rs := newResumeState()
 	for {
-		// Produce a cell worth of trustee ciphertext
-		tslice := me.Coder.TrusteeEncode(payloadlen)
-
-		// Send it to the relay
-		//println("trustee slice")
-		//println(hex.Dump(tslice))
-		n, err := conn.Write(tslice)
-		if n < len(tslice) || err != nil {
-			panic("can't write to socket: " + err.Error())
+		// (Re)connect to the relay and catch up to the session
+		conn, rr := resumeRelay(t.g, t.g.relays[0], tno|linkTrustee,
+			[]resumeState{rs})
+		if conn == nil {
+			return
 		}
+		for ; rs.cellno < rr.cellno; rs.cellno++ {
+			me.Coder.TrusteeEncode(payloadlen)
+		}
+		println("trustee", tno, "connected at cell", rs.cellno)
+		go t.check.readRelay(conn)
+
+		// Just generate ciphertext cells and stream them to the server.
+		for !t.g.stopped() {
+			// Produce a cell worth of trustee ciphertext
+			tslice := me.Coder.TrusteeEncode(payloadlen)
+
+			// Send it to the relay, tagged with its round
+			//println("trustee slice")
+			//println(hex.Dump(tslice))
+			err := writeSlice(conn, rs.cellno, tslice)
+			rs.cellno++
+			if err != nil {
+				log.Println("can't write to socket: " + err.Error())
+				break
+			}
+		}
+		conn.Close()
 	}
 }
 
+// Exit cleanly on Ctrl-C: our peers see the link close
+// and will resume the session once we, or a replacement, come back.
 func interceptCtrlC() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for sig := range c {
-			panic("signal: " + sig.String()) // with stacktrace
+			println("signal: " + sig.String() + ", exiting")
+			os.Exit(1)
 		}
 	}()
 }
@@ -610,19 +931,94 @@ func main() {
 	interceptCtrlC()
 
 	isrel := flag.Bool("relay", false, "Start relay node")
+	issub := flag.Int("subrelay", -1, "Start intermediate relay node")
 	iscli := flag.Int("client", -1, "Start client node")
 	istru := flag.Int("trustee", -1, "Start trustee node")
+	transparent := flag.String("transparent", "",
+		"Client port for iptables-redirected connections (Linux only)")
+	tproxy := flag.Bool("tproxy", false,
+		"Redirected connections come from TPROXY rather than REDIRECT")
+	window := flag.Int("window", 2,
+		"Relay's pipeline depth: maximum rounds in flight")
+	rate := flag.Float64("rate", 0,
+		"Relay's fixed round rate in cells/sec (0: as fast as possible)")
+	padding := flag.String("padding", "none",
+		"Slot owner's idle cell padding: none, always, or linger:N")
+	minanon := flag.Int("minanon", 0,
+		"Client's minimum anonymity set: hold data if fewer participants")
+	status := flag.String("status", "",
+		"Client address at which to serve anonymity-set /status")
+	pseudonym := flag.Bool("pseudonym", false,
+		"Client announces the persistent pseudonym in its config (created if absent)")
+	chat := flag.String("chat", "",
+		"Client address at which to serve the group chat to local programs")
+	metrics := flag.String("metrics", "",
+		"Relay address at which to serve /metrics and /debug/vars")
+	replay := flag.String("replaylog", "",
+		"Relay directory in which to keep a replay log of every round")
+	keep := flag.Int("replaykeep", replayKeep,
+		"Rounds to keep in the relay's replay log")
+	audit := flag.String("audit", "",
+		"Audit the replay log in the given directory, then exit")
+	auditRound := flag.Int64("auditround", -1,
+		"Round to decode again and show when auditing (default all)")
+	trans := flag.String("transport", "",
+		"Relay link transport: tcp, tls, or ws (default from config)")
 	flag.Parse()
 
-	readConfig()
+	if err := readConfig(); err != nil {
+		println("Error: " + err.Error())
+		return
+	}
+
+	if *trans == "" {
+		*trans = configData.Transport
+	}
+	t, err := newTransport(*trans)
+	if err != nil {
+		println("Error: " + err.Error())
+		return
+	}
+	transport = t
+
+	if *window < 1 {
+		println("Error: window must be at least 1")
+		return
+	}
+	if *keep < 1 {
+		println("Error: replaykeep must be at least 1")
+		return
+	}
 
-	if *isrel {
-		startRelay()
+	if *audit != "" {
+		err := auditReplay(defaultGroup(), *audit, *auditRound, os.Stdout)
+		if err != nil {
+			println("Audit failed: " + err.Error())
+			os.Exit(1)
+		}
+	} else if *isrel {
+		pace, err := newPacer(*rate)
+		if err != nil {
+			println("Error: " + err.Error())
+			return
+		}
+		if *metrics != "" {
+			startMetrics(*metrics)
+		}
+		startRelay(*window, pace, *replay, *keep)
+	} else if *issub >= 0 {
+		startSubRelay(*issub, *window)
 	} else if *iscli >= 0 {
-		startClient(*iscli)
+		pad, err := newPadPolicy(*padding)
+		if err != nil {
+			println("Error: " + err.Error())
+			return
+		}
+		startClient(*iscli, *transparent, *tproxy, pad, *minanon,
+			*status, *pseudonym, *chat)
 	} else if *istru >= 0 {
 		startTrustee(*istru)
 	} else {
-		println("Error: must specify -relay, -client=n, or -trustee=n")
+		println("Error: must specify -relay, -subrelay=n, -client=n, or -trustee=n")
 	}
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Relay metrics.
+//
+// Every metric is an expvar.Var, so the whole set appears as JSON
+// at /debug/vars alongside the runtime's cmdline and memstats,
+// where the deter test harness already polls for memory statistics.
+// The same metrics are rendered in Prometheus text format at /metrics.
+
+var (
+	metCells = newCounter("dissent_cells_total",
+		"Upstream cells decoded by the relay.")
+	metUpBytes = newCounter("dissent_up_bytes_total",
+		"Upstream cell payload bytes decoded.")
+	metDownCells = newCounter("dissent_down_cells_total",
+		"Downstream cells broadcast to clients.")
+	metDownBytes = newCounter("dissent_down_bytes_total",
+		"Downstream payload bytes broadcast to clients.")
+	metDecodeFailures = newCounter("dissent_decode_failures_total",
+		"Upstream cells that failed to decode.")
+	metMACFailures = newCounter("dissent_mac_failures_total",
+		"Upstream cells whose MAC check failed.")
+	metSocksStreams = newGauge("dissent_socks_streams",
+		"SOCKS streams currently open at the relay.")
+	metCellRate = newGauge("dissent_cells_per_second",
+		"Upstream cells decoded per second, over the last report period.")
+	metClientLatency = newHistogramVec("dissent_client_latency_seconds",
+		"Time from a downstream broadcast until the relay has read "+
+			"a client's upstream slice for that cell.",
+		"client", latencyBuckets)
+)
+
+// Histogram bucket upper bounds for latencies, in seconds
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1,
+	.25, .5, 1, 2.5, 5, 10}
+
+// A metric that can also render itself in Prometheus text format
+type promVar interface {
+	expvar.Var
+	writeProm(w io.Writer, name string)
+}
+
+type promEntry struct {
+	name, help, kind string
+	v                promVar
+}
+
+var promLock sync.Mutex
+var promVars []promEntry
+
+func publish(name, help, kind string, v promVar) {
+	expvar.Publish(name, v)
+	promLock.Lock()
+	promVars = append(promVars, promEntry{name, help, kind, v})
+	promLock.Unlock()
+}
+
+// Monotonically increasing counter
+type counter struct {
+	expvar.Int
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{}
+	publish(name, help, "counter", c)
+	return c
+}
+
+func (c *counter) writeProm(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+// Value that can go up and down
+type gauge struct {
+	expvar.Float
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{}
+	publish(name, help, "gauge", g)
+	return g
+}
+
+func (g *gauge) writeProm(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, promFloat(g.Value()))
+}
+
+// Cumulative histogram over fixed buckets
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds,
+		counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"count": %d, "sum": %s, "buckets": {`,
+		h.count, promFloat(h.sum))
+	cum := uint64(0)
+	for i := range h.counts {
+		cum += h.counts[i]
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, `"%s": %d`, h.bound(i), cum)
+	}
+	buf.WriteString("}}")
+	return buf.String()
+}
+
+func (h *histogram) bound(i int) string {
+	if i == len(h.bounds) {
+		return "+Inf"
+	}
+	return promFloat(h.bounds[i])
+}
+
+func (h *histogram) writeLabeled(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	cum := uint64(0)
+	for i := range h.counts {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n",
+			name, labels, sep, h.bound(i), cum)
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, promFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func (h *histogram) writeProm(w io.Writer, name string) {
+	h.writeLabeled(w, name, "")
+}
+
+// Set of histograms distinguished by the value of one label
+type histogramVec struct {
+	expvar.Map
+	label  string
+	bounds []float64
+}
+
+func newHistogramVec(name, help, label string,
+	bounds []float64) *histogramVec {
+	hv := &histogramVec{label: label, bounds: bounds}
+	hv.Init()
+	publish(name, help, "histogram", hv)
+	return hv
+}
+
+// Return the histogram for a given label value, creating it if necessary
+func (hv *histogramVec) With(value string) *histogram {
+	if h, ok := hv.Get(value).(*histogram); ok {
+		return h
+	}
+	hv.Set(value, newHistogram(hv.bounds))
+	return hv.Get(value).(*histogram)
+}
+
+func (hv *histogramVec) writeProm(w io.Writer, name string) {
+	hv.Do(func(kv expvar.KeyValue) {
+		labels := fmt.Sprintf("%s=%q", hv.label, kv.Key)
+		kv.Value.(*histogram).writeLabeled(w, name, labels)
+	})
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Serve all metrics in Prometheus text exposition format
+func promHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	promLock.Lock()
+	defer promLock.Unlock()
+	for _, e := range promVars {
+		fmt.Fprintf(w, "# HELP %s %s\n", e.name, e.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", e.name, e.kind)
+		e.v.writeProm(w, e.name)
+	}
+}
+
+// Start the metrics HTTP endpoint in the background.
+// Importing expvar has already registered /debug/vars.
+func startMetrics(addr string) {
+	http.HandleFunc("/metrics", promHandler)
+	go func() {
+		log.Printf("Serving metrics on %s\n", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Printf("Can't serve metrics: " + err.Error())
+		}
+	}()
+}
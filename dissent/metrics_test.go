@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The value of a series in the metrics served in Prometheus format
+func promValue(t *testing.T, series string) float64 {
+	w := httptest.NewRecorder()
+	promHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	s := bufio.NewScanner(w.Body)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), series+" ") {
+			v, err := strconv.ParseFloat(s.Text()[len(series)+1:], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("no series %s in metrics", series)
+	return 0
+}
+
+// The value of a metric as published at /debug/vars
+func expvarValue(t *testing.T, name string) float64 {
+	v, err := strconv.ParseFloat(expvar.Get(name).String(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// The value of a metric, checking both exports agree on it
+func metricValue(t *testing.T, name string) float64 {
+	v := expvarValue(t, name)
+	if p := promValue(t, name); p != v {
+		t.Fatalf("%s is %v at /metrics but %v at /debug/vars", name, p, v)
+	}
+	return v
+}
+
+func TestMetrics(t *testing.T) {
+	names := []string{"dissent_cells_total", "dissent_up_bytes_total",
+		"dissent_down_cells_total", "dissent_down_bytes_total",
+		"dissent_socks_streams"}
+	before := make(map[string]float64)
+	for _, name := range names {
+		before[name] = metricValue(t, name)
+	}
+
+	tn := newTestNet(t, 3, 2, 1)
+	tn.start()
+	defer tn.stop()
+
+	// A stream through the slot owner is open at the relay
+	conn, err := dialEcho(tn.socks.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := metricValue(t, "dissent_socks_streams"); v !=
+		before["dissent_socks_streams"]+1 {
+		t.Fatalf("%v SOCKS streams open, want %v", v,
+			before["dissent_socks_streams"]+1)
+	}
+	if err := testEcho(conn, 1); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// and the relay's side of the stream closes with it
+	for i := 0; metricValue(t, "dissent_socks_streams") !=
+		before["dissent_socks_streams"]; i++ {
+		if i == 100 {
+			t.Fatal("SOCKS stream still counted open")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	tn.stop()
+
+	delta := make(map[string]float64)
+	for _, name := range names {
+		delta[name] = metricValue(t, name) - before[name]
+	}
+	if delta["dissent_cells_total"] == 0 ||
+		delta["dissent_down_cells_total"] == 0 {
+		t.Fatalf("no cells counted: %v", delta)
+	}
+	if delta["dissent_up_bytes_total"] !=
+		delta["dissent_cells_total"]*payloadlen {
+		t.Fatalf("%v upstream bytes over %v cells",
+			delta["dissent_up_bytes_total"], delta["dissent_cells_total"])
+	}
+	echoed := float64(1 + 100 + payloadlen + 3*payloadlen + 17)
+	if delta["dissent_down_bytes_total"] < echoed {
+		t.Fatalf("%v downstream bytes counted, %v echoed",
+			delta["dissent_down_bytes_total"], echoed)
+	}
+
+	// Every client's slices were timed
+	for _, client := range []string{"0", "1", "2"} {
+		series := `dissent_client_latency_seconds_count{client="` +
+			client + `"}`
+		if promValue(t, series) == 0 {
+			t.Fatalf("no latency observed for client %s", client)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cover traffic and rate shaping.
+//
+// The relay's pacer decides when each round starts.
+// By default rounds run as fast as the clients answer,
+// so round timing follows the load on the network;
+// a clocked pacer instead starts rounds at a fixed rate,
+// independent of whether anyone has anything to send.
+// Since clients send exactly one upstream cell per downstream cell,
+// the relay's clock shapes the clients' upstream timing as well.
+//
+// The slot owner's padding policy decides whether an idle cell
+// goes out empty, or filled with a padding payload
+// that the relay cannot tell apart from data until it is decoded.
+
+// A pacer schedules the relay's rounds.
+type pacer interface {
+
+	// Block until the next round may start.
+	wait()
+
+	// Release the pacer once no more rounds are to run.
+	stop()
+}
+
+// Rounds run back-to-back, as fast as clients and trustees keep up.
+type freePacer struct{}
+
+func (freePacer) wait() {}
+
+func (freePacer) stop() {}
+
+// Rounds start on a fixed clock.
+// If a round overruns its slot, the missed ticks are dropped
+// rather than bunched up into a burst.
+type clockPacer struct {
+	ticker *time.Ticker
+}
+
+func (p *clockPacer) wait() {
+	<-p.ticker.C
+}
+
+func (p *clockPacer) stop() {
+	p.ticker.Stop()
+}
+
+// Create a pacer running the given number of rounds per second,
+// or a free-running pacer if rate is zero.
+func newPacer(rate float64) (pacer, error) {
+	if rate < 0 {
+		return nil, fmt.Errorf("invalid round rate %f", rate)
+	}
+	if rate == 0 {
+		return freePacer{}, nil
+	}
+	period := time.Duration(float64(time.Second) / rate)
+	return &clockPacer{time.NewTicker(period)}, nil
+}
+
+// A padding policy decides whether the slot owner
+// fills an idle cell with padding, given the number of
+// consecutive idle cells since it last sent data.
+type padPolicy interface {
+	pad(idle int) bool
+}
+
+// Never pad: idle cells are visibly empty to the relay.
+type padNone struct{}
+
+func (padNone) pad(idle int) bool { return false }
+
+// Always pad: every cell we own looks like a data cell.
+type padAlways struct{}
+
+func (padAlways) pad(idle int) bool { return true }
+
+// Keep padding for a while after data stops,
+// masking exactly when a burst of activity ends.
+type padLinger struct {
+	cells int
+}
+
+func (p padLinger) pad(idle int) bool { return idle < p.cells }
+
+// Parse a padding policy: "none", "always", or "linger:N".
+func newPadPolicy(s string) (padPolicy, error) {
+	switch {
+	case s == "" || s == "none":
+		return padNone{}, nil
+	case s == "always":
+		return padAlways{}, nil
+	case strings.HasPrefix(s, "linger:"):
+		n, err := strconv.Atoi(s[len("linger:"):])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid padding policy %q", s)
+		}
+		return padLinger{n}, nil
+	default:
+		return nil, fmt.Errorf("unknown padding policy %q", s)
+	}
+}
+
+// Payload of a padding cell:
+// a null connection number tells the relay there is no data.
+func padCell() []byte {
+	return make([]byte, payloadlen)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewPacer(t *testing.T) {
+	if _, err := newPacer(-1); err == nil {
+		t.Fatal("negative rate accepted")
+	}
+	p, err := newPacer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(freePacer); !ok {
+		t.Fatalf("rate 0 gave a %T", p)
+	}
+	p.wait()
+	p.stop()
+}
+
+// A clocked pacer starts rounds at its rate, however fast they run
+func TestClockPacer(t *testing.T) {
+	const rate, rounds = 200, 40
+	p, err := newPacer(rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+	start := time.Now()
+	for i := 0; i < rounds; i++ {
+		p.wait()
+	}
+	want := rounds * time.Second / rate
+	if took := time.Since(start); took < want-want/10 || took > 2*want {
+		t.Fatalf("%d rounds at %d/s took %s", rounds, rate, took)
+	}
+}
+
+// The relay runs no more rounds than its clock allows,
+// with nobody having anything to send
+func TestPacedRelay(t *testing.T) {
+	const rate = 10
+	tn := newTestNet(t, 3, 2, 1)
+	pace, err := newPacer(rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.relay.pacer = pace
+	tn.start()
+	defer tn.stop()
+
+	// Let the session get going before counting
+	for metCells.Value() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	const period = 2 * time.Second
+	before := metCells.Value()
+	time.Sleep(period)
+	cells := metCells.Value() - before
+	want := int64(rate * period / time.Second)
+	if cells > want+1 || cells < want/2 {
+		t.Fatalf("%d cells in %s at %d/s", cells, period, rate)
+	}
+}
+
+func TestPadPolicy(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		pads []bool // by number of idle cells
+	}{
+		{"", []bool{false, false}},
+		{"none", []bool{false, false}},
+		{"always", []bool{true, true, true}},
+		{"linger:2", []bool{true, true, false, false}},
+	} {
+		p, err := newPadPolicy(c.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for idle, want := range c.pads {
+			if p.pad(idle) != want {
+				t.Fatalf("%q pads after %d idle cells: %v",
+					c.s, idle, !want)
+			}
+		}
+	}
+	for _, s := range []string{"linger:", "linger:-1", "sometimes"} {
+		if _, err := newPadPolicy(s); err == nil {
+			t.Fatalf("padding policy %q accepted", s)
+		}
+	}
+}
+
+// Count the cells the relay decoded as padding in a session without
+// data, with the slot owner padding by a given policy.
+func paddedCells(t *testing.T, pad padPolicy, rounds int64) int {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tn := newTestNet(t, 3, 2, 1)
+	tn.clients[0].pad = pad
+	l, err := openReplayLog(dir, replayKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.relay.replay = l
+	before := metCells.Value()
+	tn.start()
+	for metCells.Value()-before < rounds {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tn.stop()
+
+	recs, err := readReplayLog(dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(recs)) < rounds {
+		t.Fatalf("%d rounds logged", len(recs))
+	}
+	padded := 0
+	for _, rr := range recs {
+		if rr.cell != nil {
+			padded++
+		}
+	}
+	return padded
+}
+
+// Idle cells go out as cover traffic just as the policy says
+func TestCoverPadding(t *testing.T) {
+	const rounds = 50
+	if n := paddedCells(t, padNone{}, rounds); n != 0 {
+		t.Fatalf("%d cells padded without padding", n)
+	}
+	if n := paddedCells(t, padLinger{5}, rounds); n != 5 {
+		t.Fatalf("%d cells padded lingering for 5", n)
+	}
+	if n := paddedCells(t, padAlways{}, rounds); n < rounds {
+		t.Fatalf("%d cells padded of at least %d", n, rounds)
+	}
+}
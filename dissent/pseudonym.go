@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"log"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
+	"github.com/dedis/crypto/suites"
+	"github.com/dedis/prifi/dcnet"
+)
+
+// Long-term pseudonyms.
+//
+// The slot keys set up for each session are ephemeral,
+// so nothing lets a service recognise the same anonymous user
+// across sessions. A client may instead keep a pseudonym keypair
+// in its config, created on first use.
+// The pseudonym is kept apart from the client's identity key-pairs,
+// which the other nodes know it by.
+// At the start of every session the slot owner takes the pseudonym
+// as its slot's owner keypair, and announces the public key,
+// signed for that particular round,
+// anonymously through its own slot, as connection 0.
+// The relay checks the signature and adopts the key as the slot's owner,
+// which is thus tied to the slot but never to a client's identity.
+
+// Domain separation for pseudonym announcement signatures
+const pseudonymLabel = "dissent-pseudonym"
+
+var errAnnounceFormat = errors.New("malformed pseudonym announcement")
+
+// Public key of the current slot owner's pseudonym, hex-encoded
+var slotPseudonym = expvar.NewString("dissent_slot_pseudonym")
+
+// Load our pseudonym keypair in ciphersuite s from config file f,
+// where keys lists the pseudonyms configured,
+// creating and saving a fresh one if there is none for s yet.
+func loadPseudonym(f *config.File, keys *config.Keys, s abstract.Suite) (
+	*config.KeyPair, error) {
+
+	pairs, err := f.Keys(keys, suites.All(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pairs {
+		if pairs[i].Suite.String() == s.String() {
+			return &pairs[i], nil
+		}
+	}
+	kp, err := f.GenKey(keys, s)
+	if err != nil {
+		return nil, err
+	}
+	return &kp, nil
+}
+
+func announceMessage(round uint64, pub []byte) []byte {
+	msg := []byte(pseudonymLabel)
+	msg = append(msg, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(msg[len(msg)-8:], round)
+	return append(msg, pub...)
+}
+
+// Build the announcement of our pseudonym for a given round
+func announcePseudonym(kp *config.KeyPair, round uint64) []byte {
+	pub, _ := kp.Public.MarshalBinary()
+	sig := anon.Sign(kp.Suite, random.Stream, announceMessage(round, pub),
+		anon.Set{kp.Public}, nil, 0, kp.Secret)
+	buf := make([]byte, 2, 2+len(pub)+2+len(sig))
+	binary.BigEndian.PutUint16(buf, uint16(len(pub)))
+	buf = append(buf, pub...)
+	buf = append(buf, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(sig)))
+	return append(buf, sig...)
+}
+
+// Check an announcement decoded from the given round,
+// and return the pseudonym it announces.
+func checkAnnouncement(s abstract.Suite, round uint64, buf []byte) (
+	abstract.Point, error) {
+
+	if len(buf) < 2 {
+		return nil, errAnnounceFormat
+	}
+	publen := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+publen+2 {
+		return nil, errAnnounceFormat
+	}
+	pub := buf[2 : 2+publen]
+	buf = buf[2+publen:]
+	siglen := int(binary.BigEndian.Uint16(buf))
+	if len(buf) != 2+siglen {
+		return nil, errAnnounceFormat
+	}
+	sig := buf[2:]
+
+	p := s.Point()
+	if err := p.UnmarshalBinary(pub); err != nil {
+		return nil, err
+	}
+	_, err := anon.Verify(s, announceMessage(round, pub),
+		anon.Set{p}, nil, sig)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Record the slot owner's pseudonym from an announcement
+// decoded from the given round, as the owner key of node me's slot.
+func recordPseudonym(s abstract.Suite, me *dcnet.TestNode, round uint64,
+	buf []byte) {
+
+	p, err := checkAnnouncement(s, round, buf)
+	if err != nil {
+		log.Println("Bad pseudonym announcement: " + err.Error())
+		return
+	}
+	me.SetOwner(nil, p)
+	pub, _ := p.MarshalBinary()
+	slotPseudonym.Set(hex.EncodeToString(pub))
+	log.Printf("Slot owner is pseudonym %s", slotPseudonym.Value())
+}
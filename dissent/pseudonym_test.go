@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/suites"
+)
+
+// Load our config from the home directory
+func testConfig(t *testing.T) (*config.File, *ConfigData) {
+	f := &config.File{}
+	data := &ConfigData{}
+	if err := f.Load("dissent", data); err != nil {
+		t.Fatal(err)
+	}
+	return f, data
+}
+
+func TestPseudonymPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dissent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	home := os.Getenv("HOME")
+	os.Setenv("HOME", dir)
+	defer os.Setenv("HOME", home)
+
+	f, data := testConfig(t)
+	kp, err := loadPseudonym(f, &data.Pseudonym, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Pseudonym) != 1 || len(data.Keys) != 0 {
+		t.Fatalf("pseudonym not recorded apart from identity keys: %+v",
+			data)
+	}
+
+	// Loading the saved config again gives the same pseudonym
+	f, data = testConfig(t)
+	again, err := loadPseudonym(f, &data.Pseudonym, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Public.Equal(kp.Public) {
+		t.Fatal("pseudonym changed across loads")
+	}
+
+	// Another ciphersuite gets a pseudonym of its own
+	other := suites.All()["Ed25519"]
+	okp, err := loadPseudonym(f, &data.Pseudonym, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if okp.Suite.String() != other.String() || len(data.Pseudonym) != 2 {
+		t.Fatalf("no separate pseudonym for %s", other)
+	}
+}
+
+func TestPseudonymAnnounce(t *testing.T) {
+	kp := testKeyPair()
+	a := announcePseudonym(kp, 42)
+
+	p, err := checkAnnouncement(suite, 42, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Equal(kp.Public) {
+		t.Fatal("announced wrong pseudonym")
+	}
+	if _, err := checkAnnouncement(suite, 43, a); err == nil {
+		t.Fatal("announcement replayed in another round")
+	}
+	if _, err := checkAnnouncement(suite, 42, a[:len(a)-1]); err == nil {
+		t.Fatal("truncated announcement accepted")
+	}
+	bad := append([]byte{}, a...)
+	bad[len(bad)-1]++
+	if _, err := checkAnnouncement(suite, 42, bad); err == nil {
+		t.Fatal("tampered announcement accepted")
+	}
+}
+
+func TestPseudonymEndToEnd(t *testing.T) {
+	kp := testKeyPair()
+	pub, _ := kp.Public.MarshalBinary()
+	tn := newTestNet(t, 2, 2, 1)
+	tn.clients[0].pseudonym = kp
+	tn.start()
+	defer tn.stop()
+
+	for i := 0; i < 100; i++ {
+		if slotPseudonym.Value() == hex.EncodeToString(pub) {
+			if !tn.relay.me.Owner().Equal(kp.Public) {
+				t.Fatal("relay did not adopt the pseudonym as slot owner")
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("relay never learned the slot owner's pseudonym")
+}
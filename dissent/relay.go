@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
 	"github.com/dedis/prifi/dcnet"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -20,9 +23,47 @@ type AnonSet struct {
 	trustees []Trustee
 }
 
-func startRelay() {
-	tg := dcnet.TestSetup(nil, suite, factory, nclients, ntrustees)
-	me := tg.Relay
+// State of the decoding relay, surviving across client and trustee links.
+type relay struct {
+	g         *group
+	me        *dcnet.TestNode
+	lsock     net.Listener
+	myclients []int // clients attached directly to us
+
+	// Connects to the destinations of proxied connections
+	dial func(network, addr string) (net.Conn, error)
+
+	// Current links to our clients, the trustees and intermediate relays
+	csock []net.Conn
+	tsock []net.Conn
+	rsock []net.Conn
+
+	window int   // pipeline depth: maximum rounds in flight
+	pacer  pacer // schedules the start of each round
+
+	// Anonymity-set reports, published if we have a key to sign them
+	statusKey  *config.KeyPair
+	statusNext time.Time // when the next report is due
+	interval   uint64    // number of reports published
+	sending    []bool    // clients that sent a slice since the last report
+
+	cellno     uint64 // number of cells decoded in this session
+	history    []byte // hash chain over the downstream cells broadcast
+	conns      map[int]chan<- []byte
+	downstream chan connbuf
+	chatq      [][]byte // group messages awaiting broadcast, up to chatRelayQueue
+
+	// Replay log of every round decoded, if kept
+	replay *replayLog
+
+	// Periodic stats reporting
+	begin      time.Time
+	report     time.Time
+	lastreport time.Time
+	lastcells  int64
+}
+
+func startRelay(window int, pace pacer, replay string, keep int) {
 
 	// Start our own local HTTP proxy for simplicity.
 	/*
@@ -34,161 +75,470 @@ func startRelay() {
 		}()
 	*/
 
-	lsock, err := net.Listen("tcp", bindport)
+	lsock, err := transport.Listen(relayBind(0))
 	if err != nil {
 		panic("Can't open listen socket:" + err.Error())
 	}
 
-	// Wait for all the clients and trustees to connect
+	r := newRelay(defaultGroup(), lsock, window, pace)
+	if replay != "" {
+		if r.replay, err = openReplayLog(replay, keep); err != nil {
+			panic("Can't open replay log: " + err.Error())
+		}
+	}
+	r.statusKey = ourKeyPair()
+	if r.statusKey == nil {
+		log.Println("No key-pair: not publishing anonymity-set reports")
+	}
+	if err := r.serve(); err != nil {
+		panic("Can't resume session: " + err.Error())
+	}
+}
+
+// Create the decoding relay for group g,
+// accepting links from the group's nodes on lsock.
+func newRelay(g *group, lsock net.Listener, window int, pace pacer) *relay {
+	r := &relay{g: g, me: g.setup().Relay, lsock: lsock,
+		myclients:  g.relayClients(0),
+		history:    newResumeState().history,
+		dial:       net.Dial,
+		window:     window,
+		pacer:      pace,
+		sending:    make([]bool, g.nclients),
+		conns:      make(map[int]chan<- []byte),
+		downstream: make(chan connbuf)}
+	r.begin = time.Now()
+	r.report = r.begin
+	r.lastreport = r.begin
+	return r
+}
+
+// Run the session, resuming it whenever a link fails,
+// until we can no longer accept links or the group is stopped.
+func (r *relay) serve() error {
+	defer r.pacer.stop()
+	defer r.closeReplay()
+	for {
+		if err := r.accept(); err != nil {
+			r.closeLinks()
+			if r.g.stopped() {
+				return nil
+			}
+			return err
+		}
+		err := r.run()
+		if r.g.stopped() {
+			r.closeLinks()
+			return nil
+		}
+		log.Printf("Relay link failed: %s; resuming session",
+			err.Error())
+		r.closeLinks()
+		r.resetConns()
+	}
+}
+
+// Close the replay log, if we keep one.
+func (r *relay) closeReplay() {
+	if r.replay == nil {
+		return
+	}
+	if err := r.replay.close(); err != nil {
+		log.Println("Can't close replay log: " + err.Error())
+	}
+	r.replay = nil
+}
+
+// Wait for all our clients, the trustees,
+// and any intermediate relays to connect,
+// and agree with them on where to resume the session.
+func (r *relay) accept() error {
 	ccli := 0
 	ctru := 0
-	csock := make([]net.Conn, nclients)
-	tsock := make([]net.Conn, ntrustees)
-	for ccli < nclients || ctru < ntrustees {
-		fmt.Printf("Waiting for %d clients, %d trustees\n",
-			nclients-ccli, ntrustees-ctru)
+	crel := 1 // counting ourselves
+	g := r.g
+	r.csock = make([]net.Conn, g.nclients)
+	r.tsock = make([]net.Conn, g.ntrustees)
+	r.rsock = make([]net.Conn, g.nrelays)
+	crec := make([]resumeState, g.nclients)
+	trec := make([]resumeState, g.ntrustees)
+	for ccli < len(r.myclients) || ctru < g.ntrustees || crel < g.nrelays {
+		fmt.Printf("Waiting for %d clients, %d trustees, %d relays\n",
+			len(r.myclients)-ccli, g.ntrustees-ctru, g.nrelays-crel)
 
-		conn, err := lsock.Accept()
+		conn, err := r.lsock.Accept()
 		if err != nil {
-			panic("Listen error:" + err.Error())
+			return err
 		}
 
 		b := make([]byte, 1)
-		n, err := conn.Read(b)
-		if n < 1 || err != nil {
-			panic("Read error:" + err.Error())
+		n, err := io.ReadFull(conn, b)
+		if n < 1 {
+			log.Printf("Read error: " + err.Error())
+			conn.Close()
+			continue
+		}
+		if !linkAllowed(conn, b[0]) {
+			log.Printf("Rejecting node %d: not authenticated as it",
+				b[0])
+			conn.Close()
+			continue
+		}
+		if err := readSuite(conn, g.suite); err != nil {
+			log.Printf("Rejecting node %d: %s", b[0], err.Error())
+			conn.Close()
+			continue
 		}
 
-		node := int(b[0] & 0x7f)
-		if b[0]&0x80 == 0 && node < nclients {
-			if csock[node] != nil {
-				panic("Oops, client connected twice")
+		// A node may reconnect while we are still waiting for others;
+		// its newest link replaces any older one.
+		node := int(b[0] &^ (linkTrustee | linkRelay))
+		if b[0]&linkTrustee != 0 && node < g.ntrustees {
+			rec, err := readResume(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			if r.tsock[node] != nil {
+				r.tsock[node].Close()
+			} else {
+				ctru++
 			}
-			csock[node] = conn
-			ccli++
-		} else if b[0]&0x80 != 0 && node < ntrustees {
-			if tsock[node] != nil {
-				panic("Oops, trustee connected twice")
+			r.tsock[node] = conn
+			trec[node] = rec
+		} else if b[0]&linkRelay != 0 && node > 0 && node < g.nrelays {
+			sub := g.relayClients(node)
+			recs := make([]resumeState, len(sub))
+			for i := range recs {
+				if recs[i], err = readResume(conn); err != nil {
+					break
+				}
 			}
-			tsock[node] = conn
-			ctru++
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			if r.rsock[node] != nil {
+				r.rsock[node].Close()
+			} else {
+				crel++
+			}
+			r.rsock[node] = conn
+			for i, clino := range sub {
+				crec[clino] = recs[i]
+			}
+		} else if b[0]&(linkTrustee|linkRelay) == 0 &&
+			node < g.nclients && g.clientRelay(node) == 0 {
+			rec, err := readResume(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			if r.csock[node] != nil {
+				r.csock[node].Close()
+			} else {
+				ccli++
+			}
+			r.csock[node] = conn
+			crec[node] = rec
 		} else {
-			panic("illegal node number")
+			log.Printf("illegal node number %d", b[0])
+			conn.Close()
 		}
 	}
-	println("All clients and trustees connected")
+	println("All clients, trustees and relays connected")
 
-	// Create ciphertext slice buffers for all clients and trustees
-	clisize := me.Coder.ClientCellSize(payloadlen)
-	cslice := make([][]byte, nclients)
-	for i := 0; i < nclients; i++ {
-		cslice[i] = make([]byte, clisize)
+	// Agree on where to resume, and catch up to it ourselves
+	rs, err := resumePoint(r.cellno, r.window, crec, trec)
+	if err != nil {
+		r.closeLinks()
+		return err
 	}
+	for ; r.cellno < rs.cellno; r.cellno++ {
+		r.me.Coder.DecodeStart(payloadlen, r.me.History)
+	}
+	r.history = rs.history
+	fmt.Printf("Resuming session at cell %d\n", r.cellno)
+
+	reply := rs.encode()
+	for _, conn := range r.links() {
+		if _, err := conn.Write(reply); err != nil {
+			r.closeLinks()
+			return err
+		}
+	}
+	return nil
+}
+
+// All of our current links
+func (r *relay) links() []net.Conn {
+	links := make([]net.Conn, 0)
+	for _, socks := range [][]net.Conn{r.csock, r.tsock, r.rsock} {
+		for _, conn := range socks {
+			if conn != nil {
+				links = append(links, conn)
+			}
+		}
+	}
+	return links
+}
+
+func (r *relay) closeLinks() {
+	for _, conn := range r.links() {
+		conn.Close()
+	}
+}
+
+// Reset all proxied connections,
+// whose data in flight was lost along with the failed link.
+func (r *relay) resetConns() {
+	for cno, conn := range r.conns {
+		go func(conn chan<- []byte) {
+			conn <- []byte{} // close indication
+		}(conn)
+		delete(r.conns, cno)
+	}
+}
+
+// Sign a report on the current anonymity set,
+// to be broadcast in the given round.
+// Only clients whose slices we decoded since the last report count:
+// a client that stops sending holds up every round,
+// so no report is sent until it sends again or the session resumes.
+func (r *relay) anonReport(round uint64) []byte {
+	ar := &anonReport{round: round, interval: r.interval}
+	for i := range r.sending {
+		if r.sending[i] {
+			ar.participants++
+		}
+		r.sending[i] = false
+	}
+	for i := range r.tsock {
+		if r.tsock[i] != nil {
+			ar.trustees = append(ar.trustees, i)
+		}
+	}
+	ar.sign(r.statusKey)
+	r.interval++
+	return ar.encode()
+}
+
+// Account for a downstream cell broadcast in the given round,
+// and at each checkpoint send the trustees our signed history digest.
+func (r *relay) checkpoint(round uint64, down connbuf) error {
+	r.history = chainHistory(r.history, down.cno, down.buf)
+	if r.statusKey == nil || !isCheckpoint(round) {
+		return nil
+	}
+	d := &historyDigest{round: round, history: r.history}
+	d.sign(r.statusKey)
+	buf := d.encode()
+	for i := 0; i < r.g.ntrustees; i++ {
+		if err := writeBlob(r.tsock[i], buf); err != nil {
+			return errors.New("Write to trustee: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Run the session over the current set of links until one of them fails.
+func (r *relay) run() error {
+	me := r.me
+	g := r.g
+
+	// Slices arrive tagged with their round,
+	// and are released to the decoder in round order on each link.
+	clisize := me.Coder.ClientCellSize(payloadlen)
 	trusize := me.Coder.TrusteeCellSize(payloadlen)
-	tslice := make([][]byte, ntrustees)
-	for i := 0; i < ntrustees; i++ {
-		tslice[i] = make([]byte, trusize)
+	cq := make([]*roundQueue, g.nclients)
+	for _, i := range r.myclients {
+		cq[i] = newRoundQueue(r.cellno, r.window)
+	}
+	tq := make([]*roundQueue, g.ntrustees)
+	for i := range tq {
+		tq[i] = newRoundQueue(r.cellno, r.window)
 	}
+	rq := make([]*roundQueue, g.nrelays)
+	for i := 1; i < g.nrelays; i++ {
+		rq[i] = newRoundQueue(r.cellno, r.window)
+	}
+	downno := r.cellno // next round to broadcast
 
-	// Periodic stats reporting
-	begin := time.Now()
-	report := begin
-	period, _ := time.ParseDuration("3s")
-	totupcells := int64(0)
-	totupbytes := int64(0)
-	totdowncells := int64(0)
-	totdownbytes := int64(0)
+	// Each report covers a whole interval of this session
+	for i := range r.sending {
+		r.sending[i] = false
+	}
+	r.statusNext = time.Now().Add(statusInterval)
+
+	// Per-client upstream latency histograms
+	clat := make([]*histogram, g.nclients)
+	for _, i := range r.myclients {
+		clat[i] = metClientLatency.With(strconv.Itoa(i))
+	}
 
-	conns := make(map[int]chan<- []byte)
-	downstream := make(chan connbuf)
+	period, _ := time.ParseDuration("3s")
 	nulldown := connbuf{} // default empty downstream cell
-	window := 2           // Maximum cells in-flight
 	inflight := 0         // Current cells in-flight
+
+	// Broadcast times of the cells in flight
+	sent := make([]time.Time, 0, r.window)
 	for {
 		//print(".")
 
 		// Show periodic reports
 		now := time.Now()
-		if now.After(report) {
-			duration := now.Sub(begin).Seconds()
+		if now.After(r.report) {
+			duration := now.Sub(r.begin).Seconds()
+			totupcells := metCells.Value()
+			totupbytes := metUpBytes.Value()
+			totdownbytes := metDownBytes.Value()
 			fmt.Printf("@ %f sec: %d cells, %f cells/sec, %d upbytes, %f upbytes/sec, %d downbytes, %f downbytes/sec\n",
 				duration,
 				totupcells, float64(totupcells)/duration,
 				totupbytes, float64(totupbytes)/duration,
 				totdownbytes, float64(totdownbytes)/duration)
 
+			// Cell rate over the period just ended
+			elapsed := now.Sub(r.lastreport).Seconds()
+			metCellRate.Set(float64(totupcells-r.lastcells) / elapsed)
+			r.lastreport = now
+			r.lastcells = totupcells
+
 			// Next report time
-			report = now.Add(period)
+			r.report = now.Add(period)
 		}
 
-		// See if there's any downstream data to forward.
+		// Wait for the next round to start
+		r.pacer.wait()
+
+		// See if there's an anonymity-set report due,
+		// a group message to broadcast,
+		// or any downstream data to forward.
 		var downbuf connbuf
-		select {
-		case downbuf = <-downstream: // some data to forward downstream
-			//fmt.Printf("v %d\n", len(dbuf)-6)
-		default: // nothing at the moment to forward
-			downbuf = nulldown
+		if r.statusKey != nil && time.Now().After(r.statusNext) {
+			downbuf = connbuf{0, r.anonReport(downno)}
+			r.statusNext = time.Now().Add(statusInterval)
+		} else if len(r.chatq) > 0 {
+			downbuf = connbuf{chatConn, r.chatq[0]}
+			r.chatq = r.chatq[1:]
+		} else {
+			select {
+			case downbuf = <-r.downstream: // data to forward downstream
+				//fmt.Printf("v %d\n", len(dbuf)-6)
+			default: // nothing at the moment to forward
+				downbuf = nulldown
+			}
 		}
 		dlen := len(downbuf.buf)
-		dbuf := make([]byte, 6+dlen)
-		binary.BigEndian.PutUint32(dbuf[0:4], uint32(downbuf.cno))
-		binary.BigEndian.PutUint16(dbuf[4:6], uint16(dlen))
-		copy(dbuf[6:], downbuf.buf)
+		dbuf := encodeDown(downno, downbuf.cno, downbuf.buf)
+		downno++
 
-		// Broadcast the downstream data to all clients.
-		for i := 0; i < nclients; i++ {
+		// Broadcast the downstream data to all our clients,
+		// and to the intermediate relays for their clients.
+		for _, i := range r.myclients {
 			//fmt.Printf("client %d -> %d downstream bytes\n",
-			//		i, len(dbuf)-6)
-			n, err := csock[i].Write(dbuf)
-			if n != 6+dlen {
-				panic("Write to client: " + err.Error())
+			//		i, len(dbuf)-downhdrlen)
+			n, err := r.csock[i].Write(dbuf)
+			if n != len(dbuf) {
+				return errors.New("Write to client: " + err.Error())
 			}
 		}
-		totdowncells++
-		totdownbytes += int64(dlen)
+		for i := 1; i < g.nrelays; i++ {
+			n, err := r.rsock[i].Write(dbuf)
+			if n != len(dbuf) {
+				return errors.New("Write to relay: " + err.Error())
+			}
+		}
+		if err := r.checkpoint(downno-1, downbuf); err != nil {
+			return err
+		}
+		sent = append(sent, time.Now())
+		metDownCells.Add(1)
+		metDownBytes.Add(int64(dlen))
 		//fmt.Printf("sent %d downstream cells, %d bytes \n",
 		//		totdowncells, totdownbytes)
 
 		inflight++
-		if inflight < window {
+		if inflight < r.window {
 			continue // Get more cells in flight
 		}
 
 		me.Coder.DecodeStart(payloadlen, me.History)
+		var rr *replayRound
+		if r.replay != nil {
+			rr = &replayRound{round: r.cellno}
+		}
 
 		// Collect a cell ciphertext from each trustee
-		for i := 0; i < ntrustees; i++ {
-			n, err := io.ReadFull(tsock[i], tslice[i])
-			if n < trusize {
-				panic("Read from client: " + err.Error())
+		for i := 0; i < g.ntrustees; i++ {
+			tslice, err := collectSlice(r.tsock[i], tq[i], trusize)
+			if err != nil {
+				return errors.New("Read from trustee: " + err.Error())
 			}
 			//println("trustee slice")
-			//println(hex.Dump(tslice[i]))
-			me.Coder.DecodeTrustee(tslice[i])
+			//println(hex.Dump(tslice))
+			me.Coder.DecodeTrustee(tslice)
+			rr.add(replayTrustee, i, tslice)
 		}
 
-		// Collect an upstream ciphertext from each client
-		for i := 0; i < nclients; i++ {
-			n, err := io.ReadFull(csock[i], cslice[i])
-			if n < clisize {
-				panic("Read from client: " + err.Error())
+		// Collect an upstream ciphertext from each of our clients
+		for _, i := range r.myclients {
+			cslice, err := collectSlice(r.csock[i], cq[i], clisize)
+			if err != nil {
+				return errors.New("Read from client: " + err.Error())
 			}
+			r.sending[i] = true
+			clat[i].Observe(time.Since(sent[0]).Seconds())
 			//println("client slice")
-			//println(hex.Dump(cslice[i]))
-			me.Coder.DecodeClient(cslice[i])
+			//println(hex.Dump(cslice))
+			me.Coder.DecodeClient(cslice)
+			rr.add(replayClient, i, cslice)
+		}
+
+		// Collect the combined upstream ciphertext
+		// of each intermediate relay's clients
+		for i := 1; i < g.nrelays; i++ {
+			rslice, err := collectSlice(r.rsock[i], rq[i], clisize)
+			if err != nil {
+				return errors.New("Read from relay: " + err.Error())
+			}
+			for _, c := range g.relayClients(i) {
+				r.sending[c] = true
+			}
+			me.Coder.DecodeClient(rslice)
+			rr.add(replayRelay, i, rslice)
 		}
 
 		outb := me.Coder.DecodeCell()
+		if rr != nil {
+			rr.cell = outb
+			rr.err = replayErrCode(me.Coder.DecodeErr())
+			if err := r.replay.append(rr); err != nil {
+				log.Println("Can't write replay log: " + err.Error() +
+					"; no longer logging")
+				r.closeReplay()
+			}
+		}
 		inflight--
+		sent = sent[1:]
+		r.cellno++
 
-		totupcells++
-		totupbytes += int64(payloadlen)
+		metCells.Add(1)
+		metUpBytes.Add(payloadlen)
 		//fmt.Printf("received %d upstream cells, %d bytes\n",
 		//		totupcells, totupbytes)
 
 		// Process the decoded cell
 		if outb == nil {
-			continue // empty or corrupt upstream cell
+			switch me.Coder.DecodeErr() {
+			case nil: // empty upstream cell
+			case dcnet.ErrMAC:
+				metMACFailures.Add(1)
+				metDecodeFailures.Add(1)
+			default:
+				metDecodeFailures.Add(1)
+			}
+			continue
 		}
 		if len(outb) != payloadlen {
 			panic("DecodeCell produced wrong-size payload")
@@ -198,18 +548,31 @@ func startRelay() {
 		cno := int(binary.BigEndian.Uint32(outb[0:4]))
 		uplen := int(binary.BigEndian.Uint16(outb[4:6]))
 		//fmt.Printf("^ %d (conn %d)\n", uplen, cno)
+		if 6+uplen > payloadlen {
+			log.Printf("upstream cell invalid length %d", 6+uplen)
+			continue
+		}
 		if cno == 0 {
+			if uplen > 0 { // slot owner announcing its pseudonym
+				recordPseudonym(g.suite, r.me, r.cellno-1,
+					outb[6:6+uplen])
+			}
 			continue // no upstream data
 		}
-		conn := conns[cno]
-		if conn == nil { // client initiating new connection
-			conn = relayNewConn(cno, downstream)
-			conns[cno] = conn
-		}
-		if 6+uplen > payloadlen {
-			log.Printf("upstream cell invalid length %d", 6+uplen)
+		if cno == chatConn { // group message to broadcast
+			m := relayChat(g.suite, r.cellno-1, outb[6:6+uplen])
+			if m != nil && len(r.chatq) >= chatRelayQueue {
+				log.Println("Dropping chat message: queue full")
+			} else if m != nil {
+				r.chatq = append(r.chatq, m)
+			}
 			continue
 		}
+		conn := r.conns[cno]
+		if conn == nil { // client initiating new connection
+			conn = relayNewConn(cno, r.downstream, r.dial)
+			r.conns[cno] = conn
+		}
 		conn <- outb[6 : 6+uplen]
 	}
 }
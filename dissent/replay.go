@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dedis/prifi/dcnet"
+)
+
+// Relay replay log.
+//
+// For accountability the decoding relay can keep a log of every round:
+// each trustee slice, client slice and intermediate relay's combined
+// slice it decoded, in the order it combined them, and the cell
+// that came out. Records are hash-chained, each one carrying the hash
+// of the one before it, so records cannot be altered, dropped or
+// reordered without breaking the chain, even across relay restarts.
+//
+// The log is a directory of segment files, each holding a bounded
+// number of records. The oldest segments are removed as long as those
+// left hold at least the number of rounds to keep, however many
+// segments that takes when relay restarts leave some short.
+// Since the relay's decoding state depends only on the group setup
+// and on how many rounds came before, any logged round can be
+// decoded again from its slices alone, reproducing the relay's work
+// for a blame investigation: see auditReplay.
+
+// Records per segment file
+const replaySegRounds = 1000
+
+// Default number of rounds kept in the replay log
+const replayKeep = 10000
+
+// Segment file names, by sequence number
+const replaySegFormat = "replay-%08d.log"
+
+var errReplayFormat = errors.New("malformed replay log record")
+var errReplayChain = errors.New("replay log hash chain broken")
+
+// Kinds of slices in a replay record
+const (
+	replayTrustee = 't'
+	replayClient  = 'c'
+	replayRelay   = 'r'
+)
+
+// Decoding outcomes, as recorded
+var replayErrs = []error{nil, dcnet.ErrCellHeader, dcnet.ErrMAC}
+
+// One slice combined into a round
+type replaySlice struct {
+	kind byte
+	node int
+	data []byte
+}
+
+// Everything the relay combined in one round, and what came out
+type replayRound struct {
+	prev   []byte // hash of the previous record
+	round  uint64
+	slices []replaySlice
+	cell   []byte // decoded cell, nil if none
+	err    byte   // index of the decoding error in replayErrs
+	hash   []byte // hash of this record
+}
+
+// Note a slice combined into the round; a nil round logs nothing.
+func (rr *replayRound) add(kind byte, node int, data []byte) {
+	if rr == nil {
+		return
+	}
+	rr.slices = append(rr.slices, replaySlice{kind, node, data})
+}
+
+// Code for a decoding outcome, one past replayErrs for unknown errors
+func replayErrCode(err error) byte {
+	for i := range replayErrs {
+		if err == replayErrs[i] {
+			return byte(i)
+		}
+	}
+	return byte(len(replayErrs))
+}
+
+func (rr *replayRound) encode() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(rr.prev)
+	binary.Write(buf, binary.BigEndian, rr.round)
+	buf.WriteByte(rr.err)
+	binary.Write(buf, binary.BigEndian, uint16(len(rr.slices)))
+	for _, s := range rr.slices {
+		buf.WriteByte(s.kind)
+		binary.Write(buf, binary.BigEndian, uint16(s.node))
+		binary.Write(buf, binary.BigEndian, uint32(len(s.data)))
+		buf.Write(s.data)
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(rr.cell)))
+	buf.Write(rr.cell)
+	return buf.Bytes()
+}
+
+func decodeReplayRound(body []byte) (*replayRound, error) {
+	h := sha256.Sum256(body)
+	rr := &replayRound{hash: h[:]}
+	r := bytes.NewReader(body)
+	rr.prev = make([]byte, sha256.Size)
+	var nslices uint16
+	if _, err := io.ReadFull(r, rr.prev); err != nil {
+		return nil, errReplayFormat
+	}
+	if binary.Read(r, binary.BigEndian, &rr.round) != nil ||
+		binary.Read(r, binary.BigEndian, &rr.err) != nil ||
+		binary.Read(r, binary.BigEndian, &nslices) != nil {
+		return nil, errReplayFormat
+	}
+	for i := 0; i < int(nslices); i++ {
+		var s replaySlice
+		var node uint16
+		var l uint32
+		if binary.Read(r, binary.BigEndian, &s.kind) != nil ||
+			binary.Read(r, binary.BigEndian, &node) != nil ||
+			binary.Read(r, binary.BigEndian, &l) != nil ||
+			int64(l) > int64(r.Len()) {
+			return nil, errReplayFormat
+		}
+		s.node = int(node)
+		s.data = make([]byte, l)
+		io.ReadFull(r, s.data)
+		rr.slices = append(rr.slices, s)
+	}
+	var l uint32
+	if binary.Read(r, binary.BigEndian, &l) != nil ||
+		int64(l) != int64(r.Len()) {
+		return nil, errReplayFormat
+	}
+	if l > 0 {
+		rr.cell = make([]byte, l)
+		io.ReadFull(r, rr.cell)
+	}
+	return rr, nil
+}
+
+// The relay's side of the log.
+type replayLog struct {
+	dir  string
+	keep int // rounds to keep, at least
+	seg  int // records per segment
+
+	f      *os.File
+	w      *bufio.Writer
+	seq    int            // sequence number of the current segment
+	n      int            // records in the current segment
+	counts map[string]int // records in each segment, by file name
+	prev   []byte         // hash of the last record written
+}
+
+// Open the replay log in dir, continuing the hash chain of any log
+// already there, and keeping at least the last keep rounds.
+func openReplayLog(dir string, keep int) (*replayLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	l := &replayLog{dir: dir, keep: keep, seg: replaySegRounds,
+		counts: make(map[string]int),
+		prev:   make([]byte, sha256.Size)}
+	segs, err := replaySegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick up the chain after the last complete record.
+	// Any partly written record from a crash is left as it is,
+	// and we start a fresh segment after it.
+	for _, seg := range segs {
+		recs, _ := readReplaySegment(seg)
+		l.counts[seg] = len(recs)
+		if len(recs) > 0 {
+			l.prev = recs[len(recs)-1].hash
+		}
+	}
+	if len(segs) > 0 {
+		l.seq = replaySeq(segs[len(segs)-1])
+	}
+	return l, l.rotate()
+}
+
+// Write the record of a round to the log.
+func (l *replayLog) append(rr *replayRound) error {
+	if l.n >= l.seg {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	rr.prev = l.prev
+	body := rr.encode()
+	h := sha256.Sum256(body)
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(body)))
+	l.w.Write(hdr)
+	l.w.Write(body)
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	rr.hash = h[:]
+	l.prev = rr.hash
+	l.n++
+	l.counts[l.f.Name()] = l.n
+	return nil
+}
+
+// Start a new segment, and prune the oldest ones we need no longer keep.
+func (l *replayLog) rotate() error {
+	if l.f != nil {
+		if err := l.close(); err != nil {
+			return err
+		}
+	}
+	l.seq++
+	name := filepath.Join(l.dir, fmt.Sprintf(replaySegFormat, l.seq))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.w = bufio.NewWriter(f)
+	l.n = 0
+
+	segs, err := replaySegments(l.dir)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for _, seg := range segs {
+		kept += l.counts[seg]
+	}
+	for len(segs) > 1 && kept-l.counts[segs[0]] >= l.keep {
+		if err := os.Remove(segs[0]); err != nil {
+			return err
+		}
+		kept -= l.counts[segs[0]]
+		delete(l.counts, segs[0])
+		segs = segs[1:]
+	}
+	return nil
+}
+
+// Close the current segment, once it is safely on disk.
+func (l *replayLog) close() error {
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// The segment files of a log, oldest first
+func replaySegments(dir string) ([]string, error) {
+	segs, err := filepath.Glob(filepath.Join(dir, "replay-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segs)
+	return segs, nil
+}
+
+func replaySeq(name string) int {
+	var seq int
+	fmt.Sscanf(filepath.Base(name), replaySegFormat, &seq)
+	return seq
+}
+
+// Read the records in a segment.
+// A record cut short at the end of the segment,
+// as a crash can leave behind, yields io.ErrUnexpectedEOF.
+func readReplaySegment(name string) ([]*replayRound, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var recs []*replayRound
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(r, hdr); err == io.EOF {
+			return recs, nil
+		} else if err != nil {
+			return recs, io.ErrUnexpectedEOF
+		}
+		body := make([]byte, binary.BigEndian.Uint32(hdr))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return recs, io.ErrUnexpectedEOF
+		}
+		rr, err := decodeReplayRound(body)
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rr)
+	}
+}
+
+// Read the whole log, checking its hash chain,
+// and noting on w any segment cut short by a crash.
+// The oldest record kept anchors the chain.
+func readReplayLog(dir string, w io.Writer) ([]*replayRound, error) {
+	segs, err := replaySegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var all []*replayRound
+	for _, seg := range segs {
+		recs, err := readReplaySegment(seg)
+		if err == io.ErrUnexpectedEOF {
+			fmt.Fprintf(w, "%s: ends in a partial record\n", seg)
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", seg, err.Error())
+		}
+		for _, rr := range recs {
+			if len(all) > 0 &&
+				!bytes.Equal(rr.prev, all[len(all)-1].hash) {
+				return nil, fmt.Errorf("%s: round %d: %s", seg,
+					rr.round, errReplayChain.Error())
+			}
+			all = append(all, rr)
+		}
+	}
+	return all, nil
+}
+
+// The decoding relay of group g, as it stood at a given round
+type replayDecoder struct {
+	g     *group
+	me    *dcnet.TestNode
+	round uint64 // next round to decode
+}
+
+// Decode a logged round again, from its slices alone
+func (d *replayDecoder) decode(rr *replayRound) ([]byte, error) {
+	if d.me == nil || rr.round < d.round {
+		d.me = d.g.setup().Relay // the relay restarted its session
+		d.round = 0
+	}
+	for ; d.round < rr.round; d.round++ {
+		d.me.Coder.DecodeStart(payloadlen, d.me.History)
+	}
+	d.me.Coder.DecodeStart(payloadlen, d.me.History)
+	d.round++
+	for _, s := range rr.slices {
+		if s.kind == replayTrustee {
+			d.me.Coder.DecodeTrustee(s.data)
+		} else {
+			d.me.Coder.DecodeClient(s.data)
+		}
+	}
+	cell := d.me.Coder.DecodeCell()
+	return cell, d.me.Coder.DecodeErr()
+}
+
+// Audit the replay log in dir for group g:
+// check its hash chain, then decode each round again
+// (or only the given round, if it is non-negative)
+// and check we get the very cell the relay logged.
+func auditReplay(g *group, dir string, round int64, w io.Writer) error {
+	recs, err := readReplayLog(dir, w)
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		return errors.New("replay log is empty")
+	}
+	fmt.Fprintf(w, "hash chain intact: %d records, rounds %d to %d\n",
+		len(recs), recs[0].round, recs[len(recs)-1].round)
+
+	d := &replayDecoder{g: g}
+	audited := 0
+	for _, rr := range recs {
+		if round >= 0 && rr.round != uint64(round) {
+			continue
+		}
+		cell, derr := d.decode(rr)
+		if !bytes.Equal(cell, rr.cell) || replayErrCode(derr) != rr.err {
+			return fmt.Errorf("round %d: decoded cell differs from log",
+				rr.round)
+		}
+		audited++
+		if round < 0 {
+			continue
+		}
+
+		// Show the details of the round asked for
+		fmt.Fprintf(w, "round %d (record %x):\n", rr.round, rr.hash[:8])
+		for _, s := range rr.slices {
+			fmt.Fprintf(w, "  %c%d slice %x\n", s.kind, s.node,
+				sha256.Sum256(s.data))
+		}
+		switch {
+		case derr != nil:
+			fmt.Fprintf(w, "  decoding failed: %s\n", derr.Error())
+		case cell == nil:
+			fmt.Fprintf(w, "  empty cell\n")
+		default:
+			fmt.Fprintf(w, "  cell for conn %d, %d bytes\n",
+				binary.BigEndian.Uint32(cell[0:4]),
+				binary.BigEndian.Uint16(cell[4:6]))
+		}
+	}
+	if audited == 0 {
+		return fmt.Errorf("round %d not in replay log", round)
+	}
+	fmt.Fprintf(w, "%d rounds decoded again, all matching the log\n",
+		audited)
+	return nil
+}
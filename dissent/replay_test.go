@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dissent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Log rounds from..to-1, each with a trustee and a client slice
+func logRounds(t *testing.T, l *replayLog, from, to uint64) {
+	for round := from; round < to; round++ {
+		rr := &replayRound{round: round}
+		rr.add(replayTrustee, 0, []byte{byte(round), 1, 2})
+		rr.add(replayClient, 1, []byte{byte(round), 3})
+		if round%2 == 0 {
+			rr.cell = []byte{0, 0, 0, 1, 0, 0}
+		}
+		if err := l.append(rr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplayLogChain(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := openReplayLog(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logRounds(t, l, 0, 5)
+	l.close()
+
+	// A restarted relay continues the chain in a new segment
+	l, err = openReplayLog(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logRounds(t, l, 0, 3)
+	l.close()
+
+	recs, err := readReplayLog(dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 8 || recs[5].round != 0 || recs[4].round != 4 {
+		t.Fatalf("read back %d records", len(recs))
+	}
+	if len(recs[1].slices) != 2 || recs[1].slices[0].kind != replayTrustee ||
+		recs[1].slices[1].data[1] != 3 || recs[1].cell != nil ||
+		len(recs[2].cell) != 6 {
+		t.Fatalf("record decoded wrong: %+v", recs[1])
+	}
+
+	// Altering any record breaks the chain
+	segs, _ := replaySegments(dir)
+	buf, err := ioutil.ReadFile(segs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[4+32+8+1+2+1+2+4]++ // first byte of the first trustee slice
+	if err := ioutil.WriteFile(segs[0], buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readReplayLog(dir, ioutil.Discard); err == nil {
+		t.Fatal("altered record not detected")
+	}
+}
+
+func TestReplayLogRetention(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, err := openReplayLog(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.seg = 4
+	logRounds(t, l, 0, 30)
+	l.close()
+
+	segs, _ := replaySegments(dir)
+	if len(segs) != 3 {
+		t.Fatalf("%d segments kept", len(segs))
+	}
+	recs, err := readReplayLog(dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) < 8 || recs[len(recs)-1].round != 29 {
+		t.Fatalf("kept %d records", len(recs))
+	}
+
+	// A record cut short by a crash is skipped, and the chain goes on
+	buf, _ := ioutil.ReadFile(segs[len(segs)-1])
+	ioutil.WriteFile(segs[len(segs)-1], buf[:len(buf)-1], 0600)
+	l, err = openReplayLog(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logRounds(t, l, 0, 2)
+	l.close()
+	if _, err := readReplayLog(dir, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Segments left short by restarts still count for the rounds they hold
+func TestReplayLogRetentionRestarts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for round := uint64(0); round < 20; round++ {
+		l, err := openReplayLog(dir, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.seg = 4
+		logRounds(t, l, round, round+1)
+		if err := l.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, err := readReplayLog(dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// at least the rounds to keep, and no more than a segment besides
+	if len(recs) < 8 || len(recs) > 8+4 || recs[len(recs)-1].round != 19 {
+		t.Fatalf("kept %d records", len(recs))
+	}
+}
+
+func TestReplayAudit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir) // once the group has stopped writing to it
+
+	tn := newTestNet(t, 3, 2, 1)
+	l, err := openReplayLog(dir, replayKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.relay.replay = l
+	tn.start()
+	defer tn.stop()
+	testStreams(t, tn.socks.Addr().String())
+
+	// Stop the relay appending rounds while we audit the log
+	tn.stop()
+
+	// Every round logged decodes again to the same cell
+	recs, err := readReplayLog(dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data *replayRound
+	for _, rr := range recs {
+		if rr.cell != nil {
+			data = rr
+		}
+	}
+	if data == nil {
+		t.Fatal("no data cell in replay log")
+	}
+	if err := auditReplay(tn.g, dir, -1, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	err = auditReplay(tn.g, dir, int64(data.round), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A slice other than the one logged would not have produced the cell
+	data.slices[len(data.slices)-1].data[0] ^= 1
+	d := &replayDecoder{g: tn.g}
+	if cell, _ := d.decode(data); bytes.Equal(cell, data.cell) {
+		t.Fatal("altered slice decoded to the logged cell")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Session resumption.
+//
+// Every client and trustee keeps its DC-net coder state across relay links.
+// When a link to the relay fails, or the relay restarts,
+// each node reconnects and reports how many cells it has completed
+// and (for clients) a hash of the downstream history it has seen.
+// The relay picks the furthest cell index reported by anyone,
+// every node fast-forwards its coder to that index,
+// and the session continues without rebuilding any keys.
+//
+// The records are not signed, so the relay only believes as much of them
+// as an honest node could report. Trustees stream their slices ahead of
+// the relay, but every trustee has completed at least the cells the relay
+// decoded, so the lowest trustee record (or the relay's own index, if
+// higher) is a floor no honest node is below. Clients send a slice for
+// each downstream cell, so an honest client is at most the pipeline
+// window past that floor, and a trustee at most resumeMaxLead past it.
+// Records beyond those bounds are ignored: a node claiming them could
+// as well jam the session, but cannot make the others fast-forward
+// without end.
+//
+// Cells in flight when the link failed are lost,
+// so proxied connections are reset on both sides on every resume.
+
+// Size of the downstream history hash carried in resume records
+const historylen = sha256.Size
+
+// Size of a resume record: cell index followed by history hash
+const resumelen = 8 + historylen
+
+// How far past the floor of the honest records a trustee may report
+const resumeMaxLead = 1 << 16
+
+// Bounds on the delay between attempts to reach the relay
+const retrymin = 500 * time.Millisecond
+const retrymax = 30 * time.Second
+
+var errHistoryMismatch = errors.New("clients disagree on session history")
+
+// A node's position in the session.
+type resumeState struct {
+	cellno  uint64 // number of cells completed
+	history []byte // hash chain over the downstream cells seen
+}
+
+func newResumeState() resumeState {
+	return resumeState{0, make([]byte, historylen)}
+}
+
+// Account for a downstream cell in the history hash
+func (rs *resumeState) addHistory(cno int, buf []byte) {
+	rs.history = chainHistory(rs.history, cno, buf)
+}
+
+// Extend a downstream history hash with the next cell
+func chainHistory(history []byte, cno int, buf []byte) []byte {
+	hdr := [6]byte{}
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(cno))
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(len(buf)))
+	h := sha256.New()
+	h.Write(history)
+	h.Write(hdr[:])
+	h.Write(buf)
+	return h.Sum(nil)
+}
+
+func (rs *resumeState) encode() []byte {
+	buf := make([]byte, resumelen)
+	binary.BigEndian.PutUint64(buf[0:8], rs.cellno)
+	copy(buf[8:], rs.history)
+	return buf
+}
+
+func readResume(r io.Reader) (resumeState, error) {
+	buf := make([]byte, resumelen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return resumeState{}, err
+	}
+	return resumeState{binary.BigEndian.Uint64(buf[0:8]), buf[8:]}, nil
+}
+
+// Work out where a session resumes, given the resume records
+// reported by all clients and trustees, the relay's own cell index,
+// and the pipeline window.
+// All clients at the furthest client position must agree on the history.
+func resumePoint(cellno uint64, window int, clients,
+	trustees []resumeState) (resumeState, error) {
+
+	floor := cellno
+	for i, t := range trustees {
+		if i == 0 || t.cellno < floor {
+			floor = t.cellno
+		}
+	}
+	if floor < cellno {
+		floor = cellno
+	}
+
+	rs := newResumeState()
+	rs.cellno = cellno
+	var hist []byte
+	var histno uint64
+	for i, c := range clients {
+		if c.cellno > floor+uint64(window) {
+			log.Printf("Ignoring client %d resuming at cell %d, "+
+				"past cell %d", i, c.cellno, floor+uint64(window))
+			continue
+		}
+		if hist == nil || c.cellno > histno {
+			hist, histno = c.history, c.cellno
+		} else if c.cellno == histno && !bytes.Equal(c.history, hist) {
+			return rs, errHistoryMismatch
+		}
+		if c.cellno > rs.cellno {
+			rs.cellno = c.cellno
+		}
+	}
+	for i, t := range trustees {
+		if t.cellno > floor+resumeMaxLead {
+			log.Printf("Ignoring trustee %d resuming at cell %d, "+
+				"past cell %d", i, t.cellno, floor+resumeMaxLead)
+			continue
+		}
+		if t.cellno > rs.cellno {
+			rs.cellno = t.cellno
+		}
+	}
+	if hist != nil {
+		rs.history = hist
+	}
+	return rs, nil
+}
+
+// Connect to the relay of group g and exchange resume records:
+// we send our link identification byte, ciphersuite and records,
+// and the relay answers with the agreed resume point.
+func resumeHandshake(g *group, addr string, ctno int,
+	recs []resumeState) (net.Conn, resumeState, error) {
+
+	conn, err := g.transport.Dial(addr, byte(ctno))
+	if err != nil {
+		return nil, resumeState{}, err
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(ctno))
+	writeSuite(buf, g.suite)
+	for i := range recs {
+		buf.Write(recs[i].encode())
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		conn.Close()
+		return nil, resumeState{}, err
+	}
+	rs, err := readResume(conn)
+	if err != nil {
+		conn.Close()
+		return nil, resumeState{}, err
+	}
+	return conn, rs, nil
+}
+
+// Connect to the relay, retrying with exponential backoff until it answers.
+// Returns a nil link if the group is stopped first.
+func resumeRelay(g *group, addr string, ctno int,
+	recs []resumeState) (net.Conn, resumeState) {
+
+	delay := retrymin
+	for {
+		conn, rs, err := resumeHandshake(g, addr, ctno, recs)
+		if err == nil {
+			return conn, rs
+		}
+		log.Printf("Can't connect to relay %s: %s; retrying in %s",
+			addr, err.Error(), delay)
+		select {
+		case <-time.After(delay):
+		case <-g.done:
+			return nil, resumeState{}
+		}
+		delay *= 2
+		if delay > retrymax {
+			delay = retrymax
+		}
+	}
+}
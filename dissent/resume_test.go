@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A resume record at a cell, with a history naming it
+func testResume(cellno uint64, seed byte) resumeState {
+	rs := resumeState{cellno, make([]byte, historylen)}
+	rs.history[0] = seed
+	return rs
+}
+
+func TestResumePoint(t *testing.T) {
+	trustees := []resumeState{testResume(100, 0), testResume(120, 0)}
+
+	// The furthest record wins, with the furthest client's history
+	clients := []resumeState{testResume(101, 1), testResume(102, 2)}
+	rs, err := resumePoint(90, 2, clients, trustees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.cellno != 120 || !bytes.Equal(rs.history, clients[1].history) {
+		t.Fatalf("resumed at cell %d with history %x", rs.cellno,
+			rs.history[0])
+	}
+
+	// Clients at the furthest client position must agree
+	clients = []resumeState{testResume(102, 1), testResume(102, 2)}
+	if _, err := resumePoint(90, 2, clients, trustees); err != errHistoryMismatch {
+		t.Fatal("clients disagreeing on history:", err)
+	}
+
+	// A client past the window and a trustee far past the others
+	// are not believed
+	clients = []resumeState{testResume(101, 1), testResume(1<<40, 2)}
+	far := append(trustees, testResume(1<<50, 0))
+	rs, err = resumePoint(90, 2, clients, far)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.cellno != 120 || !bytes.Equal(rs.history, clients[0].history) {
+		t.Fatalf("resumed at cell %d with history %x", rs.cellno,
+			rs.history[0])
+	}
+
+	// The relay's own count is a floor, even below every trustee
+	clients = []resumeState{testResume(501, 1)}
+	rs, err = resumePoint(500, 2, clients, trustees)
+	if err != nil || rs.cellno != 501 {
+		t.Fatal("resumed at cell", rs.cellno, err)
+	}
+}
+
+// A node sends its link byte, ciphersuite and records to the relay,
+// and gets back the resume point
+func TestResumeHandshake(t *testing.T) {
+	g := &group{suite: suite, transport: tcpTransport{},
+		done: make(chan struct{})}
+	lsock := listenLocal(t)
+	defer lsock.Close()
+
+	want := testResume(42, 7)
+	recs := []resumeState{testResume(40, 1), testResume(41, 2)}
+	got := make(chan []resumeState, 1)
+	go func() {
+		conn, err := lsock.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil || b[0] != 5 {
+			got <- nil
+			return
+		}
+		if err := readSuite(conn, g.suite); err != nil {
+			got <- nil
+			return
+		}
+		rr := make([]resumeState, len(recs))
+		for i := range rr {
+			if rr[i], err = readResume(conn); err != nil {
+				got <- nil
+				return
+			}
+		}
+		conn.Write(want.encode())
+		got <- rr
+	}()
+
+	conn, rs, err := resumeHandshake(g, lsock.Addr().String(), 5, recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if rs.cellno != want.cellno || !bytes.Equal(rs.history, want.history) {
+		t.Fatal("resume point", rs.cellno, "expected", want.cellno)
+	}
+	rr := <-got
+	if len(rr) != len(recs) {
+		t.Fatal("relay did not get the records")
+	}
+	for i := range rr {
+		if rr[i].cellno != recs[i].cellno ||
+			!bytes.Equal(rr[i].history, recs[i].history) {
+			t.Fatal("relay got record", rr[i].cellno, "expected",
+				recs[i].cellno)
+		}
+	}
+}
+
+// The nodes resume the session with a relay restarted from scratch
+func TestRelayRestart(t *testing.T) {
+	tn := newTestNet(t, 3, 2, 1)
+	tn.start()
+	defer tn.stop()
+	socks := tn.socks.Addr().String()
+	testStreams(t, socks)
+
+	// Stop the relay, and start a new one on its address
+	old := tn.relay
+	addr := tn.lsocks[0].Addr().String()
+	tn.lsocks[0].Close()
+	old.closeLinks()
+	var lsock net.Listener
+	var err error
+	for try := 0; ; try++ {
+		if lsock, err = net.Listen("tcp", addr); err == nil {
+			break
+		} else if try == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	tn.lsocks[0] = lsock
+	pace, err := newPacer(testRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.relay = newRelay(tn.g, lsock, 2, pace)
+	tn.relay.dial = old.dial
+	tn.run(func() { tn.relay.serve() })
+
+	// Streams opened before the session resumes are reset with it
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		conn, err := dialEcho(socks)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			err = testEcho(conn, 1)
+			conn.Close()
+		}
+		if err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("session not resumed:", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	testStreams(t, socks)
+	tn.stop()
+	if tn.relay.cellno == 0 {
+		t.Fatal("restarted relay did not catch up to the session")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+)
+
+// Round numbering.
+//
+// Every client and trustee slice travels to the relay prefixed by
+// the number of the round (cell) it belongs to,
+// and every downstream cell carries the number of the round it opens.
+// The relay releases each link's slices strictly in round order,
+// buffering slices that arrive early within the pipeline window,
+// so a misordered or missing slice is caught
+// instead of silently corrupting the XOR of the cell.
+
+// Size of the round number prefixed to each upstream slice
+const roundhdrlen = 8
+
+// Size of the downstream cell header: round, connection number, length
+const downhdrlen = 8 + 4 + 2
+
+var errStaleRound = errors.New("slice for a round already decoded")
+var errRoundAhead = errors.New("slice too far ahead of the current round")
+var errDupRound = errors.New("duplicate slice for a round")
+var errRoundMismatch = errors.New("cell for an unexpected round")
+
+// Send a round-numbered slice.
+func writeSlice(w io.Writer, round uint64, slice []byte) error {
+	buf := make([]byte, roundhdrlen+len(slice))
+	binary.BigEndian.PutUint64(buf[:roundhdrlen], round)
+	copy(buf[roundhdrlen:], slice)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Receive a round-numbered slice of a known size.
+func readSlice(r io.Reader, size int) (uint64, []byte, error) {
+	buf := make([]byte, roundhdrlen+size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint64(buf[:roundhdrlen]),
+		buf[roundhdrlen:], nil
+}
+
+// Frame a downstream cell for the given round.
+func encodeDown(round uint64, cno int, buf []byte) []byte {
+	dbuf := make([]byte, downhdrlen+len(buf))
+	binary.BigEndian.PutUint64(dbuf[0:8], round)
+	binary.BigEndian.PutUint32(dbuf[8:12], uint32(cno))
+	binary.BigEndian.PutUint16(dbuf[12:14], uint16(len(buf)))
+	copy(dbuf[downhdrlen:], buf)
+	return dbuf
+}
+
+// Receive a downstream cell, returning its round and whole framing.
+func readDown(r io.Reader) (uint64, []byte, error) {
+	hdr := make([]byte, downhdrlen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	dlen := int(binary.BigEndian.Uint16(hdr[12:14]))
+	dbuf := make([]byte, downhdrlen+dlen)
+	copy(dbuf, hdr)
+	if _, err := io.ReadFull(r, dbuf[downhdrlen:]); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint64(hdr[0:8]), dbuf, nil
+}
+
+// Reorder buffer for one link's slices, releasing them in round order.
+type roundQueue struct {
+	next   uint64            // next round to be released
+	window int               // how far past next a slice may arrive
+	early  map[uint64][]byte // slices that arrived ahead of their turn
+}
+
+func newRoundQueue(next uint64, window int) *roundQueue {
+	return &roundQueue{next, window, make(map[uint64][]byte)}
+}
+
+// Accept a slice received for the given round.
+func (q *roundQueue) put(round uint64, slice []byte) error {
+	switch {
+	case round < q.next:
+		return errStaleRound
+	case round >= q.next+uint64(q.window):
+		return errRoundAhead
+	}
+	if _, ok := q.early[round]; ok {
+		return errDupRound
+	}
+	q.early[round] = slice
+	return nil
+}
+
+// Release the slice for the next round, if it has arrived.
+func (q *roundQueue) get() ([]byte, bool) {
+	slice, ok := q.early[q.next]
+	if !ok {
+		return nil, false
+	}
+	delete(q.early, q.next)
+	q.next++
+	return slice, true
+}
+
+// Read slices from a link until the one for the queue's next round
+// is available, and return it.
+// Stale slices, such as retransmissions, are dropped;
+// anything else out of place is an error on the link.
+func collectSlice(r io.Reader, q *roundQueue, size int) ([]byte, error) {
+	for {
+		if slice, ok := q.get(); ok {
+			return slice, nil
+		}
+		round, slice, err := readSlice(r, size)
+		if err != nil {
+			return nil, err
+		}
+		err = q.put(round, slice)
+		if err == errStaleRound {
+			log.Printf("dropping stale slice for round %d", round)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
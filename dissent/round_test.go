@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const testSliceLen = 16
+
+func testSlice(round uint64) []byte {
+	slice := make([]byte, testSliceLen)
+	for i := range slice {
+		slice[i] = byte(round) + byte(i)
+	}
+	return slice
+}
+
+// Frame a sequence of slices as a link would deliver them
+func testLink(t *testing.T, rounds []uint64) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	for _, round := range rounds {
+		if err := writeSlice(buf, round, testSlice(round)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf
+}
+
+// Collect slices from a link and check they come out in round order.
+func testCollect(t *testing.T, first uint64, window int, rounds []uint64) {
+	link := testLink(t, rounds)
+	q := newRoundQueue(first, window)
+	for round := first; round < first+uint64(len(rounds)); round++ {
+		slice, err := collectSlice(link, q, testSliceLen)
+		if err != nil {
+			t.Fatalf("round %d: %s (delivery order %v)",
+				round, err, rounds)
+		}
+		if !bytes.Equal(slice, testSlice(round)) {
+			t.Fatalf("round %d: got the wrong slice (delivery order %v)",
+				round, rounds)
+		}
+	}
+	if link.Len() != 0 {
+		t.Fatalf("%d bytes left unread", link.Len())
+	}
+}
+
+func TestRoundInOrder(t *testing.T) {
+	testCollect(t, 0, 1, []uint64{0, 1, 2, 3, 4})
+	testCollect(t, 1000, 4, []uint64{1000, 1001, 1002})
+}
+
+func TestRoundOutOfOrder(t *testing.T) {
+	testCollect(t, 0, 2, []uint64{1, 0, 3, 2, 5, 4})
+	testCollect(t, 7, 3, []uint64{9, 8, 7, 10, 12, 11})
+
+	// Shuffle deliveries within each window-sized block
+	rng := rand.New(rand.NewSource(1))
+	for window := 1; window <= 8; window++ {
+		for trial := 0; trial < 20; trial++ {
+			n := 10 * window
+			rounds := make([]uint64, n)
+			for i := range rounds {
+				rounds[i] = uint64(i)
+			}
+			for b := 0; b < n; b += window {
+				blk := rounds[b : b+window]
+				rng.Shuffle(len(blk), func(i, j int) {
+					blk[i], blk[j] = blk[j], blk[i]
+				})
+			}
+			testCollect(t, 0, window, rounds)
+		}
+	}
+}
+
+func TestRoundStale(t *testing.T) {
+	// A retransmitted slice for a decoded round is dropped
+	link := testLink(t, []uint64{0, 1, 0, 2})
+	q := newRoundQueue(0, 2)
+	for round := uint64(0); round < 3; round++ {
+		slice, err := collectSlice(link, q, testSliceLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(slice, testSlice(round)) {
+			t.Fatalf("round %d: got the wrong slice", round)
+		}
+	}
+}
+
+func TestRoundInvalid(t *testing.T) {
+	// Beyond the window
+	q := newRoundQueue(5, 2)
+	_, err := collectSlice(testLink(t, []uint64{7}), q, testSliceLen)
+	if err != errRoundAhead {
+		t.Fatalf("slice beyond window: got %v", err)
+	}
+
+	// Duplicate of a buffered round
+	q = newRoundQueue(5, 3)
+	_, err = collectSlice(testLink(t, []uint64{6, 6}), q, testSliceLen)
+	if err != errDupRound {
+		t.Fatalf("duplicate slice: got %v", err)
+	}
+
+	// Link closed before the round arrived
+	q = newRoundQueue(0, 2)
+	_, err = collectSlice(testLink(t, []uint64{1}), q, testSliceLen)
+	if err == nil {
+		t.Fatal("missing slice not detected")
+	}
+}
+
+func TestDownFraming(t *testing.T) {
+	buf := new(bytes.Buffer)
+	data := []byte("downstream")
+	buf.Write(encodeDown(42, 3, data))
+	buf.Write(encodeDown(43, 0, nil))
+
+	round, dbuf, err := readDown(buf)
+	if err != nil || round != 42 {
+		t.Fatalf("got round %d, %v", round, err)
+	}
+	if !bytes.Equal(dbuf[downhdrlen:], data) {
+		t.Fatalf("got payload %q", dbuf[downhdrlen:])
+	}
+	round, dbuf, err = readDown(buf)
+	if err != nil || round != 43 || len(dbuf) != downhdrlen {
+		t.Fatalf("empty cell: round %d, len %d, %v",
+			round, len(dbuf), err)
+	}
+}
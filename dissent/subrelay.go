@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// Forward downstream cells from the decoding relay to our own clients.
+// On any failure, tear down all links so the main loop notices too.
+func subRelayDown(up net.Conn, csock []net.Conn) {
+	defer closeAll(up, csock)
+	for {
+		_, dbuf, err := readDown(up)
+		if err != nil {
+			log.Println("subRelayDown: " + err.Error())
+			return
+		}
+
+		for i := range csock {
+			n, err := csock[i].Write(dbuf)
+			if n != len(dbuf) {
+				log.Println("Write to client: " + err.Error())
+				return
+			}
+		}
+	}
+}
+
+func closeAll(up net.Conn, csock []net.Conn) {
+	up.Close()
+	for i := range csock {
+		csock[i].Close()
+	}
+}
+
+// Wait for all of our clients in group g to (re)connect
+// and collect their resume records.
+func subRelayAccept(g *group, lsock net.Listener, myclients []int) (
+	[]net.Conn, []resumeState, error) {
+
+	csock := make([]net.Conn, len(myclients))
+	recs := make([]resumeState, len(myclients))
+	cidx := make(map[int]int)
+	for i, clino := range myclients {
+		cidx[clino] = i
+	}
+	for ccli := 0; ccli < len(myclients); {
+		fmt.Printf("Waiting for %d clients\n", len(myclients)-ccli)
+
+		conn, err := lsock.Accept()
+		if err != nil {
+			for i := range csock {
+				if csock[i] != nil {
+					csock[i].Close()
+				}
+			}
+			return nil, nil, err
+		}
+
+		b := make([]byte, 1)
+		n, err := io.ReadFull(conn, b)
+		if n < 1 {
+			log.Println("Read error: " + err.Error())
+			conn.Close()
+			continue
+		}
+
+		i, ok := cidx[int(b[0])]
+		if !ok || !linkAllowed(conn, b[0]) {
+			log.Printf("illegal node number %d", b[0])
+			conn.Close()
+			continue
+		}
+		if err := readSuite(conn, g.suite); err != nil {
+			log.Printf("Rejecting client %d: %s", b[0], err.Error())
+			conn.Close()
+			continue
+		}
+		rec, err := readResume(conn)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		if csock[i] != nil {
+			csock[i].Close()
+		} else {
+			ccli++
+		}
+		csock[i] = conn
+		recs[i] = rec
+	}
+	println("All clients connected")
+	return csock, recs, nil
+}
+
+// Run intermediate relay r.
+// We serve our share of the clients exactly as the decoding relay would,
+// but instead of decoding each cell we combine our clients' slices
+// into a single partial aggregate and pass that upstream to relay 0,
+// which also sends us the downstream cells to rebroadcast.
+// Our clients' resume records are likewise passed through to relay 0,
+// and its answer passed back to them.
+// Client slices are reordered by round within the given window,
+// and each aggregate goes upstream tagged with its round.
+func startSubRelay(r int, window int) {
+	lsock, err := transport.Listen(relayBind(r))
+	if err != nil {
+		panic("Can't open listen socket:" + err.Error())
+	}
+	runSubRelay(defaultGroup(), r, lsock, window)
+}
+
+// Run intermediate relay r of group g, accepting its clients on lsock,
+// until we can no longer accept links or the group is stopped.
+func runSubRelay(g *group, r int, lsock net.Listener, window int) {
+	if r <= 0 || r >= g.nrelays {
+		panic("illegal relay number")
+	}
+	me := g.setup().Relay
+	myclients := g.relayClients(r)
+	if len(myclients) == 0 {
+		panic("no clients attached to this relay")
+	}
+
+	clisize := me.Coder.ClientCellSize(payloadlen)
+	cslice := make([][]byte, len(myclients))
+	for {
+		csock, recs, err := subRelayAccept(g, lsock, myclients)
+		if err != nil {
+			if !g.stopped() {
+				log.Println("Listen error: " + err.Error())
+			}
+			return
+		}
+		up, rs := resumeRelay(g, g.relays[0], r|linkRelay, recs)
+		if up == nil {
+			for i := range csock {
+				csock[i].Close()
+			}
+			return
+		}
+		println("relay", r, "connected at cell", rs.cellno)
+
+		reply := rs.encode()
+		for i := range csock {
+			csock[i].Write(reply) // failures show up below
+		}
+		go subRelayDown(up, csock)
+
+		cq := make([]*roundQueue, len(csock))
+		for i := range cq {
+			cq[i] = newRoundQueue(rs.cellno, window)
+		}
+
+		// Each client sends one upstream slice per downstream cell,
+		// so we simply combine the slices in lockstep.
+	session:
+		for round := rs.cellno; ; round++ {
+			for i := range csock {
+				var err error
+				cslice[i], err = collectSlice(csock[i], cq[i],
+					clisize)
+				if err != nil {
+					log.Println("Read from client: " +
+						err.Error())
+					break session
+				}
+			}
+
+			slice := me.Coder.CombineClients(cslice)
+			if err := writeSlice(up, round, slice); err != nil {
+				log.Println("Write to relay: " + err.Error())
+				break session
+			}
+		}
+		closeAll(up, csock)
+	}
+}
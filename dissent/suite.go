@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/suites"
+)
+
+// Ciphersuite selection.
+//
+// The group configuration names the ciphersuite every role uses,
+// as listed by suites.All(); without one we use the NIST P-256 suite.
+// Every link to a relay starts by naming the sender's ciphersuite,
+// and the relay refuses links from nodes running any other,
+// rather than letting mismatched DC-net streams decode to garbage.
+
+var defaultSuite abstract.Suite = nist.NewAES128SHA256P256()
+
+// Ciphersuite in use by this node, once the configuration is read
+var suite = defaultSuite
+
+var errSuiteMismatch = errors.New("peer uses a different ciphersuite")
+
+// Names of all the ciphersuites we can run, in sorted order
+func suiteNames() []string {
+	names := make([]string, 0)
+	for name := range suites.All() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Select the named ciphersuite, or the default if name is empty.
+func selectSuite(name string) error {
+	if name == "" {
+		suite = defaultSuite
+		return nil
+	}
+	s, ok := suites.All()[name]
+	if !ok {
+		return fmt.Errorf("unknown ciphersuite %q (available: %s)",
+			name, strings.Join(suiteNames(), ", "))
+	}
+	suite = s
+	return nil
+}
+
+// Name our ciphersuite s at the start of a link.
+func writeSuite(w io.Writer, s abstract.Suite) error {
+	name := s.String()
+	buf := append([]byte{byte(len(name))}, name...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Check that the node at the other end of a link runs our ciphersuite s.
+func readSuite(r io.Reader, s abstract.Suite) error {
+	l := [1]byte{}
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return err
+	}
+	name := make([]byte, l[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return err
+	}
+	if string(name) != s.String() {
+		return errSuiteMismatch
+	}
+	return nil
+}
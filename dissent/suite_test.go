@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/suites"
+	"github.com/dedis/prifi/dcnet"
+)
+
+// Run a session's worth of cells between clients, trustees and the relay,
+// with every slice and downstream cell going through the link framing.
+func testSession(t *testing.T, s abstract.Suite, ncells int) {
+	tg := dcnet.TestSetup(t, s, factory, nclients, ntrustees)
+	me := tg.Relay
+	clisize := me.Coder.ClientCellSize(payloadlen)
+	trusize := me.Coder.TrusteeCellSize(payloadlen)
+
+	clink := make([]*bytes.Buffer, nclients)
+	cq := make([]*roundQueue, nclients)
+	for i := range clink {
+		clink[i] = new(bytes.Buffer)
+		cq[i] = newRoundQueue(0, 1)
+	}
+	tlink := make([]*bytes.Buffer, ntrustees)
+	tq := make([]*roundQueue, ntrustees)
+	for i := range tlink {
+		tlink[i] = new(bytes.Buffer)
+		tq[i] = newRoundQueue(0, 1)
+	}
+
+	for round := uint64(0); round < uint64(ncells); round++ {
+
+		// Downstream cell opening the round
+		down := new(bytes.Buffer)
+		down.Write(encodeDown(round, 0, nil))
+		dround, _, err := readDown(down)
+		if err != nil || dround != round {
+			t.Fatalf("downstream round %d: got %d, %v",
+				round, dround, err)
+		}
+
+		// The slot owner sends a payload, others send nothing
+		p := make([]byte, payloadlen)
+		for i := range p {
+			p[i] = byte(round) ^ byte(i)
+		}
+		inb := p
+		for i, c := range tg.Clients {
+			slice := c.Coder.ClientEncode(p, payloadlen, c.History)
+			if err := writeSlice(clink[i], round, slice); err != nil {
+				t.Fatal(err)
+			}
+			p = nil
+		}
+		for i, tr := range tg.Trustees {
+			slice := tr.Coder.TrusteeEncode(payloadlen)
+			if err := writeSlice(tlink[i], round, slice); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The relay collects and decodes the round
+		me.Coder.DecodeStart(payloadlen, me.History)
+		for i := range tlink {
+			slice, err := collectSlice(tlink[i], tq[i], trusize)
+			if err != nil {
+				t.Fatalf("trustee %d round %d: %s", i, round, err)
+			}
+			me.Coder.DecodeTrustee(slice)
+		}
+		for i := range clink {
+			slice, err := collectSlice(clink[i], cq[i], clisize)
+			if err != nil {
+				t.Fatalf("client %d round %d: %s", i, round, err)
+			}
+			me.Coder.DecodeClient(slice)
+		}
+		outb := me.Coder.DecodeCell()
+		if !bytes.Equal(outb, inb) {
+			t.Fatalf("round %d: cell corrupted", round)
+		}
+	}
+}
+
+// Run a session over every ciphersuite we have
+func TestSuites(t *testing.T) {
+	for _, name := range suiteNames() {
+		t.Logf("ciphersuite %s", name)
+		testSession(t, suites.All()[name], 10)
+	}
+}
+
+func TestSuiteMismatch(t *testing.T) {
+	defer selectSuite("")
+	if err := selectSuite("no such suite"); err == nil {
+		t.Fatal("unknown ciphersuite accepted")
+	}
+
+	names := suiteNames()
+	for _, name := range names {
+		if err := selectSuite(name); err != nil || suite.String() != name {
+			t.Fatalf("ciphersuite %s not selected", name)
+		}
+		link := new(bytes.Buffer)
+		writeSuite(link, suites.All()[name])
+		for _, other := range names {
+			err := readSuite(bytes.NewReader(link.Bytes()),
+				suites.All()[other])
+			if other == name && err != nil {
+				t.Fatalf("%s link rejected: %s", name, err)
+			}
+			if other != name && err != errSuiteMismatch {
+				t.Fatalf("%s link accepted by %s", name, other)
+			}
+		}
+	}
+}
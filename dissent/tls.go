@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/anon"
+	"github.com/dedis/crypto/config"
+	"github.com/dedis/crypto/random"
+)
+
+// TLS transport, mutually authenticated with the nodes' configured keys.
+//
+// The TLS certificates themselves are throwaway and self-signed:
+// our long-term keys live in the Dissent ciphersuite, not in X.509.
+// Once the TLS handshake completes, each side signs the session's
+// exported keying material with its configured key.
+// This binds the authenticated identities to this particular TLS session,
+// so a man-in-the-middle cannot splice two sessions together.
+// The dialing node also signs the link identification byte
+// it is about to present, and the listener only accepts it
+// from the key configured for that link,
+// so one trusted node cannot take over another's slot.
+type tlsTransport struct {
+	kp      *config.KeyPair
+	trusted []abstract.Point        // keys of the nodes we dial
+	links   map[byte]abstract.Point // key of each node dialing us
+	cert    tls.Certificate
+}
+
+// Label for the keying material exported from each TLS session.
+const tlsAuthLabel = "EXPORTER-dissent-link-auth"
+
+// How long a peer gets to complete the link authentication handshake.
+const tlsAuthTimeout = 10 * time.Second
+
+var errUntrustedPeer = errors.New("peer key not in trusted key list")
+var errWrongLinkKey = errors.New("peer key not configured for its link")
+var errNoKeyPair = errors.New("no configured key-pair for ciphersuite")
+
+func newTLSTransport() (*tlsTransport, error) {
+
+	// Find our own key-pair for the ciphersuite in use
+	kp := ourKeyPair()
+	if kp == nil {
+		return nil, errNoKeyPair
+	}
+
+	// Decode the public keys of the nodes dialing us, by link,
+	// and trust them and the relay when we dial
+	trusted := make([]abstract.Point, 0)
+	relayKey, err := configRelayKey()
+	if err != nil {
+		return nil, err
+	}
+	if relayKey != nil {
+		trusted = append(trusted, relayKey)
+	}
+	links := make(map[byte]abstract.Point)
+	for l, s := range configData.LinkKeys {
+		link, err := strconv.ParseUint(l, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		if links[byte(link)], err = decodePoint(s); err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, links[byte(link)])
+	}
+
+	return newTLSTransportKeys(kp, trusted, links)
+}
+
+// Create a TLS transport authenticating with key-pair kp,
+// dialing only nodes with trusted keys,
+// and accepting each link only from the key links gives for it.
+func newTLSTransportKeys(kp *config.KeyPair, trusted []abstract.Point,
+	links map[byte]abstract.Point) (*tlsTransport, error) {
+
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	return &tlsTransport{kp: kp, trusted: trusted, links: links,
+		cert: cert}, nil
+}
+
+// Generate a fresh self-signed certificate to satisfy TLS.
+func selfSignedCert() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dissent"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv},
+		nil
+}
+
+func (t *tlsTransport) Dial(addr string, link byte) (net.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		Certificates:       []tls.Certificate{t.cert},
+		InsecureSkipVerify: true}) // peers are checked in auth()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.dialAuth(conn, link); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *tlsTransport) Listen(addr string) (net.Listener, error) {
+	lsock, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		ClientAuth:   tls.RequireAnyClientCert})
+	if err != nil {
+		return nil, err
+	}
+	l := &tlsListener{Listener: lsock, t: t,
+		links:  make(chan net.Conn),
+		failed: make(chan struct{})}
+	go l.serve()
+	return l, nil
+}
+
+// Complete the TLS handshake and export the session binding.
+func tlsBinding(conn *tls.Conn) ([]byte, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	cs := conn.ConnectionState()
+	return cs.ExportKeyingMaterial(tlsAuthLabel, nil, 32)
+}
+
+// The message each end of a link signs.
+// The role names which end of the link the signer is,
+// so that one side's signature cannot be reflected back to it;
+// the dialer's message also carries its link identification byte.
+func tlsAuthMsg(role string, binding []byte, link ...byte) []byte {
+	msg := append([]byte(role), binding...)
+	return append(msg, link...)
+}
+
+// Send our public key and our signature on msg.
+func (t *tlsTransport) sendAuth(conn net.Conn, msg []byte) error {
+	pub, _ := t.kp.Public.MarshalBinary()
+	sig := anon.Sign(t.kp.Suite, random.Stream, msg,
+		anon.Set{t.kp.Public}, nil, 0, t.kp.Secret)
+	if err := writeBlob(conn, pub); err != nil {
+		return err
+	}
+	return writeBlob(conn, sig)
+}
+
+// Receive the peer's public key and signature,
+// leaving the signature to be checked once we know what it signs.
+func (t *tlsTransport) recvAuth(conn net.Conn) (abstract.Point, []byte,
+	error) {
+
+	peerpub, err := readBlob(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	peersig, err := readBlob(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer := t.kp.Suite.Point()
+	if err := peer.UnmarshalBinary(peerpub); err != nil {
+		return nil, nil, err
+	}
+	return peer, peersig, nil
+}
+
+// Authenticate a link we dialed as the node with the given link byte.
+func (t *tlsTransport) dialAuth(conn *tls.Conn, link byte) error {
+	conn.SetDeadline(time.Now().Add(tlsAuthTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	binding, err := tlsBinding(conn)
+	if err != nil {
+		return err
+	}
+	if err := writeBlob(conn, []byte{link}); err != nil {
+		return err
+	}
+	if err := t.sendAuth(conn, tlsAuthMsg("client", binding,
+		link)); err != nil {
+		return err
+	}
+
+	peer, peersig, err := t.recvAuth(conn)
+	if err != nil {
+		return err
+	}
+	if !t.isTrusted(peer) {
+		return errUntrustedPeer
+	}
+	_, err = anon.Verify(t.kp.Suite, tlsAuthMsg("server", binding),
+		anon.Set{peer}, nil, peersig)
+	return err
+}
+
+// Authenticate a link accepted from a dialing node,
+// returning the link identification byte it proved its right to.
+func (t *tlsTransport) acceptAuth(conn *tls.Conn) (byte, error) {
+	conn.SetDeadline(time.Now().Add(tlsAuthTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	binding, err := tlsBinding(conn)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.sendAuth(conn, tlsAuthMsg("server", binding)); err != nil {
+		return 0, err
+	}
+
+	l, err := readBlob(conn)
+	if err != nil {
+		return 0, err
+	}
+	if len(l) != 1 {
+		return 0, errWrongLinkKey
+	}
+	link := l[0]
+	peer, peersig, err := t.recvAuth(conn)
+	if err != nil {
+		return 0, err
+	}
+	if key := t.links[link]; key == nil || !key.Equal(peer) {
+		return 0, errWrongLinkKey
+	}
+	_, err = anon.Verify(t.kp.Suite, tlsAuthMsg("client", binding, link),
+		anon.Set{peer}, nil, peersig)
+	return link, err
+}
+
+func (t *tlsTransport) isTrusted(p abstract.Point) bool {
+	for i := range t.trusted {
+		if t.trusted[i].Equal(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener that authenticates each TLS link before handing it out.
+// Each link is authenticated in its own goroutine,
+// so a slow or silent dialer does not hold up the others.
+type tlsListener struct {
+	net.Listener
+	t *tlsTransport
+
+	links  chan net.Conn // authenticated links, waiting for Accept
+	failed chan struct{} // closed once the listener fails, with err set
+	err    error
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.links:
+		return conn, nil
+	case <-l.failed:
+		return nil, l.err
+	}
+}
+
+// Accept connections until the listener fails or is closed.
+func (l *tlsListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.failed)
+			return
+		}
+		go l.auth(conn.(*tls.Conn))
+	}
+}
+
+// Authenticate an accepted connection and hand it to Accept.
+func (l *tlsListener) auth(conn *tls.Conn) {
+	link, err := l.t.acceptAuth(conn)
+	if err != nil {
+		log.Printf("TLS link from %s rejected: %s",
+			conn.RemoteAddr(), err.Error())
+		conn.Close()
+		return
+	}
+	select {
+	case l.links <- &tlsLink{conn, link}:
+	case <-l.failed:
+		conn.Close()
+	}
+}
+
+// An accepted TLS link, authenticated as the node with a given link byte.
+type tlsLink struct {
+	*tls.Conn
+	link byte
+}
+
+func (l *tlsLink) Link() byte {
+	return l.link
+}
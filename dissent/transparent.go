@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+)
+
+// Transparent interception support for the client.
+//
+// Connections redirected to the client by iptables (REDIRECT or TPROXY)
+// carry no SOCKS negotiation of their own,
+// so we synthesize a SOCKS5 CONNECT request to the original destination
+// and strip the relay's SOCKS5 replies on the way back down.
+// The wrapped connection then looks to the client main loop
+// exactly like a connection accepted on the SOCKS port,
+// and flows upstream through the same clientConnRead framing.
+
+var errSocksReply = errors.New("SOCKS5 relay reply indicates failure")
+
+// transConn wraps a transparently intercepted connection.
+type transConn struct {
+	net.Conn
+	hdr   []byte // synthesized SOCKS5 request not yet sent upstream
+	reply []byte // partial SOCKS5 reply received from the relay so far
+	ready bool   // SOCKS5 negotiation with the relay completed
+}
+
+func newTransConn(conn net.Conn, dst *net.TCPAddr) (*transConn, error) {
+	hdr, err := socks5Connect(dst)
+	if err != nil {
+		return nil, err
+	}
+	return &transConn{Conn: conn, hdr: hdr}, nil
+}
+
+// Build the SOCKS5 version/method header and CONNECT request
+// that a SOCKS-aware application would have sent for this destination.
+func socks5Connect(dst *net.TCPAddr) ([]byte, error) {
+	buf := []byte{5, 1, methNoAuth, 5, cmdConnect, 0}
+	if ip4 := dst.IP.To4(); ip4 != nil {
+		buf = append(buf, addrIPv4)
+		buf = append(buf, ip4...)
+	} else if ip6 := dst.IP.To16(); ip6 != nil {
+		buf = append(buf, addrIPv6)
+		buf = append(buf, ip6...)
+	} else {
+		return nil, errAddressTypeNotSupported
+	}
+	port := [2]byte{}
+	binary.BigEndian.PutUint16(port[:], uint16(dst.Port))
+	return append(buf, port[:]...), nil
+}
+
+// Return the total length of the relay's method response and CONNECT reply
+// at the head of buf, or -1 if buf does not yet hold all of it.
+func socks5ReplyLen(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return -1, nil
+	}
+	if buf[0] != 5 || buf[1] != methNoAuth {
+		return 0, errSocksReply
+	}
+	if len(buf) < 2+5 {
+		return -1, nil
+	}
+	if buf[2] != 5 || buf[3] != repSucceeded {
+		return 0, errSocksReply
+	}
+	var alen int
+	switch buf[5] {
+	case addrIPv4:
+		alen = net.IPv4len
+	case addrIPv6:
+		alen = net.IPv6len
+	case addrDomain:
+		alen = 1 + int(buf[6])
+	default:
+		return 0, errAddressTypeNotSupported
+	}
+	rlen := 2 + 4 + alen + 2
+	if len(buf) < rlen {
+		return -1, nil
+	}
+	return rlen, nil
+}
+
+func (tc *transConn) Read(p []byte) (int, error) {
+	if len(tc.hdr) > 0 {
+		n := copy(p, tc.hdr)
+		tc.hdr = tc.hdr[n:]
+		return n, nil
+	}
+	return tc.Conn.Read(p)
+}
+
+func (tc *transConn) Write(p []byte) (int, error) {
+	if tc.ready {
+		return tc.Conn.Write(p)
+	}
+
+	// Still negotiating: swallow the relay's SOCKS5 replies
+	tc.reply = append(tc.reply, p...)
+	rlen, err := socks5ReplyLen(tc.reply)
+	if err != nil {
+		log.Printf("transparent: %s: %s", tc.RemoteAddr(), err.Error())
+		tc.Conn.Close()
+		return len(p), err
+	}
+	if rlen < 0 {
+		return len(p), nil // need more reply data
+	}
+	rest := tc.reply[rlen:]
+	tc.reply = nil
+	tc.ready = true
+
+	// Pass through any application data that followed the reply
+	if len(rest) > 0 {
+		if _, err := tc.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Find the destination a redirected connection was originally headed for.
+// With TPROXY the socket is bound to the original destination itself;
+// with REDIRECT we must ask netfilter for it.
+func originalDst(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	if tproxy {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	tcpconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	return redirectedDst(tcpconn)
+}
+
+// Accept transparently redirected connections on listenport
+// and hand them to the client main loop as SOCKS-framed connections.
+func clientListenTransparent(listenport string, tproxy bool,
+	newconn chan<- net.Conn) {
+
+	log.Printf("Listening for redirected connections on port %s\n",
+		listenport)
+	lsock, err := listenTransparent(listenport, tproxy)
+	if err != nil {
+		log.Printf("Can't open transparent listen socket at port %s: %s",
+			listenport, err.Error())
+		return
+	}
+	for {
+		conn, err := lsock.Accept()
+		if err != nil {
+			lsock.Close()
+			return
+		}
+
+		dst, err := originalDst(conn, tproxy)
+		if err != nil {
+			log.Printf("transparent: no original destination: %s",
+				err.Error())
+			conn.Close()
+			continue
+		}
+		log.Printf("transparent: %s -> %s", conn.RemoteAddr(), dst)
+
+		tc, err := newTransConn(conn, dst)
+		if err != nil {
+			log.Printf("transparent: %s", err.Error())
+			conn.Close()
+			continue
+		}
+		newconn <- tc
+	}
+}
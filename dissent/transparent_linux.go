@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST from linux/netfilter_ipv4.h,
+// and its IPv6 counterpart IP6T_SO_ORIGINAL_DST.
+const soOriginalDst = 80
+
+// Ask netfilter for the pre-REDIRECT destination of a connection.
+func redirectedDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var dst *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6 fits in the IPv6MTUInfo getsockopt buffer
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd),
+				syscall.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			// The port is in network byte order in the raw sockaddr
+			sa := info.Addr
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			dst = &net.TCPAddr{
+				IP:   net.IP(append([]byte{}, sa.Addr[:]...)),
+				Port: int(binary.BigEndian.Uint16(port[:]))}
+			return
+		}
+
+		// sockaddr_in fits in the IPv6Mreq getsockopt buffer
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd),
+			syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		sa := mreq.Multiaddr
+		dst = &net.TCPAddr{
+			IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+			Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return dst, nil
+}
+
+// Open the listen socket for redirected connections.
+// TPROXY additionally requires IP_TRANSPARENT on the listening socket
+// so that it can accept connections addressed to foreign destinations.
+func listenTransparent(listenport string, tproxy bool) (net.Listener, error) {
+	if !tproxy {
+		return net.Listen("tcp", listenport)
+	}
+	lc := net.ListenConfig{Control: func(network, address string,
+		rc syscall.RawConn) error {
+		var serr error
+		err := rc.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP,
+				syscall.IP_TRANSPARENT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	return lc.Listen(context.Background(), "tcp", listenport)
+}
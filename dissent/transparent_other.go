@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoTransparent = errors.New("transparent proxying requires Linux")
+
+func redirectedDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errNoTransparent
+}
+
+func listenTransparent(listenport string, tproxy bool) (net.Listener, error) {
+	return nil, errNoTransparent
+}
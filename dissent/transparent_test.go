@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSocks5Connect(t *testing.T) {
+	hdr := []byte{5, 1, methNoAuth, 5, cmdConnect, 0}
+	tests := []struct {
+		dst  *net.TCPAddr
+		want []byte
+	}{
+		{&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 80},
+			[]byte{addrIPv4, 10, 1, 2, 3, 0, 80}},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 0x1234},
+			[]byte{addrIPv4, 192, 0, 2, 1, 0x12, 0x34}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			[]byte{addrIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb}},
+	}
+	for _, test := range tests {
+		buf, err := socks5Connect(test.dst)
+		if err != nil {
+			t.Fatalf("%s: %s", test.dst, err)
+		}
+		want := append(append([]byte{}, hdr...), test.want...)
+		if !bytes.Equal(buf, want) {
+			t.Errorf("%s: got %v, want %v", test.dst, buf, want)
+		}
+	}
+
+	if _, err := socks5Connect(&net.TCPAddr{Port: 80}); err == nil {
+		t.Error("accepted a destination without an address")
+	}
+}
+
+func TestSocks5ReplyLen(t *testing.T) {
+	meth := []byte{5, methNoAuth}
+	rep4 := []byte{5, repSucceeded, 0, addrIPv4, 10, 0, 0, 1, 0, 80}
+	rep6 := append([]byte{5, repSucceeded, 0, addrIPv6},
+		make([]byte, net.IPv6len+2)...)
+	repDomain := []byte{5, repSucceeded, 0, addrDomain, 3, 'a', 'b', 'c',
+		0, 80}
+	cat := func(bufs ...[]byte) []byte {
+		return bytes.Join(bufs, nil)
+	}
+
+	tests := []struct {
+		name string
+		buf  []byte
+		rlen int
+		err  error
+	}{
+		{"empty", nil, -1, nil},
+		{"partial method", meth[:1], -1, nil},
+		{"method only", meth, -1, nil},
+		{"partial reply", cat(meth, rep4[:6]), -1, nil},
+		{"partial address", cat(meth, rep4[:8]), -1, nil},
+		{"ipv4", cat(meth, rep4), 12, nil},
+		{"ipv4 with data", cat(meth, rep4, []byte("hello")), 12, nil},
+		{"ipv6", cat(meth, rep6), 24, nil},
+		{"domain", cat(meth, repDomain), 12, nil},
+		{"bad version", []byte{4, methNoAuth}, 0, errSocksReply},
+		{"bad method", []byte{5, 0xff}, 0, errSocksReply},
+		{"connect failed", cat(meth, []byte{5, 1, 0, addrIPv4, 0}),
+			0, errSocksReply},
+		{"bad address type", cat(meth, []byte{5, repSucceeded, 0, 7, 0}),
+			0, errAddressTypeNotSupported},
+	}
+	for _, test := range tests {
+		rlen, err := socks5ReplyLen(test.buf)
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && rlen != test.rlen {
+			t.Errorf("%s: got length %d, want %d", test.name, rlen, test.rlen)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// A Transport carries the client-to-relay and trustee-to-relay links.
+// The cell framing on top of the link is the same for every transport;
+// the transport only decides how the bytes get across the network.
+type Transport interface {
+
+	// Open a link to the relay at the given host:port address,
+	// as the node with the given link identification byte.
+	Dial(addr string, link byte) (net.Conn, error)
+
+	// Accept links from clients and trustees at the given address.
+	Listen(addr string) (net.Listener, error)
+}
+
+// Transport used by this node to reach, or to serve as, the relay.
+var transport Transport = tcpTransport{}
+
+// Select the relay link transport by name.
+func newTransport(name string) (Transport, error) {
+	switch name {
+	case "", "tcp":
+		return tcpTransport{}, nil
+	case "tls":
+		return newTLSTransport()
+	case "ws":
+		return wsTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+}
+
+// Plain TCP transport, providing no link protection.
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string, link byte) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// A link whose transport authenticated the dialer's identification byte.
+type authLink interface {
+	Link() byte
+}
+
+// Check that a node identifying itself as link on conn may do so.
+// Links over transports that authenticate nothing are taken at their word.
+func linkAllowed(conn net.Conn, link byte) bool {
+	if al, ok := conn.(authLink); ok {
+		return al.Link() == link
+	}
+	return true
+}
+
+var errListenerClosed = errors.New("listener closed")
+var errBlobTooLong = errors.New("blob too long")
+
+// Write a uint16 length-prefixed blob, as used in link handshakes.
+func writeBlob(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return errBlobTooLong
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Read a uint16 length-prefixed blob written by writeBlob.
+func readBlob(r io.Reader) ([]byte, error) {
+	hdr := [2]byte{}
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
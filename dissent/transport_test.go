@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/config"
+)
+
+// Dial a listener on tr as the given link and echo a message across,
+// returning the link as the listener accepted it.
+func testLoopback(t *testing.T, tr Transport, link byte) net.Conn {
+	lsock, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lsock.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := tr.Dial(lsock.Addr().String(), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello over the loopback")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("echoed %q, sent %q", buf, msg)
+	}
+
+	aconn := <-accepted
+	if aconn == nil {
+		t.Fatal("listener accepted no link")
+	}
+	return aconn
+}
+
+func TestTCPTransport(t *testing.T) {
+	conn := testLoopback(t, tcpTransport{}, 3)
+	if !linkAllowed(conn, 3) {
+		t.Fatal("plain link refused its node number")
+	}
+}
+
+func TestWSTransport(t *testing.T) {
+	conn := testLoopback(t, wsTransport{}, 3)
+	if !linkAllowed(conn, 3) {
+		t.Fatal("websocket link refused its node number")
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	relay := testKeyPair()
+	client := testKeyPair()
+	other := testKeyPair()
+	links := map[byte]abstract.Point{
+		1: client.Public,
+		2: other.Public}
+
+	server, err := newTLSTransportKeys(relay, nil, links)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsock, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	addr := lsock.Addr().String()
+
+	// Accept in the background as server above; dial as each client below
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := lsock.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dialer := func(kp *config.KeyPair, trusted abstract.Point) Transport {
+		tr, err := newTLSTransportKeys(kp, []abstract.Point{trusted},
+			nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+
+	// The right key for its link
+	conn, err := dialer(client, relay.Public).Dial(addr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	aconn := <-accepted
+	if !linkAllowed(aconn, 1) || linkAllowed(aconn, 2) {
+		t.Fatal("accepted link not bound to its node number")
+	}
+	aconn.Close()
+
+	// A trusted node claiming another node's link:
+	// the listener drops the link once it has checked the claim.
+	conn, err = dialer(client, relay.Public).Dial(addr, 2)
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("node took over another node's link")
+		}
+		conn.Close()
+	}
+
+	select {
+	case <-accepted:
+		t.Fatal("listener accepted a link with the wrong key")
+	default:
+	}
+
+	// A node that does not trust the listener's key
+	if _, err := dialer(client, other.Public).Dial(addr, 1); err == nil {
+		t.Fatal("dialer accepted an untrusted listener")
+	}
+}
+
+// A dialer that never authenticates does not hold up the others
+func TestTLSSilentDialer(t *testing.T) {
+	relay := testKeyPair()
+	client := testKeyPair()
+	server, err := newTLSTransportKeys(relay, nil,
+		map[byte]abstract.Point{1: client.Public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsock, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	addr := lsock.Addr().String()
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lsock.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	tr, err := newTLSTransportKeys(client, []abstract.Point{relay.Public},
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tr.Dial(addr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case aconn := <-accepted:
+		aconn.Close()
+	case <-time.After(tlsAuthTimeout / 2):
+		t.Fatal("silent dialer held up the listener")
+	}
+}
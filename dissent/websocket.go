@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket transport, for traversing HTTP-only middleboxes.
+// Cells travel as binary WebSocket frames;
+// the framing inside the stream is unchanged.
+type wsTransport struct{}
+
+// HTTP path on which the relay accepts WebSocket links.
+const wsPath = "/dissent"
+
+func (wsTransport) Dial(addr string, link byte) (net.Conn, error) {
+	ws, err := websocket.Dial("ws://"+addr+wsPath, "",
+		"http://"+addr+"/")
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+func (wsTransport) Listen(addr string) (net.Listener, error) {
+	lsock, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &wsListener{Listener: lsock,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{})}
+
+	mux := http.NewServeMux()
+	mux.Handle(wsPath, websocket.Handler(l.serve))
+	go http.Serve(lsock, mux)
+	return l, nil
+}
+
+// Listener handing out WebSocket links accepted by an HTTP server.
+type wsListener struct {
+	net.Listener // underlying TCP listener, owned by the HTTP server
+	conns        chan net.Conn
+	closed       chan struct{}
+	once         sync.Once
+}
+
+func (l *wsListener) serve(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	c := &wsConn{Conn: ws, done: make(chan struct{})}
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		return
+	}
+
+	// The websocket package closes the link when we return,
+	// so hold on to it until the user is done with it.
+	<-c.done
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// Server-side WebSocket link.
+type wsConn struct {
+	*websocket.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
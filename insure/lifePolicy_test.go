@@ -1,14 +1,15 @@
 package insure
 
 import (
+	"net"
 	"testing"
 
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/config"
 	"github.com/dedis/crypto/random"
 
+	"github.com/dedis/prifi/coco/coconet"
 	"github.com/dedis/prifi/connMan"
-	"github.com/dedis/prifi/coconet"
 )
 
 var goDir = coconet.NewGoDirectory()
@@ -198,3 +199,93 @@ func TestTakeOutPolicy(t *testing.T) {
 		}
 	}
 }
+
+// Pick a free local address for a server to listen on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// A copy of a public key: points of this suite are not safe to compare
+// from several goroutines at once, so each server needs its own.
+func clonePoint(p abstract.Point) abstract.Point {
+	b, _ := p.MarshalBinary()
+	c := KEY_SUITE.Point()
+	c.UnmarshalBinary(b)
+	return c
+}
+
+// The policy taken out over TCP connection managers
+func TestTakeOutPolicyTCP(t *testing.T) {
+	taker := produceKeyPairT()
+	keys := make([]*config.KeyPair, numServers)
+	for i := range keys {
+		keys[i] = produceKeyPairT()
+	}
+	addrs := make([]string, numServers+1)
+	for i := range addrs {
+		addrs[i] = freeAddr(t)
+	}
+	directory := func() *connMan.AddrDirectory {
+		dir := new(connMan.AddrDirectory).Init()
+		dir.Add(clonePoint(taker.Public), addrs[numServers])
+		for i := range keys {
+			dir.Add(clonePoint(keys[i].Public), addrs[i])
+		}
+		return dir
+	}
+
+	tcm, err := new(connMan.TCPConnManager).Init(taker, directory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcm.Close()
+	done := make(chan bool)
+	for i := range keys {
+		cm, err := new(connMan.TCPConnManager).Init(keys[i], directory())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cm.Close()
+		go func(k *config.KeyPair, cm connMan.ConnManager,
+			taker abstract.Point) {
+
+			policy := new(LifePolicy).Init(k, cm)
+			for {
+				msg := new(PolicyMessage)
+				if err := cm.Get(taker, msg); err != nil {
+					t.Error(err)
+					done <- false
+					return
+				}
+				msgType, err := policy.handlePolicyMessage(msg)
+				if msgType == RequestInsurance && err == nil {
+					done <- true
+					return
+				}
+			}
+		}(keys[i], cm, clonePoint(taker.Public))
+	}
+
+	insurers := make([]abstract.Point, numServers)
+	for i := range keys {
+		insurers[i] = clonePoint(keys[i].Public)
+	}
+	policy, ok := new(LifePolicy).Init(taker, tcm).TakeOutPolicy(
+		insurers, nil, INSURE_GROUP, TSHARES, numServers)
+	if !ok {
+		t.Fatal("Policy failed to be created.")
+	}
+	for range keys {
+		if !<-done {
+			t.Fatal("An insurer failed.")
+		}
+	}
+	if policy.GetPolicyProof().Len() != numServers {
+		t.Error("Insufficient number of proofs.")
+	}
+}
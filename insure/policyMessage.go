@@ -12,6 +12,7 @@ import (
 	"github.com/dedis/crypto/poly"
 	"github.com/dedis/crypto/random"
 
+	"github.com/dedis/prifi/coco/coconet"
 	"github.com/dedis/protobuf"
 )
 
@@ -90,6 +91,15 @@ func (pm *PolicyMessage) MarshalBinary() ([]byte, error) {
 	return b.Bytes(), err
 }
 
+/* Registers PolicyMessages in the Registry, so that the insurance policy
+ * protocol can share its hosts with other protocols.
+ */
+func RegisterMessages(r *coconet.Registry) error {
+	return r.Register(coconet.PolicyMessageID, func() coconet.BinaryUnmarshaler {
+		return &PolicyMessage{}
+	})
+}
+
 // This function is responsible for unmarshalling the data. It keeps track
 // of which type the message is and decodes it properly.
 func (pm *PolicyMessage) UnmarshalBinary(data []byte) error {